@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package body
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/google/martian/v3/filter"
+	"github.com/google/martian/v3/martianjson"
+	"github.com/google/martian/v3/parse"
+)
+
+func init() {
+	parse.Register("body.Filter", filterFromJSON)
+}
+
+// Filter runs modifiers iff the message body matches.
+type Filter struct {
+	*filter.Filter
+}
+
+// matcherJSON holds the conditions of a body matcher, of which exactly one
+// must be set.
+type matcherJSON struct {
+	Regex            string          `json:"regex"`
+	JSONPath         string          `json:"jsonPath"`
+	Field            string          `json:"field"`
+	GraphQLOperation string          `json:"graphQLOperation"`
+	Value            json.RawMessage `json:"value"`
+}
+
+type filterJSON struct {
+	matcherJSON
+	Modifier     json.RawMessage      `json:"modifier"`
+	ElseModifier json.RawMessage      `json:"else"`
+	Scope        []parse.ModifierType `json:"scope"`
+}
+
+// NewFilter builds a body.Filter that runs modifiers when m matches.
+func NewFilter(m *Matcher) *Filter {
+	f := filter.New()
+	f.SetRequestCondition(m)
+	f.SetResponseCondition(m)
+	return &Filter{f}
+}
+
+// matcher builds the matcher of msg.
+func (msg *matcherJSON) matcher() (*Matcher, error) {
+	var ms []*Matcher
+
+	if msg.Regex != "" {
+		re, err := regexp.Compile(msg.Regex)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, NewRegexMatcher(re))
+	}
+	if msg.JSONPath != "" {
+		p, err := martianjson.ParsePath(msg.JSONPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		if len(msg.Value) > 0 {
+			if err := json.Unmarshal(msg.Value, &value); err != nil {
+				return nil, err
+			}
+		}
+		ms = append(ms, NewJSONPathMatcher(p, value))
+	}
+	if msg.Field != "" {
+		var value string
+		if len(msg.Value) > 0 {
+			if err := json.Unmarshal(msg.Value, &value); err != nil {
+				return nil, fmt.Errorf("body: value of field %q is not a string", msg.Field)
+			}
+		}
+		ms = append(ms, NewFormMatcher(msg.Field, value))
+	}
+	if msg.GraphQLOperation != "" {
+		ms = append(ms, NewGraphQLMatcher(msg.GraphQLOperation))
+	}
+
+	if len(ms) != 1 {
+		return nil, fmt.Errorf("body: want one of regex, jsonPath, field or graphQLOperation, got %d", len(ms))
+	}
+
+	return ms[0], nil
+}
+
+// filterFromJSON takes a JSON message and returns a body.Filter.
+//
+// Example JSON:
+// {
+//   "body.Filter": {
+//     "scope": ["request", "response"],
+//     "graphQLOperation": "GetUser",
+//     "modifier": { ... },
+//     "else": { ... }
+//   }
+// }
+//
+// Exactly one of the following conditions must be set:
+//   "regex": "pattern"                        matches bodies containing pattern
+//   "jsonPath": "$.user.id", "value": 42      matches JSON bodies where the path selects value; without value, where it selects anything
+//   "field": "name", "value": "x"             matches form bodies with the field, optionally equal to value
+//   "graphQLOperation": "GetUser"             matches GraphQL requests for the operation, and their responses
+func filterFromJSON(b []byte) (*parse.Result, error) {
+	msg := &filterJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	m, err := msg.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	f := NewFilter(m)
+
+	if len(msg.Modifier) > 0 {
+		r, err := parse.FromJSON(msg.Modifier)
+		if err != nil {
+			return nil, err
+		}
+
+		f.RequestWhenTrue(r.RequestModifier())
+		f.ResponseWhenTrue(r.ResponseModifier())
+	}
+
+	if len(msg.ElseModifier) > 0 {
+		em, err := parse.FromJSON(msg.ElseModifier)
+		if err != nil {
+			return nil, err
+		}
+
+		if em != nil {
+			f.RequestWhenFalse(em.RequestModifier())
+			f.ResponseWhenFalse(em.ResponseModifier())
+		}
+	}
+
+	return parse.NewResult(f, msg.Scope)
+}
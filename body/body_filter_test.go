@@ -0,0 +1,228 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package body
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/martianjson"
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+
+	// Import to register header.Modifier with JSON parser.
+	_ "github.com/google/martian/v3/header"
+)
+
+func newBodyRequest(t *testing.T, contentType, body string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return req
+}
+
+func TestMatchers(t *testing.T) {
+	mpbody := new(bytes.Buffer)
+	mpw := multipart.NewWriter(mpbody)
+	mpw.WriteField("email", "user@example.com")
+	fw, _ := mpw.CreateFormFile("upload", "file.txt")
+	fw.Write([]byte("contents"))
+	mpw.Close()
+
+	mustPath := func(s string) *martianjson.Path {
+		p, err := martianjson.ParsePath(s)
+		if err != nil {
+			t.Fatalf("martianjson.ParsePath(%q): got %v, want no error", s, err)
+		}
+		return p
+	}
+
+	tt := []struct {
+		name        string
+		m           *Matcher
+		contentType string
+		body        string
+		want        bool
+	}{
+		{"regex", NewRegexMatcher(regexp.MustCompile(`"id":\s*\d+`)), "application/json", `{"id": 42}`, true},
+		{"regex no match", NewRegexMatcher(regexp.MustCompile(`secret`)), "text/plain", `public`, false},
+		{"json number", NewJSONPathMatcher(mustPath("$.user.id"), 42), "application/json", `{"user":{"id":42}}`, true},
+		{"json string", NewJSONPathMatcher(mustPath("$.items[*].sku"), "b"), "application/json", `{"items":[{"sku":"a"},{"sku":"b"}]}`, true},
+		{"json object", NewJSONPathMatcher(mustPath("$.a"), map[string]int{"b": 1}), "application/json", `{"a":{"b":1.0}}`, true},
+		{"json mismatch", NewJSONPathMatcher(mustPath("$.user.id"), 7), "application/json", `{"user":{"id":42}}`, false},
+		{"json presence", NewJSONPathMatcher(mustPath("$.user"), nil), "application/json", `{"user":null}`, true},
+		{"json absent", NewJSONPathMatcher(mustPath("$.user"), nil), "application/json", `{}`, false},
+		{"json invalid", NewJSONPathMatcher(mustPath("$"), nil), "application/json", `not json`, false},
+		{"form", NewFormMatcher("q", "martian"), "application/x-www-form-urlencoded", `a=1&q=martian`, true},
+		{"form presence", NewFormMatcher("q", ""), "application/x-www-form-urlencoded", `q=`, true},
+		{"form mismatch", NewFormMatcher("q", "martian"), "application/x-www-form-urlencoded", `q=other`, false},
+		{"form wrong type", NewFormMatcher("q", ""), "text/plain", `q=martian`, false},
+		{"multipart", NewFormMatcher("email", "user@example.com"), mpw.FormDataContentType(), mpbody.String(), true},
+		{"multipart file", NewFormMatcher("upload", "contents"), mpw.FormDataContentType(), mpbody.String(), true},
+		{"multipart missing", NewFormMatcher("name", ""), mpw.FormDataContentType(), mpbody.String(), false},
+		{"graphql", NewGraphQLMatcher("GetUser"), "application/json", `{"operationName":"GetUser","query":"query GetUser { user { id } }"}`, true},
+		{"graphql query", NewGraphQLMatcher("GetUser"), "application/json", `{"query":"query GetUser { user { id } }"}`, true},
+		{"graphql batch", NewGraphQLMatcher("Save"), "application/json", `[{"operationName":"GetUser"},{"query":"mutation Save { save }"}]`, true},
+		{"graphql document", NewGraphQLMatcher("GetUser"), "application/graphql", `query GetUser { user { id } }`, true},
+		{"graphql other", NewGraphQLMatcher("GetUser"), "application/json", `{"operationName":"ListUsers"}`, false},
+	}
+
+	for _, tc := range tt {
+		req := newBodyRequest(t, tc.contentType, tc.body)
+		if got := tc.m.MatchRequest(req); got != tc.want {
+			t.Errorf("%s: MatchRequest(): got %t, want %t", tc.name, got, tc.want)
+		}
+
+		got, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("%s: ioutil.ReadAll(): got %v, want no error", tc.name, err)
+		}
+		if string(got) != tc.body {
+			t.Errorf("%s: req.Body: got %q, want %q", tc.name, got, tc.body)
+		}
+	}
+}
+
+func TestGraphQLMatcherURLQuery(t *testing.T) {
+	m := NewGraphQLMatcher("GetUser")
+
+	req, err := http.NewRequest("GET", "http://example.com/graphql?query=query%20GetUser%20%7B%20id%20%7D", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if !m.MatchRequest(req) {
+		t.Error("MatchRequest(): got false, want true")
+	}
+}
+
+func TestFilterMatchesEncodedResponse(t *testing.T) {
+	f := NewFilter(NewRegexMatcher(regexp.MustCompile("needle")))
+
+	tm := martiantest.NewModifier()
+	f.ResponseWhenTrue(tm)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	h := http.Header{}
+	h.Set("Content-Encoding", "gzip")
+	body, err := proxyutil.EncodeContent(h, []byte("haystack with a needle"))
+	if err != nil {
+		t.Fatalf("EncodeContent(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, bytes.NewReader(body), req)
+	res.Header.Set("Content-Encoding", "gzip")
+
+	if err := f.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if !tm.ResponseModified() {
+		t.Error("tm.ResponseModified(): got false, want true")
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("res.Body: got %q, want %q", got, body)
+	}
+}
+
+func TestFilterFromJSON(t *testing.T) {
+	msg := []byte(`{
+	  "body.Filter": {
+	    "scope": ["request", "response"],
+	    "graphQLOperation": "GetUser",
+	    "modifier": {
+	      "header.Modifier": {
+	        "scope": ["request", "response"],
+	        "name": "Martian-Testing",
+	        "value": "true"
+	      }
+	    }
+	  }
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	reqmod := r.RequestModifier()
+	if reqmod == nil {
+		t.Fatal("reqmod: got nil, want not nil")
+	}
+	resmod := r.ResponseModifier()
+	if resmod == nil {
+		t.Fatal("resmod: got nil, want not nil")
+	}
+
+	for _, op := range []string{"GetUser", "ListUsers"} {
+		req := newBodyRequest(t, "application/json", `{"operationName":"`+op+`"}`)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("martian.TestContext(): got %v, want no error", err)
+		}
+		defer remove()
+
+		if err := reqmod.ModifyRequest(req); err != nil {
+			t.Fatalf("ModifyRequest(): got %v, want no error", err)
+		}
+		res := proxyutil.NewResponse(200, strings.NewReader(`{"data":{}}`), req)
+		if err := resmod.ModifyResponse(res); err != nil {
+			t.Fatalf("ModifyResponse(): got %v, want no error", err)
+		}
+
+		want := ""
+		if op == "GetUser" {
+			want = "true"
+		}
+		if got := req.Header.Get("Martian-Testing"); got != want {
+			t.Errorf("%s: req.Header.Get(%q): got %q, want %q", op, "Martian-Testing", got, want)
+		}
+		if got := res.Header.Get("Martian-Testing"); got != want {
+			t.Errorf("%s: res.Header.Get(%q): got %q, want %q", op, "Martian-Testing", got, want)
+		}
+	}
+
+	for _, msg := range []string{
+		`{"body.Filter": {}}`,
+		`{"body.Filter": {"regex": "a", "field": "b"}}`,
+		`{"body.Filter": {"regex": "("}}`,
+		`{"body.Filter": {"jsonPath": "user"}}`,
+		`{"body.Filter": {"field": "a", "value": 1}}`,
+	} {
+		if _, err := parse.FromJSON([]byte(msg)); err == nil {
+			t.Errorf("parse.FromJSON(%s): got no error, want error", msg)
+		}
+	}
+}
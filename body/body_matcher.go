@@ -0,0 +1,298 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package body
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/martianjson"
+	"github.com/google/martian/v3/messageview"
+)
+
+// graphQLOperationsKey is the context key of the GraphQL operation names of a
+// request, recorded when a GraphQL matcher evaluates the request.
+const graphQLOperationsKey = "body.GraphQLOperations"
+
+var graphQLOperationRegex = regexp.MustCompile(`\b(?:query|mutation|subscription)\s+([_A-Za-z][_0-9A-Za-z]*)`)
+
+// Matcher is a conditional evaluator of message bodies to be used in structs
+// that take conditions. Bodies are decoded according to their
+// Content-Encoding before they are evaluated, and restored afterwards.
+type Matcher struct {
+	desc    string
+	match   func(header http.Header, body []byte) bool
+	graphQL string
+}
+
+// NewRegexMatcher builds a matcher that matches bodies containing a match of
+// re.
+func NewRegexMatcher(re *regexp.Regexp) *Matcher {
+	return &Matcher{
+		desc: fmt.Sprintf("regex %q", re.String()),
+		match: func(_ http.Header, body []byte) bool {
+			return re.Match(body)
+		},
+	}
+}
+
+// NewJSONPathMatcher builds a matcher that matches JSON bodies in which path
+// selects a value equal to value, compared as JSON. If value is nil, the
+// matcher only checks that path selects a value.
+func NewJSONPathMatcher(path *martianjson.Path, value interface{}) *Matcher {
+	desc := fmt.Sprintf("JSONPath %s", path)
+
+	var want interface{}
+	if value != nil {
+		// Round trip value through JSON so that it compares equal to the
+		// values decoded from bodies.
+		b, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(b, &want)
+		}
+		if err != nil {
+			log.Errorf("body.NewJSONPathMatcher: invalid value %v: %v", value, err)
+		}
+		desc = fmt.Sprintf("JSONPath %s == %s", path, b)
+	}
+
+	return &Matcher{
+		desc: desc,
+		match: func(_ http.Header, body []byte) bool {
+			var doc interface{}
+			if err := json.Unmarshal(body, &doc); err != nil {
+				return false
+			}
+
+			for _, v := range path.Get(doc) {
+				if value == nil || reflect.DeepEqual(v, want) {
+					return true
+				}
+			}
+
+			return false
+		},
+	}
+}
+
+// NewFormMatcher builds a matcher that matches application/x-www-form-urlencoded
+// and multipart/form-data bodies with a field for name. If value is
+// non-empty, one of the values of the field must equal value.
+func NewFormMatcher(name, value string) *Matcher {
+	desc := fmt.Sprintf("form field %q", name)
+	if value != "" {
+		desc = fmt.Sprintf("form field %q == %q", name, value)
+	}
+
+	return &Matcher{
+		desc: desc,
+		match: func(header http.Header, body []byte) bool {
+			for _, v := range formValues(header, body, name) {
+				if value == "" || v == value {
+					return true
+				}
+			}
+
+			return false
+		},
+	}
+}
+
+// formValues returns the values of the form field name in body.
+func formValues(header http.Header, body []byte, name string) []string {
+	mt, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+
+	switch mt {
+	case "application/x-www-form-urlencoded":
+		// ParseQuery returns the fields it parsed along with an error.
+		vs, _ := url.ParseQuery(string(body))
+		return vs[name]
+	case "multipart/form-data", "multipart/mixed":
+		var vs []string
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				return vs
+			}
+			if p.FormName() != name {
+				continue
+			}
+
+			b, err := ioutil.ReadAll(p)
+			if err != nil {
+				return vs
+			}
+			vs = append(vs, string(b))
+		}
+	}
+
+	return nil
+}
+
+// NewGraphQLMatcher builds a matcher that matches GraphQL requests for the
+// operation named operationName. The operation is read from the
+// operationName of JSON bodies, including batched requests, from the query
+// document, or from the URL query of requests without a body.
+//
+// Responses are matched by the operation of their request, which is only known
+// once the matcher has evaluated the request, such as in a filter scoped to
+// both requests and responses.
+func NewGraphQLMatcher(operationName string) *Matcher {
+	return &Matcher{
+		desc:    fmt.Sprintf("GraphQL operation %q", operationName),
+		graphQL: operationName,
+	}
+}
+
+// graphQLOperations returns the GraphQL operation names of a request.
+func graphQLOperations(req *http.Request, body []byte) []string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		q := req.URL.Query()
+		return graphQLOperation(q.Get("operationName"), q.Get("query"))
+	}
+
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mt == "application/graphql" {
+		return graphQLOperation("", string(body))
+	}
+
+	type operation struct {
+		OperationName string `json:"operationName"`
+		Query         string `json:"query"`
+	}
+
+	var ops []operation
+	if err := json.Unmarshal(body, &ops); err != nil {
+		op := operation{}
+		if err := json.Unmarshal(body, &op); err != nil {
+			return nil
+		}
+		ops = append(ops, op)
+	}
+
+	var names []string
+	for _, op := range ops {
+		names = append(names, graphQLOperation(op.OperationName, op.Query)...)
+	}
+
+	return names
+}
+
+// graphQLOperation returns operationName, or else the name of the first
+// operation in query.
+func graphQLOperation(operationName, query string) []string {
+	if operationName != "" {
+		return []string{operationName}
+	}
+	if m := graphQLOperationRegex.FindStringSubmatch(query); m != nil {
+		return []string{m[1]}
+	}
+
+	return nil
+}
+
+func (m *Matcher) matchGraphQL(names []string) bool {
+	for _, name := range names {
+		if name == m.graphQL {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns a description of what the matcher matches.
+func (m *Matcher) String() string {
+	return m.desc
+}
+
+// MatchRequest evaluates a request and returns whether or not its body
+// matches.
+func (m *Matcher) MatchRequest(req *http.Request) bool {
+	mv := messageview.New()
+	if err := mv.SnapshotRequest(req); err != nil {
+		log.Errorf("body.MatchRequest: failed to read body: %v", err)
+		return false
+	}
+
+	body, err := decodedBody(mv)
+	if err != nil {
+		log.Errorf("body.MatchRequest: failed to decode body: %v", err)
+		return false
+	}
+
+	if m.graphQL != "" {
+		names := graphQLOperations(req, body)
+		if ctx := martian.NewContext(req); ctx != nil {
+			ctx.Set(graphQLOperationsKey, names)
+		}
+		return m.matchGraphQL(names)
+	}
+
+	return m.match(req.Header, body)
+}
+
+// MatchResponse evaluates a response and returns whether or not its body
+// matches. GraphQL matchers evaluate the operation of the request instead.
+func (m *Matcher) MatchResponse(res *http.Response) bool {
+	if m.graphQL != "" {
+		ctx := martian.NewContext(res.Request)
+		if ctx == nil {
+			return false
+		}
+		names, _ := ctx.Get(graphQLOperationsKey)
+		ns, _ := names.([]string)
+		return m.matchGraphQL(ns)
+	}
+
+	mv := messageview.New()
+	if err := mv.SnapshotResponse(res); err != nil {
+		log.Errorf("body.MatchResponse: failed to read body: %v", err)
+		return false
+	}
+
+	body, err := decodedBody(mv)
+	if err != nil {
+		log.Errorf("body.MatchResponse: failed to decode body: %v", err)
+		return false
+	}
+
+	return m.match(res.Header, body)
+}
+
+// decodedBody returns the decoded body of mv.
+func decodedBody(mv *messageview.MessageView) ([]byte, error) {
+	br, err := mv.BodyReader(messageview.Decode())
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+
+	return ioutil.ReadAll(br)
+}
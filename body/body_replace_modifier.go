@@ -0,0 +1,477 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package body
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// DefaultBufferSize is the size of the largest body that a ReplaceModifier
+// replaces in memory. Larger bodies are streamed.
+const DefaultBufferSize = 1 << 20
+
+// StreamWindow is the length of the longest match found across the chunks of
+// a streamed body.
+const StreamWindow = 4 << 10
+
+func init() {
+	parse.Register("body.Replace", replaceModifierFromJSON)
+}
+
+// defaultContentTypes are the content types replaced when none are set.
+var defaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/ecmascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/x-www-form-urlencoded",
+	"*+json",
+	"*+xml",
+}
+
+type replacement struct {
+	re      *regexp.Regexp
+	repl    []byte
+	literal bool
+}
+
+// replaceAll returns b with all matches replaced.
+func (r *replacement) replaceAll(b []byte) []byte {
+	if r.literal {
+		return r.re.ReplaceAllLiteral(b, r.repl)
+	}
+	return r.re.ReplaceAll(b, r.repl)
+}
+
+// ReplaceModifier runs ordered find-and-replace operations on textual request
+// and response bodies.
+//
+// Bodies are decoded according to their Content-Encoding and their charset
+// before the replacements run, and encoded again afterwards. Gzip, deflate and
+// br are supported; other encodings can be added with
+// proxyutil.RegisterContentEncoding. Bodies with an unsupported encoding or
+// charset are left unchanged.
+//
+// Bodies larger than the buffer size are streamed in chunks, without a
+// Content-Length. In streamed bodies, matches longer than StreamWindow bytes
+// may be missed, and anchors such as ^ and \b also match at chunk boundaries.
+type ReplaceModifier struct {
+	replacements []*replacement
+	contentTypes []string
+	bufferSize   int64
+}
+
+type replaceModifierJSON struct {
+	Replacements []struct {
+		Regex       string `json:"regex"`
+		Literal     string `json:"literal"`
+		Replacement string `json:"replacement"`
+	} `json:"replacements"`
+	ContentTypes []string             `json:"contentTypes"`
+	BufferSize   int64                `json:"bufferSize"`
+	Scope        []parse.ModifierType `json:"scope"`
+}
+
+// NewReplaceModifier returns a ReplaceModifier without replacements.
+func NewReplaceModifier() *ReplaceModifier {
+	return &ReplaceModifier{
+		bufferSize: DefaultBufferSize,
+	}
+}
+
+// AddRegexp adds a replacement of the matches of re with repl, in which $1
+// and ${name} are expanded to submatches as in regexp.Regexp.Expand.
+//
+// Streamed bodies are matched chunk by chunk, so in them ^, \A, \b and \B
+// also match at the start of every chunk after the first. Regexps relying on
+// them should be used with a buffer size that holds the whole bodies.
+func (m *ReplaceModifier) AddRegexp(re *regexp.Regexp, repl string) {
+	m.replacements = append(m.replacements, &replacement{
+		re:   re,
+		repl: []byte(repl),
+	})
+}
+
+// AddLiteral adds a replacement of the occurrences of old with repl.
+func (m *ReplaceModifier) AddLiteral(old, repl string) {
+	m.replacements = append(m.replacements, &replacement{
+		re:      regexp.MustCompile(regexp.QuoteMeta(old)),
+		repl:    []byte(repl),
+		literal: true,
+	})
+}
+
+// SetContentTypes sets the media types of the bodies that are replaced, such
+// as "text/html". A type of "text/*" matches all text types and "*+json"
+// matches all types with a +json suffix. By default, common textual types
+// are replaced.
+func (m *ReplaceModifier) SetContentTypes(cts ...string) {
+	m.contentTypes = cts
+}
+
+// SetBufferSize sets the size of the largest body that is replaced in
+// memory, defaulting to DefaultBufferSize.
+func (m *ReplaceModifier) SetBufferSize(size int64) {
+	m.bufferSize = size
+}
+
+// replaceModifierFromJSON takes a JSON message as a byte slice and returns a
+// body.ReplaceModifier and an error.
+//
+// Example JSON configuration message:
+// {
+//   "scope": ["response"],
+//   "contentTypes": ["text/html", "application/javascript"],
+//   "replacements": [
+//     { "regex": "https?://api\\.example\\.com", "replacement": "http://localhost:8080" },
+//     { "literal": "newCheckout: false", "replacement": "newCheckout: true" }
+//   ],
+//   "bufferSize": 1048576
+// }
+func replaceModifierFromJSON(b []byte) (*parse.Result, error) {
+	msg := &replaceModifierJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	mod := NewReplaceModifier()
+	for _, r := range msg.Replacements {
+		switch {
+		case r.Regex != "" && r.Literal != "":
+			return nil, fmt.Errorf("body.Replace: replacement with both regex and literal")
+		case r.Regex != "":
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, err
+			}
+			mod.AddRegexp(re, r.Replacement)
+		case r.Literal != "":
+			mod.AddLiteral(r.Literal, r.Replacement)
+		default:
+			return nil, fmt.Errorf("body.Replace: replacement without regex or literal")
+		}
+	}
+	if len(msg.ContentTypes) > 0 {
+		mod.SetContentTypes(msg.ContentTypes...)
+	}
+	if msg.BufferSize > 0 {
+		mod.SetBufferSize(msg.BufferSize)
+	}
+
+	return parse.NewResult(mod, msg.Scope)
+}
+
+// ModifyRequest runs the replacements on the request body.
+func (m *ReplaceModifier) ModifyRequest(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || !m.replaces(req.Header) {
+		return nil
+	}
+	log.Debugf("body.ReplaceModifier.ModifyRequest: request: %s", req.URL)
+
+	body, size, err := m.replace(req.Header, req.Body)
+	req.Body = body
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	setContentLength(req.Header, size)
+	if size == -1 {
+		req.TransferEncoding = []string{"chunked"}
+	}
+
+	return nil
+}
+
+// ModifyResponse runs the replacements on the response body.
+func (m *ReplaceModifier) ModifyResponse(res *http.Response) error {
+	if res.Body == nil || res.Body == http.NoBody || !m.replaces(res.Header) {
+		return nil
+	}
+	log.Debugf("body.ReplaceModifier.ModifyResponse: request: %s", res.Request.URL)
+
+	body, size, err := m.replace(res.Header, res.Body)
+	res.Body = body
+	if err != nil {
+		return err
+	}
+
+	res.ContentLength = size
+	setContentLength(res.Header, size)
+	if size == -1 {
+		res.TransferEncoding = []string{"chunked"}
+	}
+
+	return nil
+}
+
+func setContentLength(header http.Header, size int64) {
+	if size == -1 {
+		header.Del("Content-Length")
+		return
+	}
+	if header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+}
+
+// replaces returns whether bodies with header are replaced. Bodies with an
+// unsupported Content-Encoding are skipped.
+func (m *ReplaceModifier) replaces(header http.Header) bool {
+	if len(m.replacements) == 0 {
+		return false
+	}
+	if !proxyutil.HasContentEncoding(header) {
+		log.Debugf("body.ReplaceModifier: skipping body with unsupported content encoding %q", header.Get("Content-Encoding"))
+		return false
+	}
+
+	ct := header.Get("Content-Type")
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mt = strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+	}
+
+	cts := m.contentTypes
+	if len(cts) == 0 {
+		cts = defaultContentTypes
+	}
+	for _, pattern := range cts {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case strings.HasSuffix(pattern, "/*"):
+			if strings.HasPrefix(mt, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		case strings.HasPrefix(pattern, "*+"):
+			if strings.HasSuffix(mt, pattern[1:]) {
+				return true
+			}
+		case pattern == mt:
+			return true
+		}
+	}
+
+	return false
+}
+
+// charset returns the encoding of the charset of header, or nil if the body
+// is UTF-8 or ASCII.
+func charset(header http.Header) (encoding.Encoding, error) {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil
+	}
+
+	name := strings.ToLower(params["charset"])
+	switch name {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return nil, nil
+	}
+
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("body.ReplaceModifier: unsupported charset %q", name)
+	}
+
+	return enc, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc *readCloser) Close() error {
+	return rc.close()
+}
+
+// replace returns body with the replacements run and its length, which is -1
+// if the body is streamed. If the body cannot be replaced, it is returned
+// unchanged along with an error.
+func (m *ReplaceModifier) replace(header http.Header, body io.ReadCloser) (io.ReadCloser, int64, error) {
+	enc, err := charset(header)
+	if err != nil {
+		return body, 0, err
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(body, m.bufferSize+1))
+	if err != nil {
+		return &readCloser{
+			Reader: io.MultiReader(bytes.NewReader(raw), body),
+			close:  body.Close,
+		}, 0, err
+	}
+
+	if int64(len(raw)) <= m.bufferSize {
+		body.Close()
+
+		b, err := ioutil.ReadAll(m.pipeline(header, enc, bytes.NewReader(raw)))
+		if err != nil {
+			return ioutil.NopCloser(bytes.NewReader(raw)), 0, err
+		}
+
+		return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+	}
+
+	r := m.pipeline(header, enc, io.MultiReader(bytes.NewReader(raw), body))
+	return &readCloser{
+		Reader: r,
+		close: func() error {
+			r.Close()
+			return body.Close()
+		},
+	}, -1, nil
+}
+
+// pipeline returns a reader of src decoded, replaced and encoded again.
+func (m *ReplaceModifier) pipeline(header http.Header, enc encoding.Encoding, src io.Reader) io.ReadCloser {
+	// The caller updates the headers of the message while the body is
+	// streamed, so the goroutine uses its own copy.
+	header = header.Clone()
+	pr, pw := io.Pipe()
+
+	go func() {
+		cr, err := proxyutil.NewContentReader(header, src)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		defer cr.Close()
+
+		var r io.Reader = cr
+		if enc != nil {
+			r = transform.NewReader(r, enc.NewDecoder())
+		}
+		for _, rep := range m.replacements {
+			r = &replaceReader{
+				r:         r,
+				rep:       rep,
+				chunkSize: int(m.bufferSize),
+			}
+		}
+		if enc != nil {
+			r = transform.NewReader(r, encoding.ReplaceUnsupported(enc.NewEncoder()))
+		}
+
+		cw, err := proxyutil.NewContentWriter(header, pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(cw, r)
+		if cerr := cw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// replaceReader runs a replacement on the body read from r. Bodies of up to
+// chunkSize bytes are replaced at once; longer bodies are replaced in chunks,
+// with the last StreamWindow bytes of each chunk carried over to the next.
+type replaceReader struct {
+	r         io.Reader
+	rep       *replacement
+	chunkSize int
+	buf       []byte
+	out       []byte
+	err       error
+}
+
+func (rr *replaceReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		rr.fill()
+	}
+
+	n := copy(p, rr.out)
+	rr.out = rr.out[n:]
+
+	return n, nil
+}
+
+// fill reads the next chunk and replaces the matches that start before its
+// window. The chunk is matched on its own, so anchors match at its start.
+func (rr *replaceReader) fill() {
+	size := rr.chunkSize
+	if size < 2*StreamWindow {
+		size = 2 * StreamWindow
+	}
+
+	chunk := make([]byte, size)
+	n, err := io.ReadFull(rr.r, chunk)
+	rr.buf = append(rr.buf, chunk[:n]...)
+
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		rr.out = rr.rep.replaceAll(rr.buf)
+		rr.buf = nil
+		rr.err = io.EOF
+		return
+	default:
+		rr.err = err
+		return
+	}
+
+	cut := len(rr.buf) - StreamWindow
+	var out []byte
+	last := 0
+	for _, loc := range rr.rep.re.FindAllSubmatchIndex(rr.buf, -1) {
+		if loc[0] >= cut {
+			break
+		}
+
+		out = append(out, rr.buf[last:loc[0]]...)
+		if rr.rep.literal {
+			out = append(out, rr.rep.repl...)
+		} else {
+			out = rr.rep.re.Expand(out, rr.rep.repl, rr.buf, loc)
+		}
+		last = loc[1]
+	}
+	if last > cut {
+		cut = last
+	}
+
+	rr.out = append(out, rr.buf[last:cut]...)
+	rr.buf = append([]byte(nil), rr.buf[cut:]...)
+}
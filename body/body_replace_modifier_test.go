@@ -0,0 +1,318 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package body
+
+import (
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+func newReplaceResponse(t *testing.T, contentType, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader(body), req)
+	res.Header.Set("Content-Type", contentType)
+	res.ContentLength = int64(len(body))
+
+	return res
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	return string(b)
+}
+
+func TestReplaceModifier(t *testing.T) {
+	mod := NewReplaceModifier()
+	mod.AddRegexp(regexp.MustCompile(`https?://api\.example\.com(/v\d)`), "http://localhost:8080$1")
+	mod.AddLiteral("localhost:8080", "127.0.0.1:8080")
+	mod.AddLiteral("$flag", "on")
+
+	res := newReplaceResponse(t, "text/html; charset=utf-8",
+		`<a href="https://api.example.com/v2/users">$flag</a>`)
+	if err := mod.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	want := `<a href="http://127.0.0.1:8080/v2/users">on</a>`
+	if got := readBody(t, res); got != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+	if got, want := res.ContentLength, int64(len(want)); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader(`{"url":"http://api.example.com/v1"}`))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", "35")
+
+	if err := mod.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(b), `{"url":"http://127.0.0.1:8080/v1"}`; got != want {
+		t.Errorf("req.Body: got %q, want %q", got, want)
+	}
+	if got, want := req.Header.Get("Content-Length"), "34"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Content-Length", got, want)
+	}
+}
+
+func TestReplaceModifierContentTypes(t *testing.T) {
+	tt := []struct {
+		types       []string
+		contentType string
+		replaced    bool
+	}{
+		{nil, "text/plain", true},
+		{nil, "application/vnd.api+json", true},
+		{nil, "image/png", false},
+		{nil, "", false},
+		{[]string{"application/javascript"}, "application/javascript; charset=utf-8", true},
+		{[]string{"application/javascript"}, "text/html", false},
+		{[]string{"image/*"}, "image/svg+xml", true},
+	}
+
+	for i, tc := range tt {
+		mod := NewReplaceModifier()
+		mod.AddLiteral("old", "new")
+		mod.SetContentTypes(tc.types...)
+
+		res := newReplaceResponse(t, tc.contentType, "old")
+		if err := mod.ModifyResponse(res); err != nil {
+			t.Fatalf("%d. ModifyResponse(): got %v, want no error", i, err)
+		}
+
+		want := "old"
+		if tc.replaced {
+			want = "new"
+		}
+		if got := readBody(t, res); got != want {
+			t.Errorf("%d. res.Body: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestReplaceModifierEncodings(t *testing.T) {
+	mod := NewReplaceModifier()
+	mod.AddLiteral("example.com", "martian.local")
+	mod.AddLiteral("café", "caffè")
+
+	// Gzip and br encoded bodies.
+	for _, ce := range []string{"gzip", "br"} {
+		h := http.Header{}
+		h.Set("Content-Encoding", ce)
+		encoded, err := proxyutil.EncodeContent(h, []byte("visit example.com"))
+		if err != nil {
+			t.Fatalf("%s: EncodeContent(): got %v, want no error", ce, err)
+		}
+
+		res := newReplaceResponse(t, "text/plain", string(encoded))
+		res.Header.Set("Content-Encoding", ce)
+		if err := mod.ModifyResponse(res); err != nil {
+			t.Fatalf("%s: ModifyResponse(): got %v, want no error", ce, err)
+		}
+
+		b, err := proxyutil.DecodeContent(res.Header, []byte(readBody(t, res)))
+		if err != nil {
+			t.Fatalf("%s: DecodeContent(): got %v, want no error", ce, err)
+		}
+		if got, want := string(b), "visit martian.local"; got != want {
+			t.Errorf("%s: res.Body: got %q, want %q", ce, got, want)
+		}
+	}
+
+	// ISO-8859-1 encoded body.
+	res := newReplaceResponse(t, "text/plain; charset=ISO-8859-1", "un caf\xe9 \xe0 example.com")
+	if err := mod.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if got, want := readBody(t, res), "un caff\xe8 \xe0 martian.local"; got != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	// Unsupported encodings are skipped.
+	res = newReplaceResponse(t, "text/plain", "example.com")
+	res.Header.Set("Content-Encoding", "zstd")
+	if err := mod.ModifyResponse(res); err != nil {
+		t.Errorf("zstd: ModifyResponse(): got %v, want no error", err)
+	}
+	if got, want := readBody(t, res), "example.com"; got != want {
+		t.Errorf("zstd: res.Body: got %q, want %q", got, want)
+	}
+
+	// Unsupported charsets are left unchanged.
+	res = newReplaceResponse(t, "text/plain; charset=unknown", "example.com")
+	if err := mod.ModifyResponse(res); err == nil {
+		t.Error("charset=unknown: ModifyResponse(): got no error, want error")
+	}
+	if got, want := readBody(t, res), "example.com"; got != want {
+		t.Errorf("charset=unknown: res.Body: got %q, want %q", got, want)
+	}
+}
+
+func TestReplaceModifierStreaming(t *testing.T) {
+	mod := NewReplaceModifier()
+	mod.AddRegexp(regexp.MustCompile(`host-(\d+)\.example\.com`), "h$1.local")
+	mod.AddLiteral("h1", "first")
+	mod.SetBufferSize(10)
+
+	var sb strings.Builder
+	for i := 0; sb.Len() < 5*StreamWindow; i++ {
+		sb.WriteString("<p>host-")
+		sb.WriteString(strings.Repeat("1", i%7+1))
+		sb.WriteString(".example.com</p>\n")
+	}
+	body := sb.String()
+	want := regexp.MustCompile(`host-(\d+)\.example\.com`).ReplaceAllString(body, "h$1.local")
+	want = strings.Replace(want, "h1", "first", -1)
+
+	h := http.Header{}
+	h.Set("Content-Encoding", "deflate")
+	encoded, err := proxyutil.EncodeContent(h, []byte(body))
+	if err != nil {
+		t.Fatalf("EncodeContent(): got %v, want no error", err)
+	}
+
+	res := newReplaceResponse(t, "text/html", string(encoded))
+	res.Header.Set("Content-Encoding", "deflate")
+	res.Header.Set("Content-Length", "1")
+	if err := mod.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.ContentLength, int64(-1); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Content-Length"), ""; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Content-Length", got, want)
+	}
+	if got, want := res.TransferEncoding, []string{"chunked"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("res.TransferEncoding: got %v, want %v", got, want)
+	}
+
+	b, err := proxyutil.DecodeContent(res.Header, []byte(readBody(t, res)))
+	if err != nil {
+		t.Fatalf("DecodeContent(): got %v, want no error", err)
+	}
+	if string(b) != want {
+		t.Errorf("res.Body: got %d bytes, want %d bytes replaced", len(b), len(want))
+	}
+}
+
+func TestReplaceModifierStreamingRequest(t *testing.T) {
+	mod := NewReplaceModifier()
+	mod.AddLiteral("example.com", "martian.local")
+	mod.SetBufferSize(10)
+
+	body := strings.Repeat("example.com\n", StreamWindow)
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	if err := mod.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	if got, want := req.ContentLength, int64(-1); got != want {
+		t.Errorf("req.ContentLength: got %d, want %d", got, want)
+	}
+	if got, want := req.Header.Get("Content-Length"), ""; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Content-Length", got, want)
+	}
+	if got, want := req.TransferEncoding, []string{"chunked"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("req.TransferEncoding: got %v, want %v", got, want)
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(b), strings.Repeat("martian.local\n", StreamWindow); got != want {
+		t.Errorf("req.Body: got %d bytes, want %d bytes replaced", len(got), len(want))
+	}
+}
+
+func TestReplaceModifierFromJSON(t *testing.T) {
+	msg := []byte(`{
+	  "body.Replace": {
+	    "scope": ["response"],
+	    "contentTypes": ["application/javascript"],
+	    "replacements": [
+	      { "regex": "debug: (false|0)", "replacement": "debug: true" },
+	      { "literal": "api.example.com", "replacement": "localhost" }
+	    ]
+	  }
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	resmod := r.ResponseModifier()
+	if resmod == nil {
+		t.Fatalf("resmod: got nil, want not nil")
+	}
+	if reqmod := r.RequestModifier(); reqmod != nil {
+		t.Errorf("reqmod: got %v, want nil", reqmod)
+	}
+
+	res := newReplaceResponse(t, "application/javascript", `fetch("//api.example.com", {debug: 0})`)
+	if err := resmod.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if got, want := readBody(t, res), `fetch("//localhost", {debug: true})`; got != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	for _, msg := range []string{
+		`{"body.Replace": {"replacements": [{"replacement": "x"}]}}`,
+		`{"body.Replace": {"replacements": [{"regex": "(", "replacement": "x"}]}}`,
+		`{"body.Replace": {"replacements": [{"regex": "a", "literal": "a", "replacement": "x"}]}}`,
+	} {
+		if _, err := parse.FromJSON([]byte(msg)); err == nil {
+			t.Errorf("parse.FromJSON(%s): got no error, want error", msg)
+		}
+	}
+}
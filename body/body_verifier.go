@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package body
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/verify"
+)
+
+const bodyErrFormat = "%s(%s) body verify failure: got no match, want %s"
+
+func init() {
+	parse.Register("body.Verifier", verifierFromJSON)
+}
+
+type verifier struct {
+	m      *Matcher
+	reqerr *martian.MultiError
+	reserr *martian.MultiError
+}
+
+type verifierJSON struct {
+	matcherJSON
+	Scope []parse.ModifierType `json:"scope"`
+}
+
+// NewVerifier returns a verifier that checks that the bodies of all modified
+// requests and responses match m.
+func NewVerifier(m *Matcher) verify.RequestResponseVerifier {
+	return &verifier{
+		m:      m,
+		reqerr: martian.NewMultiError(),
+		reserr: martian.NewMultiError(),
+	}
+}
+
+// ModifyRequest verifies that the request body matches. An error will be
+// added to the contained *MultiError for every unmatched request.
+func (v *verifier) ModifyRequest(req *http.Request) error {
+	if !v.m.MatchRequest(req) {
+		v.reqerr.Add(fmt.Errorf(bodyErrFormat, "request", req.URL, v.m))
+	}
+
+	return nil
+}
+
+// ModifyResponse verifies that the response body matches. An error will be
+// added to the contained *MultiError for every unmatched response.
+func (v *verifier) ModifyResponse(res *http.Response) error {
+	if !v.m.MatchResponse(res) {
+		v.reserr.Add(fmt.Errorf(bodyErrFormat, "response", res.Request.URL, v.m))
+	}
+
+	return nil
+}
+
+// VerifyRequests returns an error if verification for any request failed.
+// If an error is returned it will be of type *martian.MultiError.
+func (v *verifier) VerifyRequests() error {
+	if v.reqerr.Empty() {
+		return nil
+	}
+
+	return v.reqerr
+}
+
+// VerifyResponses returns an error if verification for any response failed.
+// If an error is returned it will be of type *martian.MultiError.
+func (v *verifier) VerifyResponses() error {
+	if v.reserr.Empty() {
+		return nil
+	}
+
+	return v.reserr
+}
+
+// ResetRequestVerifications clears all failed request verifications.
+func (v *verifier) ResetRequestVerifications() {
+	v.reqerr = martian.NewMultiError()
+}
+
+// ResetResponseVerifications clears all failed response verifications.
+func (v *verifier) ResetResponseVerifications() {
+	v.reserr = martian.NewMultiError()
+}
+
+// verifierFromJSON builds a body.Verifier from JSON, with the conditions of
+// body.Filter.
+//
+// Example JSON:
+// {
+//   "body.Verifier": {
+//     "scope": ["request"],
+//     "field": "email",
+//     "value": "user@example.com"
+//   }
+// }
+func verifierFromJSON(b []byte) (*parse.Result, error) {
+	msg := &verifierJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	m, err := msg.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return parse.NewResult(NewVerifier(m), msg.Scope)
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package body
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+	"github.com/google/martian/v3/verify"
+)
+
+func TestVerifyRequests(t *testing.T) {
+	v := NewVerifier(NewFormMatcher("email", "user@example.com"))
+
+	for _, body := range []string{"email=user%40example.com", "email=other%40example.com", "name=user"} {
+		req := newBodyRequest(t, "application/x-www-form-urlencoded", body)
+		if err := v.ModifyRequest(req); err != nil {
+			t.Fatalf("ModifyRequest(): got %v, want no error", err)
+		}
+	}
+
+	merr, ok := v.VerifyRequests().(*martian.MultiError)
+	if !ok {
+		t.Fatal("VerifyRequests(): got no error, want *martian.MultiError")
+	}
+	if got, want := len(merr.Errors()), 2; got != want {
+		t.Fatalf("len(merr.Errors()): got %d, want %d", got, want)
+	}
+
+	want := `request(http://example.com) body verify failure: got no match, want form field "email" == "user@example.com"`
+	if got := merr.Errors()[0].Error(); got != want {
+		t.Errorf("merr.Errors()[0]: got %q, want %q", got, want)
+	}
+
+	v.ResetRequestVerifications()
+	if err := v.VerifyRequests(); err != nil {
+		t.Errorf("VerifyRequests(): got %v, want no error", err)
+	}
+}
+
+func TestVerifyResponses(t *testing.T) {
+	v := NewVerifier(NewRegexMatcher(regexp.MustCompile(`"status":\s*"ok"`)))
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	for _, body := range []string{`{"status": "ok"}`, `{"status": "error"}`} {
+		res := proxyutil.NewResponse(200, strings.NewReader(body), req)
+		if err := v.ModifyResponse(res); err != nil {
+			t.Fatalf("ModifyResponse(): got %v, want no error", err)
+		}
+	}
+
+	merr, ok := v.VerifyResponses().(*martian.MultiError)
+	if !ok {
+		t.Fatal("VerifyResponses(): got no error, want *martian.MultiError")
+	}
+	if got, want := len(merr.Errors()), 1; got != want {
+		t.Fatalf("len(merr.Errors()): got %d, want %d", got, want)
+	}
+
+	v.ResetResponseVerifications()
+	if err := v.VerifyResponses(); err != nil {
+		t.Errorf("VerifyResponses(): got %v, want no error", err)
+	}
+}
+
+func TestVerifierFromJSON(t *testing.T) {
+	msg := []byte(`{
+	  "body.Verifier": {
+	    "scope": ["request"],
+	    "jsonPath": "$.user.role",
+	    "value": "admin"
+	  }
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	reqv, ok := r.RequestModifier().(verify.RequestVerifier)
+	if !ok {
+		t.Fatal("reqv.(verify.RequestVerifier): got !ok, want ok")
+	}
+	if r.ResponseModifier() != nil {
+		t.Error("r.ResponseModifier(): got not nil, want nil")
+	}
+
+	req := newBodyRequest(t, "application/json", `{"user":{"role":"guest"}}`)
+	if err := reqv.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if err := reqv.VerifyRequests(); err == nil {
+		t.Error("VerifyRequests(): got nil, want not nil")
+	}
+}
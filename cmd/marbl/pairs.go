@@ -0,0 +1,333 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"github.com/google/martian/v3/marbl"
+)
+
+// filter selects request/response pairs.
+type filter struct {
+	host     string
+	statuses [][2]int
+	ids      map[string]bool
+}
+
+// newFilter returns a filter for pairs with the request host, a response
+// status in statuses and an ID in ids. Empty values match all pairs.
+func newFilter(host, statuses, ids string) (*filter, error) {
+	f := &filter{
+		host: host,
+	}
+
+	for _, s := range splitList(statuses) {
+		r, err := parseStatus(s)
+		if err != nil {
+			return nil, err
+		}
+		f.statuses = append(f.statuses, r)
+	}
+
+	for _, id := range splitList(ids) {
+		if f.ids == nil {
+			f.ids = make(map[string]bool)
+		}
+		f.ids[id] = true
+	}
+
+	return f, nil
+}
+
+// parseStatus parses a status code (200), class (4xx) or range (500-599).
+func parseStatus(s string) ([2]int, error) {
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") {
+		c, err := strconv.Atoi(s[:1])
+		if err == nil {
+			return [2]int{c * 100, c*100 + 99}, nil
+		}
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return [2]int{}, fmt.Errorf("invalid status %q", s)
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil {
+			return [2]int{}, fmt.Errorf("invalid status %q", s)
+		}
+	}
+
+	return [2]int{min, max}, nil
+}
+
+func splitList(s string) []string {
+	var vs []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			vs = append(vs, v)
+		}
+	}
+
+	return vs
+}
+
+func (f *filter) matchesID(id string) bool {
+	return f.ids == nil || f.ids[id]
+}
+
+func (f *filter) matches(p *marbl.Pair) bool {
+	if !f.matchesID(p.ID) {
+		return false
+	}
+
+	if f.host != "" {
+		if p.Request == nil {
+			return false
+		}
+		h := p.Request.Meta[":authority"]
+		if hh, _, err := net.SplitHostPort(h); err == nil && !strings.Contains(f.host, ":") {
+			h = hh
+		}
+		if !strings.EqualFold(h, f.host) {
+			return false
+		}
+	}
+
+	if len(f.statuses) > 0 {
+		if p.Response == nil {
+			return false
+		}
+		code, err := strconv.Atoi(p.Response.Meta[":status"])
+		if err != nil {
+			return false
+		}
+
+		ok := false
+		for _, r := range f.statuses {
+			if code >= r[0] && code <= r[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// printPairs writes the pairs read from pr that match f to w in format.
+func printPairs(w io.Writer, pr *marbl.PairReader, f *filter, format string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if format == "summary" {
+		fmt.Fprintln(tw, "ID\tMETHOD\tSTATUS\tURL\tREQUEST\tRESPONSE\tTIME\tERROR")
+	}
+
+	hl := &har.HAR{
+		Log: &har.Log{
+			Version: "1.2",
+			Creator: &har.Creator{
+				Name:    "martian marbl",
+				Version: "2.0.0",
+			},
+			Entries: []*har.Entry{},
+		},
+	}
+
+	for {
+		p, err := pr.ReadPair()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Captures are often cut short; keep what was read so far.
+			log.Printf("pr.ReadPair(): got %v, want no error or io.EOF", err)
+			break
+		}
+		if !f.matches(p) {
+			continue
+		}
+
+		switch format {
+		case "summary":
+			printSummary(tw, p)
+		case "messages":
+			if err := printMessages(w, p); err != nil {
+				return err
+			}
+		case "har":
+			e, err := harEntry(p)
+			if err != nil {
+				log.Printf("skipping pair %s: %v", p.ID, err)
+				continue
+			}
+			hl.Log.Entries = append(hl.Log.Entries, e)
+		}
+	}
+
+	switch format {
+	case "summary":
+		return tw.Flush()
+	case "har":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(hl)
+	}
+
+	return nil
+}
+
+func printSummary(w io.Writer, p *marbl.Pair) {
+	method, url, status := "-", "-", "-"
+	reqSize, resSize, d := "-", "-", "-"
+
+	if req := p.Request; req != nil {
+		method = req.Meta[":method"]
+		url = req.Meta[":scheme"] + "://" + req.Meta[":authority"] + req.Meta[":path"]
+		if q := req.Meta[":query"]; q != "" {
+			url += "?" + q
+		}
+		reqSize = strconv.Itoa(len(req.Body))
+	}
+	if res := p.Response; res != nil {
+		status = res.Meta[":status"]
+		resSize = strconv.Itoa(len(res.Body))
+		if !res.Complete {
+			resSize += "+"
+		}
+	}
+	if t, ok := duration(p); ok {
+		d = t.String()
+	}
+	errMsg := "-"
+	if p.Response != nil && p.Response.Error != "" {
+		errMsg = p.Response.Error
+	}
+
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.ID, method, status, url, reqSize, resSize, d, errMsg)
+}
+
+// duration returns the time from the request until the response ended, or
+// until the response was logged before version 2.
+func duration(p *marbl.Pair) (time.Duration, bool) {
+	if p.Response == nil {
+		return 0, false
+	}
+	if p.Response.Ended {
+		return p.Response.Duration, true
+	}
+	if p.Request == nil {
+		return 0, false
+	}
+
+	start, end := p.Request.Time(), p.Response.Time()
+	if start.IsZero() || end.IsZero() {
+		return 0, false
+	}
+
+	return end.Sub(start), true
+}
+
+func printMessages(w io.Writer, p *marbl.Pair) error {
+	fmt.Fprintf(w, "=== %s\n", p.ID)
+
+	if p.Request != nil {
+		req, err := p.HTTPRequest()
+		if err != nil {
+			return err
+		}
+		b, err := httputil.DumpRequest(req, true)
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+		fmt.Fprintln(w)
+	}
+
+	if p.Response != nil {
+		res, err := p.HTTPResponse()
+		if err != nil {
+			return err
+		}
+		b, err := httputil.DumpResponse(res, true)
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
+
+// harEntry converts p into a HAR entry. The timings of the round trip are not
+// recorded in .marbl files, so the whole time is attributed to waiting.
+func harEntry(p *marbl.Pair) (*har.Entry, error) {
+	req, err := p.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := har.NewRequest(req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &har.Entry{
+		ID:              p.ID,
+		StartedDateTime: p.Request.Time().UTC(),
+		Request:         hreq,
+		Cache:           &har.Cache{},
+		Timings: &har.Timings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			SSL:     -1,
+		},
+	}
+
+	if p.Response == nil {
+		return e, nil
+	}
+
+	res, err := p.HTTPResponse()
+	if err != nil {
+		return nil, err
+	}
+	if e.Response, err = har.NewResponse(res, true); err != nil {
+		return nil, err
+	}
+
+	if d, ok := duration(p); ok {
+		e.Time = d.Nanoseconds() / 1000000
+		e.Timings.Wait = e.Time
+	}
+
+	return e, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/har"
+	"github.com/google/martian/v3/marbl"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// capture returns a .marbl capture of a round trip to each of urls, answered
+// with the corresponding status.
+func capture(t *testing.T, urls []string, statuses []int) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	s := marbl.NewStream(&b)
+
+	for i, u := range urls {
+		req, err := http.NewRequest("GET", u, strings.NewReader(""))
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("TestContext(): got %v, want no error", err)
+		}
+		defer remove()
+
+		id := strings.Repeat(string(rune('a'+i)), 8)
+		s.LogRequest(id, req)
+		ioutil.ReadAll(req.Body)
+
+		res := proxyutil.NewResponse(statuses[i], strings.NewReader("body"), req)
+		s.LogResponse(id, res)
+		ioutil.ReadAll(res.Body)
+	}
+	s.Close()
+
+	return b.Bytes()
+}
+
+func TestPrintPairsHAR(t *testing.T) {
+	b := capture(t, []string{"http://example.com/ok", "http://example.com:8080/missing", "http://other.com/"}, []int{200, 404, 500})
+
+	f, err := newFilter("example.com", "2xx,400-499", "")
+	if err != nil {
+		t.Fatalf("newFilter(): got %v, want no error", err)
+	}
+
+	var out bytes.Buffer
+	if err := printPairs(&out, marbl.NewPairReader(bytes.NewReader(b)), f, "har"); err != nil {
+		t.Fatalf("printPairs(): got %v, want no error", err)
+	}
+
+	hl := &har.HAR{}
+	if err := json.Unmarshal(out.Bytes(), hl); err != nil {
+		t.Fatalf("json.Unmarshal(): got %v, want no error", err)
+	}
+	if got, want := len(hl.Log.Entries), 2; got != want {
+		t.Fatalf("len(hl.Log.Entries): got %d, want %d", got, want)
+	}
+
+	e := hl.Log.Entries[1]
+	if got, want := e.Request.URL, "http://example.com:8080/missing"; got != want {
+		t.Errorf("e.Request.URL: got %q, want %q", got, want)
+	}
+	if got, want := e.Response.Status, 404; got != want {
+		t.Errorf("e.Response.Status: got %d, want %d", got, want)
+	}
+	if got, want := string(e.Response.Content.Text), "body"; got != want {
+		t.Errorf("e.Response.Content.Text: got %q, want %q", got, want)
+	}
+}
+
+func TestPrintPairsSummary(t *testing.T) {
+	b := capture(t, []string{"http://example.com/ok", "http://other.com/"}, []int{200, 500})
+
+	f, err := newFilter("", "", "bbbbbbbb")
+	if err != nil {
+		t.Fatalf("newFilter(): got %v, want no error", err)
+	}
+
+	var out bytes.Buffer
+	if err := printPairs(&out, marbl.NewPairReader(bytes.NewReader(b)), f, "summary"); err != nil {
+		t.Fatalf("printPairs(): got %v, want no error", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if got, want := len(lines), 2; got != want {
+		t.Fatalf("len(lines): got %d, want %d:\n%s", got, want, out.String())
+	}
+	if got, want := strings.Fields(lines[1])[:4], []string{"bbbbbbbb", "GET", "500", "http://other.com/"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("lines[1]: got %v, want prefix %v", got, want)
+	}
+
+	if _, err := newFilter("", "abc", ""); err == nil {
+		t.Error("newFilter(): got no error, want error for invalid status")
+	}
+}
@@ -12,30 +12,51 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Command-line tool to view .marbl files. This tool reads all headers from provided .marbl
-// file and prints them to stdout. Bodies of request/response are not printed to stdout,
+// Command-line tool to view and convert .marbl files.
+//
+// By default, this tool reads all headers from provided .marbl file and prints
+// them to stdout. Bodies of request/response are not printed to stdout,
 // instead they are saved into individual files in form of "marbl_ID_TYPE" where
 // ID is the ID of request or response and TYPE is "request" or "response".
 //
+// The other formats reassemble the frames into request/response pairs, which
+// may be filtered by host, status and ID.
+//
 // Command line arguments:
-//   --file  Path to the .marbl file to view.
-//   --out   Optional, folder where this tool will save request/response bodies.
-//           uses current folder by default.
+//   --file    Path to the .marbl file to view; .gz files are decompressed.
+//   --format  Optional, one of:
+//               frames    prints frames and saves bodies (default)
+//               summary   prints a table of the request/response pairs
+//               messages  prints each request and response in full
+//               har       prints the request/response pairs as a HAR log
+//   --out     Optional, folder where this tool will save request/response bodies.
+//             uses current folder by default.
+//   --host    Optional, only include pairs with this request host.
+//   --status  Optional, only include pairs with a response status (200), class
+//             (4xx) or range (500-599); may be comma separated.
+//   --id      Optional, only include frames or pairs with this ID; may be comma
+//             separated.
 package main
 
 import (
+	"compress/gzip"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/google/martian/v3/marbl"
 )
 
 var (
-	file = flag.String("file", "", ".marbl file to show contents of")
-	out  = flag.String("out", "", "folder to write request/response bodies to. Folder must exist.")
+	file   = flag.String("file", "", ".marbl file to show contents of")
+	format = flag.String("format", "frames", "output format: frames, summary, messages or har")
+	out    = flag.String("out", "", "folder to write request/response bodies to. Folder must exist.")
+	host   = flag.String("host", "", "only include pairs with this request host")
+	status = flag.String("status", "", "only include pairs with this response status, class (4xx) or range (500-599)")
+	ids    = flag.String("id", "", "only include frames or pairs with this ID")
 )
 
 func main() {
@@ -46,12 +67,45 @@ func main() {
 		return
 	}
 
+	f, err := newFilter(*host, *status, *ids)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	file, err := os.Open(*file)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(file.Name(), ".gz") {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r = gr
+	}
 
-	reader := marbl.NewReader(file)
+	switch *format {
+	case "frames":
+		if *host != "" || *status != "" {
+			log.Fatal("--host and --status require a format other than frames")
+		}
+		printFrames(r, f)
+	case "summary", "messages", "har":
+		if err := printPairs(os.Stdout, marbl.NewPairReader(r), f, *format); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+}
+
+// printFrames prints the frames read from r that match f, and appends their
+// bodies to files.
+func printFrames(r io.Reader, f *filter) {
+	reader := marbl.NewReader(r)
 
 	// Iterate through all frames in .marbl file.
 	for {
@@ -64,10 +118,26 @@ func main() {
 			break
 		}
 
+		var id string
+		switch frame := frame.(type) {
+		case marbl.Header:
+			id = frame.ID
+		case marbl.Data:
+			id = frame.ID
+		case marbl.End:
+			id = frame.ID
+		}
+		if !f.matchesID(id) {
+			continue
+		}
+
 		// Print current frame to stdout.
-		if frame.FrameType() == marbl.HeaderFrame {
+		switch frame.FrameType() {
+		case marbl.HeaderFrame:
 			fmt.Print("Header ")
-		} else {
+		case marbl.EndFrame:
+			fmt.Print("End ")
+		default:
 			fmt.Print("Data ")
 		}
 		fmt.Println(frame.String())
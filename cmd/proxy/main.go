@@ -140,6 +140,17 @@
 // reset the in-memory HAR log; note that the log will grow unbounded unless it
 // is periodically reset
 //
+//   POST http://martian.proxy/logs/page?title=Home
+//
+// starts a new HAR page that subsequent entries belong to; posting the id of a
+// page with onContentLoad and onLoad query parameters sets its timings
+//
+//   GET http://martian.proxy/logs/curl
+//   GET http://martian.proxy/logs/go
+//
+// exports the logged requests as curl command lines or Go snippets; the
+// requests are selected with the same query parameters as /logs
+//
 // passing the -cors flag will enable CORS support for the endpoints so that they
 // may be called via AJAX
 //
@@ -174,16 +185,76 @@
 //     window of time around the time of request that the dynamically-generated
 //     certificate is valid for; the duration is set such that the total valid
 //     timeframe is double the value of validity (1h before & 1h after)
+//   -h2-hosts=""
+//     comma-separated list of hosts, with or without port, whose HTTP/2
+//     traffic is relayed as HTTP/2 instead of being downgraded to HTTP/1.1.
+//     Requires -cert and -key or -generate-ca-cert.
+//   -h2c-hosts=""
+//     comma-separated list of hosts, with or without port, whose servers speak
+//     cleartext HTTP/2 (h2c); HTTP/2 traffic to them is relayed with prior
+//     knowledge. Cleartext h2c from clients, sent directly or through an
+//     Upgrade, is relayed as HTTP/2 without MITM. With MITM, implies -h2-hosts
+//     for these hosts.
 //   -cors=false
 //     allow the proxy to be configured via CORS requests; such as when
 //     configuring the proxy via AJAX
 //   -har=false
 //     enable logging endpoints for retrieving full request/response logs in
 //     HAR format.
+//   -har-dir=""
+//     directory to stream completed HAR entries to; files are rotated every
+//     100MB. Requires -har.
+//   -har-format="har"
+//     format of the files written to -har-dir; "har" for HAR documents or
+//     "ndjson" for one JSON encoded entry per line.
+//   -har-gzip=false
+//     gzip compress the files written to -har-dir.
+//   -har-max-age=0
+//     rotate the files written to -har-dir once they are this old; 0 only
+//     rotates by size.
+//   -har-max-entries=0
+//     maximum number of completed HAR entries kept in memory for the logging
+//     endpoints; 0 keeps all entries.
+//   -har-page-header=""
+//     request header whose value groups HAR entries into pages of that title.
+//   -har-pages-from-referer=false
+//     infer HAR pages from navigation requests and Referer chains.
+//   -har-shaping=false
+//     record the traffic shaping actions performed on responses in the
+//     _shaping field of their HAR entries. Requires -har and -traffic-shaping.
+//   -marbl-dir=""
+//     directory to record all traffic to as MARBL files; files are rotated
+//     every 100MB. Does not require -marbl.
+//   -marbl-gzip=false
+//     gzip compress the files written to -marbl-dir.
+//   -marbl-max-age=0
+//     rotate the files written to -marbl-dir once they are this old; 0 only
+//     rotates by size.
+//   -marbl-zstd=false
+//     zstd compress the files written to -marbl-dir. Cannot be combined with
+//     -marbl-gzip.
 //   -traffic-shaping=false
 //     enable traffic shaping endpoints for simulating latency and constrained
 //     bandwidth conditions (e.g. mobile, exotic network infrastructure, the
-//     90's)
+//     90's); live stats of the shaped connections are served at
+//     /shape-traffic/stats
+//   -traffic-shaping-upstream=false
+//     shape the connections from the proxy to servers as configured through
+//     the "upstream" rules of the traffic shaping endpoint. Requires
+//     -traffic-shaping.
+//   -traffic-shaping-profiles=""
+//     JSON file of named traffic shaping profiles to register in addition to
+//     the built-in ones, such as "3g-slow" and "satellite".
+//   -traffic-shaping-profile=""
+//     name of the traffic shaping profile applied on startup. Requires
+//     -traffic-shaping.
+//   -traffic-shaping-trace-up=""
+//     trace file driving the bandwidth written to clients over time, either
+//     a Mahimahi trace or a CSV of milliseconds and bits per second if its
+//     extension is .csv. The trace loops. Requires -traffic-shaping.
+//   -traffic-shaping-trace-down=""
+//     trace file driving the bandwidth read from clients over time, as
+//     -traffic-shaping-trace-up.
 //   -skip-tls-verify=false
 //     skip TLS server verification; insecure and intended for testing only
 //   -v=0
@@ -194,6 +265,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -209,6 +281,7 @@ import (
 	mapi "github.com/google/martian/v3/api"
 	"github.com/google/martian/v3/cors"
 	"github.com/google/martian/v3/fifo"
+	"github.com/google/martian/v3/h2"
 	"github.com/google/martian/v3/har"
 	"github.com/google/martian/v3/httpspec"
 	mlog "github.com/google/martian/v3/log"
@@ -222,9 +295,13 @@ import (
 
 	_ "github.com/google/martian/v3/body"
 	_ "github.com/google/martian/v3/cookie"
+	_ "github.com/google/martian/v3/delay"
 	_ "github.com/google/martian/v3/failure"
+	_ "github.com/google/martian/v3/fault"
+	_ "github.com/google/martian/v3/martianjson"
 	_ "github.com/google/martian/v3/martianurl"
 	_ "github.com/google/martian/v3/method"
+	_ "github.com/google/martian/v3/mock"
 	_ "github.com/google/martian/v3/pingback"
 	_ "github.com/google/martian/v3/port"
 	_ "github.com/google/martian/v3/priority"
@@ -245,10 +322,29 @@ var (
 	key            = flag.String("key", "", "filepath to the private key of the CA used to sign MITM certificates")
 	organization   = flag.String("organization", "Martian Proxy", "organization name for MITM certificates")
 	validity       = flag.Duration("validity", time.Hour, "window of time that MITM certificates are valid")
+	h2Hosts        = flag.String("h2-hosts", "", "comma-separated hosts whose HTTP/2 traffic is relayed as HTTP/2")
+	h2cHosts       = flag.String("h2c-hosts", "", "comma-separated hosts whose servers speak cleartext HTTP/2")
 	allowCORS      = flag.Bool("cors", false, "allow CORS requests to configure the proxy")
 	harLogging     = flag.Bool("har", false, "enable HAR logging API")
+	harDir         = flag.String("har-dir", "", "directory to stream HAR entries to")
+	harFormat      = flag.String("har-format", "har", "format of the files written to -har-dir: har or ndjson")
+	harGzip        = flag.Bool("har-gzip", false, "gzip compress the HAR files written to -har-dir")
+	harMaxAge      = flag.Duration("har-max-age", 0, "age after which HAR files written to -har-dir are rotated")
+	harMaxEntries  = flag.Int("har-max-entries", 0, "maximum number of completed HAR entries kept in memory")
+	harPageHeader  = flag.String("har-page-header", "", "request header whose value groups HAR entries into pages")
+	harPageReferer = flag.Bool("har-pages-from-referer", false, "infer HAR pages from navigations and Referer chains")
+	harShaping     = flag.Bool("har-shaping", false, "record traffic shaping actions in HAR entries")
 	marblLogging   = flag.Bool("marbl", false, "enable MARBL logging API")
+	marblDir       = flag.String("marbl-dir", "", "directory to record all traffic to as MARBL files")
+	marblGzip      = flag.Bool("marbl-gzip", false, "gzip compress the MARBL files written to -marbl-dir")
+	marblMaxAge    = flag.Duration("marbl-max-age", 0, "age after which MARBL files written to -marbl-dir are rotated")
+	marblZstd      = flag.Bool("marbl-zstd", false, "zstd compress the MARBL files written to -marbl-dir")
 	trafficShaping = flag.Bool("traffic-shaping", false, "enable traffic shaping API")
+	tsUpstream     = flag.Bool("traffic-shaping-upstream", false, "enable traffic shaping of connections to servers")
+	tsProfiles     = flag.String("traffic-shaping-profiles", "", "JSON file of traffic shaping profiles to register")
+	tsProfile      = flag.String("traffic-shaping-profile", "", "name of the traffic shaping profile applied on startup")
+	tsTraceUp      = flag.String("traffic-shaping-trace-up", "", "trace file driving the bandwidth written to clients")
+	tsTraceDown    = flag.String("traffic-shaping-trace-down", "", "trace file driving the bandwidth read from clients")
 	skipTLSVerify  = flag.Bool("skip-tls-verify", false, "skip TLS server verification; insecure")
 	dsProxyURL     = flag.String("downstream-proxy-url", "", "URL of downstream proxy")
 	level          = flag.Int("v", 0, "log level")
@@ -295,6 +391,12 @@ func main() {
 		p.SetDownstreamProxy(u)
 	}
 
+	if *h2cHosts != "" {
+		p.SetH2CConfig(&h2.Config{
+			AllowedHostsFilter: hostsFilter(*h2cHosts),
+		})
+	}
+
 	mux := http.NewServeMux()
 
 	var x509c *x509.Certificate
@@ -329,6 +431,14 @@ func main() {
 		mc.SetOrganization(*organization)
 		mc.SkipTLSVerify(*skipTLSVerify)
 
+		if *h2Hosts != "" || *h2cHosts != "" {
+			h2f, h2cf := hostsFilter(*h2Hosts), hostsFilter(*h2cHosts)
+			mc.SetH2Config(&h2.Config{
+				AllowedHostsFilter: func(host string) bool { return h2f(host) || h2cf(host) },
+				H2CHostsFilter:     h2cf,
+			})
+		}
+
 		p.SetMITM(mc)
 
 		// Expose certificate authority.
@@ -376,8 +486,32 @@ func main() {
 	fg.AddRequestModifier(m)
 	fg.AddResponseModifier(m)
 
+	var harSink *har.FileSink
+	var hl *har.Logger
 	if *harLogging {
-		hl := har.NewLogger()
+		hl = har.NewLogger()
+		hl.SetOption(har.MaxEntries(*harMaxEntries))
+		hl.SetOption(har.PagesFromReferer(*harPageReferer))
+		if *harPageHeader != "" {
+			hl.SetOption(har.PageHeader(*harPageHeader))
+		}
+		if *harDir != "" {
+			harSink, err = har.NewFileSink(*harDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			switch *harFormat {
+			case "har":
+				harSink.SetFormat(har.FormatHAR)
+			case "ndjson":
+				harSink.SetFormat(har.FormatNDJSON)
+			default:
+				log.Fatalf("martian: unknown -har-format %q", *harFormat)
+			}
+			harSink.SetGzip(*harGzip)
+			harSink.SetMaxAge(*harMaxAge)
+			hl.SetOption(har.StreamTo(harSink))
+		}
 		muxf := servemux.NewFilter(mux)
 		// Only append to HAR logs when the requests are not API requests,
 		// that is, they are not matched in http.DefaultServeMux
@@ -389,6 +523,9 @@ func main() {
 
 		configure("/logs", har.NewExportHandler(hl), mux)
 		configure("/logs/reset", har.NewResetHandler(hl), mux)
+		configure("/logs/page", har.NewPageHandler(hl), mux)
+		configure("/logs/curl", har.NewCurlHandler(hl), mux)
+		configure("/logs/go", har.NewGoSnippetHandler(hl), mux)
 	}
 
 	logger := martianlog.NewLogger()
@@ -397,17 +534,40 @@ func main() {
 	stack.AddRequestModifier(logger)
 	stack.AddResponseModifier(logger)
 
-	if *marblLogging {
-		lsh := marbl.NewHandler()
-		lsm := marbl.NewModifier(lsh)
+	var lsm *marbl.Modifier
+	var marblSink *marbl.FileSink
+	if *marblLogging || *marblDir != "" {
+		var ws []io.Writer
+		if *marblLogging {
+			lsh := marbl.NewHandler()
+			ws = append(ws, lsh)
+
+			// retrieve binary marbl logs
+			mux.Handle("/binlogs", lsh)
+		}
+		if *marblDir != "" {
+			marblSink, err = marbl.NewFileSink(*marblDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			switch {
+			case *marblGzip && *marblZstd:
+				log.Fatal("martian: -marbl-gzip and -marbl-zstd cannot be combined")
+			case *marblGzip:
+				marblSink.SetCompressor(marbl.Gzip)
+			case *marblZstd:
+				marblSink.SetCompressor(marbl.Zstd)
+			}
+			marblSink.SetMaxAge(*marblMaxAge)
+			ws = append(ws, marblSink)
+		}
+
+		lsm = marbl.NewModifier(io.MultiWriter(ws...))
 		muxf := servemux.NewFilter(mux)
 		muxf.RequestWhenFalse(lsm)
 		muxf.ResponseWhenFalse(lsm)
 		stack.AddRequestModifier(muxf)
 		stack.AddResponseModifier(muxf)
-
-		// retrieve binary marbl logs
-		mux.Handle("/binlogs", lsh)
 	}
 
 	// Configure modifiers.
@@ -426,9 +586,49 @@ func main() {
 	configure("/verify/reset", rh, mux)
 
 	if *trafficShaping {
+		if *tsProfiles != "" {
+			if err := trafficshape.LoadProfilesFile(*tsProfiles); err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		tsl := trafficshape.NewListener(l)
+		if *tsProfile != "" {
+			if err := tsl.SetProfile(*tsProfile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *tsTraceUp != "" || *tsTraceDown != "" {
+			var up, down *trafficshape.Trace
+			if *tsTraceUp != "" {
+				t, err := trafficshape.LoadTraceFile(*tsTraceUp)
+				if err != nil {
+					log.Fatal(err)
+				}
+				up = t
+			}
+			if *tsTraceDown != "" {
+				t, err := trafficshape.LoadTraceFile(*tsTraceDown)
+				if err != nil {
+					log.Fatal(err)
+				}
+				down = t
+			}
+			if err := tsl.SetTraces(up, down); err != nil {
+				log.Fatal(err)
+			}
+		}
 		tsh := trafficshape.NewHandler(tsl)
+		if *tsUpstream {
+			tsd := trafficshape.NewDialer(nil)
+			p.SetDialContext(tsd.DialContext)
+			tsh.SetDialer(tsd)
+		}
 		configure("/shape-traffic", tsh, mux)
+		configure("/shape-traffic/stats", trafficshape.NewStatsHandler(tsl), mux)
+		if *harShaping && hl != nil {
+			hl.SetOption(har.ShapingEvents(tsl))
+		}
 
 		l = tsl
 	}
@@ -443,6 +643,19 @@ func main() {
 	<-sigc
 
 	log.Println("martian: shutting down")
+	if harSink != nil {
+		if err := harSink.Close(); err != nil {
+			log.Printf("martian: failed to close HAR sink: %v", err)
+		}
+	}
+	if marblSink != nil {
+		// Closing the stream writes the frames being logged, so that they are
+		// synced by closing the sink.
+		lsm.Close()
+		if err := marblSink.Close(); err != nil {
+			log.Printf("martian: failed to close MARBL sink: %v", err)
+		}
+	}
 	os.Exit(0)
 }
 
@@ -460,3 +673,25 @@ func configure(pattern string, handler http.Handler, mux *http.ServeMux) {
 	p := path.Join("localhost"+*apiAddr, pattern)
 	mux.Handle(p, handler)
 }
+
+// hostsFilter returns a function returning true if its argument, a host with
+// an optional port, is in the comma-separated list of hosts. Hosts in the list
+// without a port match any port.
+func hostsFilter(hosts string) func(string) bool {
+	set := make(map[string]bool)
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			set[h] = true
+		}
+	}
+
+	return func(host string) bool {
+		if set[host] {
+			return true
+		}
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			return set[hostname]
+		}
+		return false
+	}
+}
@@ -17,11 +17,16 @@ package martian
 import (
 	"bufio"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Context provides information and storage for a single request/response pair.
@@ -36,6 +41,67 @@ type Context struct {
 	skipRoundTrip bool
 	skipLogging   bool
 	apiRequest    bool
+	trace         RoundTripTrace
+
+	tunnelExpected  bool
+	tunnelClosed    bool
+	tunnelObservers []TunnelObserver
+	tunnelStart     time.Time
+	bytesSent       int64 // atomic
+	bytesReceived   int64 // atomic
+}
+
+// RoundTripTrace records when the phases of the round trip of a request from
+// the proxy to the server happened, and the connection it was sent on. Phases
+// that did not happen have a zero time, for instance DNSStart and
+// ConnectStart for requests sent on a reused keep-alive connection.
+type RoundTripTrace struct {
+	// GetConn is when the proxy started waiting for a connection.
+	GetConn time.Time
+	// DNSStart and DNSDone are when the DNS lookup started and finished.
+	DNSStart, DNSDone time.Time
+	// ConnectStart and ConnectDone are when the first dial started and the
+	// last dial finished.
+	ConnectStart, ConnectDone time.Time
+	// TLSHandshakeStart and TLSHandshakeDone are when the TLS handshake with
+	// the server started and finished.
+	TLSHandshakeStart, TLSHandshakeDone time.Time
+	// GotConn is when a connection was obtained.
+	GotConn time.Time
+	// WroteRequest is when the request was fully written to the connection.
+	WroteRequest time.Time
+	// GotFirstResponseByte is when the first byte of the response was read.
+	GotFirstResponseByte time.Time
+
+	// Reused is whether the connection was previously used for another
+	// request.
+	Reused bool
+	// LocalAddr and RemoteAddr are the addresses of the connection.
+	LocalAddr, RemoteAddr net.Addr
+}
+
+// TunnelStats describes the traffic of a CONNECT tunnel or of a connection
+// upgraded by a 101 Switching Protocols response.
+type TunnelStats struct {
+	// Start and End are when the proxy started and stopped relaying data. Both
+	// are zero if the tunnel was not established after all.
+	Start, End time.Time
+	// BytesSent is the number of bytes relayed from the client to the server.
+	BytesSent int64
+	// BytesReceived is the number of bytes relayed from the server to the
+	// client.
+	BytesReceived int64
+}
+
+// TunnelObserver observes the traffic relayed through the connection that a
+// request established.
+type TunnelObserver interface {
+	// TunnelData is called with data read from the client if fromClient is
+	// true, or from the server otherwise. b must not be retained. Calls for the
+	// two directions may happen concurrently.
+	TunnelData(fromClient bool, b []byte)
+	// TunnelClosed is called once the tunnel has closed.
+	TunnelClosed(stats TunnelStats)
 }
 
 // Session provides information and storage about a connection.
@@ -47,6 +113,8 @@ type Session struct {
 	conn     net.Conn
 	brw      *bufio.ReadWriter
 	vals     map[string]interface{}
+	// hijackHook is called before the connection is handed to a hijacker.
+	hijackHook func()
 }
 
 var (
@@ -128,14 +196,19 @@ func (s *Session) MarkInsecure() {
 // return of the hijacker.
 func (s *Session) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if s.hijacked {
+		s.mu.Unlock()
 		return nil, nil, fmt.Errorf("martian: session has already been hijacked")
 	}
 	s.hijacked = true
+	conn, brw, hook := s.conn, s.brw, s.hijackHook
+	s.mu.Unlock()
 
-	return s.conn, s.brw, nil
+	if hook != nil {
+		hook()
+	}
+
+	return conn, brw, nil
 }
 
 // Hijacked returns whether the connection has been hijacked.
@@ -156,6 +229,16 @@ func (s *Session) setConn(conn net.Conn, brw *bufio.ReadWriter) {
 	s.brw = brw
 }
 
+// setHijackHook sets the function called by Hijack before it hands the
+// connection to the hijacker. Used by the proxy to stop reading from the
+// connection.
+func (s *Session) setHijackHook(hook func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hijackHook = hook
+}
+
 // Get takes key and returns the associated value from the session.
 func (s *Session) Get(key string) (interface{}, bool) {
 	s.mu.RLock()
@@ -255,6 +338,162 @@ func (ctx *Context) IsAPIRequest() bool {
 	return ctx.apiRequest
 }
 
+// RoundTripTrace returns the trace of the round trip to the server for the
+// current request. The trace is empty if the round trip has not started or was
+// skipped.
+func (ctx *Context) RoundTripTrace() RoundTripTrace {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.trace
+}
+
+// ObserveTunnel registers o to observe the tunnel that the response to the
+// current request establishes: an opaque CONNECT tunnel or a connection
+// upgraded by a 101 Switching Protocols response. It returns false, and o is
+// never called, if the response does not establish a tunnel. Observers must be
+// registered by response modifiers.
+func (ctx *Context) ObserveTunnel(o TunnelObserver) bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if !ctx.tunnelExpected || ctx.tunnelClosed {
+		return false
+	}
+	ctx.tunnelObservers = append(ctx.tunnelObservers, o)
+
+	return true
+}
+
+// expectTunnel marks the response to the current request as establishing a
+// tunnel. It must be followed by a call to closeTunnel.
+func (ctx *Context) expectTunnel() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.tunnelExpected = true
+}
+
+// startTunnel records that the proxy started relaying data.
+func (ctx *Context) startTunnel() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.tunnelStart = time.Now()
+}
+
+// tunnelData counts data relayed through the tunnel and passes it to the
+// observers.
+func (ctx *Context) tunnelData(fromClient bool, b []byte) {
+	if fromClient {
+		atomic.AddInt64(&ctx.bytesSent, int64(len(b)))
+	} else {
+		atomic.AddInt64(&ctx.bytesReceived, int64(len(b)))
+	}
+
+	ctx.mu.RLock()
+	obs := ctx.tunnelObservers
+	ctx.mu.RUnlock()
+
+	for _, o := range obs {
+		o.TunnelData(fromClient, b)
+	}
+}
+
+// closeTunnel notifies the observers that the tunnel has closed, or was never
+// started. Only the first call has an effect.
+func (ctx *Context) closeTunnel() {
+	ctx.mu.Lock()
+	if ctx.tunnelClosed {
+		ctx.mu.Unlock()
+		return
+	}
+	ctx.tunnelClosed = true
+	obs := ctx.tunnelObservers
+
+	stats := TunnelStats{
+		Start:         ctx.tunnelStart,
+		BytesSent:     atomic.LoadInt64(&ctx.bytesSent),
+		BytesReceived: atomic.LoadInt64(&ctx.bytesReceived),
+	}
+	if !stats.Start.IsZero() {
+		stats.End = time.Now()
+	}
+	ctx.mu.Unlock()
+
+	for _, o := range obs {
+		o.TunnelClosed(stats)
+	}
+}
+
+// tunnelReader passes data read from one side of a tunnel to the context.
+type tunnelReader struct {
+	r          io.Reader
+	ctx        *Context
+	fromClient bool
+}
+
+func (tr *tunnelReader) Read(b []byte) (int, error) {
+	n, err := tr.r.Read(b)
+	if n > 0 {
+		tr.ctx.tunnelData(tr.fromClient, b[:n])
+	}
+	return n, err
+}
+
+// clientTrace returns an httptrace.ClientTrace that records the round trip
+// of the current request.
+func (ctx *Context) clientTrace() *httptrace.ClientTrace {
+	record := func(f func(rtt *RoundTripTrace, t time.Time)) {
+		t := time.Now()
+		ctx.mu.Lock()
+		defer ctx.mu.Unlock()
+		f(&ctx.trace, t)
+	}
+
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			record(func(rtt *RoundTripTrace, t time.Time) { rtt.GetConn = t })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			record(func(rtt *RoundTripTrace, t time.Time) { rtt.DNSStart = t })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			record(func(rtt *RoundTripTrace, t time.Time) { rtt.DNSDone = t })
+		},
+		ConnectStart: func(string, string) {
+			record(func(rtt *RoundTripTrace, t time.Time) {
+				if rtt.ConnectStart.IsZero() {
+					rtt.ConnectStart = t
+				}
+			})
+		},
+		ConnectDone: func(string, string, error) {
+			record(func(rtt *RoundTripTrace, t time.Time) { rtt.ConnectDone = t })
+		},
+		TLSHandshakeStart: func() {
+			record(func(rtt *RoundTripTrace, t time.Time) { rtt.TLSHandshakeStart = t })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			record(func(rtt *RoundTripTrace, t time.Time) { rtt.TLSHandshakeDone = t })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			record(func(rtt *RoundTripTrace, t time.Time) {
+				rtt.GotConn = t
+				rtt.Reused = info.Reused
+				rtt.LocalAddr = info.Conn.LocalAddr()
+				rtt.RemoteAddr = info.Conn.RemoteAddr()
+			})
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			record(func(rtt *RoundTripTrace, t time.Time) { rtt.WroteRequest = t })
+		},
+		GotFirstResponseByte: func() {
+			record(func(rtt *RoundTripTrace, t time.Time) { rtt.GotFirstResponseByte = t })
+		},
+	}
+}
+
 // newID creates a new 16 character random hex ID; note these are not UUIDs.
 func newID() (string, error) {
 	src := make([]byte, 8)
@@ -72,13 +72,15 @@ func filterFromJSON(b []byte) (*parse.Result, error) {
 	}
 	filter := NewFilter(cookie)
 
-	m, err := parse.FromJSON(msg.Modifier)
-	if err != nil {
-		return nil, err
-	}
+	if len(msg.Modifier) > 0 {
+		m, err := parse.FromJSON(msg.Modifier)
+		if err != nil {
+			return nil, err
+		}
 
-	filter.RequestWhenTrue(m.RequestModifier())
-	filter.ResponseWhenTrue(m.ResponseModifier())
+		filter.RequestWhenTrue(m.RequestModifier())
+		filter.ResponseWhenTrue(m.ResponseModifier())
+	}
 
 	if msg.ElseModifier != nil {
 		em, err := parse.FromJSON(msg.ElseModifier)
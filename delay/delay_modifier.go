@@ -0,0 +1,198 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package delay provides a modifier that adds latency to requests and
+// responses.
+package delay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/parse"
+)
+
+func init() {
+	parse.Register("delay.Modifier", modifierFromJSON)
+}
+
+// Distribution is the distribution of the delays of a Modifier.
+type Distribution int
+
+const (
+	// Fixed delays are always the duration of the modifier.
+	Fixed Distribution = iota
+	// Uniform delays are uniformly distributed within the jitter of the
+	// duration.
+	Uniform
+	// Normal delays are normally distributed with the duration as mean and
+	// the jitter as standard deviation.
+	Normal
+)
+
+var distributions = map[string]Distribution{
+	"":        Fixed,
+	"fixed":   Fixed,
+	"uniform": Uniform,
+	"normal":  Normal,
+}
+
+// Modifier delays requests before their round trip and responses before
+// they are written. A delay ends early with an error if the context of the
+// request is canceled before it elapses.
+type Modifier struct {
+	duration time.Duration
+	jitter   time.Duration
+	dist     Distribution
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+type modifierJSON struct {
+	Distribution string               `json:"distribution"`
+	Duration     string               `json:"duration"`
+	Jitter       string               `json:"jitter"`
+	Scope        []parse.ModifierType `json:"scope"`
+}
+
+// NewModifier returns a delay.Modifier with fixed delays of d.
+func NewModifier(d time.Duration) *Modifier {
+	return &Modifier{
+		duration: d,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetJitter sets the distribution of the delays around the duration of the
+// modifier: within jitter of it for Uniform, or with a standard deviation of
+// jitter for Normal. Delays are never negative.
+func (m *Modifier) SetJitter(dist Distribution, jitter time.Duration) {
+	m.dist = dist
+	m.jitter = jitter
+}
+
+// Delay returns a delay drawn from the distribution of the modifier.
+func (m *Modifier) Delay() time.Duration {
+	var d time.Duration
+
+	switch m.dist {
+	case Uniform:
+		m.mu.Lock()
+		f := m.rand.Float64()
+		m.mu.Unlock()
+
+		d = m.duration - m.jitter + time.Duration(f*float64(2*m.jitter))
+	case Normal:
+		m.mu.Lock()
+		f := m.rand.NormFloat64()
+		m.mu.Unlock()
+
+		d = m.duration + time.Duration(f*float64(m.jitter))
+	default:
+		d = m.duration
+	}
+
+	if d < 0 {
+		return 0
+	}
+
+	return d
+}
+
+// ModifyRequest delays the request before its round trip.
+func (m *Modifier) ModifyRequest(req *http.Request) error {
+	return m.wait(req.Context(), req)
+}
+
+// ModifyResponse delays the response before it is written. A response without
+// a request is delayed for the full duration.
+func (m *Modifier) ModifyResponse(res *http.Response) error {
+	if res.Request == nil {
+		return m.wait(context.Background(), nil)
+	}
+	return m.wait(res.Request.Context(), res.Request)
+}
+
+// wait waits for a delay, returning the error of ctx if it is done first. req
+// may be nil.
+func (m *Modifier) wait(ctx context.Context, req *http.Request) error {
+	d := m.Delay()
+	if req != nil {
+		log.Debugf("delay.Modifier: delaying %s by %v", req.URL, d)
+	} else {
+		log.Debugf("delay.Modifier: delaying response by %v", d)
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("delay.Modifier: %v", ctx.Err())
+	}
+}
+
+// modifierFromJSON takes a JSON message as a byte slice and returns a
+// delay.Modifier and an error. Durations are parsed with time.ParseDuration.
+// The distribution is one of "fixed" (the default), "uniform" or "normal".
+// Request scope delays requests before their round trip, and response scope
+// delays responses before they are written.
+//
+// Example JSON configuration message:
+// {
+//   "scope": ["response"],
+//   "distribution": "uniform",
+//   "duration": "300ms",
+//   "jitter": "100ms"
+// }
+func modifierFromJSON(b []byte) (*parse.Result, error) {
+	msg := &modifierJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	d, err := time.ParseDuration(msg.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("delay.Modifier: invalid duration: %v", err)
+	}
+
+	dist, ok := distributions[msg.Distribution]
+	if !ok {
+		return nil, fmt.Errorf("delay.Modifier: unknown distribution %q", msg.Distribution)
+	}
+
+	var jitter time.Duration
+	if msg.Jitter != "" {
+		if jitter, err = time.ParseDuration(msg.Jitter); err != nil {
+			return nil, fmt.Errorf("delay.Modifier: invalid jitter: %v", err)
+		}
+	}
+	if d < 0 || jitter < 0 {
+		return nil, fmt.Errorf("delay.Modifier: negative duration or jitter")
+	}
+
+	mod := NewModifier(d)
+	mod.SetJitter(dist, jitter)
+
+	return parse.NewResult(mod, msg.Scope)
+}
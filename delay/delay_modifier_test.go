@@ -0,0 +1,200 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package delay
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+
+	// Import to register method.Filter with JSON parser.
+	_ "github.com/google/martian/v3/method"
+)
+
+func TestDelayDistributions(t *testing.T) {
+	fixed := NewModifier(300 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if got, want := fixed.Delay(), 300*time.Millisecond; got != want {
+			t.Fatalf("fixed.Delay(): got %v, want %v", got, want)
+		}
+	}
+
+	uniform := NewModifier(300 * time.Millisecond)
+	uniform.SetJitter(Uniform, 100*time.Millisecond)
+	var min, max time.Duration = time.Hour, 0
+	for i := 0; i < 1000; i++ {
+		d := uniform.Delay()
+		if d < 200*time.Millisecond || d > 400*time.Millisecond {
+			t.Fatalf("uniform.Delay(): got %v, want within 300ms±100ms", d)
+		}
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	if min > 250*time.Millisecond || max < 350*time.Millisecond {
+		t.Errorf("uniform.Delay(): got range [%v, %v], want spread over 300ms±100ms", min, max)
+	}
+
+	normal := NewModifier(time.Second)
+	normal.SetJitter(Normal, 100*time.Millisecond)
+	var sum time.Duration
+	for i := 0; i < 1000; i++ {
+		sum += normal.Delay()
+	}
+	if mean := sum / 1000; mean < 950*time.Millisecond || mean > 1050*time.Millisecond {
+		t.Errorf("normal.Delay(): got mean %v, want about 1s", mean)
+	}
+
+	clamped := NewModifier(0)
+	clamped.SetJitter(Normal, time.Second)
+	for i := 0; i < 100; i++ {
+		if d := clamped.Delay(); d < 0 {
+			t.Fatalf("clamped.Delay(): got %v, want no negative delay", d)
+		}
+	}
+}
+
+func TestModifyRequestAndResponse(t *testing.T) {
+	m := NewModifier(50 * time.Millisecond)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	start := time.Now()
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("ModifyRequest(): took %v, want at least 50ms", d)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	start = time.Now()
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("ModifyResponse(): took %v, want at least 50ms", d)
+	}
+}
+
+func TestModifyResponseWithoutRequest(t *testing.T) {
+	m := NewModifier(50 * time.Millisecond)
+
+	res := proxyutil.NewResponse(200, nil, nil)
+	start := time.Now()
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("ModifyResponse(): took %v, want at least 50ms", d)
+	}
+}
+
+func TestModifyRequestCanceled(t *testing.T) {
+	m := NewModifier(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req = req.WithContext(ctx)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.ModifyRequest(req)
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("ModifyRequest(): got no error, want error for canceled request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ModifyRequest(): still waiting after the request was canceled")
+	}
+}
+
+func TestModifierFromJSON(t *testing.T) {
+	msg := []byte(`{
+	  "method.Filter": {
+	    "scope": ["request"],
+	    "method": "POST",
+	    "modifier": {
+	      "delay.Modifier": {
+	        "scope": ["request"],
+	        "distribution": "uniform",
+	        "duration": "40ms",
+	        "jitter": "10ms"
+	      }
+	    }
+	  }
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	reqmod := r.RequestModifier()
+	if reqmod == nil {
+		t.Fatal("reqmod: got nil, want not nil")
+	}
+
+	for _, tc := range []struct {
+		method string
+		min    time.Duration
+	}{
+		{"POST", 30 * time.Millisecond},
+		{"GET", 0},
+	} {
+		req, err := http.NewRequest(tc.method, "http://example.com/checkout", nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+
+		start := time.Now()
+		if err := reqmod.ModifyRequest(req); err != nil {
+			t.Fatalf("ModifyRequest(): got %v, want no error", err)
+		}
+		d := time.Since(start)
+		if d < tc.min || (tc.min == 0 && d > 20*time.Millisecond) {
+			t.Errorf("%s: ModifyRequest(): took %v, want at least %v", tc.method, d, tc.min)
+		}
+	}
+
+	for _, msg := range []string{
+		`{"delay.Modifier": {"duration": "soon"}}`,
+		`{"delay.Modifier": {"duration": "1s", "distribution": "poisson"}}`,
+		`{"delay.Modifier": {"duration": "1s", "jitter": "x"}}`,
+		`{"delay.Modifier": {"duration": "-1s"}}`,
+	} {
+		if _, err := parse.FromJSON([]byte(msg)); err == nil {
+			t.Errorf("parse.FromJSON(%s): got no error, want error", msg)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fault provides a modifier that injects faults into a fraction of
+// requests, such as error responses, connection resets and broken bodies.
+package fault
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/parse"
+)
+
+func init() {
+	parse.Register("fault.Modifier", modifierFromJSON)
+}
+
+// DefaultTimeout is how long a Hang fault holds the connection by default.
+const DefaultTimeout = time.Minute
+
+// Fault is a kind of fault injected by a Modifier.
+type Fault int
+
+const (
+	// Status replaces the response with an empty response of the status code
+	// of the modifier, which requires response scope. In request scope the
+	// round trip is skipped.
+	Status Fault = iota
+	// Reset drops the connection to the client without a response.
+	Reset
+	// Truncate sends the Content-Length of the whole response body but only
+	// half of the body, then drops the connection.
+	Truncate
+	// Corrupt replaces random bytes of the response body.
+	Corrupt
+	// ContentLength sends the whole response body with a Content-Length of half
+	// of it, then drops the connection.
+	ContentLength
+	// Hang holds the connection without a response until the timeout of the
+	// modifier elapses or the request is canceled, which the proxy does when
+	// the client disconnects, then drops the connection.
+	Hang
+)
+
+var faults = map[string]Fault{
+	"status":        Status,
+	"reset":         Reset,
+	"truncate":      Truncate,
+	"corrupt":       Corrupt,
+	"contentLength": ContentLength,
+	"hang":          Hang,
+}
+
+// Modifier injects a fault into requests, either with a probability or into
+// every Nth request. When the modifier runs in both scopes, whether a request
+// is faulted is decided once, when the request is modified.
+type Modifier struct {
+	fault       Fault
+	statusCode  int
+	probability float64
+	every       int
+	timeout     time.Duration
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	count int
+}
+
+type modifierJSON struct {
+	Fault       string               `json:"fault"`
+	Status      int                  `json:"status"`
+	Probability *float64             `json:"probability"`
+	Every       int                  `json:"every"`
+	Seed        *int64               `json:"seed"`
+	Timeout     string               `json:"timeout"`
+	Scope       []parse.ModifierType `json:"scope"`
+}
+
+// NewModifier returns a fault.Modifier that injects f into every request. For
+// Status faults, the status code is 503 Service Unavailable.
+func NewModifier(f Fault) *Modifier {
+	return &Modifier{
+		fault:       f,
+		statusCode:  http.StatusServiceUnavailable,
+		probability: 1,
+		timeout:     DefaultTimeout,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetStatusCode sets the status code of the responses of Status faults.
+func (m *Modifier) SetStatusCode(code int) {
+	m.statusCode = code
+}
+
+// SetProbability sets the probability with which a request is faulted.
+func (m *Modifier) SetProbability(p float64) {
+	m.probability = p
+	m.every = 0
+}
+
+// SetEvery sets the modifier to fault every nth request, starting with the
+// nth, instead of faulting with a probability.
+func (m *Modifier) SetEvery(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.every = n
+	m.count = 0
+}
+
+// SetSeed seeds the source of randomness of the modifier, so that the same
+// sequence of requests is faulted, and corrupted the same way, on every run.
+func (m *Modifier) SetSeed(seed int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rand = rand.New(rand.NewSource(seed))
+}
+
+// SetTimeout sets how long Hang faults hold the connection.
+func (m *Modifier) SetTimeout(d time.Duration) {
+	m.timeout = d
+}
+
+// next returns whether the next request is faulted.
+func (m *Modifier) next() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.every > 0 {
+		m.count++
+		return m.count%m.every == 0
+	}
+
+	return m.rand.Float64() < m.probability
+}
+
+// contextKey returns the key under which the decision of m is recorded in the
+// context of a request.
+func (m *Modifier) contextKey() string {
+	return fmt.Sprintf("fault.Modifier.%p", m)
+}
+
+// faulted returns whether req is faulted, deciding and recording it in ctx if
+// it has not been decided yet.
+func (m *Modifier) faulted(ctx *martian.Context) bool {
+	if ctx == nil {
+		return m.next()
+	}
+
+	if v, ok := ctx.Get(m.contextKey()); ok {
+		return v.(bool)
+	}
+
+	f := m.next()
+	ctx.Set(m.contextKey(), f)
+
+	return f
+}
+
+// ModifyRequest decides whether the request is faulted. Status faults skip the
+// round trip, and Reset and Hang faults drop the connection before it.
+func (m *Modifier) ModifyRequest(req *http.Request) error {
+	ctx := martian.NewContext(req)
+	if !m.faulted(ctx) {
+		return nil
+	}
+
+	log.Debugf("fault.Modifier.ModifyRequest: injecting fault %d into %s", m.fault, req.URL)
+
+	switch m.fault {
+	case Status:
+		if ctx != nil {
+			ctx.SkipRoundTrip()
+		}
+	case Reset:
+		return reset(ctx)
+	case Hang:
+		return m.hang(ctx, req)
+	}
+
+	return nil
+}
+
+// ModifyResponse injects the fault into the response if its request is
+// faulted.
+func (m *Modifier) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+	if !m.faulted(ctx) {
+		return nil
+	}
+
+	log.Debugf("fault.Modifier.ModifyResponse: injecting fault %d into %s", m.fault, res.Request.URL)
+
+	switch m.fault {
+	case Status:
+		if res.Body != nil {
+			res.Body.Close()
+		}
+
+		res.StatusCode = m.statusCode
+		res.Status = fmt.Sprintf("%d %s", m.statusCode, http.StatusText(m.statusCode))
+		res.Header = http.Header{}
+		res.ContentLength = 0
+		res.TransferEncoding = nil
+		res.Body = ioutil.NopCloser(new(bytes.Buffer))
+	case Reset:
+		return reset(ctx)
+	case Hang:
+		return m.hang(ctx, res.Request)
+	case Corrupt:
+		body, err := readBody(res)
+		if err != nil {
+			return err
+		}
+
+		m.corrupt(body)
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	case Truncate:
+		body, err := readBody(res)
+		if err != nil {
+			return err
+		}
+
+		return writeAndClose(ctx, res, len(body), body[:len(body)/2])
+	case ContentLength:
+		body, err := readBody(res)
+		if err != nil {
+			return err
+		}
+
+		return writeAndClose(ctx, res, len(body)/2, body)
+	}
+
+	return nil
+}
+
+// corrupt replaces about one in a hundred of the bytes of body, and at least
+// one, with different ones.
+func (m *Modifier) corrupt(body []byte) {
+	if len(body) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := len(body)/100 + 1
+	for i := 0; i < n; i++ {
+		body[m.rand.Intn(len(body))] ^= byte(m.rand.Intn(255) + 1)
+	}
+}
+
+// hang waits for the timeout of m or for req to be canceled, and then drops
+// the connection.
+func (m *Modifier) hang(ctx *martian.Context, req *http.Request) error {
+	t := time.NewTimer(m.timeout)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-req.Context().Done():
+	}
+
+	return reset(ctx)
+}
+
+// reset hijacks the connection of ctx and closes it, discarding unsent data
+// when the connection is TCP.
+func reset(ctx *martian.Context) error {
+	conn, _, err := hijack(ctx)
+	if err != nil {
+		return err
+	}
+	if conn == nil {
+		return nil
+	}
+
+	if tconn, ok := conn.(*net.TCPConn); ok {
+		tconn.SetLinger(0)
+	}
+
+	return conn.Close()
+}
+
+// writeAndClose hijacks the connection of ctx, writes the status line and
+// headers of res with a Content-Length of contentLength followed by body, and
+// closes the connection.
+func writeAndClose(ctx *martian.Context, res *http.Response, contentLength int, body []byte) error {
+	conn, brw, err := hijack(ctx)
+	if err != nil {
+		return err
+	}
+	if conn == nil {
+		return nil
+	}
+	defer conn.Close()
+
+	header := res.Header.Clone()
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(contentLength))
+	header.Set("Connection", "close")
+
+	fmt.Fprintf(brw, "HTTP/1.1 %03d %s\r\n", res.StatusCode, http.StatusText(res.StatusCode))
+	header.Write(brw)
+	brw.WriteString("\r\n")
+	brw.Write(body)
+
+	return brw.Flush()
+}
+
+// hijack takes over the connection of the session of ctx.
+func hijack(ctx *martian.Context) (net.Conn, *bufio.ReadWriter, error) {
+	if ctx == nil {
+		return nil, nil, fmt.Errorf("fault.Modifier: no session to hijack")
+	}
+
+	conn, brw, err := ctx.Session().Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("fault.Modifier: %v", err)
+	}
+
+	return conn, brw, nil
+}
+
+// readBody reads and closes the body of res.
+func readBody(res *http.Response) ([]byte, error) {
+	if res.Body == nil {
+		return nil, nil
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fault.Modifier: failed to read body: %v", err)
+	}
+
+	return body, nil
+}
+
+// modifierFromJSON takes a JSON message as a byte slice and returns a
+// fault.Modifier and an error.
+//
+// The fault is one of "status", "reset", "truncate", "corrupt",
+// "contentLength" or "hang". Requests are faulted with the probability
+// between 0 and 1, or every Nth request when every is set, or always when
+// neither is set. The seed makes the faulted requests deterministic, status
+// defaults to 503 and timeout, the duration of hang faults, to one minute.
+// Only reset and hang faults can be injected without response scope.
+//
+// Example JSON configuration message:
+// {
+//   "scope": ["request", "response"],
+//   "fault": "status",
+//   "status": 503,
+//   "probability": 0.1,
+//   "seed": 42
+// }
+func modifierFromJSON(b []byte) (*parse.Result, error) {
+	msg := &modifierJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	f, ok := faults[msg.Fault]
+	if !ok {
+		return nil, fmt.Errorf("fault.Modifier: unknown fault %q", msg.Fault)
+	}
+
+	// The other faults are injected into responses; in request scope alone, a
+	// status fault would skip the round trip and send an empty 200 response.
+	if msg.Scope != nil && f != Reset && f != Hang && !hasScope(msg.Scope, parse.Response) {
+		return nil, fmt.Errorf("fault.Modifier: %s fault requires response scope", msg.Fault)
+	}
+
+	mod := NewModifier(f)
+
+	if msg.Status != 0 {
+		if msg.Status < 100 || msg.Status > 999 {
+			return nil, fmt.Errorf("fault.Modifier: invalid status %d", msg.Status)
+		}
+		mod.SetStatusCode(msg.Status)
+	}
+
+	if msg.Probability != nil && msg.Every != 0 {
+		return nil, fmt.Errorf("fault.Modifier: want one of probability or every, got both")
+	}
+	if p := msg.Probability; p != nil {
+		if *p < 0 || *p > 1 {
+			return nil, fmt.Errorf("fault.Modifier: probability %v not between 0 and 1", *p)
+		}
+		mod.SetProbability(*p)
+	}
+	if msg.Every < 0 {
+		return nil, fmt.Errorf("fault.Modifier: negative every %d", msg.Every)
+	}
+	if msg.Every > 0 {
+		mod.SetEvery(msg.Every)
+	}
+
+	if msg.Seed != nil {
+		mod.SetSeed(*msg.Seed)
+	}
+
+	if msg.Timeout != "" {
+		d, err := time.ParseDuration(msg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("fault.Modifier: invalid timeout: %v", err)
+		}
+		mod.SetTimeout(d)
+	}
+
+	return parse.NewResult(mod, msg.Scope)
+}
+
+// hasScope returns whether scope includes t.
+func hasScope(scope []parse.ModifierType, t parse.ModifierType) bool {
+	for _, s := range scope {
+		if s == t {
+			return true
+		}
+	}
+
+	return false
+}
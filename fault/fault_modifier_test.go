@@ -0,0 +1,383 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fault
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+const body = "the quick brown fox jumps over the lazy dog"
+
+// newResponse returns a response to a GET request for http://example.com
+// with body, linked to a context whose connection is server. The returned
+// function must be called to unlink the context.
+func newResponse(t *testing.T, server net.Conn) (*http.Response, *martian.Context, func()) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	var brw *bufio.ReadWriter
+	if server != nil {
+		brw = bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))
+	}
+
+	ctx, remove, err := martian.TestContext(req, server, brw)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader(body), req)
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Type", "text/plain")
+
+	return res, ctx, remove
+}
+
+func TestEvery(t *testing.T) {
+	m := NewModifier(Status)
+	m.SetEvery(3)
+
+	var got []int
+	for i := 1; i <= 9; i++ {
+		res, _, remove := newResponse(t, nil)
+		if err := m.ModifyResponse(res); err != nil {
+			t.Fatalf("ModifyResponse(): got %v, want no error", err)
+		}
+		remove()
+
+		if res.StatusCode == 503 {
+			got = append(got, i)
+		}
+	}
+
+	if want := []int{3, 6, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("faulted requests: got %v, want %v", got, want)
+	}
+}
+
+func TestSeedIsDeterministic(t *testing.T) {
+	sequence := func() []bool {
+		m := NewModifier(Status)
+		m.SetProbability(0.3)
+		m.SetSeed(42)
+
+		var faulted []bool
+		for i := 0; i < 1000; i++ {
+			faulted = append(faulted, m.next())
+		}
+		return faulted
+	}
+
+	a, b := sequence(), sequence()
+
+	n := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("faulted[%d]: got %t and %t, want same sequence for the same seed", i, a[i], b[i])
+		}
+		if a[i] {
+			n++
+		}
+	}
+
+	if n < 250 || n > 350 {
+		t.Errorf("faulted: got %d of 1000, want about 300", n)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m := NewModifier(Status)
+	m.SetStatusCode(500)
+
+	res, ctx, remove := newResponse(t, nil)
+	defer remove()
+
+	if err := m.ModifyRequest(res.Request); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if !ctx.SkippingRoundTrip() {
+		t.Error("ctx.SkippingRoundTrip(): got false, want true")
+	}
+
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 500; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.ContentLength, int64(0); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+	if got := res.Header.Get("Content-Type"); got != "" {
+		t.Errorf("res.Header.Get(%q): got %q, want no header", "Content-Type", got)
+	}
+}
+
+func TestDecisionIsSharedAcrossScopes(t *testing.T) {
+	m := NewModifier(Status)
+	m.SetEvery(2)
+
+	// The first request is not faulted when modified, so its response must not
+	// be faulted either even though it is the second decision.
+	res, _, remove := newResponse(t, nil)
+	defer remove()
+
+	if err := m.ModifyRequest(res.Request); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	m := NewModifier(Reset)
+
+	res, ctx, remove := newResponse(t, server)
+	defer remove()
+
+	if err := m.ModifyRequest(res.Request); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if !ctx.Session().Hijacked() {
+		t.Error("ctx.Session().Hijacked(): got false, want true")
+	}
+
+	got, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("client read: got %q, want nothing", got)
+	}
+}
+
+func TestHang(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	m := NewModifier(Hang)
+	m.SetTimeout(20 * time.Millisecond)
+
+	res, ctx, remove := newResponse(t, server)
+	defer remove()
+
+	start := time.Now()
+	if err := m.ModifyRequest(res.Request); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("ModifyRequest(): took %v, want at least 20ms", d)
+	}
+	if !ctx.Session().Hijacked() {
+		t.Error("ctx.Session().Hijacked(): got false, want true")
+	}
+}
+
+func TestHangEndsWhenClientDisconnects(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := martian.NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(martiantest.NewTransport())
+
+	m := NewModifier(Hang)
+	m.SetTimeout(time.Minute)
+
+	done := make(chan time.Duration, 1)
+	p.SetRequestModifier(martian.RequestModifierFunc(func(req *http.Request) error {
+		start := time.Now()
+		err := m.ModifyRequest(req)
+		done <- time.Since(start)
+		return err
+	}))
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	conn.Close()
+
+	select {
+	case d := <-done:
+		if d >= time.Minute {
+			t.Errorf("ModifyRequest(): took %v, want to end when the client disconnects", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ModifyRequest(): still hanging after the client disconnected")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	m := NewModifier(Corrupt)
+	m.SetSeed(1)
+
+	res, _, remove := newResponse(t, nil)
+	defer remove()
+
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if len(got) != len(body) {
+		t.Errorf("len(body): got %d, want %d", len(got), len(body))
+	}
+	if string(got) == body {
+		t.Errorf("body: got %q, want corrupted body", got)
+	}
+}
+
+func TestBrokenBodies(t *testing.T) {
+	tt := []struct {
+		fault         Fault
+		contentLength string
+		body          string
+	}{
+		{Truncate, "43", body[:21]},
+		{ContentLength, "21", body},
+	}
+
+	for i, tc := range tt {
+		client, server := net.Pipe()
+
+		m := NewModifier(tc.fault)
+		res, _, remove := newResponse(t, server)
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- m.ModifyResponse(res)
+		}()
+
+		got, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatalf("%d. ioutil.ReadAll(): got %v, want no error", i, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("%d. ModifyResponse(): got %v, want no error", i, err)
+		}
+		remove()
+		client.Close()
+
+		parts := bytes.SplitN(got, []byte("\r\n\r\n"), 2)
+		if len(parts) != 2 {
+			t.Fatalf("%d. response: got %q, want headers and body", i, got)
+		}
+		if !bytes.HasPrefix(parts[0], []byte("HTTP/1.1 200 OK\r\n")) {
+			t.Errorf("%d. status line: got %q, want HTTP/1.1 200 OK", i, parts[0])
+		}
+		if want := "Content-Length: " + tc.contentLength + "\r\n"; !bytes.Contains(parts[0], []byte(want)) {
+			t.Errorf("%d. headers: got %q, want %q", i, parts[0], want)
+		}
+		if got, want := string(parts[1]), tc.body; got != want {
+			t.Errorf("%d. body: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestModifierFromJSON(t *testing.T) {
+	msg := []byte(`{
+	  "fault.Modifier": {
+	    "scope": ["request", "response"],
+	    "fault": "status",
+	    "status": 429,
+	    "every": 2
+	  }
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	reqmod := r.RequestModifier()
+	if reqmod == nil {
+		t.Fatal("reqmod: got nil, want not nil")
+	}
+	resmod := r.ResponseModifier()
+	if resmod == nil {
+		t.Fatal("resmod: got nil, want not nil")
+	}
+
+	for i, want := range []int{200, 429, 200, 429} {
+		res, _, remove := newResponse(t, nil)
+
+		if err := reqmod.ModifyRequest(res.Request); err != nil {
+			t.Fatalf("%d. ModifyRequest(): got %v, want no error", i, err)
+		}
+		if err := resmod.ModifyResponse(res); err != nil {
+			t.Fatalf("%d. ModifyResponse(): got %v, want no error", i, err)
+		}
+		remove()
+
+		if got := res.StatusCode; got != want {
+			t.Errorf("%d. res.StatusCode: got %d, want %d", i, got, want)
+		}
+	}
+
+	for _, msg := range []string{
+		`{"fault.Modifier": {"fault": "explode"}}`,
+		`{"fault.Modifier": {"fault": "status", "status": 42}}`,
+		`{"fault.Modifier": {"fault": "status", "probability": 1.5}}`,
+		`{"fault.Modifier": {"fault": "status", "probability": 0.5, "every": 2}}`,
+		`{"fault.Modifier": {"fault": "status", "every": -1}}`,
+		`{"fault.Modifier": {"fault": "hang", "timeout": "later"}}`,
+		`{"fault.Modifier": {"fault": "status", "scope": ["request"]}}`,
+		`{"fault.Modifier": {"fault": "corrupt", "scope": ["request"]}}`,
+	} {
+		if _, err := parse.FromJSON([]byte(msg)); err == nil {
+			t.Errorf("parse.FromJSON(%s): got no error, want error", msg)
+		}
+	}
+}
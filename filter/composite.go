@@ -0,0 +1,331 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/martian/v3/parse"
+)
+
+func init() {
+	parse.Register("filter.All", allFromJSON)
+	parse.Register("filter.Any", anyFromJSON)
+	parse.Register("filter.Not", notFromJSON)
+}
+
+// All is a condition that matches when all of its conditions match. An All
+// without request or response conditions matches all requests or responses,
+// so an All with request conditions only matches every response. Conditions
+// parsed from JSON that are scoped to requests only are also evaluated on
+// responses, against their request.
+type All struct {
+	reqconds []RequestCondition
+	resconds []ResponseCondition
+}
+
+// NewAll returns an All without conditions.
+func NewAll() *All {
+	return &All{}
+}
+
+// AddRequestCondition adds a condition evaluated on requests.
+func (a *All) AddRequestCondition(cond RequestCondition) {
+	a.reqconds = append(a.reqconds, cond)
+}
+
+// AddResponseCondition adds a condition evaluated on responses.
+func (a *All) AddResponseCondition(cond ResponseCondition) {
+	a.resconds = append(a.resconds, cond)
+}
+
+// MatchRequest returns true if all request conditions match req.
+func (a *All) MatchRequest(req *http.Request) bool {
+	for _, cond := range a.reqconds {
+		if !cond.MatchRequest(req) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchResponse returns true if all response conditions match res.
+func (a *All) MatchResponse(res *http.Response) bool {
+	for _, cond := range a.resconds {
+		if !cond.MatchResponse(res) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Any is a condition that matches when any of its conditions matches. An Any
+// without request or response conditions matches no requests or responses.
+type Any struct {
+	reqconds []RequestCondition
+	resconds []ResponseCondition
+}
+
+// NewAny returns an Any without conditions.
+func NewAny() *Any {
+	return &Any{}
+}
+
+// AddRequestCondition adds a condition evaluated on requests.
+func (a *Any) AddRequestCondition(cond RequestCondition) {
+	a.reqconds = append(a.reqconds, cond)
+}
+
+// AddResponseCondition adds a condition evaluated on responses.
+func (a *Any) AddResponseCondition(cond ResponseCondition) {
+	a.resconds = append(a.resconds, cond)
+}
+
+// MatchRequest returns true if any request condition matches req.
+func (a *Any) MatchRequest(req *http.Request) bool {
+	for _, cond := range a.reqconds {
+		if cond.MatchRequest(req) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchResponse returns true if any response condition matches res.
+func (a *Any) MatchResponse(res *http.Response) bool {
+	for _, cond := range a.resconds {
+		if cond.MatchResponse(res) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Not is a condition that matches when its condition does not. A Not without
+// a request or response condition matches no requests or responses.
+type Not struct {
+	reqcond RequestCondition
+	rescond ResponseCondition
+}
+
+// NewNot returns a Not without conditions.
+func NewNot() *Not {
+	return &Not{}
+}
+
+// SetRequestCondition sets the condition negated on requests.
+func (n *Not) SetRequestCondition(cond RequestCondition) {
+	n.reqcond = cond
+}
+
+// SetResponseCondition sets the condition negated on responses.
+func (n *Not) SetResponseCondition(cond ResponseCondition) {
+	n.rescond = cond
+}
+
+// MatchRequest returns true if the request condition does not match req.
+func (n *Not) MatchRequest(req *http.Request) bool {
+	return n.reqcond != nil && !n.reqcond.MatchRequest(req)
+}
+
+// MatchResponse returns true if the response condition does not match res.
+func (n *Not) MatchResponse(res *http.Response) bool {
+	return n.rescond != nil && !n.rescond.MatchResponse(res)
+}
+
+type compositeJSON struct {
+	Conditions   []json.RawMessage    `json:"conditions"`
+	Condition    json.RawMessage      `json:"condition"`
+	Modifier     json.RawMessage      `json:"modifier"`
+	ElseModifier json.RawMessage      `json:"else"`
+	Scope        []parse.ModifierType `json:"scope"`
+}
+
+// allFromJSON builds a filter with an All condition from JSON. Conditions are
+// filter messages, whose modifiers may be omitted.
+//
+// Example JSON:
+// {
+//   "filter.All": {
+//     "scope": ["request", "response"],
+//     "conditions": [
+//       { "url.Filter": { "host": "example.com" } },
+//       { "header.Filter": { "name": "Martian-Testing" } },
+//       { "filter.Not": { "condition": { "method.Filter": { "method": "GET" } } } }
+//     ],
+//     "modifier": { ... },
+//     "else": { ... }
+//   }
+// }
+func allFromJSON(b []byte) (*parse.Result, error) {
+	msg := &compositeJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	all := NewAll()
+	for _, c := range msg.Conditions {
+		reqcond, rescond, err := conditionFromJSON(c)
+		if err != nil {
+			return nil, err
+		}
+		if reqcond != nil {
+			all.AddRequestCondition(reqcond)
+		}
+		if rescond != nil {
+			all.AddResponseCondition(rescond)
+		}
+	}
+
+	return compositeFromJSON(all, all, msg)
+}
+
+// anyFromJSON builds a filter with an Any condition from JSON, like
+// allFromJSON.
+//
+// Example JSON:
+// {
+//   "filter.Any": {
+//     "conditions": [
+//       { "port.Filter": { "port": 8080 } },
+//       { "querystring.Filter": { "name": "debug" } }
+//     ],
+//     "modifier": { ... }
+//   }
+// }
+func anyFromJSON(b []byte) (*parse.Result, error) {
+	msg := &compositeJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	anyc := NewAny()
+	for _, c := range msg.Conditions {
+		reqcond, rescond, err := conditionFromJSON(c)
+		if err != nil {
+			return nil, err
+		}
+		if reqcond != nil {
+			anyc.AddRequestCondition(reqcond)
+		}
+		if rescond != nil {
+			anyc.AddResponseCondition(rescond)
+		}
+	}
+
+	return compositeFromJSON(anyc, anyc, msg)
+}
+
+// notFromJSON builds a filter with a Not condition from JSON.
+//
+// Example JSON:
+// {
+//   "filter.Not": {
+//     "condition": { "cookie.Filter": { "name": "session" } },
+//     "modifier": { ... }
+//   }
+// }
+func notFromJSON(b []byte) (*parse.Result, error) {
+	msg := &compositeJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	if len(msg.Condition) == 0 {
+		return nil, fmt.Errorf("filter.Not: no condition")
+	}
+
+	reqcond, rescond, err := conditionFromJSON(msg.Condition)
+	if err != nil {
+		return nil, err
+	}
+
+	not := NewNot()
+	not.SetRequestCondition(reqcond)
+	not.SetResponseCondition(rescond)
+
+	return compositeFromJSON(not, not, msg)
+}
+
+// conditionFromJSON parses a filter message and returns its request and
+// response conditions. The request condition is nil if the filter is not
+// scoped to requests. If the filter is scoped to requests only, the response
+// condition evaluates the request condition on the request of the response.
+func conditionFromJSON(b []byte) (RequestCondition, ResponseCondition, error) {
+	r, err := parse.FromJSON(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reqcond, _ := r.RequestModifier().(RequestCondition)
+	rescond, _ := r.ResponseModifier().(ResponseCondition)
+	if reqcond == nil && rescond == nil {
+		return nil, nil, fmt.Errorf("filter: not a condition: %s", b)
+	}
+	if rescond == nil {
+		rescond = &requestOfResponse{reqcond}
+	}
+
+	return reqcond, rescond, nil
+}
+
+// requestOfResponse is a response condition that matches when its request
+// condition matches the request of the response.
+type requestOfResponse struct {
+	cond RequestCondition
+}
+
+// MatchResponse returns true if the request condition matches the request of
+// res.
+func (c *requestOfResponse) MatchResponse(res *http.Response) bool {
+	return res.Request != nil && c.cond.MatchRequest(res.Request)
+}
+
+// compositeFromJSON returns a filter with the conditions and the modifiers
+// of msg.
+func compositeFromJSON(reqcond RequestCondition, rescond ResponseCondition, msg *compositeJSON) (*parse.Result, error) {
+	f := New()
+	f.SetRequestCondition(reqcond)
+	f.SetResponseCondition(rescond)
+
+	if len(msg.Modifier) > 0 {
+		m, err := parse.FromJSON(msg.Modifier)
+		if err != nil {
+			return nil, err
+		}
+
+		f.RequestWhenTrue(m.RequestModifier())
+		f.ResponseWhenTrue(m.ResponseModifier())
+	}
+
+	if len(msg.ElseModifier) > 0 {
+		em, err := parse.FromJSON(msg.ElseModifier)
+		if err != nil {
+			return nil, err
+		}
+
+		if em != nil {
+			f.RequestWhenFalse(em.RequestModifier())
+			f.ResponseWhenFalse(em.ResponseModifier())
+		}
+	}
+
+	return parse.NewResult(f, msg.Scope)
+}
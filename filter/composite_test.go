@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+var testModifier = martiantest.NewModifier()
+
+func init() {
+	// filter.testCondition is a filter whose condition is the value of
+	// "match", standing in for the filters of other packages.
+	parse.Register("filter.testCondition", func(b []byte) (*parse.Result, error) {
+		msg := &struct {
+			Match bool                 `json:"match"`
+			Scope []parse.ModifierType `json:"scope"`
+		}{}
+		if err := json.Unmarshal(b, msg); err != nil {
+			return nil, err
+		}
+
+		tm := martiantest.NewMatcher()
+		tm.RequestEvaluatesTo(msg.Match)
+		tm.ResponseEvaluatesTo(msg.Match)
+
+		f := New()
+		f.SetRequestCondition(tm)
+		f.SetResponseCondition(tm)
+
+		return parse.NewResult(f, msg.Scope)
+	})
+	parse.Register("filter.testModifier", func(b []byte) (*parse.Result, error) {
+		return parse.NewResult(testModifier, nil)
+	})
+}
+
+func matcher(match bool) *martiantest.Matcher {
+	tm := martiantest.NewMatcher()
+	tm.RequestEvaluatesTo(match)
+	tm.ResponseEvaluatesTo(match)
+	return tm
+}
+
+func TestCompositeConditions(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	res := proxyutil.NewResponse(200, nil, req)
+
+	tt := []struct {
+		name    string
+		matches []bool
+		all     bool
+		any     bool
+	}{
+		{name: "none", matches: nil, all: true, any: false},
+		{name: "true", matches: []bool{true}, all: true, any: true},
+		{name: "false", matches: []bool{false}, all: false, any: false},
+		{name: "mixed", matches: []bool{true, false, true}, all: false, any: true},
+		{name: "all true", matches: []bool{true, true}, all: true, any: true},
+	}
+
+	for _, tc := range tt {
+		all := NewAll()
+		anyc := NewAny()
+		for _, m := range tc.matches {
+			all.AddRequestCondition(matcher(m))
+			all.AddResponseCondition(matcher(m))
+			anyc.AddRequestCondition(matcher(m))
+			anyc.AddResponseCondition(matcher(m))
+		}
+
+		if got, want := all.MatchRequest(req), tc.all; got != want {
+			t.Errorf("%s: all.MatchRequest(): got %t, want %t", tc.name, got, want)
+		}
+		if got, want := all.MatchResponse(res), tc.all; got != want {
+			t.Errorf("%s: all.MatchResponse(): got %t, want %t", tc.name, got, want)
+		}
+		if got, want := anyc.MatchRequest(req), tc.any; got != want {
+			t.Errorf("%s: any.MatchRequest(): got %t, want %t", tc.name, got, want)
+		}
+		if got, want := anyc.MatchResponse(res), tc.any; got != want {
+			t.Errorf("%s: any.MatchResponse(): got %t, want %t", tc.name, got, want)
+		}
+	}
+
+	not := NewNot()
+	if not.MatchRequest(req) {
+		t.Error("not.MatchRequest(): got true, want false without condition")
+	}
+	not.SetRequestCondition(matcher(false))
+	not.SetResponseCondition(matcher(true))
+	if got, want := not.MatchRequest(req), true; got != want {
+		t.Errorf("not.MatchRequest(): got %t, want %t", got, want)
+	}
+	if got, want := not.MatchResponse(res), false; got != want {
+		t.Errorf("not.MatchResponse(): got %t, want %t", got, want)
+	}
+}
+
+func TestCompositeFromJSON(t *testing.T) {
+	tt := []struct {
+		msg  string
+		want bool
+	}{
+		{
+			msg: `{"filter.All": {"conditions": [
+				{"filter.testCondition": {"match": true}},
+				{"filter.Not": {"condition": {"filter.testCondition": {"match": false}}}}
+			], "modifier": {"filter.testModifier": {}}}}`,
+			want: true,
+		},
+		{
+			msg: `{"filter.All": {"conditions": [
+				{"filter.testCondition": {"match": true}},
+				{"filter.testCondition": {"match": false}}
+			], "modifier": {"filter.testModifier": {}}}}`,
+			want: false,
+		},
+		{
+			msg: `{"filter.Any": {"conditions": [
+				{"filter.testCondition": {"match": false}},
+				{"filter.All": {"conditions": [{"filter.testCondition": {"match": true}}]}}
+			], "modifier": {"filter.testModifier": {}}}}`,
+			want: true,
+		},
+		{
+			msg: `{"filter.Not": {"condition": {"filter.Any": {"conditions": [
+				{"filter.testCondition": {"match": true}}
+			]}}, "modifier": {"filter.testModifier": {}}}}`,
+			want: false,
+		},
+		{
+			// Conditions scoped to requests are evaluated on responses against
+			// their request.
+			msg: `{"filter.All": {"conditions": [
+				{"filter.testCondition": {"match": true}},
+				{"filter.testCondition": {"match": false, "scope": ["request"]}}
+			], "modifier": {"filter.testModifier": {}}}}`,
+			want: false,
+		},
+		{
+			msg: `{"filter.Not": {"condition":
+				{"filter.testCondition": {"match": false, "scope": ["request"]}}
+			, "modifier": {"filter.testModifier": {}}}}`,
+			want: true,
+		},
+	}
+
+	for i, tc := range tt {
+		r, err := parse.FromJSON([]byte(tc.msg))
+		if err != nil {
+			t.Fatalf("%d. parse.FromJSON(): got %v, want no error", i, err)
+		}
+
+		reqmod := r.RequestModifier()
+		if reqmod == nil {
+			t.Fatalf("%d. reqmod: got nil, want not nil", i)
+		}
+		resmod := r.ResponseModifier()
+		if resmod == nil {
+			t.Fatalf("%d. resmod: got nil, want not nil", i)
+		}
+
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		res := proxyutil.NewResponse(200, nil, req)
+
+		testModifier.Reset()
+		if err := reqmod.ModifyRequest(req); err != nil {
+			t.Fatalf("%d. ModifyRequest(): got %v, want no error", i, err)
+		}
+		if err := resmod.ModifyResponse(res); err != nil {
+			t.Fatalf("%d. ModifyResponse(): got %v, want no error", i, err)
+		}
+
+		if got, want := testModifier.RequestModified(), tc.want; got != want {
+			t.Errorf("%d. testModifier.RequestModified(): got %t, want %t", i, got, want)
+		}
+		if got, want := testModifier.ResponseModified(), tc.want; got != want {
+			t.Errorf("%d. testModifier.ResponseModified(): got %t, want %t", i, got, want)
+		}
+	}
+
+	for _, msg := range []string{
+		`{"filter.Not": {}}`,
+		`{"filter.All": {"conditions": [{"filter.testModifier": {}}]}}`,
+		`{"filter.Any": {"conditions": [{"unknown.Filter": {}}]}}`,
+	} {
+		if _, err := parse.FromJSON([]byte(msg)); err == nil {
+			t.Errorf("parse.FromJSON(%s): got no error, want error", msg)
+		}
+	}
+}
@@ -155,6 +155,20 @@ func (f *Filter) ModifyResponse(res *http.Response) error {
 	return f.fresmod.ModifyResponse(res)
 }
 
+// MatchRequest evaluates reqcond, so that a filter can be used as the
+// condition of another filter. It returns false if no request condition is
+// set.
+func (f *Filter) MatchRequest(req *http.Request) bool {
+	return f.reqcond != nil && f.reqcond.MatchRequest(req)
+}
+
+// MatchResponse evaluates rescond, so that a filter can be used as the
+// condition of another filter. It returns false if no response condition is
+// set.
+func (f *Filter) MatchResponse(res *http.Response) bool {
+	return f.rescond != nil && f.rescond.MatchResponse(res)
+}
+
 // VerifyRequests returns an error containing all the verification errors
 // returned by request verifiers.
 func (f *Filter) VerifyRequests() error {
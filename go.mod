@@ -3,8 +3,11 @@ module github.com/google/martian/v3
 go 1.18
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/golang/snappy v0.0.3
+	github.com/klauspost/compress v1.15.15
 	golang.org/x/net v0.0.0-20190628185345-da137c7871d7
+	golang.org/x/text v0.3.0
 	google.golang.org/grpc v1.37.0
 	google.golang.org/protobuf v1.26.0
 )
@@ -12,6 +15,5 @@ require (
 require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
-	golang.org/x/text v0.3.0 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
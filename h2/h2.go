@@ -17,11 +17,14 @@ package h2
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
+	"net/http/httptrace"
 	"net/url"
 	"sync"
 
@@ -41,6 +44,11 @@ type Config struct {
 	// permitted.
 	AllowedHostsFilter func(string) bool
 
+	// H2CHostsFilter is a function returning true if the argument is a host whose server speaks
+	// cleartext HTTP/2 (h2c). Upstream connections to such hosts are made with prior knowledge
+	// instead of TLS, even when the client connection to the proxy is TLS.
+	H2CHostsFilter func(string) bool
+
 	// RootCAs is the pool of CA certificates used by the MitM client to authenticate the server.
 	RootCAs *x509.CertPool
 
@@ -52,19 +60,57 @@ type Config struct {
 	EnableDebugLogs bool
 }
 
-// Proxy proxies HTTP/2 traffic between a client connection, `cc`, and the HTTP/2 `url` assuming
-// h2 is being used. Since no browsers use h2c, it's safe to assume all traffic uses TLS.
+// Proxy proxies HTTP/2 traffic between a client connection, `cc`, and the HTTP/2 `url`. The
+// upstream connection uses TLS unless the host is matched by `H2CHostsFilter`, in which case h2c
+// with prior knowledge is used.
 func (c *Config) Proxy(closing chan bool, cc io.ReadWriter, url *url.URL) error {
-	if c.EnableDebugLogs {
-		log.Infof("\u001b[1;35mProxying %v with HTTP/2\u001b[0m", url)
-	}
-	sc, err := tls.Dial("tcp", url.Host, &tls.Config{
-		RootCAs:    c.RootCAs,
-		NextProtos: []string{"h2"},
-	})
+	return c.ProxyDial(context.Background(), (&net.Dialer{}).DialContext, closing, cc, url)
+}
+
+// ProxyDial is like Proxy, but dials the upstream connection with `dial` and `ctx`, so that the
+// dialer and the httptrace.ClientTrace of the caller apply to it.
+func (c *Config) ProxyDial(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), closing chan bool, cc io.ReadWriter, url *url.URL) error {
+	sc, err := dial(ctx, "tcp", url.Host)
 	if err != nil {
 		return fmt.Errorf("connecting h2 to %v: %w", url, err)
 	}
+	defer sc.Close()
+
+	if !c.h2cHost(url.Host) {
+		tlsc := tls.Client(sc, &tls.Config{
+			ServerName: url.Hostname(),
+			RootCAs:    c.RootCAs,
+			NextProtos: []string{"h2"},
+		})
+
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		err := tlsc.HandshakeContext(ctx)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsc.ConnectionState(), err)
+		}
+		if err != nil {
+			return fmt.Errorf("connecting h2 to %v: %w", url, err)
+		}
+
+		sc = tlsc
+	}
+
+	return c.ProxyConn(closing, cc, sc, url)
+}
+
+// ProxyConn proxies HTTP/2 traffic between a client connection, `cc`, and an established server
+// connection, `sc`, for the HTTP/2 `url`. The client connection preface must not have been read
+// from `cc` yet. The caller remains responsible for closing both connections.
+//
+// This is used for cleartext HTTP/2 (h2c), where the server connection is either dialed directly
+// for clients with prior knowledge, or is the connection that was upgraded by `Upgrade: h2c`.
+func (c *Config) ProxyConn(closing chan bool, cc, sc io.ReadWriter, url *url.URL) error {
+	if c.EnableDebugLogs {
+		log.Infof("\u001b[1;35mProxying %v with HTTP/2\u001b[0m", url)
+	}
 	if err := forwardPreface(sc, cc); err != nil {
 		return fmt.Errorf("initializing h2 with %v: %w", url, err)
 	}
@@ -118,10 +164,14 @@ func (c *Config) Proxy(closing chan bool, cc io.ReadWriter, url *url.URL) error
 	return nil
 }
 
+func (c *Config) h2cHost(host string) bool {
+	return c.H2CHostsFilter != nil && c.H2CHostsFilter(host)
+}
+
 // forwardPreface forwards the connection preface from the client to the server.
 func forwardPreface(server io.Writer, client io.Reader) error {
 	preface := make([]byte, len(connectionPreface))
-	if _, err := client.Read(preface); err != nil {
+	if _, err := io.ReadFull(client, preface); err != nil {
 		return fmt.Errorf("reading preface: %w", err)
 	}
 	if !bytes.Equal(preface, connectionPreface) {
@@ -27,6 +27,7 @@ import (
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -38,6 +39,7 @@ import (
 	"github.com/google/martian/v3/log"
 	"github.com/google/martian/v3/messageview"
 	"github.com/google/martian/v3/proxyutil"
+	"github.com/google/martian/v3/redact"
 )
 
 // Logger maintains request and response log entries.
@@ -45,11 +47,27 @@ type Logger struct {
 	bodyLogging     func(*http.Response) bool
 	postDataLogging func(*http.Request) bool
 
-	creator *Creator
-
-	mu      sync.Mutex
-	entries map[string]*Entry
-	tail    *Entry
+	creator    *Creator
+	sink       Sink
+	maxEntries int
+	redact     *redact.Policy
+
+	pageHeader  string
+	pageReferer bool
+
+	mu        sync.Mutex
+	entries   map[string]*Entry
+	tail      *Entry
+	completed int
+
+	pages      []*Page
+	pageCount  int
+	page       *Page
+	pageIDs    map[string]*Page
+	pageRefs   map[string]int
+	pageURLs   map[string][]string
+	titlePages map[string]*Page
+	urlPages   map[string]*Page
 }
 
 // HAR is the top level object of a HAR log.
@@ -63,6 +81,8 @@ type Log struct {
 	Version string `json:"version"`
 	// Creator holds information about the log creator application.
 	Creator *Creator `json:"creator"`
+	// Pages is a list of the pages that entries belong to.
+	Pages []*Page `json:"pages,omitempty"`
 	// Entries is a list containing requests and responses.
 	Entries []*Entry `json:"entries"`
 }
@@ -79,6 +99,8 @@ type Creator struct {
 type Entry struct {
 	// ID is the unique ID for the entry.
 	ID string `json:"_id"`
+	// PageRef is the ID of the page the entry belongs to, if any.
+	PageRef string `json:"pageref,omitempty"`
 	// StartedDateTime is the date and time stamp of the request start (ISO 8601).
 	StartedDateTime time.Time `json:"startedDateTime"`
 	// Time is the total elapsed time of the request in milliseconds.
@@ -92,6 +114,20 @@ type Entry struct {
 	// Timings describes various phases within request-response round trip. All
 	// times are specified in milliseconds.
 	Timings *Timings `json:"timings"`
+	// ServerIPAddress is the IP address of the server that was connected to.
+	ServerIPAddress string `json:"serverIPAddress,omitempty"`
+	// Connection is a unique ID of the connection to the server, which is the
+	// local address of the proxy side of the connection.
+	Connection string `json:"connection,omitempty"`
+	// Tunnel describes the traffic relayed through the opaque CONNECT tunnel or
+	// upgraded connection established by the request, once it has closed.
+	Tunnel *Tunnel `json:"_tunnel,omitempty"`
+	// WebSocketMessages are the messages exchanged on a connection upgraded to
+	// WebSocket.
+	WebSocketMessages []WebSocketMessage `json:"_webSocketMessages,omitempty"`
+	// Shaping are the traffic shaping actions performed while the response was
+	// written to the client.
+	Shaping []ShapingEvent `json:"_shaping,omitempty"`
 	next    *Entry
 }
 
@@ -152,8 +188,18 @@ type Cache struct {
 }
 
 // Timings describes various phases within request-response round trip. All
-// times are specified in milliseconds
+// times are specified in milliseconds. Phases that do not apply to a request
+// are set to -1.
 type Timings struct {
+	// Blocked is the time spent waiting for a network connection.
+	Blocked int64 `json:"blocked"`
+	// DNS is the time required to resolve the host name.
+	DNS int64 `json:"dns"`
+	// Connect is the time required to create the TCP connection, including
+	// the SSL/TLS negotiation.
+	Connect int64 `json:"connect"`
+	// SSL is the time required for the SSL/TLS negotiation.
+	SSL int64 `json:"ssl"`
 	// Send is the time required to send HTTP request to the server.
 	Send int64 `json:"send"`
 	// Wait is the time spent waiting for a response from the server.
@@ -449,15 +495,54 @@ func SkipBodyLoggingForContentTypes(cts ...string) Option {
 	}
 }
 
+// StreamTo returns an option that writes every entry to s as soon as its
+// response has been recorded.
+func StreamTo(s Sink) Option {
+	return func(l *Logger) {
+		l.sink = s
+	}
+}
+
+// MaxEntries returns an option that bounds the number of completed entries
+// kept in memory, discarding the oldest completed entries first. Pending
+// entries are always kept. A value of zero or less keeps all entries, which is
+// the default.
+//
+// MaxEntries is intended to be used with StreamTo, so that long running
+// sessions are persisted while only a recent window is exported.
+func MaxEntries(n int) Option {
+	return func(l *Logger) {
+		l.maxEntries = n
+	}
+}
+
+// Redact returns an option that applies p to every entry before it is
+// stored. Without this option, the policy attached to the request context by
+// a redact.Policy modifier is applied, if any.
+func Redact(p *redact.Policy) Option {
+	return func(l *Logger) {
+		l.redact = p
+	}
+}
+
+func newCreator() *Creator {
+	return &Creator{
+		Name:    "martian proxy",
+		Version: "2.0.0",
+	}
+}
+
 // NewLogger returns a HAR logger. The returned
 // logger logs all request post data and response bodies by default.
 func NewLogger() *Logger {
 	l := &Logger{
-		creator: &Creator{
-			Name:    "martian proxy",
-			Version: "2.0.0",
-		},
-		entries: make(map[string]*Entry),
+		creator:    newCreator(),
+		entries:    make(map[string]*Entry),
+		pageIDs:    make(map[string]*Page),
+		pageRefs:   make(map[string]int),
+		pageURLs:   make(map[string][]string),
+		titlePages: make(map[string]*Page),
+		urlPages:   make(map[string]*Page),
 	}
 	l.SetOption(BodyLogging(true))
 	l.SetOption(PostDataLogging(true))
@@ -490,13 +575,14 @@ func (l *Logger) RecordRequest(id string, req *http.Request) error {
 	if err != nil {
 		return err
 	}
+	redactRequest(l.policy(req), hreq)
 
 	entry := &Entry{
 		ID:              id,
 		StartedDateTime: time.Now().UTC(),
 		Request:         hreq,
 		Cache:           &Cache{},
-		Timings:         &Timings{},
+		Timings:         newTimings(),
 	}
 
 	l.mu.Lock()
@@ -505,6 +591,10 @@ func (l *Logger) RecordRequest(id string, req *http.Request) error {
 	if _, exists := l.entries[id]; exists {
 		return fmt.Errorf("Duplicate request ID: %s", id)
 	}
+	if p := l.pageFor(req); p != nil {
+		entry.PageRef = p.ID
+		l.pageRefs[p.ID]++
+	}
 	l.entries[id] = entry
 	if l.tail == nil {
 		l.tail = entry
@@ -558,28 +648,186 @@ func (l *Logger) ModifyResponse(res *http.Response) error {
 	}
 	id := ctx.ID()
 
-	return l.RecordResponse(id, res)
+	// Entries of requests that establish a tunnel are completed, and written to
+	// the sink, once the tunnel closes.
+	to := newTunnelObserver(l, res, l.bodyLogging(res))
+	if !ctx.ObserveTunnel(to) {
+		to = nil
+	}
+
+	return l.recordResponse(id, res, ctx.RoundTripTrace(), to)
 }
 
 // RecordResponse logs an HTTP response, associating it with the previously-logged
 // HTTP request with the same ID.
 func (l *Logger) RecordResponse(id string, res *http.Response) error {
+	return l.recordResponse(id, res, martian.RoundTripTrace{}, nil)
+}
+
+func (l *Logger) recordResponse(id string, res *http.Response, rtt martian.RoundTripTrace, to *tunnelObserver) error {
 	hres, err := NewResponse(res, l.bodyLogging(res))
 	if err != nil {
 		return err
 	}
+	redactResponse(l.policy(res.Request), hres)
+	// The response body has been read if body logging is enabled, so this is
+	// the end of the receive phase.
+	end := time.Now()
 
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	var snapshot *Entry
+	var page *Page
 
-	if e, ok := l.entries[id]; ok {
+	l.mu.Lock()
+	e, ok := l.entries[id]
+	if ok {
+		if e.Response == nil {
+			l.completed++
+		}
 		e.Response = hres
-		e.Time = time.Since(e.StartedDateTime).Nanoseconds() / 1000000
+		e.Time = end.Sub(e.StartedDateTime).Nanoseconds() / 1000000
+		if !rtt.GotConn.IsZero() {
+			e.Timings = timings(rtt, end)
+			if addr, ok := rtt.RemoteAddr.(*net.TCPAddr); ok {
+				e.ServerIPAddress = addr.IP.String()
+			}
+			if rtt.LocalAddr != nil {
+				e.Connection = rtt.LocalAddr.String()
+			}
+		}
+		if to != nil {
+			to.e = e
+		}
+		snapshot = e.snapshot()
+		page = l.pageSnapshot(e.PageRef)
+		l.evict()
+	}
+	l.mu.Unlock()
+
+	if ok && to == nil {
+		l.writeToSink(snapshot, page)
 	}
 
 	return nil
 }
 
+// pageSnapshot returns a copy of the page with id, or nil if there is no such
+// page. l.mu must be held.
+func (l *Logger) pageSnapshot(id string) *Page {
+	p, ok := l.pageIDs[id]
+	if !ok {
+		return nil
+	}
+
+	cp := *p
+	return &cp
+}
+
+// writeToSink writes e, preceded by its page p if it has one, to the sink.
+// Failing to persist an entry must not affect the traffic being logged, so
+// sink errors are only logged.
+func (l *Logger) writeToSink(e *Entry, p *Page) {
+	if l.sink == nil {
+		return
+	}
+
+	if pw, ok := l.sink.(PageWriter); ok && p != nil {
+		if err := pw.WritePage(p); err != nil {
+			log.Errorf("har: failed to write page %s to sink: %v", p.ID, err)
+		}
+	}
+	if err := l.sink.WriteEntry(e); err != nil {
+		log.Errorf("har: failed to write entry %s to sink: %v", e.ID, err)
+	}
+}
+
+// evict discards the oldest completed entries until no more than maxEntries
+// completed entries remain. l.mu must be held.
+func (l *Logger) evict() {
+	if l.maxEntries <= 0 {
+		return
+	}
+
+	prev := l.tail
+	for l.completed > l.maxEntries {
+		curr := prev.next
+		if curr.Response == nil {
+			prev = curr
+			continue
+		}
+
+		delete(l.entries, curr.ID)
+		l.unrefPage(curr)
+		l.completed--
+		if curr == prev {
+			l.tail = nil
+			break
+		}
+		prev.next = curr.next
+		if curr == l.tail {
+			l.tail = prev
+		}
+	}
+}
+
+func newTimings() *Timings {
+	return &Timings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		SSL:     -1,
+	}
+}
+
+// timings returns the timings of a round trip that finished receiving the
+// response at end.
+func timings(rtt martian.RoundTripTrace, end time.Time) *Timings {
+	ts := newTimings()
+
+	ts.DNS = millis(rtt.DNSStart, rtt.DNSDone)
+	ts.SSL = millis(rtt.TLSHandshakeStart, rtt.TLSHandshakeDone)
+	connectDone := rtt.ConnectDone
+	if rtt.TLSHandshakeDone.After(connectDone) {
+		connectDone = rtt.TLSHandshakeDone
+	}
+	ts.Connect = millis(rtt.ConnectStart, connectDone)
+
+	// Blocked is whatever part of waiting for the connection was not spent on
+	// resolving and connecting.
+	if blocked := millis(rtt.GetConn, rtt.GotConn); blocked >= 0 {
+		if ts.DNS > 0 {
+			blocked -= ts.DNS
+		}
+		if ts.Connect > 0 {
+			blocked -= ts.Connect
+		}
+		if blocked < 0 {
+			blocked = 0
+		}
+		ts.Blocked = blocked
+	}
+
+	if send := millis(rtt.GotConn, rtt.WroteRequest); send >= 0 {
+		ts.Send = send
+	}
+	if wait := millis(rtt.WroteRequest, rtt.GotFirstResponseByte); wait >= 0 {
+		ts.Wait = wait
+	}
+	if receive := millis(rtt.GotFirstResponseByte, end); receive >= 0 {
+		ts.Receive = receive
+	}
+
+	return ts
+}
+
+// millis returns the milliseconds between from and to, or -1 if either is
+// unknown.
+func millis(from, to time.Time) int64 {
+	if from.IsZero() || to.IsZero() {
+		return -1
+	}
+	return to.Sub(from).Nanoseconds() / 1000000
+}
+
 // NewResponse constructs and returns a Response from resp. If withBody is true,
 // resp.Body is read to EOF and replaced with a copy in a bytes.Buffer. An error
 // is returned (and resp.Body may be in an intermediate state) if an error is
@@ -626,7 +874,72 @@ func NewResponse(res *http.Response, withBody bool) (*Response, error) {
 	return r, nil
 }
 
-// Export returns the in-memory log.
+// policy returns the redaction policy for req, which is nil if there is none.
+func (l *Logger) policy(req *http.Request) *redact.Policy {
+	if l.redact != nil || req == nil {
+		return l.redact
+	}
+	return redact.FromContext(martian.NewContext(req))
+}
+
+func redactRequest(p *redact.Policy, r *Request) {
+	if p == nil {
+		return
+	}
+
+	r.URL = p.URL(r.URL)
+	for i, q := range r.QueryString {
+		r.QueryString[i].Value = p.QueryParam(q.Name, q.Value)
+	}
+	for i, h := range r.Headers {
+		r.Headers[i].Value = p.Header(h.Name, h.Value)
+	}
+	for i, c := range r.Cookies {
+		r.Cookies[i].Value = p.Cookie(c.Name, c.Value)
+	}
+	if pd := r.PostData; pd != nil {
+		pd.Text = string(p.Body(pd.MimeType, []byte(pd.Text)))
+		for i, pp := range pd.Params {
+			pd.Params[i].Value = p.QueryParam(pp.Name, pp.Value)
+		}
+	}
+}
+
+func redactResponse(p *redact.Policy, r *Response) {
+	if p == nil {
+		return
+	}
+
+	for i, h := range r.Headers {
+		r.Headers[i].Value = p.Header(h.Name, h.Value)
+	}
+	for i, c := range r.Cookies {
+		r.Cookies[i].Value = p.Cookie(c.Name, c.Value)
+	}
+	r.RedirectURL = p.URL(r.RedirectURL)
+	if c := r.Content; c != nil {
+		c.Text = p.Body(c.MimeType, c.Text)
+	}
+}
+
+// snapshot returns a copy of e that is unaffected by later changes to e, such
+// as WebSocket messages and shaping events recorded after the response, so
+// that it can be used without holding the lock of the logger. The lock must
+// be held while the copy is made.
+func (e *Entry) snapshot() *Entry {
+	c := *e
+	c.next = nil
+	if e.WebSocketMessages != nil {
+		c.WebSocketMessages = append([]WebSocketMessage(nil), e.WebSocketMessages...)
+	}
+	if e.Shaping != nil {
+		c.Shaping = append([]ShapingEvent(nil), e.Shaping...)
+	}
+
+	return &c
+}
+
+// Export returns a snapshot of the in-memory log.
 func (l *Logger) Export() *HAR {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -635,7 +948,7 @@ func (l *Logger) Export() *HAR {
 	curr := l.tail
 	for curr != nil {
 		curr = curr.next
-		es = append(es, curr)
+		es = append(es, curr.snapshot())
 		if curr == l.tail {
 			break
 		}
@@ -656,8 +969,11 @@ func (l *Logger) ExportAndReset() *HAR {
 	for curr != nil {
 		curr = curr.next
 		if curr.Response != nil {
-			es = append(es, curr)
+			es = append(es, curr.snapshot())
 			delete(l.entries, curr.ID)
+			if curr.PageRef != "" {
+				l.pageRefs[curr.PageRef]--
+			}
 		} else {
 			if first == nil {
 				first = curr
@@ -669,6 +985,7 @@ func (l *Logger) ExportAndReset() *HAR {
 			break
 		}
 	}
+	l.completed = 0
 	if len(l.entries) == 0 {
 		l.tail = nil
 	} else {
@@ -676,7 +993,10 @@ func (l *Logger) ExportAndReset() *HAR {
 		l.tail.next = first
 	}
 
-	return l.makeHAR(es)
+	h := l.makeHAR(es)
+	l.prunePages()
+
+	return h
 }
 
 func (l *Logger) makeHAR(es []*Entry) *HAR {
@@ -684,6 +1004,7 @@ func (l *Logger) makeHAR(es []*Entry) *HAR {
 		Log: &Log{
 			Version: "1.2",
 			Creator: l.creator,
+			Pages:   referencedPages(l.pages, es),
 			Entries: es,
 		},
 	}
@@ -696,6 +1017,9 @@ func (l *Logger) Reset() {
 
 	l.entries = make(map[string]*Entry)
 	l.tail = nil
+	l.completed = 0
+	l.pageRefs = make(map[string]int)
+	l.prunePages()
 }
 
 func cookies(cs []*http.Cookie) []Cookie {
@@ -16,9 +16,14 @@ package har
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/martian/v3/log"
 )
@@ -31,7 +36,34 @@ type resetHandler struct {
 	logger *Logger
 }
 
+type pageHandler struct {
+	logger *Logger
+}
+
+type snippetHandler struct {
+	logger  *Logger
+	snippet func(r *Request) string
+}
+
 // NewExportHandler returns an http.Handler for requesting HAR logs.
+//
+// The exported entries can be narrowed down with the following query
+// parameters, all of which must match for an entry to be included:
+//
+//   url          regular expression matched against the request URL
+//   method       request method; may be repeated or comma separated
+//   status       response status code (200), class (4xx) or range (500-599);
+//                may be repeated or comma separated
+//   since        RFC 3339 time at or after which the request started
+//   until        RFC 3339 time before which the request started
+//   minDuration  minimum total time of the entry (250ms, 2s)
+//   contentType  substring of the response MIME type (json)
+//   id           entry ID, as set in the X-Martian-ID header by header.Id;
+//                may be repeated or comma separated
+//
+// Matching entries are paginated with offset and limit; the total number of
+// matching entries is returned in the X-Total-Count header. If metadata is
+// true, request and response bodies are omitted.
 func NewExportHandler(l *Logger) http.Handler {
 	return &exportHandler{
 		logger: l,
@@ -45,6 +77,40 @@ func NewResetHandler(l *Logger) http.Handler {
 	}
 }
 
+// NewPageHandler returns an http.Handler for grouping entries into pages.
+//
+// A POST request starts a new page with the title query parameter and returns
+// it, so that subsequent entries belong to it. A POST request with the id of a
+// page instead sets its onContentLoad and onLoad timings, in milliseconds
+// since the page started. A DELETE request ends the current page.
+func NewPageHandler(l *Logger) http.Handler {
+	return &pageHandler{
+		logger: l,
+	}
+}
+
+// NewCurlHandler returns an http.Handler for exporting logged requests as curl
+// command lines, separated by blank lines. The requests are selected with the
+// same query parameters as the export handler; metadata is ignored, since the
+// commands send the request bodies.
+func NewCurlHandler(l *Logger) http.Handler {
+	return &snippetHandler{
+		logger:  l,
+		snippet: (*Request).Curl,
+	}
+}
+
+// NewGoSnippetHandler returns an http.Handler for exporting logged requests as
+// Go snippets that send them with net/http, separated by blank lines. The
+// requests are selected with the same query parameters as the export handler;
+// metadata is ignored, since the snippets send the request bodies.
+func NewGoSnippetHandler(l *Logger) http.Handler {
+	return &snippetHandler{
+		logger:  l,
+		snippet: (*Request).GoSnippet,
+	}
+}
+
 // ServeHTTP writes the log in HAR format to the response body.
 func (h *exportHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
@@ -53,10 +119,24 @@ func (h *exportHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		log.Errorf("har.ServeHTTP: method not allowed: %s", req.Method)
 		return
 	}
+
+	q, err := parseExportQuery(req.URL.Query())
+	if err != nil {
+		log.Errorf("har: invalid export query: %v", err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	log.Debugf("exportHandler.ServeHTTP: writing HAR logs to ResponseWriter")
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 	hl := h.logger.Export()
+	if q != nil {
+		var total int
+		hl.Log.Entries, total = q.apply(hl.Log.Entries)
+		hl.Log.Pages = referencedPages(hl.Log.Pages, hl.Log.Entries)
+		rw.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
 	json.NewEncoder(rw).Encode(hl)
 }
 
@@ -70,7 +150,6 @@ func (h *resetHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-
 	v, err := parseBoolQueryParam(req.URL.Query(), "return")
 	if err != nil {
 		log.Errorf("har: invalid value for return param: %s", err)
@@ -90,13 +169,368 @@ func (h *resetHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	log.Infof("resetHandler.ServeHTTP: HAR logs cleared")
 }
 
+// ServeHTTP starts or ends a page, or sets its timings.
+func (h *pageHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "POST":
+	case "DELETE":
+		h.logger.EndPage()
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		rw.Header().Add("Allow", "POST")
+		rw.Header().Add("Allow", "DELETE")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		log.Errorf("har: method not allowed: %s", req.Method)
+		return
+	}
+
+	params := req.URL.Query()
+	id := params.Get("id")
+	if id == "" {
+		p := h.logger.StartPage(params.Get("title"))
+		log.Infof("pageHandler.ServeHTTP: started page %s", p.ID)
+
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(rw).Encode(p)
+		return
+	}
+
+	timings := make([]int64, 2)
+	for i, name := range []string{"onContentLoad", "onLoad"} {
+		timings[i] = -1
+		if params.Get(name) == "" {
+			continue
+		}
+
+		n, err := parseIntQueryParam(params, name)
+		if err != nil {
+			log.Errorf("har: %v", err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timings[i] = int64(n)
+	}
+
+	if err := h.logger.SetPageTimings(id, timings[0], timings[1]); err != nil {
+		log.Errorf("har: %v", err)
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// ServeHTTP writes the selected requests as snippets to the response body.
+func (h *snippetHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		rw.Header().Add("Allow", "GET")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		log.Errorf("har: method not allowed: %s", req.Method)
+		return
+	}
+
+	q, err := parseExportQuery(req.URL.Query())
+	if err != nil {
+		log.Errorf("har: invalid export query: %v", err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	es := h.logger.Export().Log.Entries
+	if q != nil {
+		// Snippets need the request body to send the request, and never include
+		// the response, so metadata has nothing to omit.
+		q.metadata = false
+
+		var total int
+		es, total = q.apply(es)
+		rw.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for i, e := range es {
+		if i > 0 {
+			io.WriteString(rw, "\n")
+		}
+		snippet := h.snippet(e.Request)
+		if !strings.HasSuffix(snippet, "\n") {
+			snippet += "\n"
+		}
+		io.WriteString(rw, snippet)
+	}
+}
+
 func parseBoolQueryParam(params url.Values, name string) (bool, error) {
 	if params[name] == nil {
 		return false, nil
 	}
-	v, err := strconv.ParseBool(params.Get("return"))
+	v, err := strconv.ParseBool(params.Get(name))
 	if err != nil {
 		return false, err
 	}
 	return v, nil
 }
+
+// exportQuery selects and paginates the entries returned by the export
+// handler.
+type exportQuery struct {
+	url         *regexp.Regexp
+	methods     map[string]bool
+	statuses    []statusRange
+	since       time.Time
+	until       time.Time
+	minDuration time.Duration
+	contentType string
+	ids         map[string]bool
+	offset      int
+	limit       int
+	metadata    bool
+}
+
+// statusRange is an inclusive range of response status codes.
+type statusRange struct {
+	min, max int
+}
+
+// parseExportQuery parses the export query parameters. It returns nil if
+// there are none, in which case the full log is exported.
+func parseExportQuery(params url.Values) (*exportQuery, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	q := &exportQuery{}
+
+	if v := params.Get("url"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url regexp %q: %v", v, err)
+		}
+		q.url = re
+	}
+
+	if ms := listQueryParam(params, "method"); len(ms) > 0 {
+		q.methods = make(map[string]bool)
+		for _, m := range ms {
+			q.methods[strings.ToUpper(m)] = true
+		}
+	}
+
+	for _, v := range listQueryParam(params, "status") {
+		sr, err := parseStatusRange(v)
+		if err != nil {
+			return nil, err
+		}
+		q.statuses = append(q.statuses, sr)
+	}
+
+	var err error
+	if q.since, err = parseTimeQueryParam(params, "since"); err != nil {
+		return nil, err
+	}
+	if q.until, err = parseTimeQueryParam(params, "until"); err != nil {
+		return nil, err
+	}
+
+	if v := params.Get("minDuration"); v != "" {
+		if q.minDuration, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid minDuration %q: %v", v, err)
+		}
+	}
+
+	q.contentType = strings.ToLower(params.Get("contentType"))
+
+	if ids := listQueryParam(params, "id"); len(ids) > 0 {
+		q.ids = make(map[string]bool)
+		for _, id := range ids {
+			q.ids[id] = true
+		}
+	}
+
+	if q.offset, err = parseIntQueryParam(params, "offset"); err != nil {
+		return nil, err
+	}
+	if q.limit, err = parseIntQueryParam(params, "limit"); err != nil {
+		return nil, err
+	}
+
+	if q.metadata, err = parseBoolQueryParam(params, "metadata"); err != nil {
+		return nil, fmt.Errorf("invalid metadata %q: %v", params.Get("metadata"), err)
+	}
+
+	return q, nil
+}
+
+// apply returns the page of entries in es that match q, along with the total
+// number of matching entries.
+func (q *exportQuery) apply(es []*Entry) ([]*Entry, int) {
+	matched := make([]*Entry, 0, len(es))
+	for _, e := range es {
+		if q.matches(e) {
+			matched = append(matched, e)
+		}
+	}
+	total := len(matched)
+
+	if q.offset >= len(matched) {
+		matched = matched[:0]
+	} else {
+		matched = matched[q.offset:]
+	}
+	if q.limit > 0 && q.limit < len(matched) {
+		matched = matched[:q.limit]
+	}
+
+	if q.metadata {
+		for i, e := range matched {
+			matched[i] = withoutBodies(e)
+		}
+	}
+
+	return matched, total
+}
+
+func (q *exportQuery) matches(e *Entry) bool {
+	if q.ids != nil && !q.ids[e.ID] {
+		return false
+	}
+	if e.Request == nil {
+		return false
+	}
+	if q.url != nil && !q.url.MatchString(e.Request.URL) {
+		return false
+	}
+	if q.methods != nil && !q.methods[e.Request.Method] {
+		return false
+	}
+	if !q.since.IsZero() && e.StartedDateTime.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !e.StartedDateTime.Before(q.until) {
+		return false
+	}
+	if q.minDuration > 0 && time.Duration(e.Time)*time.Millisecond < q.minDuration {
+		return false
+	}
+
+	if len(q.statuses) == 0 && q.contentType == "" {
+		return true
+	}
+	// Response filters never match pending entries.
+	if e.Response == nil {
+		return false
+	}
+
+	if len(q.statuses) > 0 {
+		var ok bool
+		for _, sr := range q.statuses {
+			if e.Response.Status >= sr.min && e.Response.Status <= sr.max {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if q.contentType != "" {
+		if e.Response.Content == nil || !strings.Contains(strings.ToLower(e.Response.Content.MimeType), q.contentType) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withoutBodies returns a copy of e without the request post data and the
+// response content text.
+func withoutBodies(e *Entry) *Entry {
+	ce := *e
+	ce.next = nil
+
+	if e.Request != nil && e.Request.PostData != nil {
+		req := *e.Request
+		req.PostData = &PostData{
+			MimeType: e.Request.PostData.MimeType,
+			Params:   []Param{},
+		}
+		ce.Request = &req
+	}
+
+	if e.Response != nil && e.Response.Content != nil {
+		res := *e.Response
+		c := *e.Response.Content
+		c.Text = nil
+		c.Encoding = ""
+		res.Content = &c
+		ce.Response = &res
+	}
+
+	return &ce
+}
+
+// parseStatusRange parses a status code (404), class (4xx) or inclusive
+// range (500-599).
+func parseStatusRange(v string) (statusRange, error) {
+	if len(v) == 3 && strings.HasSuffix(strings.ToLower(v), "xx") {
+		c, err := strconv.Atoi(v[:1])
+		if err != nil {
+			return statusRange{}, fmt.Errorf("invalid status %q", v)
+		}
+		return statusRange{min: c * 100, max: c*100 + 99}, nil
+	}
+
+	parts := strings.SplitN(v, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid status %q", v)
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil {
+			return statusRange{}, fmt.Errorf("invalid status %q", v)
+		}
+	}
+
+	return statusRange{min: min, max: max}, nil
+}
+
+// listQueryParam returns the values of a query parameter that may be repeated
+// or hold comma separated values.
+func listQueryParam(params url.Values, name string) []string {
+	var vs []string
+	for _, v := range params[name] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				vs = append(vs, s)
+			}
+		}
+	}
+	return vs
+}
+
+func parseTimeQueryParam(params url.Values, name string) (time.Time, error) {
+	v := params.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+	return t, nil
+}
+
+func parseIntQueryParam(params url.Values, name string) (int, error) {
+	v := params.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
@@ -18,7 +18,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/martian/v3"
 	"github.com/google/martian/v3/proxyutil"
@@ -148,3 +152,309 @@ func TestExportHandlerServeHTTP(t *testing.T) {
 		t.Errorf("rw.Code: got %d, want %d", got, want)
 	}
 }
+
+func TestExportHandlerQuery(t *testing.T) {
+	logger := NewLogger()
+
+	var ids []string
+	for _, tc := range []struct {
+		method string
+		url    string
+		status int
+		ct     string
+	}{
+		{"GET", "http://example.com/api/users", 200, "application/json"},
+		{"POST", "http://example.com/api/users", 201, "application/json"},
+		{"GET", "http://example.com/static/logo.png", 404, "text/html"},
+		{"GET", "http://example.com/api/orders", 503, "application/json"},
+	} {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+
+		ctx, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("martian.TestContext(): got %v, want no error", err)
+		}
+		defer remove()
+		ids = append(ids, ctx.ID())
+
+		if err := logger.ModifyRequest(req); err != nil {
+			t.Fatalf("ModifyRequest(): got %v, want no error", err)
+		}
+
+		res := proxyutil.NewResponse(tc.status, strings.NewReader("body"), req)
+		res.Header.Set("Content-Type", tc.ct)
+		if err := logger.ModifyResponse(res); err != nil {
+			t.Fatalf("ModifyResponse(): got %v, want no error", err)
+		}
+	}
+
+	h := NewExportHandler(logger)
+
+	tt := []struct {
+		query string
+		want  []int
+		total int
+	}{
+		{"url=/api/", []int{0, 1, 3}, 3},
+		{"method=post", []int{1}, 1},
+		{"method=POST,GET&url=orders", []int{3}, 1},
+		{"status=2xx", []int{0, 1}, 2},
+		{"status=404,500-599", []int{2, 3}, 2},
+		{"contentType=json&status=5xx", []int{3}, 1},
+		{"id=" + ids[2], []int{2}, 1},
+		{"url=/api/&offset=1&limit=1", []int{1}, 3},
+		{"offset=10", []int{}, 4},
+		{"since=" + time.Now().Add(time.Hour).Format(time.RFC3339), []int{}, 0},
+		{"until=" + time.Now().Add(time.Hour).Format(time.RFC3339), []int{0, 1, 2, 3}, 4},
+		{"minDuration=1h", []int{}, 0},
+	}
+
+	for i, tc := range tt {
+		req, err := http.NewRequest("GET", "/?"+tc.query, nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if got, want := rw.Code, http.StatusOK; got != want {
+			t.Fatalf("%d. rw.Code: got %d, want %d", i, got, want)
+		}
+		if got, want := rw.Header().Get("X-Total-Count"), strconv.Itoa(tc.total); got != want {
+			t.Errorf("%d. X-Total-Count: got %q, want %q", i, got, want)
+		}
+
+		hl := &HAR{}
+		if err := json.Unmarshal(rw.Body.Bytes(), hl); err != nil {
+			t.Fatalf("%d. json.Unmarshal(): got %v, want no error", i, err)
+		}
+
+		var got []string
+		for _, e := range hl.Log.Entries {
+			got = append(got, e.ID)
+		}
+		var want []string
+		for _, j := range tc.want {
+			want = append(want, ids[j])
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d. %q: got entries %v, want %v", i, tc.query, got, want)
+		}
+	}
+
+	for _, query := range []string{"url=(", "status=abc", "since=yesterday", "minDuration=1", "limit=-1", "metadata=maybe"} {
+		req, err := http.NewRequest("GET", "/?"+query, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if got, want := rw.Code, http.StatusBadRequest; got != want {
+			t.Errorf("%q: rw.Code: got %d, want %d", query, got, want)
+		}
+	}
+}
+
+func TestExportHandlerMetadataOnly(t *testing.T) {
+	logger := NewLogger()
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader("response body"), req)
+	if err := logger.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	h := NewExportHandler(logger)
+
+	req, err = http.NewRequest("GET", "/?metadata=true", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	hl := &HAR{}
+	if err := json.Unmarshal(rw.Body.Bytes(), hl); err != nil {
+		t.Fatalf("json.Unmarshal(): got %v, want no error", err)
+	}
+	if got, want := len(hl.Log.Entries), 1; got != want {
+		t.Fatalf("len(hl.Log.Entries): got %d, want %d", got, want)
+	}
+	if got := hl.Log.Entries[0].Response.Content.Text; len(got) != 0 {
+		t.Errorf("Content.Text: got %q, want no body", got)
+	}
+
+	// The logged entry keeps its body.
+	if got, want := string(logger.Export().Log.Entries[0].Response.Content.Text), "response body"; got != want {
+		t.Errorf("logged Content.Text: got %q, want %q", got, want)
+	}
+}
+
+func TestPageHandler(t *testing.T) {
+	logger := NewLogger()
+	h := NewPageHandler(logger)
+
+	req, err := http.NewRequest("POST", "/?title=Home", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if got, want := rw.Code, http.StatusOK; got != want {
+		t.Fatalf("rw.Code: got %d, want %d", got, want)
+	}
+
+	p := &Page{}
+	if err := json.Unmarshal(rw.Body.Bytes(), p); err != nil {
+		t.Fatalf("json.Unmarshal(): got %v, want no error", err)
+	}
+	if got, want := p.Title, "Home"; got != want {
+		t.Errorf("p.Title: got %q, want %q", got, want)
+	}
+
+	req, err = http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	req, err = http.NewRequest("POST", "/?id="+p.ID+"&onContentLoad=100&onLoad=250", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if got, want := rw.Code, http.StatusNoContent; got != want {
+		t.Fatalf("rw.Code: got %d, want %d", got, want)
+	}
+
+	hl := logger.Export()
+	if got, want := hl.Log.Entries[0].PageRef, p.ID; got != want {
+		t.Errorf("PageRef: got %q, want %q", got, want)
+	}
+	if got, want := hl.Log.Pages[0].PageTimings, (PageTimings{OnContentLoad: 100, OnLoad: 250}); got != want {
+		t.Errorf("PageTimings: got %+v, want %+v", got, want)
+	}
+
+	tt := []struct {
+		method, url string
+		want        int
+	}{
+		{"POST", "/?id=missing&onLoad=1", http.StatusNotFound},
+		{"POST", "/?id=" + p.ID + "&onLoad=soon", http.StatusBadRequest},
+		{"GET", "/", http.StatusMethodNotAllowed},
+		{"DELETE", "/", http.StatusNoContent},
+	}
+
+	for i, tc := range tt {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if got := rw.Code; got != tc.want {
+			t.Errorf("%d. rw.Code: got %d, want %d", i, got, tc.want)
+		}
+	}
+}
+
+func TestSnippetHandlers(t *testing.T) {
+	logger := NewLogger()
+
+	for _, u := range []string{"http://example.com/a", "http://example.com/b"} {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("martian.TestContext(): got %v, want no error", err)
+		}
+		defer remove()
+
+		if err := logger.ModifyRequest(req); err != nil {
+			t.Fatalf("ModifyRequest(): got %v, want no error", err)
+		}
+	}
+
+	req, err := http.NewRequest("POST", "http://example.com/c", strings.NewReader("hello martian"))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	tt := []struct {
+		h    http.Handler
+		url  string
+		want string
+	}{
+		{NewCurlHandler(logger), "/", "curl 'http://example.com/a'\n\ncurl 'http://example.com/b'\n"},
+		{NewCurlHandler(logger), "/?url=/b$", "curl 'http://example.com/b'\n"},
+		{NewGoSnippetHandler(logger), "/?url=/a$", `http.NewRequest("GET", "http://example.com/a", nil)`},
+		// Snippets keep the request body, which is needed to send the request.
+		{NewCurlHandler(logger), "/?url=/c$&metadata=true", "hello martian"},
+		{NewGoSnippetHandler(logger), "/?url=/c$&metadata=true", "hello martian"},
+	}
+
+	for i, tc := range tt {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		rw := httptest.NewRecorder()
+		tc.h.ServeHTTP(rw, req)
+
+		if got, want := rw.Code, http.StatusOK; got != want {
+			t.Fatalf("%d. rw.Code: got %d, want %d", i, got, want)
+		}
+		if got := rw.Body.String(); !strings.Contains(got, tc.want) {
+			t.Errorf("%d. rw.Body: got %q, want to contain %q", i, got, tc.want)
+		}
+	}
+
+	req, err = http.NewRequest("GET", "/?status=abc", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw := httptest.NewRecorder()
+	NewCurlHandler(logger).ServeHTTP(rw, req)
+	if got, want := rw.Code, http.StatusBadRequest; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+}
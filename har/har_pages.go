@@ -0,0 +1,295 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+// Page groups the entries that were requested while loading a page.
+type Page struct {
+	// StartedDateTime is the date and time stamp for the beginning of the page
+	// load (ISO 8601).
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// ID is the unique identifier of the page, referenced by entries.
+	ID string `json:"id"`
+	// Title is the page title.
+	Title string `json:"title"`
+	// PageTimings holds the timings of page load events.
+	PageTimings PageTimings `json:"pageTimings"`
+}
+
+// PageTimings describes the timings of page load events, in milliseconds since
+// the page load started. Timings that are not known are -1.
+type PageTimings struct {
+	// OnContentLoad is when the content of the page was loaded.
+	OnContentLoad int64 `json:"onContentLoad"`
+	// OnLoad is when the page was loaded.
+	OnLoad int64 `json:"onLoad"`
+}
+
+// PageHeader returns an option that groups entries into pages by the value of
+// the named request header, which is used as the page title. A page is
+// started for each title that has not been seen before.
+func PageHeader(name string) Option {
+	return func(l *Logger) {
+		l.pageHeader = http.CanonicalHeaderKey(name)
+	}
+}
+
+// PagesFromReferer returns an option that infers pages from navigation
+// requests, which start a new page titled with their URL. Other requests
+// belong to the page of their Referer, so that resources referenced by
+// stylesheets and scripts are also grouped with the page that loaded them.
+func PagesFromReferer(enabled bool) Option {
+	return func(l *Logger) {
+		l.pageReferer = enabled
+	}
+}
+
+// StartPage starts a new page with title. Requests logged afterwards belong to
+// the page, unless they are assigned to a page by the PageHeader or
+// PagesFromReferer options.
+func (l *Logger) StartPage(title string) Page {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.page = l.newPage(title)
+
+	return *l.page
+}
+
+// EndPage ends the page started by StartPage. Requests logged afterwards do
+// not belong to it.
+func (l *Logger) EndPage() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.page = nil
+}
+
+// SetPageTimings sets the timings of the page with id, in milliseconds since
+// the page started. Negative values leave the timing unchanged. Sinks that
+// write pages are given the updated page.
+func (l *Logger) SetPageTimings(id string, onContentLoad, onLoad int64) error {
+	l.mu.Lock()
+	p, ok := l.pageIDs[id]
+	if ok {
+		if onContentLoad >= 0 {
+			p.PageTimings.OnContentLoad = onContentLoad
+		}
+		if onLoad >= 0 {
+			p.PageTimings.OnLoad = onLoad
+		}
+		p = l.pageSnapshot(id)
+	}
+	l.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("har: page %s not found", id)
+	}
+
+	if pw, ok := l.sink.(PageWriter); ok {
+		if err := pw.WritePage(p); err != nil {
+			log.Errorf("har: failed to write page %s to sink: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// newPage starts a page with title. l.mu must be held.
+func (l *Logger) newPage(title string) *Page {
+	l.pageCount++
+	p := &Page{
+		StartedDateTime: time.Now().UTC(),
+		ID:              fmt.Sprintf("page_%d", l.pageCount),
+		Title:           title,
+		PageTimings: PageTimings{
+			OnContentLoad: -1,
+			OnLoad:        -1,
+		},
+	}
+	// The previously started page is no longer kept for loading; discard it
+	// if all of its entries have been discarded.
+	if n := len(l.pages); n > 0 {
+		if prev := l.pages[n-1]; prev != l.page && l.pageRefs[prev.ID] <= 0 {
+			l.pages = l.pages[:n-1]
+			l.forgetPage(prev)
+		}
+	}
+	l.pages = append(l.pages, p)
+	l.pageIDs[p.ID] = p
+
+	return p
+}
+
+// pageFor returns the page that req belongs to, starting one if req begins
+// a page, or nil if it does not belong to a page. l.mu must be held.
+func (l *Logger) pageFor(req *http.Request) *Page {
+	if l.pageHeader != "" {
+		if title := req.Header.Get(l.pageHeader); title != "" {
+			p, ok := l.titlePages[title]
+			if !ok {
+				p = l.newPage(title)
+				l.titlePages[title] = p
+			}
+			return p
+		}
+	}
+
+	if l.pageReferer {
+		u := pageURL(req.URL.String())
+
+		if isNavigation(req) {
+			p := l.newPage(l.policy(req).URL(u))
+			l.setURLPage(u, p)
+			return p
+		}
+
+		if ref := req.Header.Get("Referer"); ref != "" {
+			if p, ok := l.urlPages[pageURL(ref)]; ok {
+				l.setURLPage(u, p)
+				return p
+			}
+		}
+	}
+
+	return l.page
+}
+
+// keepPage returns whether p is kept even if no entry belongs to it, which is
+// the case for the page started by StartPage and the most recently started
+// page, which may still be loading. l.mu must be held.
+func (l *Logger) keepPage(p *Page) bool {
+	return p == l.page || (len(l.pages) > 0 && p == l.pages[len(l.pages)-1])
+}
+
+// unrefPage records that e has been discarded, and discards the page it
+// belonged to if no other entry belongs to it. l.mu must be held.
+func (l *Logger) unrefPage(e *Entry) {
+	if e.PageRef == "" {
+		return
+	}
+
+	l.pageRefs[e.PageRef]--
+	if l.pageRefs[e.PageRef] > 0 {
+		return
+	}
+
+	p, ok := l.pageIDs[e.PageRef]
+	if !ok || l.keepPage(p) {
+		return
+	}
+
+	for i, pp := range l.pages {
+		if pp == p {
+			copy(l.pages[i:], l.pages[i+1:])
+			l.pages[len(l.pages)-1] = nil
+			l.pages = l.pages[:len(l.pages)-1]
+			break
+		}
+	}
+	l.forgetPage(p)
+}
+
+// prunePages discards the pages that no entry belongs to, other than the
+// pages kept by keepPage. l.mu must be held.
+func (l *Logger) prunePages() {
+	ps := l.pages[:0]
+	for _, p := range l.pages {
+		if l.pageRefs[p.ID] > 0 || l.keepPage(p) {
+			ps = append(ps, p)
+			continue
+		}
+		l.forgetPage(p)
+	}
+	for i := len(ps); i < len(l.pages); i++ {
+		l.pages[i] = nil
+	}
+	l.pages = ps
+}
+
+// setURLPage records that requests referred by u belong to p. Each URL is
+// listed once per page, however often it is requested. l.mu must be held.
+func (l *Logger) setURLPage(u string, p *Page) {
+	if l.urlPages[u] == p {
+		return
+	}
+	l.urlPages[u] = p
+	l.pageURLs[p.ID] = append(l.pageURLs[p.ID], u)
+}
+
+// forgetPage removes p from the lookups of pages, once it has been removed
+// from l.pages. l.mu must be held.
+func (l *Logger) forgetPage(p *Page) {
+	delete(l.pageIDs, p.ID)
+	delete(l.pageRefs, p.ID)
+	if l.titlePages[p.Title] == p {
+		delete(l.titlePages, p.Title)
+	}
+	for _, u := range l.pageURLs[p.ID] {
+		if l.urlPages[u] == p {
+			delete(l.urlPages, u)
+		}
+	}
+	delete(l.pageURLs, p.ID)
+}
+
+// referencedPages returns copies of the pages in ps that any of es belong to.
+func referencedPages(ps []*Page, es []*Entry) []*Page {
+	refs := make(map[string]bool)
+	for _, e := range es {
+		if e.PageRef != "" {
+			refs[e.PageRef] = true
+		}
+	}
+
+	var rps []*Page
+	for _, p := range ps {
+		if refs[p.ID] {
+			cp := *p
+			rps = append(rps, &cp)
+		}
+	}
+
+	return rps
+}
+
+// isNavigation returns whether req loads a top level document.
+func isNavigation(req *http.Request) bool {
+	if dest := req.Header.Get("Sec-Fetch-Dest"); dest != "" {
+		return dest == "document"
+	}
+
+	return req.Method == "GET" && strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// pageURL returns u without its fragment, which is not sent in the Referer.
+func pageURL(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	pu.Fragment = ""
+
+	return pu.String()
+}
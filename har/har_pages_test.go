@@ -0,0 +1,237 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// logRequest logs a request to url with the given headers and returns the
+// page it was assigned to.
+func logRequest(t *testing.T, l *Logger, url string, headers map[string]string) string {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := l.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	es := l.Export().Log.Entries
+	return es[len(es)-1].PageRef
+}
+
+func TestStartPage(t *testing.T) {
+	l := NewLogger()
+
+	if got := logRequest(t, l, "http://example.com/before", nil); got != "" {
+		t.Errorf("PageRef: got %q, want no page", got)
+	}
+
+	p := l.StartPage("Home")
+	if got, want := p.Title, "Home"; got != want {
+		t.Errorf("p.Title: got %q, want %q", got, want)
+	}
+	if got, want := p.PageTimings.OnLoad, int64(-1); got != want {
+		t.Errorf("p.PageTimings.OnLoad: got %d, want %d", got, want)
+	}
+
+	if got := logRequest(t, l, "http://example.com/", nil); got != p.ID {
+		t.Errorf("PageRef: got %q, want %q", got, p.ID)
+	}
+
+	if err := l.SetPageTimings(p.ID, 120, -1); err != nil {
+		t.Fatalf("SetPageTimings(): got %v, want no error", err)
+	}
+	if err := l.SetPageTimings(p.ID, -1, 450); err != nil {
+		t.Fatalf("SetPageTimings(): got %v, want no error", err)
+	}
+	if err := l.SetPageTimings("missing", 1, 1); err == nil {
+		t.Error("SetPageTimings(): got no error, want error for unknown page")
+	}
+
+	ps := l.Export().Log.Pages
+	if got, want := len(ps), 1; got != want {
+		t.Fatalf("len(Pages): got %d, want %d", got, want)
+	}
+	if got, want := ps[0].PageTimings, (PageTimings{OnContentLoad: 120, OnLoad: 450}); got != want {
+		t.Errorf("PageTimings: got %+v, want %+v", got, want)
+	}
+
+	l.EndPage()
+	if got := logRequest(t, l, "http://example.com/after", nil); got != "" {
+		t.Errorf("PageRef: got %q, want no page", got)
+	}
+}
+
+func TestPageHeader(t *testing.T) {
+	l := NewLogger()
+	l.SetOption(PageHeader("x-martian-page"))
+
+	a := logRequest(t, l, "http://example.com/a", map[string]string{"X-Martian-Page": "checkout"})
+	b := logRequest(t, l, "http://example.com/b", map[string]string{"X-Martian-Page": "search"})
+	c := logRequest(t, l, "http://example.com/c", map[string]string{"X-Martian-Page": "checkout"})
+
+	if a == "" || a == b {
+		t.Errorf("PageRef: got %q and %q, want distinct pages", a, b)
+	}
+	if a != c {
+		t.Errorf("PageRef: got %q, want %q", c, a)
+	}
+
+	ps := l.Export().Log.Pages
+	if got, want := len(ps), 2; got != want {
+		t.Fatalf("len(Pages): got %d, want %d", got, want)
+	}
+	if got, want := ps[0].Title, "checkout"; got != want {
+		t.Errorf("ps[0].Title: got %q, want %q", got, want)
+	}
+}
+
+func TestPagesFromReferer(t *testing.T) {
+	l := NewLogger()
+	l.SetOption(PagesFromReferer(true))
+
+	doc := map[string]string{"Sec-Fetch-Dest": "document"}
+	home := logRequest(t, l, "http://example.com/#top", doc)
+	if home == "" {
+		t.Fatal("PageRef: got no page, want page for navigation")
+	}
+
+	css := logRequest(t, l, "http://cdn.example.com/style.css", map[string]string{
+		"Sec-Fetch-Dest": "style",
+		"Referer":        "http://example.com/",
+	})
+	if css != home {
+		t.Errorf("PageRef: got %q, want %q", css, home)
+	}
+
+	// Fonts are referred by the stylesheet that loaded them.
+	font := logRequest(t, l, "http://cdn.example.com/font.woff2", map[string]string{
+		"Sec-Fetch-Dest": "font",
+		"Referer":        "http://cdn.example.com/style.css",
+	})
+	if font != home {
+		t.Errorf("PageRef: got %q, want %q", font, home)
+	}
+
+	next := logRequest(t, l, "http://example.com/next", map[string]string{"Accept": "text/html,*/*"})
+	if next == "" || next == home {
+		t.Errorf("PageRef: got %q, want new page", next)
+	}
+
+	if got := logRequest(t, l, "http://other.com/", map[string]string{"Referer": "http://unknown.com/"}); got != "" {
+		t.Errorf("PageRef: got %q, want no page", got)
+	}
+
+	ps := l.Export().Log.Pages
+	if got, want := len(ps), 2; got != want {
+		t.Fatalf("len(Pages): got %d, want %d", got, want)
+	}
+	if got, want := ps[0].Title, "http://example.com/"; got != want {
+		t.Errorf("ps[0].Title: got %q, want %q", got, want)
+	}
+}
+
+func TestPagesFromRefererListsURLsOnce(t *testing.T) {
+	l := NewLogger()
+	l.SetOption(PagesFromReferer(true))
+
+	home := logRequest(t, l, "http://example.com/", map[string]string{"Sec-Fetch-Dest": "document"})
+	for i := 0; i < 10; i++ {
+		logRequest(t, l, "http://example.com/poll", map[string]string{"Referer": "http://example.com/"})
+	}
+
+	if got, want := len(l.pageURLs[home]), 2; got != want {
+		t.Errorf("len(pageURLs[%q]): got %d, want %d", home, got, want)
+	}
+}
+
+func TestResetPrunesPages(t *testing.T) {
+	l := NewLogger()
+	l.SetOption(PageHeader("X-Martian-Page"))
+
+	logRequest(t, l, "http://example.com/a", map[string]string{"X-Martian-Page": "a"})
+	logRequest(t, l, "http://example.com/b", map[string]string{"X-Martian-Page": "b"})
+	if got, want := len(l.pages), 2; got != want {
+		t.Fatalf("len(l.pages): got %d, want %d", got, want)
+	}
+
+	l.Reset()
+
+	// The most recent page may still be loading, so it is kept.
+	if got, want := len(l.pages), 1; got != want {
+		t.Fatalf("len(l.pages): got %d, want %d", got, want)
+	}
+	if got, want := l.pages[0].Title, "b"; got != want {
+		t.Errorf("l.pages[0].Title: got %q, want %q", got, want)
+	}
+	if got := len(l.Export().Log.Pages); got != 0 {
+		t.Errorf("len(Pages): got %d, want no pages without entries", got)
+	}
+}
+
+func TestEvictionPrunesOrphanedPages(t *testing.T) {
+	l := NewLogger()
+	l.SetOption(PageHeader("X-Martian-Page"), MaxEntries(1))
+
+	for _, title := range []string{"a", "b", "c"} {
+		req, err := http.NewRequest("GET", "http://example.com/"+title, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		req.Header.Set("X-Martian-Page", title)
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("martian.TestContext(): got %v, want no error", err)
+		}
+		defer remove()
+
+		if err := l.ModifyRequest(req); err != nil {
+			t.Fatalf("ModifyRequest(): got %v, want no error", err)
+		}
+		if err := l.ModifyResponse(proxyutil.NewResponse(200, nil, req)); err != nil {
+			t.Fatalf("ModifyResponse(): got %v, want no error", err)
+		}
+	}
+
+	// Only the page of the remaining entry is kept.
+	if got, want := len(l.pages), 1; got != want {
+		t.Fatalf("len(l.pages): got %d, want %d", got, want)
+	}
+	if got, want := l.pages[0].Title, "c"; got != want {
+		t.Errorf("l.pages[0].Title: got %q, want %q", got, want)
+	}
+	if _, ok := l.titlePages["a"]; ok {
+		t.Error(`l.titlePages["a"]: got page, want evicted page forgotten`)
+	}
+}
@@ -0,0 +1,476 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// replayEntryKey is the context key under which the entry matched for a
+// request is stored between ModifyRequest and ModifyResponse.
+const replayEntryKey = "har.ReplayEntry"
+
+// replayMissKey is the context key set when no entry matched a request and
+// unmatched requests are not passed through.
+const replayMissKey = "har.ReplayMiss"
+
+// Replayer is a martian.RequestResponseModifier that answers requests with
+// responses recorded in HAR logs, skipping the round trip to the server.
+//
+// Requests match a recorded entry if their method and URL are equal. Matching
+// can be relaxed by ignoring query parameters, and tightened by also requiring
+// equal bodies or equal values for a set of headers.
+type Replayer struct {
+	mu           sync.Mutex
+	entries      map[string][]*Entry
+	ignoreParams map[string]bool
+	headers      []string
+	matchBody    bool
+	sequential   bool
+	passthrough  bool
+	calls        map[string]int
+}
+
+type replayerJSON struct {
+	Files             []string             `json:"files"`
+	IgnoreQueryParams []string             `json:"ignoreQueryParams"`
+	MatchHeaders      []string             `json:"matchHeaders"`
+	MatchBody         bool                 `json:"matchBody"`
+	Sequential        bool                 `json:"sequential"`
+	Passthrough       bool                 `json:"passthrough"`
+	Scope             []parse.ModifierType `json:"scope"`
+}
+
+func init() {
+	parse.Register("har.Replayer", replayerFromJSON)
+}
+
+// NewReplayer returns a Replayer without any recorded entries. By default,
+// unmatched requests are answered with a 502.
+func NewReplayer() *Replayer {
+	return &Replayer{
+		entries:      make(map[string][]*Entry),
+		ignoreParams: make(map[string]bool),
+		calls:        make(map[string]int),
+	}
+}
+
+// IgnoreQueryParams excludes the named query parameters when comparing URLs.
+func (r *Replayer) IgnoreQueryParams(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, n := range names {
+		r.ignoreParams[n] = true
+	}
+
+	// Keys of entries that were already added depend on the ignored params.
+	var es []*Entry
+	for _, kes := range r.entries {
+		es = append(es, kes...)
+	}
+	r.entries = make(map[string][]*Entry)
+	r.add(es)
+}
+
+// MatchHeaders requires the values of the named headers to be equal to the
+// recorded values for a request to match.
+func (r *Replayer) MatchHeaders(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.headers = append(r.headers, names...)
+}
+
+// SetMatchBody sets whether request bodies must be equal to the recorded post
+// data for a request to match. URL encoded and multipart bodies are compared
+// by their parameters.
+func (r *Replayer) SetMatchBody(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.matchBody = enabled
+}
+
+// SetSequential sets whether repeated matching requests are answered with
+// the recorded entries in order. Once all entries for a request have been
+// replayed, the last one is repeated. If disabled, the first recorded entry
+// is always used.
+func (r *Replayer) SetSequential(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sequential = enabled
+}
+
+// SetPassthrough sets whether requests that do not match a recorded entry are
+// sent to the server. If disabled, they are answered with a 502.
+func (r *Replayer) SetPassthrough(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.passthrough = enabled
+}
+
+// Reset restarts the sequence of replayed entries.
+func (r *Replayer) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = make(map[string]int)
+}
+
+// AddEntries adds recorded entries. Entries without a response are ignored.
+func (r *Replayer) AddEntries(es ...*Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.add(es)
+}
+
+// Load adds the entries of a HAR log, or of newline delimited JSON entries as
+// written by a FileSink in FormatNDJSON.
+func (r *Replayer) Load(rd io.Reader) error {
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+
+	var h HAR
+	if err := json.Unmarshal(b, &h); err == nil && h.Log != nil {
+		r.AddEntries(h.Log.Entries...)
+		return nil
+	}
+
+	var es []*Entry
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		e := &Entry{}
+		if err := dec.Decode(e); err != nil {
+			return fmt.Errorf("har: failed to decode entry: %v", err)
+		}
+		es = append(es, e)
+	}
+	r.AddEntries(es...)
+
+	return nil
+}
+
+// LoadFile adds the entries of the HAR or NDJSON file at path. Files ending in
+// .gz are decompressed.
+func (r *Replayer) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rd io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		rd = gr
+	}
+
+	return r.Load(rd)
+}
+
+// ModifyRequest looks up the recorded entry for the request. If one is found,
+// or unmatched requests are not passed through, the round trip is skipped.
+func (r *Replayer) ModifyRequest(req *http.Request) error {
+	ctx := martian.NewContext(req)
+
+	e, err := r.match(req)
+	if err != nil {
+		return err
+	}
+
+	if e != nil {
+		ctx.SkipRoundTrip()
+		ctx.Set(replayEntryKey, e)
+		return nil
+	}
+
+	r.mu.Lock()
+	passthrough := r.passthrough
+	r.mu.Unlock()
+
+	if !passthrough {
+		ctx.SkipRoundTrip()
+		ctx.Set(replayMissKey, true)
+	}
+
+	return nil
+}
+
+// ModifyResponse replaces the response with the recorded response of the
+// entry matched in ModifyRequest.
+func (r *Replayer) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+
+	if v, ok := ctx.Get(replayEntryKey); ok {
+		return replayResponse(res, v.(*Entry).Response)
+	}
+
+	if _, ok := ctx.Get(replayMissKey); ok {
+		msg := fmt.Sprintf("har: no recorded response for %s %s", res.Request.Method, res.Request.URL)
+		log.Errorf("%s", msg)
+
+		res.Body.Close()
+		res.StatusCode = http.StatusBadGateway
+		res.Status = http.StatusText(http.StatusBadGateway)
+		res.Header = http.Header{}
+		res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		res.Body = ioutil.NopCloser(strings.NewReader(msg))
+		res.ContentLength = int64(len(msg))
+		proxyutil.Warning(res.Header, errors.New(msg))
+	}
+
+	return nil
+}
+
+// add indexes es by their match key. r.mu must be held.
+func (r *Replayer) add(es []*Entry) {
+	for _, e := range es {
+		if e == nil || e.Request == nil || e.Response == nil {
+			continue
+		}
+
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			log.Errorf("har: skipping entry %s with invalid URL %q: %v", e.ID, e.Request.URL, err)
+			continue
+		}
+
+		k := r.key(e.Request.Method, u)
+		r.entries[k] = append(r.entries[k], e)
+	}
+}
+
+// key returns the method and URL of a request with ignored query parameters
+// removed and the remaining ones sorted. r.mu must be held.
+func (r *Replayer) key(method string, u *url.URL) string {
+	q := u.Query()
+	for n := range r.ignoreParams {
+		q.Del(n)
+	}
+
+	ku := *u
+	ku.RawQuery = q.Encode()
+	ku.Fragment = ""
+
+	return method + " " + ku.String()
+}
+
+func (r *Replayer) match(req *http.Request) (*Entry, error) {
+	var body string
+	if r.matchesBody() {
+		b, err := requestBodyKey(req)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := r.key(req.Method, req.URL)
+
+	var candidates []*Entry
+	for _, e := range r.entries[k] {
+		if !r.headersMatch(req, e) {
+			continue
+		}
+		if r.matchBody && postDataKey(e.Request.PostData) != body {
+			continue
+		}
+		candidates = append(candidates, e)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	if !r.sequential {
+		return candidates[0], nil
+	}
+
+	// Requests that differ in their body or matched headers are separate
+	// sequences.
+	sk := k + "\n" + body
+	for _, h := range r.headers {
+		sk += "\n" + req.Header.Get(h)
+	}
+
+	i := r.calls[sk]
+	r.calls[sk]++
+	if i >= len(candidates) {
+		i = len(candidates) - 1
+	}
+
+	return candidates[i], nil
+}
+
+func (r *Replayer) matchesBody() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.matchBody
+}
+
+// headersMatch returns whether the matched headers of req have the values
+// recorded in e. r.mu must be held.
+func (r *Replayer) headersMatch(req *http.Request, e *Entry) bool {
+	for _, name := range r.headers {
+		var recorded []string
+		for _, h := range e.Request.Headers {
+			if http.CanonicalHeaderKey(h.Name) == http.CanonicalHeaderKey(name) {
+				recorded = append(recorded, h.Value)
+			}
+		}
+
+		if strings.Join(recorded, ",") != strings.Join(req.Header.Values(name), ",") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestBodyKey returns the hash of the body of req, leaving the body
+// readable.
+func requestBodyKey(req *http.Request) (string, error) {
+	// postData reads parameters of form bodies the same way as they are
+	// recorded, so that both sides of the comparison are normalized alike.
+	pd, err := postData(req, true)
+	if err != nil {
+		return "", err
+	}
+
+	return postDataKey(pd), nil
+}
+
+// postDataKey returns a hash of the text of pd, or of its sorted parameters.
+func postDataKey(pd *PostData) string {
+	if pd == nil {
+		return ""
+	}
+
+	text := pd.Text
+	if len(pd.Params) > 0 {
+		vs := url.Values{}
+		for _, p := range pd.Params {
+			vs.Add(p.Name, p.Filename+"\x00"+p.Value)
+		}
+		text = vs.Encode()
+	}
+	if text == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(text)))
+}
+
+// replayResponse overwrites res with the recorded response hres.
+func replayResponse(res *http.Response, hres *Response) error {
+	res.Body.Close()
+
+	res.StatusCode = hres.Status
+	res.Status = fmt.Sprintf("%d %s", hres.Status, hres.StatusText)
+	if hres.HTTPVersion != "" {
+		if major, minor, ok := http.ParseHTTPVersion(hres.HTTPVersion); ok {
+			res.Proto = hres.HTTPVersion
+			res.ProtoMajor = major
+			res.ProtoMinor = minor
+		}
+	}
+
+	res.Header = http.Header{}
+	for _, h := range hres.Headers {
+		res.Header.Add(h.Name, h.Value)
+	}
+
+	var body []byte
+	if hres.Content != nil {
+		body = hres.Content.Text
+	}
+
+	// Recorded content is decoded, so the framing and encoding headers of the
+	// original response no longer apply.
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Transfer-Encoding")
+	res.Header.Del("Content-Length")
+	res.TransferEncoding = nil
+	res.ContentLength = int64(len(body))
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return nil
+}
+
+// replayerFromJSON builds a har.Replayer from JSON.
+//
+// Example JSON:
+// {
+//   "har.Replayer": {
+//     "scope": ["request", "response"],
+//     "files": ["/path/to/session.har"],
+//     "ignoreQueryParams": ["timestamp"],
+//     "matchHeaders": ["Accept"],
+//     "matchBody": true,
+//     "sequential": true,
+//     "passthrough": false
+//   }
+// }
+func replayerFromJSON(b []byte) (*parse.Result, error) {
+	msg := &replayerJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	r := NewReplayer()
+	r.IgnoreQueryParams(msg.IgnoreQueryParams...)
+	r.MatchHeaders(msg.MatchHeaders...)
+	r.SetMatchBody(msg.MatchBody)
+	r.SetSequential(msg.Sequential)
+	r.SetPassthrough(msg.Passthrough)
+
+	for _, f := range msg.Files {
+		if err := r.LoadFile(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return parse.NewResult(r, msg.Scope)
+}
@@ -0,0 +1,278 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// record logs a round trip of a request with body to url that was answered
+// with resBody.
+func record(t *testing.T, l *Logger, method, url, body, resBody string) {
+	t.Helper()
+
+	var br io.Reader
+	if body != "" {
+		br = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, br)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := l.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader(resBody), req)
+	res.ContentLength = int64(len(resBody))
+	res.Header.Set("Content-Type", "text/plain")
+	if err := l.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+}
+
+// replay runs a request through r and returns the replayed response body, or
+// the empty string if the round trip was not skipped.
+func replay(t *testing.T, r *Replayer, method, url, body string) (int, string) {
+	t.Helper()
+
+	var br io.Reader
+	if body != "" {
+		br = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, br)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := r.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if !ctx.SkippingRoundTrip() {
+		return 0, ""
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := r.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := res.ContentLength, int64(len(got)); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+
+	return res.StatusCode, string(got)
+}
+
+func TestReplayerSequential(t *testing.T) {
+	l := NewLogger()
+	record(t, l, "GET", "http://example.com/path?a=1&b=2", "", "first")
+	record(t, l, "GET", "http://example.com/path?b=2&a=1", "", "second")
+
+	b, err := json.Marshal(l.Export())
+	if err != nil {
+		t.Fatalf("json.Marshal(): got %v, want no error", err)
+	}
+
+	r := NewReplayer()
+	if err := r.Load(bytes.NewReader(b)); err != nil {
+		t.Fatalf("Load(): got %v, want no error", err)
+	}
+	r.SetSequential(true)
+
+	for _, want := range []string{"first", "second", "second"} {
+		if _, got := replay(t, r, "GET", "http://example.com/path?a=1&b=2", ""); got != want {
+			t.Errorf("replay(): got body %q, want %q", got, want)
+		}
+	}
+
+	r.Reset()
+	if _, got := replay(t, r, "GET", "http://example.com/path?a=1&b=2", ""); got != "first" {
+		t.Errorf("replay(): got body %q after Reset, want %q", got, "first")
+	}
+
+	r.SetSequential(false)
+	for i := 0; i < 2; i++ {
+		if _, got := replay(t, r, "GET", "http://example.com/path?a=1&b=2", ""); got != "first" {
+			t.Errorf("replay(): got body %q, want %q", got, "first")
+		}
+	}
+}
+
+func TestReplayerIgnoreQueryParams(t *testing.T) {
+	l := NewLogger()
+	record(t, l, "GET", "http://example.com/?q=martian&ts=1", "", "recorded")
+
+	r := NewReplayer()
+	r.AddEntries(l.Export().Log.Entries...)
+
+	if status, _ := replay(t, r, "GET", "http://example.com/?q=martian&ts=2", ""); status != http.StatusBadGateway {
+		t.Errorf("replay(): got status %d, want %d", status, http.StatusBadGateway)
+	}
+
+	r.IgnoreQueryParams("ts")
+	if _, got := replay(t, r, "GET", "http://example.com/?ts=2&q=martian", ""); got != "recorded" {
+		t.Errorf("replay(): got body %q, want %q", got, "recorded")
+	}
+}
+
+func TestReplayerMatchBody(t *testing.T) {
+	l := NewLogger()
+	record(t, l, "POST", "http://example.com/form", "a=1&b=2", "one")
+	record(t, l, "POST", "http://example.com/form", "a=2&b=2", "two")
+
+	r := NewReplayer()
+	r.AddEntries(l.Export().Log.Entries...)
+	r.SetMatchBody(true)
+
+	if _, got := replay(t, r, "POST", "http://example.com/form", "b=2&a=2"); got != "two" {
+		t.Errorf("replay(): got body %q, want %q", got, "two")
+	}
+	if _, got := replay(t, r, "POST", "http://example.com/form", "a=1&b=2"); got != "one" {
+		t.Errorf("replay(): got body %q, want %q", got, "one")
+	}
+	if status, _ := replay(t, r, "POST", "http://example.com/form", "a=3"); status != http.StatusBadGateway {
+		t.Errorf("replay(): got status %d, want %d", status, http.StatusBadGateway)
+	}
+}
+
+func TestReplayerMissWarningKeepsEscapedURL(t *testing.T) {
+	r := NewReplayer()
+
+	req, err := http.NewRequest("GET", "http://example.com/a%2Fb?q=x%20y", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := r.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := r.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.Header.Get("Warning"), "http://example.com/a%2Fb?q=x%20y"; !strings.Contains(got, want) {
+		t.Errorf("res.Header.Get(%q): got %q, want it to contain %q", "Warning", got, want)
+	}
+}
+
+func TestReplayerPassthrough(t *testing.T) {
+	r := NewReplayer()
+
+	status, body := replay(t, r, "GET", "http://example.com/missing", "")
+	if got, want := status, http.StatusBadGateway; got != want {
+		t.Errorf("replay(): got status %d, want %d", got, want)
+	}
+	if !strings.Contains(body, "http://example.com/missing") {
+		t.Errorf("replay(): got body %q, want it to contain the URL", body)
+	}
+
+	r.SetPassthrough(true)
+	if status, _ := replay(t, r, "GET", "http://example.com/missing", ""); status != 0 {
+		t.Errorf("replay(): got status %d, want round trip not to be skipped", status)
+	}
+}
+
+func TestReplayerFromJSON(t *testing.T) {
+	l := NewLogger()
+	record(t, l, "GET", "http://example.com/", "", "recorded")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.ndjson.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("os.Create(): got %v, want no error", err)
+	}
+	gw := gzip.NewWriter(f)
+	enc := json.NewEncoder(gw)
+	for _, e := range l.Export().Log.Entries {
+		if err := enc.Encode(e); err != nil {
+			t.Fatalf("Encode(): got %v, want no error", err)
+		}
+	}
+	gw.Close()
+	f.Close()
+
+	msg, err := json.Marshal(map[string]interface{}{
+		"har.Replayer": map[string]interface{}{
+			"scope": []string{"request", "response"},
+			"files": []string{path},
+		},
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal(): got %v, want no error", err)
+	}
+
+	res, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	r, ok := res.RequestModifier().(*Replayer)
+	if !ok {
+		t.Fatal("res.RequestModifier().(*Replayer): got !ok, want ok")
+	}
+	if _, ok := res.ResponseModifier().(*Replayer); !ok {
+		t.Fatal("res.ResponseModifier().(*Replayer): got !ok, want ok")
+	}
+
+	if _, got := replay(t, r, "GET", "http://example.com/", ""); got != "recorded" {
+		t.Errorf("replay(): got body %q, want %q", got, "recorded")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"time"
+
+	"github.com/google/martian/v3/trafficshape"
+)
+
+// ShapingEvent is a traffic shaping action performed while a response was
+// written to the client.
+type ShapingEvent struct {
+	// Type is "shape", "throttle", "halt" or "close".
+	Type string `json:"type"`
+	// Time is when the action was performed.
+	Time time.Time `json:"time"`
+	// URLRegex is the regex of the shape that matched the request.
+	URLRegex string `json:"urlRegex"`
+	// ByteOffset is the offset in the response body at which the action was
+	// performed.
+	ByteOffset int64 `json:"byteOffset"`
+	// Bandwidth is the bandwidth in bytes per second set by a throttle.
+	Bandwidth int64 `json:"bandwidth,omitempty"`
+	// Duration is the duration in milliseconds of a halt.
+	Duration int64 `json:"duration,omitempty"`
+}
+
+// ShapingEvents returns an option that records the traffic shaping events of
+// the connections of tl in the _shaping field of the entries of the shaped
+// requests. Since the events happen while the response is written, after it
+// has been recorded, they are not included in entries written by StreamTo.
+func ShapingEvents(tl *trafficshape.Listener) Option {
+	return func(l *Logger) {
+		tl.SetEventObserver(l.RecordShapingEvent)
+	}
+}
+
+// RecordShapingEvent adds e to the entry of the request it was recorded for,
+// if the entry is still in memory.
+func (l *Logger) RecordShapingEvent(e trafficshape.Event) {
+	if e.RequestID == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[e.RequestID]
+	if !ok {
+		return
+	}
+	entry.Shaping = append(entry.Shaping, ShapingEvent{
+		Type:       e.Type,
+		Time:       e.Time,
+		URLRegex:   e.URLRegex,
+		ByteOffset: e.ByteOffset,
+		Bandwidth:  e.Bandwidth,
+		Duration:   e.Duration,
+	})
+}
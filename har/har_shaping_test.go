@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/proxyutil"
+	"github.com/google/martian/v3/trafficshape"
+)
+
+func TestLoggerRecordsShapingEvents(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := trafficshape.NewListener(l)
+	defer tsl.Close()
+
+	logger := NewLogger()
+	logger.SetOption(ShapingEvents(tsl))
+
+	req, err := http.NewRequest("GET", "http://example.com/video", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := logger.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := tsl.GetTrafficShapedConn(c1)
+	defer conn.Close()
+
+	conn.SetContext(&trafficshape.Context{
+		Shaping:   true,
+		URLRegex:  "video",
+		RequestID: ctx.ID(),
+	})
+	conn.RecordEvent(trafficshape.Event{Type: trafficshape.EventHalt, ByteOffset: 100, Duration: 500})
+	conn.RecordEvent(trafficshape.Event{Type: trafficshape.EventClose, RequestID: "unknown"})
+
+	log := logger.Export().Log
+	if got, want := len(log.Entries), 1; got != want {
+		t.Fatalf("len(log.Entries): got %d, want %d", got, want)
+	}
+
+	shaping := log.Entries[0].Shaping
+	if got, want := len(shaping), 1; got != want {
+		t.Fatalf("len(Shaping): got %d, want %d", got, want)
+	}
+	if got, want := shaping[0].Type, "halt"; got != want {
+		t.Errorf("Shaping[0].Type: got %q, want %q", got, want)
+	}
+	if got, want := shaping[0].URLRegex, "video"; got != want {
+		t.Errorf("Shaping[0].URLRegex: got %q, want %q", got, want)
+	}
+	if got, want := shaping[0].ByteOffset, int64(100); got != want {
+		t.Errorf("Shaping[0].ByteOffset: got %d, want %d", got, want)
+	}
+	if got, want := shaping[0].Duration, int64(500); got != want {
+		t.Errorf("Shaping[0].Duration: got %d, want %d", got, want)
+	}
+
+	b, err := json.Marshal(log.Entries[0])
+	if err != nil {
+		t.Fatalf("json.Marshal(): got %v, want no error", err)
+	}
+	if !strings.Contains(string(b), `"_shaping":[{"type":"halt"`) {
+		t.Errorf("json.Marshal(): got %s, want _shaping field", b)
+	}
+}
+
+func TestExportWhileShapingEventsAreRecorded(t *testing.T) {
+	logger := NewLogger()
+
+	req, err := http.NewRequest("GET", "http://example.com/video", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := logger.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	// Exported entries are encoded without the lock of the logger while
+	// events are recorded; run with -race to detect shared state.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			logger.RecordShapingEvent(trafficshape.Event{
+				Type:       trafficshape.EventThrottle,
+				RequestID:  ctx.ID(),
+				ByteOffset: int64(i),
+			})
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if _, err := json.Marshal(logger.Export()); err != nil {
+			t.Fatalf("json.Marshal(): got %v, want no error", err)
+		}
+	}
+	<-done
+
+	if got, want := len(logger.Export().Log.Entries[0].Shaping), 100; got != want {
+		t.Errorf("len(Shaping): got %d, want %d", got, want)
+	}
+}
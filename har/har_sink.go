@@ -0,0 +1,418 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+// Sink receives entries from a Logger as soon as their response has been
+// recorded.
+type Sink interface {
+	// WriteEntry persists a completed entry.
+	WriteEntry(e *Entry) error
+}
+
+// PageWriter is implemented by sinks that also persist the pages that entries
+// belong to. A Logger writes the page of an entry right before the entry, and
+// again when the timings of the page are set.
+type PageWriter interface {
+	// WritePage persists p, replacing a page previously written with the same
+	// ID.
+	WritePage(p *Page) error
+}
+
+// Format is the on-disk format of the files written by a FileSink.
+type Format int
+
+const (
+	// FormatHAR writes every file as a HAR document. Uncompressed files are a
+	// valid HAR document after every entry; compressed files only once they have
+	// been rotated or the sink has been closed.
+	FormatHAR Format = iota
+	// FormatNDJSON writes one JSON encoded entry per line.
+	FormatNDJSON
+)
+
+// harTrailer closes the entries array and the log and HAR objects of a file
+// without pages.
+const harTrailer = "]}}\n"
+
+// FileSink is a Sink that streams entries to files in a directory, rotating
+// to a new file once the current one exceeds a size or age limit. HAR files
+// hold the pages that their entries belong to.
+type FileSink struct {
+	dir     string
+	format  Format
+	gzip    bool
+	maxSize int64
+	maxAge  time.Duration
+	creator *Creator
+
+	mu sync.Mutex
+	// ff is the format of the current file, which may differ from format if it
+	// was changed after the file was created.
+	ff      Format
+	f       *os.File
+	gz      *gzip.Writer
+	w       *bufio.Writer
+	size    int64
+	opened  time.Time
+	entries int
+	seq     int
+	closed  bool
+	// pages are the pages written to the current file, which are written in the
+	// trailer of HAR files.
+	pages      []*Page
+	trailerLen int64
+}
+
+// NewFileSink returns a FileSink that writes HAR files to dir, creating the
+// directory if it does not exist. By default files are written uncompressed
+// in HAR format and rotated once they reach 100MB.
+func NewFileSink(dir string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileSink{
+		dir:     dir,
+		format:  FormatHAR,
+		maxSize: 100 << 20,
+		creator: newCreator(),
+	}, nil
+}
+
+// SetFormat sets the format of files created after the call.
+func (s *FileSink) SetFormat(f Format) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.format = f
+}
+
+// SetGzip sets whether files created after the call are gzip compressed.
+func (s *FileSink) SetGzip(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gzip = enabled
+}
+
+// SetMaxSize sets the number of uncompressed bytes after which the current
+// file is rotated. A size of zero or less disables size based rotation.
+func (s *FileSink) SetMaxSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxSize = size
+}
+
+// SetMaxAge sets the duration after which the current file is rotated. A
+// duration of zero or less disables time based rotation.
+func (s *FileSink) SetMaxAge(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxAge = d
+}
+
+// WriteEntry appends the entry to the current file, rotating it first if it
+// has reached its size or age limit.
+func (s *FileSink) WriteEntry(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("har: write to closed sink")
+	}
+
+	if s.f != nil && s.shouldRotate() {
+		// The page of the entry is written to the new file as well.
+		var carry []*Page
+		for _, p := range s.pages {
+			if p.ID == e.PageRef {
+				carry = append(carry, p)
+			}
+		}
+		if err := s.closeFile(); err != nil {
+			return err
+		}
+		s.pages = carry
+	}
+	if s.f == nil {
+		if err := s.openFile(); err != nil {
+			return err
+		}
+	}
+
+	switch s.ff {
+	case FormatNDJSON:
+		b = append(b, '\n')
+	case FormatHAR:
+		if s.entries > 0 {
+			b = append([]byte{','}, b...)
+		}
+		// Uncompressed files are kept valid by overwriting the trailer
+		// written after the previous entry.
+		if s.gz == nil {
+			if err := s.truncateTrailer(); err != nil {
+				return err
+			}
+			t, err := s.trailer()
+			if err != nil {
+				return err
+			}
+			b = append(b, t...)
+			s.trailerLen = int64(len(t))
+		}
+	}
+
+	if err := s.write(b); err != nil {
+		return err
+	}
+	s.entries++
+
+	return s.flush()
+}
+
+// WritePage records p in the pages of the current file, which are written in
+// the trailer of HAR files. Pages are not written in FormatNDJSON.
+func (s *FileSink) WritePage(p *Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("har: write to closed sink")
+	}
+
+	cp := *p
+	replaced := false
+	for i, pp := range s.pages {
+		if pp.ID == p.ID {
+			s.pages[i] = &cp
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		s.pages = append(s.pages, &cp)
+	}
+
+	if s.f == nil || s.ff != FormatHAR || s.gz != nil {
+		return nil
+	}
+
+	// Keep uncompressed files valid with the updated pages.
+	if err := s.truncateTrailer(); err != nil {
+		return err
+	}
+	t, err := s.trailer()
+	if err != nil {
+		return err
+	}
+	if err := s.write(t); err != nil {
+		return err
+	}
+	s.trailerLen = int64(len(t))
+
+	return s.flush()
+}
+
+// Rotate closes the current file. The next entry is written to a new file.
+func (s *FileSink) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+
+	return s.closeFile()
+}
+
+// Close flushes and syncs the current file to disk and closes it. Subsequent
+// writes to the sink fail.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+
+	return s.closeFile()
+}
+
+func (s *FileSink) shouldRotate() bool {
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		return true
+	}
+	if s.maxAge > 0 && time.Since(s.opened) >= s.maxAge {
+		return true
+	}
+	return false
+}
+
+func (s *FileSink) openFile() error {
+	ext := ".har"
+	if s.format == FormatNDJSON {
+		ext = ".ndjson"
+	}
+	if s.gzip {
+		ext += ".gz"
+	}
+
+	s.opened = time.Now()
+	s.seq++
+	name := fmt.Sprintf("martian-%s-%04d%s", s.opened.UTC().Format("20060102T150405"), s.seq, ext)
+
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	log.Infof("har: writing entries to %s", f.Name())
+
+	s.ff = s.format
+	s.f = f
+	s.size = 0
+	s.entries = 0
+	if s.gzip {
+		s.gz = gzip.NewWriter(f)
+		s.w = bufio.NewWriter(s.gz)
+	} else {
+		s.w = bufio.NewWriter(f)
+	}
+
+	if s.ff != FormatHAR {
+		return nil
+	}
+
+	hb, err := json.Marshal(s.creator)
+	if err != nil {
+		return err
+	}
+	header := []byte(fmt.Sprintf(`{"log":{"version":"1.2","creator":%s,"entries":[`, hb))
+	if !s.gzip {
+		t, err := s.trailer()
+		if err != nil {
+			return err
+		}
+		header = append(header, t...)
+		s.trailerLen = int64(len(t))
+	}
+	if err := s.write(header); err != nil {
+		return err
+	}
+
+	return s.flush()
+}
+
+// trailer returns the trailer of HAR files, which closes the entries array and
+// holds the pages of the file.
+func (s *FileSink) trailer() ([]byte, error) {
+	if len(s.pages) == 0 {
+		return []byte(harTrailer), nil
+	}
+
+	pb, err := json.Marshal(s.pages)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf(`],"pages":%s}}`+"\n", pb)), nil
+}
+
+// truncateTrailer removes the trailer from the end of the current
+// uncompressed file, so that it can be written again after more entries.
+func (s *FileSink) truncateTrailer() error {
+	off, err := s.f.Seek(-s.trailerLen, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if err := s.f.Truncate(off); err != nil {
+		return err
+	}
+	s.size -= s.trailerLen
+	s.trailerLen = 0
+
+	return nil
+}
+
+func (s *FileSink) write(b []byte) error {
+	n, err := s.w.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+// flush pushes buffered data to the file so that it survives the process
+// dying. Compressed data is flushed at a block boundary.
+func (s *FileSink) flush() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.gz != nil {
+		return s.gz.Flush()
+	}
+	return nil
+}
+
+func (s *FileSink) closeFile() error {
+	f := s.f
+	s.f = nil
+
+	var err error
+	if s.ff == FormatHAR && s.gz != nil {
+		var t []byte
+		if t, err = s.trailer(); err == nil {
+			err = s.write(t)
+		}
+	}
+	s.pages = nil
+	s.trailerLen = 0
+	if ferr := s.w.Flush(); err == nil {
+		err = ferr
+	}
+	if s.gz != nil {
+		if gerr := s.gz.Close(); err == nil {
+			err = gerr
+		}
+		s.gz = nil
+	}
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,377 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+func sinkFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	fs, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatalf("filepath.Glob(): got %v, want no error", err)
+	}
+	return fs
+}
+
+func readHARFile(t *testing.T, path string) *HAR {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): got %v, want no error", err)
+	}
+
+	var h HAR
+	if err := json.Unmarshal(b, &h); err != nil {
+		t.Fatalf("json.Unmarshal(%q): got %v, want no error", b, err)
+	}
+	return &h
+}
+
+func TestFileSinkHARIsValidAfterEveryEntry(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	defer s.Close()
+
+	for i, id := range []string{"first", "second", "third"} {
+		if err := s.WriteEntry(&Entry{ID: id}); err != nil {
+			t.Fatalf("WriteEntry(): got %v, want no error", err)
+		}
+
+		fs := sinkFiles(t, dir)
+		if got, want := len(fs), 1; got != want {
+			t.Fatalf("len(files): got %d, want %d", got, want)
+		}
+
+		h := readHARFile(t, fs[0])
+		if got, want := h.Log.Version, "1.2"; got != want {
+			t.Errorf("h.Log.Version: got %q, want %q", got, want)
+		}
+		if got, want := len(h.Log.Entries), i+1; got != want {
+			t.Fatalf("len(h.Log.Entries): got %d, want %d", got, want)
+		}
+		if got, want := h.Log.Entries[i].ID, id; got != want {
+			t.Errorf("h.Log.Entries[%d].ID: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestFileSinkGzipNDJSON(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	s.SetFormat(FormatNDJSON)
+	s.SetGzip(true)
+
+	for _, id := range []string{"first", "second"} {
+		if err := s.WriteEntry(&Entry{ID: id}); err != nil {
+			t.Fatalf("WriteEntry(): got %v, want no error", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close(): got %v, want no error", err)
+	}
+	if err := s.WriteEntry(&Entry{ID: "closed"}); err == nil {
+		t.Error("WriteEntry(): got no error, want error after Close")
+	}
+
+	fs := sinkFiles(t, dir)
+	if got, want := len(fs), 1; got != want {
+		t.Fatalf("len(files): got %d, want %d", got, want)
+	}
+	if got, want := filepath.Ext(fs[0]), ".gz"; got != want {
+		t.Errorf("filepath.Ext(): got %q, want %q", got, want)
+	}
+
+	f, err := os.Open(fs[0])
+	if err != nil {
+		t.Fatalf("os.Open(): got %v, want no error", err)
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader(): got %v, want no error", err)
+	}
+
+	var ids []string
+	sc := bufio.NewScanner(gr)
+	for sc.Scan() {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("json.Unmarshal(%q): got %v, want no error", sc.Bytes(), err)
+		}
+		ids = append(ids, e.ID)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("sc.Err(): got %v, want no error", err)
+	}
+
+	if got, want := len(ids), 2; got != want {
+		t.Fatalf("len(ids): got %d, want %d", got, want)
+	}
+	if ids[0] != "first" || ids[1] != "second" {
+		t.Errorf("ids: got %v, want [first second]", ids)
+	}
+}
+
+func TestFileSinkRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	s.SetMaxSize(1)
+	s.SetGzip(true)
+
+	for _, id := range []string{"first", "second", "third"} {
+		if err := s.WriteEntry(&Entry{ID: id}); err != nil {
+			t.Fatalf("WriteEntry(): got %v, want no error", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close(): got %v, want no error", err)
+	}
+
+	fs := sinkFiles(t, dir)
+	if got, want := len(fs), 3; got != want {
+		t.Fatalf("len(files): got %d, want %d", got, want)
+	}
+
+	for _, name := range fs {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("os.Open(): got %v, want no error", err)
+		}
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip.NewReader(): got %v, want no error", err)
+		}
+
+		var h HAR
+		if err := json.NewDecoder(gr).Decode(&h); err != nil {
+			t.Fatalf("Decode(): got %v, want no error", err)
+		}
+		f.Close()
+
+		if got, want := len(h.Log.Entries), 1; got != want {
+			t.Errorf("len(h.Log.Entries): got %d, want %d", got, want)
+		}
+	}
+}
+
+func TestLoggerStreamsToSinkWithBoundedMemory(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	defer s.Close()
+
+	logger := NewLogger()
+	logger.SetOption(StreamTo(s), MaxEntries(2))
+
+	var pending *http.Request
+	for i := 0; i < 5; i++ {
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+
+		_, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("martian.TestContext(): got %v, want no error", err)
+		}
+		defer remove()
+
+		if err := logger.ModifyRequest(req); err != nil {
+			t.Fatalf("ModifyRequest(): got %v, want no error", err)
+		}
+
+		// Leave the first request pending; it must not be evicted.
+		if i == 0 {
+			pending = req
+			continue
+		}
+
+		res := proxyutil.NewResponse(200, nil, req)
+		if err := logger.ModifyResponse(res); err != nil {
+			t.Fatalf("ModifyResponse(): got %v, want no error", err)
+		}
+	}
+
+	es := logger.Export().Log.Entries
+	if got, want := len(es), 3; got != want {
+		t.Fatalf("len(es): got %d, want %d", got, want)
+	}
+	if got, want := es[0].ID, martian.NewContext(pending).ID(); got != want {
+		t.Errorf("es[0].ID: got %q, want pending entry %q", got, want)
+	}
+
+	fs := sinkFiles(t, dir)
+	if got, want := len(fs), 1; got != want {
+		t.Fatalf("len(files): got %d, want %d", got, want)
+	}
+	h := readHARFile(t, fs[0])
+	if got, want := len(h.Log.Entries), 4; got != want {
+		t.Errorf("len(h.Log.Entries): got %d, want %d", got, want)
+	}
+}
+
+func TestLoggerIgnoresSinkErrors(t *testing.T) {
+	s, err := NewFileSink(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	// Writes to a closed sink fail.
+	s.Close()
+
+	logger := NewLogger()
+	logger.SetOption(StreamTo(s))
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := logger.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := len(logger.Export().Log.Entries), 1; got != want {
+		t.Errorf("len(entries): got %d, want %d", got, want)
+	}
+}
+
+func TestLoggerWritesPagesToSink(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	defer s.Close()
+
+	logger := NewLogger()
+	logger.SetOption(StreamTo(s), PageHeader("X-Martian-Page"))
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("X-Martian-Page", "home")
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if err := logger.ModifyResponse(proxyutil.NewResponse(200, nil, req)); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	ref := logger.Export().Log.Entries[0].PageRef
+	if err := logger.SetPageTimings(ref, 10, 20); err != nil {
+		t.Fatalf("SetPageTimings(): got %v, want no error", err)
+	}
+
+	fs := sinkFiles(t, dir)
+	if got, want := len(fs), 1; got != want {
+		t.Fatalf("len(files): got %d, want %d", got, want)
+	}
+	h := readHARFile(t, fs[0])
+	if got, want := len(h.Log.Pages), 1; got != want {
+		t.Fatalf("len(h.Log.Pages): got %d, want %d", got, want)
+	}
+	if got, want := h.Log.Pages[0].ID, ref; got != want {
+		t.Errorf("h.Log.Pages[0].ID: got %q, want %q", got, want)
+	}
+	if got, want := h.Log.Pages[0].PageTimings.OnLoad, int64(20); got != want {
+		t.Errorf("h.Log.Pages[0].PageTimings.OnLoad: got %d, want %d", got, want)
+	}
+}
+
+func TestFileSinkWritesPageToRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	s.SetMaxSize(1)
+
+	if err := s.WritePage(&Page{ID: "page_1"}); err != nil {
+		t.Fatalf("WritePage(): got %v, want no error", err)
+	}
+	for _, id := range []string{"first", "second"} {
+		if err := s.WriteEntry(&Entry{ID: id, PageRef: "page_1"}); err != nil {
+			t.Fatalf("WriteEntry(): got %v, want no error", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close(): got %v, want no error", err)
+	}
+
+	fs := sinkFiles(t, dir)
+	if got, want := len(fs), 2; got != want {
+		t.Fatalf("len(files): got %d, want %d", got, want)
+	}
+	for _, name := range fs {
+		h := readHARFile(t, name)
+		if got, want := len(h.Log.Pages), 1; got != want {
+			t.Fatalf("%s: len(h.Log.Pages): got %d, want %d", name, got, want)
+		}
+		if got, want := h.Log.Pages[0].ID, "page_1"; got != want {
+			t.Errorf("%s: h.Log.Pages[0].ID: got %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// snippetSkipHeaders are set by curl and the Go client from the URL and body,
+// or are specific to a single connection.
+var snippetSkipHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// CurlFromRequest returns a curl command line that sends req. The body of req
+// is read with a messageview and restored, so req may still be sent.
+func CurlFromRequest(req *http.Request) (string, error) {
+	r, err := NewRequest(req, true)
+	if err != nil {
+		return "", err
+	}
+
+	return r.Curl(), nil
+}
+
+// GoSnippetFromRequest returns Go code that sends req with net/http. The body
+// of req is read with a messageview and restored, so req may still be sent.
+func GoSnippetFromRequest(req *http.Request) (string, error) {
+	r, err := NewRequest(req, true)
+	if err != nil {
+		return "", err
+	}
+
+	return r.GoSnippet(), nil
+}
+
+// Curl returns a curl command line that sends r. Bodies that are not printable
+// text are piped to curl from base64, and files posted in multipart forms are
+// written to the working directory before curl uploads them.
+func (r *Request) Curl() string {
+	var pre []string
+	args := []string{"curl " + shellQuote(r.URL)}
+
+	form := r.PostData != nil && r.PostData.MimeType == "multipart/form-data" && len(r.PostData.Params) > 0
+	body, _ := r.body()
+
+	switch {
+	case r.Method == "GET" && body == nil:
+	case r.Method == "HEAD":
+		args = append(args, "--head")
+	default:
+		// curl would otherwise send POST for requests with a body.
+		args = append(args, "-X "+shellQuote(r.Method))
+	}
+
+	switch r.HTTPVersion {
+	case "HTTP/1.0":
+		args = append(args, "--http1.0")
+	case "HTTP/2.0":
+		args = append(args, "--http2")
+	}
+
+	compressed := false
+	for _, h := range r.snippetHeaders() {
+		if form && http.CanonicalHeaderKey(h.Name) == "Content-Type" {
+			// curl generates its own boundary.
+			continue
+		}
+		if http.CanonicalHeaderKey(h.Name) == "Accept-Encoding" {
+			compressed = true
+		}
+		args = append(args, "-H "+shellQuote(h.Name+": "+h.Value))
+	}
+	if compressed {
+		args = append(args, "--compressed")
+	}
+
+	if form {
+		files := make(map[string]bool)
+		for _, p := range r.PostData.Params {
+			if p.Filename == "" {
+				args = append(args, "--form-string "+shellQuote(p.Name+"="+p.Value))
+				continue
+			}
+
+			name := snippetFilename(p.Filename, files)
+			if printable(p.Value) {
+				pre = append(pre, fmt.Sprintf("printf '%%s' %s > %s", shellQuote(p.Value), shellQuote(name)))
+			} else {
+				pre = append(pre, fmt.Sprintf("echo %s | base64 --decode > %s", shellQuote(base64.StdEncoding.EncodeToString([]byte(p.Value))), shellQuote(name)))
+			}
+
+			f := fmt.Sprintf("%s=@%s", p.Name, name)
+			if p.Filename != name && !strings.ContainsAny(p.Filename, `;,"`) {
+				f += ";filename=" + p.Filename
+			}
+			if p.ContentType != "" {
+				f += ";type=" + p.ContentType
+			}
+			args = append(args, "-F "+shellQuote(f))
+		}
+	} else if body != nil {
+		if printable(string(body)) {
+			args = append(args, "--data-raw "+shellQuote(string(body)))
+		} else {
+			args[0] = fmt.Sprintf("echo %s | base64 --decode | %s", shellQuote(base64.StdEncoding.EncodeToString(body)), args[0])
+			args = append(args, "--data-binary @-")
+		}
+	}
+
+	return strings.Join(append(pre, strings.Join(args, " \\\n  ")), "\n")
+}
+
+// GoSnippet returns Go code that sends r with net/http.
+func (r *Request) GoSnippet() string {
+	buf := &bytes.Buffer{}
+
+	body, ct := r.body()
+	br := "nil"
+	if body != nil {
+		br = fmt.Sprintf("strings.NewReader(%s)", strconv.Quote(string(body)))
+	}
+
+	fmt.Fprintf(buf, "req, err := http.NewRequest(%s, %s, %s)\n", strconv.Quote(r.Method), strconv.Quote(r.URL), br)
+	buf.WriteString("if err != nil {\n\tlog.Fatal(err)\n}\n")
+
+	for _, h := range r.snippetHeaders() {
+		if ct != "" && http.CanonicalHeaderKey(h.Name) == "Content-Type" {
+			h.Value = ct
+			ct = ""
+		}
+		if http.CanonicalHeaderKey(h.Name) == "Host" {
+			fmt.Fprintf(buf, "req.Host = %s\n", strconv.Quote(h.Value))
+			continue
+		}
+		fmt.Fprintf(buf, "req.Header.Add(%s, %s)\n", strconv.Quote(h.Name), strconv.Quote(h.Value))
+	}
+
+	if ct != "" {
+		fmt.Fprintf(buf, "req.Header.Add(\"Content-Type\", %s)\n", strconv.Quote(ct))
+	}
+
+	buf.WriteString("\nres, err := http.DefaultClient.Do(req)\n")
+	buf.WriteString("if err != nil {\n\tlog.Fatal(err)\n}\n")
+	buf.WriteString("defer res.Body.Close()\n")
+
+	return buf.String()
+}
+
+// snippetHeaders returns the headers of r sorted by name, without the headers
+// that the client sets itself. The Host header is only kept if it differs
+// from the host of the URL.
+func (r *Request) snippetHeaders() []Header {
+	var host string
+	if u, err := url.Parse(r.URL); err == nil {
+		host = u.Host
+	}
+
+	var hs []Header
+	for _, h := range r.Headers {
+		name := http.CanonicalHeaderKey(h.Name)
+		if snippetSkipHeaders[name] || strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+		if name == "Host" && h.Value == host {
+			continue
+		}
+		hs = append(hs, h)
+	}
+
+	sort.SliceStable(hs, func(i, j int) bool {
+		return http.CanonicalHeaderKey(hs[i].Name) < http.CanonicalHeaderKey(hs[j].Name)
+	})
+
+	return hs
+}
+
+// body returns the body of r, rebuilt from its params if the post data was
+// parsed, and the content type to send it with if it differs from the
+// logged one.
+func (r *Request) body() ([]byte, string) {
+	pd := r.PostData
+	if pd == nil || (pd.Text == "" && len(pd.Params) == 0) {
+		return nil, ""
+	}
+	if pd.Text != "" {
+		return []byte(pd.Text), ""
+	}
+
+	switch pd.MimeType {
+	case "multipart/form-data":
+		buf := &bytes.Buffer{}
+		mw := multipart.NewWriter(buf)
+
+		// Keep the logged boundary so that the Content-Type header matches.
+		ct := mw.FormDataContentType()
+		for _, h := range r.Headers {
+			if http.CanonicalHeaderKey(h.Name) != "Content-Type" {
+				continue
+			}
+			if _, ps, err := mime.ParseMediaType(h.Value); err == nil && mw.SetBoundary(ps["boundary"]) == nil {
+				ct = ""
+			}
+		}
+
+		for _, p := range pd.Params {
+			mh := make(textproto.MIMEHeader)
+			if p.Filename != "" {
+				mh.Set("Content-Disposition", fmt.Sprintf("form-data; name=%q; filename=%q", p.Name, p.Filename))
+			} else {
+				mh.Set("Content-Disposition", fmt.Sprintf("form-data; name=%q", p.Name))
+			}
+			if p.ContentType != "" {
+				mh.Set("Content-Type", p.ContentType)
+			}
+
+			pw, err := mw.CreatePart(mh)
+			if err != nil {
+				return nil, ""
+			}
+			pw.Write([]byte(p.Value))
+		}
+		mw.Close()
+
+		return buf.Bytes(), ct
+	default:
+		vs := make([]string, 0, len(pd.Params))
+		for _, p := range pd.Params {
+			vs = append(vs, url.QueryEscape(p.Name)+"="+url.QueryEscape(p.Value))
+		}
+
+		return []byte(strings.Join(vs, "&")), ""
+	}
+}
+
+// shellQuote quotes s as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// printable returns whether s can be quoted on a command line as is, which
+// excludes invalid UTF-8 and control characters other than tabs and newlines.
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, c := range s {
+		if unicode.IsControl(c) && c != '\t' && c != '\n' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// snippetFilename returns a safe local file name for an uploaded file, which
+// is distinct from the names in seen.
+func snippetFilename(filename string, seen map[string]bool) string {
+	base := path.Base(strings.Replace(filename, `\`, "/", -1))
+	base = strings.Map(func(c rune) rune {
+		if c < utf8.RuneSelf && (unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("._-", c)) {
+			return c
+		}
+		return '_'
+	}, base)
+	if strings.Trim(base, ".") == "" {
+		base = "upload"
+	}
+
+	name := base
+	for i := 2; seen[name]; i++ {
+		name = fmt.Sprintf("%d_%s", i, base)
+	}
+	seen[name] = true
+
+	return name
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// multipartRequest returns a request to url posting a form with a field and a
+// binary file.
+func multipartRequest(t *testing.T, url string, file []byte) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("name", "martian's")
+	fw, err := mw.CreateFormFile("upload", "../data.bin")
+	if err != nil {
+		t.Fatalf("mw.CreateFormFile(): got %v, want no error", err)
+	}
+	fw.Write(file)
+	mw.Close()
+
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	return req
+}
+
+func TestCurl(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/?q=it's", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("X-Martian", "true")
+	req.Header.Set("Connection", "close")
+
+	got, err := CurlFromRequest(req)
+	if err != nil {
+		t.Fatalf("CurlFromRequest(): got %v, want no error", err)
+	}
+
+	want := "curl 'http://example.com/?q=it'\\''s' \\\n" +
+		"  -H 'Accept-Encoding: gzip' \\\n" +
+		"  -H 'X-Martian: true' \\\n" +
+		"  --compressed"
+	if got != want {
+		t.Errorf("CurlFromRequest():\ngot  %s\nwant %s", got, want)
+	}
+
+	req, err = http.NewRequest("PUT", "http://example.com/", bytes.NewReader([]byte{0x00, 0xff}))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Host = "martian.local"
+
+	got, err = CurlFromRequest(req)
+	if err != nil {
+		t.Fatalf("CurlFromRequest(): got %v, want no error", err)
+	}
+
+	want = "echo 'AP8=' | base64 --decode | curl 'http://example.com/' \\\n" +
+		"  -X 'PUT' \\\n" +
+		"  -H 'Host: martian.local' \\\n" +
+		"  --data-binary @-"
+	if got != want {
+		t.Errorf("CurlFromRequest():\ngot  %s\nwant %s", got, want)
+	}
+
+	// The body is restored.
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if !bytes.Equal(body, []byte{0x00, 0xff}) {
+		t.Errorf("req.Body: got %v, want %v", body, []byte{0x00, 0xff})
+	}
+}
+
+func TestCurlRunsMultipart(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl not installed")
+	}
+
+	file := []byte{0x00, 0x01, 'm', 0xff}
+
+	received := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := req.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("req.ParseMultipartForm(): got %v, want no error", err)
+		}
+		received <- req
+	}))
+	defer srv.Close()
+
+	cmd, err := CurlFromRequest(multipartRequest(t, srv.URL, file))
+	if err != nil {
+		t.Fatalf("CurlFromRequest(): got %v, want no error", err)
+	}
+
+	c := exec.Command("sh", "-c", cmd)
+	c.Dir = t.TempDir()
+	if out, err := c.CombinedOutput(); err != nil {
+		t.Fatalf("sh -c %q: got %v, want no error\n%s", cmd, err, out)
+	}
+
+	req := <-received
+	if got, want := req.Method, "POST"; got != want {
+		t.Errorf("req.Method: got %q, want %q", got, want)
+	}
+	if got, want := req.FormValue("name"), "martian's"; got != want {
+		t.Errorf("req.FormValue(%q): got %q, want %q", "name", got, want)
+	}
+
+	f, fh, err := req.FormFile("upload")
+	if err != nil {
+		t.Fatalf("req.FormFile(): got %v, want no error", err)
+	}
+	defer f.Close()
+	if got, want := fh.Filename, "data.bin"; got != want {
+		t.Errorf("fh.Filename: got %q, want %q", got, want)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if !bytes.Equal(got, file) {
+		t.Errorf("file: got %v, want %v", got, file)
+	}
+}
+
+func TestGoSnippet(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://example.com/form", strings.NewReader("a=1"))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	got, err := GoSnippetFromRequest(req)
+	if err != nil {
+		t.Fatalf("GoSnippetFromRequest(): got %v, want no error", err)
+	}
+
+	want := `req, err := http.NewRequest("POST", "http://example.com/form", strings.NewReader("a=1"))
+if err != nil {
+	log.Fatal(err)
+}
+req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+res, err := http.DefaultClient.Do(req)
+if err != nil {
+	log.Fatal(err)
+}
+defer res.Body.Close()
+`
+	if got != want {
+		t.Errorf("GoSnippetFromRequest():\ngot  %s\nwant %s", got, want)
+	}
+}
+
+func TestGoSnippetMultipart(t *testing.T) {
+	file := []byte{0x00, 'm'}
+	req := multipartRequest(t, "http://example.com/upload", file)
+	ct := req.Header.Get("Content-Type")
+
+	r, err := NewRequest(req, true)
+	if err != nil {
+		t.Fatalf("NewRequest(): got %v, want no error", err)
+	}
+
+	body, bct := r.body()
+	if bct != "" {
+		t.Errorf("r.body(): got content type %q, want logged content type", bct)
+	}
+
+	// The rebuilt body parses with the logged boundary.
+	preq, err := http.NewRequest("POST", "http://example.com/upload", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	preq.Header.Set("Content-Type", ct)
+	if err := preq.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatalf("ParseMultipartForm(): got %v, want no error", err)
+	}
+	if got, want := preq.FormValue("name"), "martian's"; got != want {
+		t.Errorf("FormValue(%q): got %q, want %q", "name", got, want)
+	}
+
+	if got := r.GoSnippet(); !strings.Contains(got, `\x00m`) {
+		t.Errorf("GoSnippet(): got %s, want escaped binary file", got)
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/google/martian/v3"
 	"github.com/google/martian/v3/proxyutil"
+	"github.com/google/martian/v3/redact"
 )
 
 func TestModifyRequest(t *testing.T) {
@@ -953,3 +954,121 @@ func TestJSONMarshalContent(t *testing.T) {
 		}
 	}
 }
+
+func TestTimingsFromRoundTripTrace(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	tt := []struct {
+		name string
+		rtt  martian.RoundTripTrace
+		want Timings
+	}{
+		{
+			name: "new TLS connection",
+			rtt: martian.RoundTripTrace{
+				GetConn:              at(0),
+				DNSStart:             at(1),
+				DNSDone:              at(6),
+				ConnectStart:         at(6),
+				ConnectDone:          at(16),
+				TLSHandshakeStart:    at(16),
+				TLSHandshakeDone:     at(36),
+				GotConn:              at(40),
+				WroteRequest:         at(42),
+				GotFirstResponseByte: at(142),
+			},
+			want: Timings{
+				Blocked: 5,
+				DNS:     5,
+				Connect: 30,
+				SSL:     20,
+				Send:    2,
+				Wait:    100,
+				Receive: 58,
+			},
+		},
+		{
+			name: "reused connection",
+			rtt: martian.RoundTripTrace{
+				GetConn:              at(0),
+				GotConn:              at(3),
+				WroteRequest:         at(4),
+				GotFirstResponseByte: at(150),
+				Reused:               true,
+			},
+			want: Timings{
+				Blocked: 3,
+				DNS:     -1,
+				Connect: -1,
+				SSL:     -1,
+				Send:    1,
+				Wait:    146,
+				Receive: 50,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := timings(tc.rtt, at(200)); *got != tc.want {
+				t.Errorf("timings(): got %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRedactPolicyFromContext(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://example.com/login?token=abc", strings.NewReader(`{"user":"martian","password":"hunter2"}`))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer abc")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	p := redact.NewPolicy()
+	p.RedactHeaders("Authorization")
+	p.RedactCookies("session")
+	p.RedactQueryParams("token")
+	p.RedactJSONPaths("password")
+
+	if err := p.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	logger := NewLogger()
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader(`{"password":"hunter2"}`), req)
+	res.Header.Set("Content-Type", "application/json")
+	res.Header.Set("Set-Cookie", "session=def; Path=/")
+	if err := logger.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	b, err := json.Marshal(logger.Export())
+	if err != nil {
+		t.Fatalf("json.Marshal(): got %v, want no error", err)
+	}
+	for _, secret := range []string{"hunter2", "Bearer abc", "session=abc", "session=def", "token=abc"} {
+		if bytes.Contains(b, []byte(secret)) {
+			t.Errorf("json.Marshal(): got %q in %s, want redacted", secret, b)
+		}
+	}
+
+	// The request itself is not modified.
+	if got, want := req.Header.Get("Authorization"), "Bearer abc"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Authorization", got, want)
+	}
+}
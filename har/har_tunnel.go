@@ -0,0 +1,378 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/log"
+)
+
+// Tunnel describes the traffic relayed through an opaque CONNECT tunnel or a
+// connection upgraded by a 101 Switching Protocols response.
+type Tunnel struct {
+	// Time is the number of milliseconds the tunnel was open.
+	Time int64 `json:"time"`
+	// BytesSent is the number of bytes sent from the client to the server.
+	BytesSent int64 `json:"bytesSent"`
+	// BytesReceived is the number of bytes received from the server.
+	BytesReceived int64 `json:"bytesReceived"`
+}
+
+// WebSocketMessage is a message sent or received on a WebSocket connection,
+// in the format used by Chrome.
+type WebSocketMessage struct {
+	// Type is "send" for messages from the client and "receive" for messages
+	// from the server.
+	Type string `json:"type"`
+	// Time is when the message was completed, in seconds since the epoch.
+	Time float64 `json:"time"`
+	// Opcode is 1 for text and 2 for binary messages.
+	Opcode int `json:"opcode"`
+	// Data is the text of the message, or the base64 encoded binary data.
+	Data string `json:"data"`
+	// Size is the length of the message payload in bytes. It is only set for
+	// messages too large to record, whose Data is left empty.
+	Size int64 `json:"_size,omitempty"`
+}
+
+// WebSocket opcodes of data frames.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+)
+
+const (
+	// maxWSMessageSize is the largest message payload that is recorded.
+	maxWSMessageSize = 1 << 20
+	// maxWSMessages is the number of messages recorded on an entry, later
+	// messages are dropped.
+	maxWSMessages = 1000
+	// maxWSHeaderSize is the length of a frame header with the largest payload
+	// length and a mask.
+	maxWSHeaderSize = 14
+)
+
+// deflateTail is removed from the end of messages compressed with the
+// permessage-deflate extension (RFC 7692 section 7.2.1).
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// tunnelObserver records the traffic of the tunnel established by a logged
+// request on its entry.
+type tunnelObserver struct {
+	l *Logger
+	// e is set once the response has been recorded, which happens before any
+	// data is relayed.
+	e *Entry
+
+	withData bool
+	send     *wsParser
+	receive  *wsParser
+}
+
+// newTunnelObserver returns an observer for the tunnel established by res. If
+// res upgrades to WebSocket, messages are recorded, including their data if
+// withData is true.
+func newTunnelObserver(l *Logger, res *http.Response, withData bool) *tunnelObserver {
+	to := &tunnelObserver{
+		l:        l,
+		withData: withData,
+	}
+
+	if res.StatusCode == http.StatusSwitchingProtocols && strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		deflate := strings.Contains(strings.ToLower(res.Header.Get("Sec-WebSocket-Extensions")), "permessage-deflate")
+		to.send = &wsParser{deflate: deflate}
+		to.receive = &wsParser{deflate: deflate}
+	}
+
+	return to
+}
+
+// TunnelData parses WebSocket frames relayed in either direction. Parsing
+// stops once the entry has been evicted or holds maxWSMessages messages.
+func (to *tunnelObserver) TunnelData(fromClient bool, b []byte) {
+	p, typ := to.receive, "receive"
+	if fromClient {
+		p, typ = to.send, "send"
+	}
+	if p == nil || !to.recording() {
+		return
+	}
+
+	for _, m := range p.write(b) {
+		wm := WebSocketMessage{
+			Type:   typ,
+			Time:   float64(time.Now().UnixNano()) / float64(time.Second),
+			Opcode: m.opcode,
+		}
+		switch {
+		case m.truncated:
+			wm.Size = m.size
+		case !to.withData:
+		case m.opcode == wsText && utf8.Valid(m.data):
+			wm.Data = string(m.data)
+		default:
+			wm.Data = base64.StdEncoding.EncodeToString(m.data)
+		}
+
+		to.l.mu.Lock()
+		if to.e != nil && to.l.entries[to.e.ID] == to.e && len(to.e.WebSocketMessages) < maxWSMessages {
+			to.e.WebSocketMessages = append(to.e.WebSocketMessages, wm)
+		}
+		to.l.mu.Unlock()
+	}
+}
+
+// recording returns whether messages can still be recorded on the entry.
+func (to *tunnelObserver) recording() bool {
+	to.l.mu.Lock()
+	defer to.l.mu.Unlock()
+
+	return to.e != nil && to.l.entries[to.e.ID] == to.e && len(to.e.WebSocketMessages) < maxWSMessages
+}
+
+// TunnelClosed records the tunnel statistics on the entry and writes it to the
+// sink, which was deferred until now.
+func (to *tunnelObserver) TunnelClosed(stats martian.TunnelStats) {
+	var e *Entry
+	var page *Page
+
+	to.l.mu.Lock()
+	if to.e != nil {
+		to.e.Tunnel = &Tunnel{
+			Time:          stats.End.Sub(stats.Start).Nanoseconds() / 1000000,
+			BytesSent:     stats.BytesSent,
+			BytesReceived: stats.BytesReceived,
+		}
+		to.e.Time += to.e.Tunnel.Time
+		e = to.e.snapshot()
+		page = to.l.pageSnapshot(e.PageRef)
+	}
+	to.l.mu.Unlock()
+
+	if e != nil {
+		to.l.writeToSink(e, page)
+	}
+}
+
+// wsMessage is a complete WebSocket data message. The data of messages with
+// payloads larger than maxWSMessageSize is dropped and only their size kept.
+type wsMessage struct {
+	opcode    int
+	data      []byte
+	size      int64
+	truncated bool
+}
+
+// wsParser reassembles WebSocket data messages from the frames relayed in one
+// direction. Control frames are skipped.
+type wsParser struct {
+	deflate bool
+
+	// hdr buffers the header of the next frame until it is complete.
+	hdr []byte
+	// inFrame is set while the payload of the current frame is being read.
+	inFrame   bool
+	fin       bool
+	control   bool
+	mask      []byte
+	maskPos   int
+	remaining uint64
+
+	opcode     int
+	compressed bool
+	msg        []byte
+	size       int64
+	truncated  bool
+	// window holds the most recent decompressed data, which later messages may
+	// refer to unless context takeover is disabled.
+	window []byte
+	failed bool
+}
+
+// write consumes b and returns the messages that it completed.
+func (p *wsParser) write(b []byte) []wsMessage {
+	var ms []wsMessage
+	for len(b) > 0 && !p.failed {
+		if !p.inFrame {
+			k := len(p.hdr)
+			n := maxWSHeaderSize - k
+			if n > len(b) {
+				n = len(b)
+			}
+			p.hdr = append(p.hdr, b[:n]...)
+
+			hn, ok := p.parseHeader()
+			if !ok {
+				b = b[n:]
+				continue
+			}
+			b = b[hn-k:]
+			p.hdr = p.hdr[:0]
+		}
+
+		n := uint64(len(b))
+		if n > p.remaining {
+			n = p.remaining
+		}
+		if !p.control {
+			p.appendPayload(b[:n])
+		}
+		b = b[n:]
+		p.remaining -= n
+
+		if p.remaining > 0 {
+			continue
+		}
+		p.inFrame = false
+		if !p.control && p.fin {
+			ms = append(ms, p.message())
+		}
+	}
+
+	return ms
+}
+
+// parseHeader parses the frame header buffered in p.hdr. It returns the
+// length of the header, or false if the header is not complete yet.
+func (p *wsParser) parseHeader() (int, bool) {
+	b := p.hdr
+	if len(b) < 2 {
+		return 0, false
+	}
+
+	fin := b[0]&0x80 != 0
+	rsv1 := b[0]&0x40 != 0
+	opcode := int(b[0] & 0x0f)
+	masked := b[1]&0x80 != 0
+
+	n := 2
+	plen := uint64(b[1] & 0x7f)
+	switch plen {
+	case 126:
+		if len(b) < n+2 {
+			return 0, false
+		}
+		plen = uint64(binary.BigEndian.Uint16(b[n:]))
+		n += 2
+	case 127:
+		if len(b) < n+8 {
+			return 0, false
+		}
+		plen = binary.BigEndian.Uint64(b[n:])
+		n += 8
+	}
+
+	var mask []byte
+	if masked {
+		if len(b) < n+4 {
+			return 0, false
+		}
+		mask = append([]byte(nil), b[n:n+4]...)
+		n += 4
+	}
+
+	p.inFrame = true
+	p.fin = fin
+	p.control = opcode >= 0x8
+	p.mask = mask
+	p.maskPos = 0
+	p.remaining = plen
+
+	switch {
+	case p.control:
+	case opcode == wsText, opcode == wsBinary:
+		p.opcode = opcode
+		p.compressed = rsv1
+		p.msg = p.msg[:0]
+		p.size = 0
+		p.truncated = false
+	case opcode == wsContinuation:
+	default:
+		log.Errorf("har: unknown WebSocket opcode %d, no longer recording messages", opcode)
+		p.failed = true
+	}
+
+	return n, true
+}
+
+// appendPayload unmasks a chunk of the payload of a data frame and adds it to
+// the current message, unless the message has outgrown maxWSMessageSize.
+func (p *wsParser) appendPayload(b []byte) {
+	p.size += int64(len(b))
+	if p.truncated {
+		return
+	}
+	if p.size > maxWSMessageSize {
+		p.truncated = true
+		p.msg = nil
+		return
+	}
+
+	i := len(p.msg)
+	p.msg = append(p.msg, b...)
+	if p.mask != nil {
+		for ; i < len(p.msg); i++ {
+			p.msg[i] ^= p.mask[p.maskPos%4]
+			p.maskPos++
+		}
+	}
+}
+
+// message returns the message completed by the last frame.
+func (p *wsParser) message() wsMessage {
+	if p.truncated {
+		return wsMessage{opcode: p.opcode, size: p.size, truncated: true}
+	}
+
+	data := append([]byte(nil), p.msg...)
+	if p.deflate && p.compressed {
+		d, err := p.inflate(data)
+		if err != nil {
+			log.Errorf("har: failed to decompress WebSocket message: %v", err)
+		} else {
+			data = d
+		}
+	}
+
+	return wsMessage{opcode: p.opcode, data: data, size: int64(len(p.msg))}
+}
+
+func (p *wsParser) inflate(data []byte) ([]byte, error) {
+	fr := flate.NewReaderDict(bytes.NewReader(append(data, deflateTail...)), p.window)
+	defer fr.Close()
+
+	out, err := ioutil.ReadAll(fr)
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+
+	p.window = append(p.window, out...)
+	if len(p.window) > 32<<10 {
+		p.window = append([]byte(nil), p.window[len(p.window)-32<<10:]...)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,377 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// wsFrame encodes a WebSocket frame, masking it if mask is not nil.
+func wsFrame(fin bool, rsv1 bool, opcode byte, mask []byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+
+	f := []byte{b0}
+	var mb byte
+	if mask != nil {
+		mb = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		f = append(f, mb|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		f = append(f, mb|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		f = append(f, mb|127, 0, 0, 0, 0, byte(len(payload)>>24), byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	}
+
+	if mask == nil {
+		return append(f, payload...)
+	}
+
+	f = append(f, mask...)
+	for i, c := range payload {
+		f = append(f, c^mask[i%4])
+	}
+	return f
+}
+
+type entrySink struct {
+	entries []*Entry
+}
+
+func (s *entrySink) WriteEntry(e *Entry) error {
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func TestWebSocketParser(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	large := bytes.Repeat([]byte("x"), 300)
+
+	var stream []byte
+	stream = append(stream, wsFrame(false, false, wsText, mask, []byte("hel"))...)
+	// Control frames may be interleaved with fragments.
+	stream = append(stream, wsFrame(true, false, 0x9, mask, []byte("ping"))...)
+	stream = append(stream, wsFrame(true, false, wsContinuation, mask, []byte("lo"))...)
+	stream = append(stream, wsFrame(true, false, wsBinary, nil, large)...)
+
+	p := &wsParser{}
+	var ms []wsMessage
+	// Feed the stream a byte at a time, so that every frame is split.
+	for _, c := range stream {
+		ms = append(ms, p.write([]byte{c})...)
+	}
+
+	if got, want := len(ms), 2; got != want {
+		t.Fatalf("len(ms): got %d, want %d", got, want)
+	}
+	if got, want := ms[0].opcode, wsText; got != want {
+		t.Errorf("ms[0].opcode: got %d, want %d", got, want)
+	}
+	if got, want := string(ms[0].data), "hello"; got != want {
+		t.Errorf("ms[0].data: got %q, want %q", got, want)
+	}
+	if got, want := ms[1].opcode, wsBinary; got != want {
+		t.Errorf("ms[1].opcode: got %d, want %d", got, want)
+	}
+	if !bytes.Equal(ms[1].data, large) {
+		t.Errorf("ms[1].data: got %d bytes, want %d", len(ms[1].data), len(large))
+	}
+}
+
+func TestWebSocketParserTruncatesLargeMessages(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	large := bytes.Repeat([]byte("x"), maxWSMessageSize+1)
+
+	p := &wsParser{}
+	var ms []wsMessage
+	ms = append(ms, p.write(wsFrame(false, false, wsBinary, mask, large[:maxWSMessageSize]))...)
+	if got, want := len(p.msg), maxWSMessageSize; got != want {
+		t.Fatalf("len(p.msg): got %d, want %d", got, want)
+	}
+	ms = append(ms, p.write(wsFrame(true, false, wsContinuation, mask, large[maxWSMessageSize:]))...)
+	ms = append(ms, p.write(wsFrame(true, false, wsText, mask, []byte("hello")))...)
+
+	if got, want := len(ms), 2; got != want {
+		t.Fatalf("len(ms): got %d, want %d", got, want)
+	}
+	if !ms[0].truncated || ms[0].data != nil {
+		t.Errorf("ms[0]: got %d bytes of data, want truncated message", len(ms[0].data))
+	}
+	if got, want := ms[0].size, int64(len(large)); got != want {
+		t.Errorf("ms[0].size: got %d, want %d", got, want)
+	}
+	if got, want := string(ms[1].data), "hello"; got != want {
+		t.Errorf("ms[1].data: got %q, want %q", got, want)
+	}
+	if got := len(p.hdr); got != 0 {
+		t.Errorf("len(p.hdr): got %d, want 0", got)
+	}
+}
+
+func TestWebSocketParserPerMessageDeflate(t *testing.T) {
+	// Compress two messages with a shared window, as with context takeover.
+	buf := &bytes.Buffer{}
+	fw, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		t.Fatalf("flate.NewWriter(): got %v, want no error", err)
+	}
+
+	p := &wsParser{deflate: true}
+	for _, msg := range []string{"hello, martian", "hello, martian"} {
+		buf.Reset()
+		fw.Write([]byte(msg))
+		fw.Flush()
+		payload := bytes.TrimSuffix(buf.Bytes(), deflateTail)
+
+		ms := p.write(wsFrame(true, true, wsText, nil, payload))
+		if got, want := len(ms), 1; got != want {
+			t.Fatalf("len(ms): got %d, want %d", got, want)
+		}
+		if got := string(ms[0].data); got != msg {
+			t.Errorf("ms[0].data: got %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestLoggerRecordsTunnel(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/socket", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	s := &entrySink{}
+	logger := NewLogger()
+	logger.SetOption(StreamTo(s))
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(http.StatusSwitchingProtocols, nil, req)
+	res.Header.Set("Upgrade", "websocket")
+	id := martian.NewContext(req).ID()
+
+	to := newTunnelObserver(logger, res, true)
+	if err := logger.recordResponse(id, res, martian.RoundTripTrace{}, to); err != nil {
+		t.Fatalf("recordResponse(): got %v, want no error", err)
+	}
+	if got, want := len(s.entries), 0; got != want {
+		t.Fatalf("len(s.entries): got %d, want %d before the tunnel closed", got, want)
+	}
+
+	sent := wsFrame(true, false, wsText, []byte{1, 2, 3, 4}, []byte("ping?"))
+	received := wsFrame(true, false, wsBinary, nil, []byte{0xff, 0x00})
+	to.TunnelData(true, sent)
+	to.TunnelData(false, received)
+
+	start := time.Now()
+	to.TunnelClosed(martian.TunnelStats{
+		Start:         start,
+		End:           start.Add(2 * time.Second),
+		BytesSent:     int64(len(sent)),
+		BytesReceived: int64(len(received)),
+	})
+
+	if got, want := len(s.entries), 1; got != want {
+		t.Fatalf("len(s.entries): got %d, want %d", got, want)
+	}
+
+	e := logger.Export().Log.Entries[0]
+	if e.Tunnel == nil {
+		t.Fatal("e.Tunnel: got nil, want tunnel")
+	}
+	if got, want := e.Tunnel.Time, int64(2000); got != want {
+		t.Errorf("e.Tunnel.Time: got %d, want %d", got, want)
+	}
+	if got, want := e.Tunnel.BytesSent, int64(len(sent)); got != want {
+		t.Errorf("e.Tunnel.BytesSent: got %d, want %d", got, want)
+	}
+	if got, want := e.Tunnel.BytesReceived, int64(len(received)); got != want {
+		t.Errorf("e.Tunnel.BytesReceived: got %d, want %d", got, want)
+	}
+
+	if got, want := len(e.WebSocketMessages), 2; got != want {
+		t.Fatalf("len(e.WebSocketMessages): got %d, want %d", got, want)
+	}
+
+	m := e.WebSocketMessages[0]
+	if m.Type != "send" || m.Opcode != 1 || m.Data != "ping?" {
+		t.Errorf("e.WebSocketMessages[0]: got %+v, want text message %q sent", m, "ping?")
+	}
+	if m.Time < float64(start.Unix()) {
+		t.Errorf("e.WebSocketMessages[0].Time: got %f, want at least %d", m.Time, start.Unix())
+	}
+
+	m = e.WebSocketMessages[1]
+	if m.Type != "receive" || m.Opcode != 2 || m.Data != "/wA=" {
+		t.Errorf("e.WebSocketMessages[1]: got %+v, want binary message %q received", m, "/wA=")
+	}
+}
+
+func TestExportWhileTunnelIsOpen(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/socket", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	logger := NewLogger()
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(http.StatusSwitchingProtocols, nil, req)
+	res.Header.Set("Upgrade", "websocket")
+	id := martian.NewContext(req).ID()
+
+	to := newTunnelObserver(logger, res, true)
+	if err := logger.recordResponse(id, res, martian.RoundTripTrace{}, to); err != nil {
+		t.Fatalf("recordResponse(): got %v, want no error", err)
+	}
+
+	// Exported entries are encoded without the lock of the logger while
+	// messages are recorded; run with -race to detect shared state.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		frame := wsFrame(true, false, wsText, []byte{1, 2, 3, 4}, []byte("ping?"))
+		for i := 0; i < 100; i++ {
+			to.TunnelData(true, frame)
+		}
+		to.TunnelClosed(martian.TunnelStats{Start: time.Now(), End: time.Now()})
+	}()
+
+	for i := 0; i < 100; i++ {
+		if _, err := json.Marshal(logger.Export()); err != nil {
+			t.Fatalf("json.Marshal(): got %v, want no error", err)
+		}
+	}
+	<-done
+
+	if got, want := len(logger.Export().Log.Entries[0].WebSocketMessages), 100; got != want {
+		t.Errorf("len(WebSocketMessages): got %d, want %d", got, want)
+	}
+}
+
+// newWebSocketObserver logs a request upgraded to WebSocket with logger and
+// returns the observer of its tunnel.
+func newWebSocketObserver(t *testing.T, logger *Logger) *tunnelObserver {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", "http://example.com/socket", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	t.Cleanup(remove)
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(http.StatusSwitchingProtocols, nil, req)
+	res.Header.Set("Upgrade", "websocket")
+
+	to := newTunnelObserver(logger, res, true)
+	if err := logger.recordResponse(martian.NewContext(req).ID(), res, martian.RoundTripTrace{}, to); err != nil {
+		t.Fatalf("recordResponse(): got %v, want no error", err)
+	}
+
+	return to
+}
+
+func TestTunnelObserverRecordsSizeOfLargeMessages(t *testing.T) {
+	logger := NewLogger()
+	to := newWebSocketObserver(t, logger)
+
+	large := bytes.Repeat([]byte("x"), maxWSMessageSize+1)
+	to.TunnelData(false, wsFrame(true, false, wsText, nil, large))
+
+	ms := logger.Export().Log.Entries[0].WebSocketMessages
+	if got, want := len(ms), 1; got != want {
+		t.Fatalf("len(WebSocketMessages): got %d, want %d", got, want)
+	}
+	if got, want := ms[0].Size, int64(len(large)); got != want {
+		t.Errorf("WebSocketMessages[0].Size: got %d, want %d", got, want)
+	}
+	if got := ms[0].Data; got != "" {
+		t.Errorf("WebSocketMessages[0].Data: got %d bytes, want none", len(got))
+	}
+}
+
+func TestTunnelObserverLimitsMessages(t *testing.T) {
+	logger := NewLogger()
+	to := newWebSocketObserver(t, logger)
+
+	frame := wsFrame(true, false, wsText, nil, []byte("ping?"))
+	for i := 0; i < maxWSMessages+10; i++ {
+		to.TunnelData(false, frame)
+	}
+
+	if got, want := len(logger.Export().Log.Entries[0].WebSocketMessages), maxWSMessages; got != want {
+		t.Errorf("len(WebSocketMessages): got %d, want %d", got, want)
+	}
+}
+
+func TestTunnelObserverStopsAfterEviction(t *testing.T) {
+	logger := NewLogger()
+	logger.SetOption(MaxEntries(1))
+	to := newWebSocketObserver(t, logger)
+
+	frame := wsFrame(true, false, wsText, nil, []byte("ping?"))
+	to.TunnelData(false, frame)
+
+	// Logging another round trip evicts the entry of the tunnel.
+	newWebSocketObserver(t, logger)
+
+	to.TunnelData(false, frame)
+	to.TunnelData(false, frame[:3])
+	if got, want := len(to.e.WebSocketMessages), 1; got != want {
+		t.Errorf("len(WebSocketMessages): got %d, want %d", got, want)
+	}
+	if got := len(to.receive.hdr); got != 0 {
+		t.Errorf("len(to.receive.hdr): got %d, want 0 after eviction", got)
+	}
+}
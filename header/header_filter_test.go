@@ -20,6 +20,7 @@ import (
 
 	"github.com/google/martian/v3/filter"
 	"github.com/google/martian/v3/martiantest"
+	_ "github.com/google/martian/v3/method"
 	"github.com/google/martian/v3/parse"
 	"github.com/google/martian/v3/proxyutil"
 )
@@ -134,6 +135,61 @@ func TestFilterFromJSONWithoutElse(t *testing.T) {
 	}
 }
 
+func TestFilterAsConditionFromJSON(t *testing.T) {
+	msg := []byte(`{
+		"filter.All": {
+			"scope": ["request"],
+			"conditions": [
+				{ "header.Filter": { "name": "Martian-Passthrough", "value": "true" } },
+				{ "header.RegexFilter": { "header": "Martian-Stage", "regex": "^(dev|qa)$" } },
+				{ "filter.Not": { "condition": { "method.Filter": { "method": "GET" } } } }
+			],
+			"modifier": {
+				"header.Modifier": {
+					"scope": ["request"],
+					"name": "Martian-Testing",
+					"value": "true"
+				}
+			}
+		}
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+	reqmod := r.RequestModifier()
+	if reqmod == nil {
+		t.Fatal("reqmod: got nil, want not nil")
+	}
+
+	tt := []struct {
+		method string
+		stage  string
+		want   string
+	}{
+		{method: "POST", stage: "qa", want: "true"},
+		{method: "GET", stage: "qa", want: ""},
+		{method: "POST", stage: "prod", want: ""},
+	}
+
+	for i, tc := range tt {
+		req, err := http.NewRequest(tc.method, "http://example.com", nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		req.Header.Set("Martian-Passthrough", "true")
+		req.Header.Set("Martian-Stage", tc.stage)
+
+		if err := reqmod.ModifyRequest(req); err != nil {
+			t.Fatalf("%d. ModifyRequest(): got %v, want no error", i, err)
+		}
+		if got, want := req.Header.Get("Martian-Testing"), tc.want; got != want {
+			t.Errorf("%d. req.Header.Get(%q): got %q, want %q", i, "Martian-Testing", got, want)
+		}
+	}
+}
+
 func TestRequestWhenTrueCondition(t *testing.T) {
 	hm := NewMatcher("Martian-Testing", "true")
 
@@ -65,28 +65,25 @@ func headerValueRegexFilterFromJSON(b []byte) (*parse.Result, error) {
 	}
 	filter := NewValueRegexFilter(cr, msg.HeaderName)
 
-	r, err := parse.FromJSON(msg.Modifier)
-	if err != nil {
-		return nil, err
-	}
+	if len(msg.Modifier) > 0 {
+		r, err := parse.FromJSON(msg.Modifier)
+		if err != nil {
+			return nil, err
+		}
 
-	reqmod := r.RequestModifier()
-	filter.SetRequestModifier(reqmod)
+		reqmod := r.RequestModifier()
+		filter.SetRequestModifier(reqmod)
 
-	resmod := r.ResponseModifier()
-	filter.SetResponseModifier(resmod)
+		resmod := r.ResponseModifier()
+		filter.SetResponseModifier(resmod)
+	}
 
 	return parse.NewResult(filter, msg.Scope)
 }
 
 // ModifyRequest runs reqmod iff the value of header matches regex.
 func (f *ValueRegexFilter) ModifyRequest(req *http.Request) error {
-	hvalue := req.Header.Get(f.header)
-	if hvalue == "" {
-		return nil
-	}
-
-	if f.regex.MatchString(hvalue) {
+	if f.MatchRequest(req) {
 		return f.reqmod.ModifyRequest(req)
 	}
 
@@ -95,18 +92,29 @@ func (f *ValueRegexFilter) ModifyRequest(req *http.Request) error {
 
 // ModifyResponse runs resmod iff the value of request header matches regex.
 func (f *ValueRegexFilter) ModifyResponse(res *http.Response) error {
-	hvalue := res.Request.Header.Get(f.header)
-	if hvalue == "" {
-		return nil
-	}
-
-	if f.regex.MatchString(hvalue) {
+	if f.MatchResponse(res) {
 		return f.resmod.ModifyResponse(res)
 	}
 
 	return nil
 }
 
+// MatchRequest returns true if the value of header matches regex, so that the
+// filter can be used as a condition.
+func (f *ValueRegexFilter) MatchRequest(req *http.Request) bool {
+	hvalue := req.Header.Get(f.header)
+	if hvalue == "" {
+		return false
+	}
+
+	return f.regex.MatchString(hvalue)
+}
+
+// MatchResponse returns true if the value of request header matches regex.
+func (f *ValueRegexFilter) MatchResponse(res *http.Response) bool {
+	return f.MatchRequest(res.Request)
+}
+
 // SetRequestModifier sets the request modifier of HeaderValueRegexFilter.
 func (f *ValueRegexFilter) SetRequestModifier(reqmod martian.RequestModifier) {
 	if reqmod == nil {
@@ -75,6 +75,8 @@ func (h *Handler) streamLogs(conn *websocket.Conn) {
 		return
 	}
 	framec := make(chan []byte, 16384)
+	// Subscribers may join mid-stream, so each starts with its own version frame.
+	framec <- versionFrame()
 
 	h.subscribe(id, framec)
 	defer h.unsubscribe(id)
@@ -15,6 +15,7 @@
 package marbl
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"net"
@@ -50,6 +51,15 @@ func TestStreamsInSentOrder(t *testing.T) {
 	// no easy way to synchronize so we just wait a bit
 	time.Sleep(300 * time.Millisecond)
 
+	// Subscribers receive a version frame first.
+	var vf []byte
+	if err := websocket.Message.Receive(ws, &vf); err != nil {
+		t.Fatalf("websocket.Conn.Read(): got %v, want no error", err)
+	}
+	if got, want := vf, versionFrame(); !bytes.Equal(got, want) {
+		t.Fatalf("version frame: got %v, want %v", got, want)
+	}
+
 	var iterations int64 = 5000
 	go func() {
 		for i := int64(0); i < iterations; i++ {
@@ -21,7 +21,8 @@
 // FrameType   uint8
 // MessageType uint8
 // ID		   [8]byte
-// Payload	   HeaderFrame/DataFrame
+// Timestamp   int64 (since version 2)
+// Payload	   HeaderFrame/DataFrame/EndFrame
 //
 // Header   Frame
 // NameLen  uint32
@@ -34,18 +35,58 @@
 // Terminal uint8
 // Len      uint32
 // Data     variable
+//
+// End Frame (since version 2)
+// Duration int64
+// ErrorLen uint32
+// Error    variable
+//
+// Streams start with a version frame, which is a frame header with the
+// VersionFrame type, the version in place of the message type, a zero ID and
+// no timestamp. Streams without a version frame are version 1. The timestamp
+// is in nanoseconds since the Unix epoch.
+//
+// Besides the HTTP headers, header frames carry the following pseudo headers:
+//
+// Request
+// :method, :scheme, :authority, :path, :query, :proto
+// :remote       address of the client
+// :timestamp    milliseconds since the Unix epoch
+// :api          "true" for requests to the proxy API
+// :session      ID of the client connection (since version 2)
+// :mitm         "true" if the proxy terminated TLS (since version 2)
+// :tls-version TLS version of the client connection (since version 2)
+// :tls-cipher   TLS cipher suite of the client connection (since version 2)
+// :tls-sni      server name requested by the client (since version 2)
+//
+// Response
+// :proto, :status, :reason, :timestamp, :api
+// :server       address of the server (since version 2)
+// :tls-version TLS version of the server connection (since version 2)
+// :tls-cipher   TLS cipher suite of the server connection (since version 2)
+//
+// The end frame of a response follows its body, or its headers for
+// 101 Switching Protocols responses. Its duration is measured from when the
+// request was logged, and its error is empty if the body was read completely.
 package marbl
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/martian/v3"
 	"github.com/google/martian/v3/log"
 	"github.com/google/martian/v3/proxyutil"
+	"github.com/google/martian/v3/redact"
 )
 
 // MessageType incicates whether the message represents an HTTP request or response.
@@ -70,13 +111,34 @@ const (
 	HeaderFrame FrameType = 0x1
 	// DataFrame indicates a frame that contains the payload, usually the body.
 	DataFrame FrameType = 0x2
+	// EndFrame indicates a frame that ends a message.
+	EndFrame FrameType = 0x3
+	// VersionFrame indicates a frame that sets the version of the frames that
+	// follow it.
+	VersionFrame FrameType = 0x4
 )
 
+// Version is the version of the frames written by Stream.
+const Version = 2
+
+// startKey is the context key of the time a request was logged.
+const startKey = "marbl.Start"
+
+// errBodyClosed is the error state of a message whose body was closed before
+// it was read completely.
+var errBodyClosed = errors.New("body closed before EOF")
+
 // Stream writes logs of requests and responses to a writer.
 type Stream struct {
 	w      io.Writer
 	framec chan []byte
-	closec chan struct{}
+	donec  chan struct{}
+	redact *redact.Policy
+
+	// mu is held for reading while a frame is sent, so that Close waits for
+	// the frames being sent.
+	mu     sync.RWMutex
+	closed bool
 }
 
 // NewStream initializes a Stream with an io.Writer to log requests and
@@ -86,41 +148,92 @@ func NewStream(w io.Writer) *Stream {
 	s := &Stream{
 		w:      w,
 		framec: make(chan []byte),
-		closec: make(chan struct{}),
+		donec:  make(chan struct{}),
 	}
 
 	go s.loop()
 
+	s.framec <- versionFrame()
+
 	return s
 }
 
+// SetRedactPolicy sets the redaction policy applied to logged messages.
+// Without a policy, the policy attached to the request context by a
+// redact.Policy modifier is applied, if any.
+//
+// If the policy has body rules, unencoded bodies are buffered and sent in a
+// single data frame once they have been read completely.
+func (s *Stream) SetRedactPolicy(p *redact.Policy) {
+	s.redact = p
+}
+
+func (s *Stream) policy(req *http.Request) *redact.Policy {
+	if s.redact != nil || req == nil {
+		return s.redact
+	}
+	return redact.FromContext(martian.NewContext(req))
+}
+
 func (s *Stream) loop() {
-	for {
-		select {
-		case f := <-s.framec:
-			_, err := s.w.Write(f)
-			if err != nil {
-				log.Errorf("martian: Error while writing frame")
-			}
-		case <-s.closec:
-			return
+	defer close(s.donec)
+
+	for f := range s.framec {
+		_, err := s.w.Write(f)
+		if err != nil {
+			log.Errorf("martian: Error while writing frame")
 		}
 	}
 }
 
-// Close signals Stream to stop listening for frames in the log loop and stop writing logs.
+// send queues f to be written by the log loop. Frames sent after the stream
+// is closed are dropped.
+func (s *Stream) send(f []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+	s.framec <- f
+}
+
+// Close stops the stream once the frames being logged have been written, so
+// that the writer can be closed when Close returns. Frames logged afterwards,
+// such as those of bodies read later, are dropped.
 func (s *Stream) Close() error {
-	s.closec <- struct{}{}
-	close(s.closec)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.framec)
+	s.mu.Unlock()
+
+	<-s.donec
 
 	return nil
 }
 
 func newFrame(id string, ft FrameType, mt MessageType, plen uint32) []byte {
-	f := make([]byte, 0, 10+plen)
+	f := make([]byte, 0, 18+plen)
 	f = append(f, byte(ft), byte(mt))
 	f = append(f, id[:8]...)
 
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()))
+	f = append(f, ts[:]...)
+
+	return f
+}
+
+// versionFrame returns the frame that starts a stream.
+func versionFrame() []byte {
+	f := make([]byte, 10)
+	f[0] = byte(VersionFrame)
+	f[1] = Version
+
 	return f
 }
 
@@ -134,7 +247,7 @@ func (s *Stream) sendHeader(id string, mt MessageType, key, value string) {
 	f = append(f, key[:kl]...)
 	f = append(f, value[:vl]...)
 
-	s.framec <- f
+	s.send(f)
 }
 
 func (s *Stream) sendData(id string, mt MessageType, i uint32, terminal bool, b []byte, bl int) {
@@ -149,16 +262,33 @@ func (s *Stream) sendData(id string, mt MessageType, i uint32, terminal bool, b
 	f = append(f, byte(bl>>24), byte(bl>>16), byte(bl>>8), byte(bl))
 	f = append(f, b[:bl]...)
 
-	s.framec <- f
+	s.send(f)
+}
+
+func (s *Stream) sendEnd(id string, mt MessageType, d time.Duration, err error) {
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+	ml := uint32(len(msg))
+
+	f := newFrame(id, EndFrame, mt, 12+ml)
+	f = append(f, byte(d>>56), byte(d>>48), byte(d>>40), byte(d>>32), byte(d>>24), byte(d>>16), byte(d>>8), byte(d))
+	f = append(f, byte(ml>>24), byte(ml>>16), byte(ml>>8), byte(ml))
+	f = append(f, msg...)
+
+	s.send(f)
 }
 
 // LogRequest writes an http.Request to Stream with an id unique for the request / response pair.
 func (s *Stream) LogRequest(id string, req *http.Request) error {
+	p := s.policy(req)
+
 	s.sendHeader(id, Request, ":method", req.Method)
 	s.sendHeader(id, Request, ":scheme", req.URL.Scheme)
 	s.sendHeader(id, Request, ":authority", req.URL.Host)
 	s.sendHeader(id, Request, ":path", req.URL.EscapedPath())
-	s.sendHeader(id, Request, ":query", req.URL.RawQuery)
+	s.sendHeader(id, Request, ":query", p.Query(req.URL.RawQuery))
 	s.sendHeader(id, Request, ":proto", req.Proto)
 	s.sendHeader(id, Request, ":remote", req.RemoteAddr)
 	ts := strconv.FormatInt(time.Now().UnixNano()/1000/1000, 10)
@@ -168,20 +298,35 @@ func (s *Stream) LogRequest(id string, req *http.Request) error {
 	if ctx.IsAPIRequest() {
 		s.sendHeader(id, Request, ":api", "true")
 	}
+	if _, ok := ctx.Get(startKey); !ok {
+		ctx.Set(startKey, time.Now())
+	}
+
+	s.sendHeader(id, Request, ":session", ctx.Session().ID())
+	if ctx.Session().IsSecure() {
+		s.sendHeader(id, Request, ":mitm", "true")
+	}
+	if req.TLS != nil {
+		s.sendTLS(id, Request, req.TLS)
+		if req.TLS.ServerName != "" {
+			s.sendHeader(id, Request, ":tls-sni", req.TLS.ServerName)
+		}
+	}
 
 	h := proxyutil.RequestHeader(req)
 
 	for k, vs := range h.Map() {
 		for _, v := range vs {
-			s.sendHeader(id, Request, k, v)
+			s.sendHeader(id, Request, k, p.Header(k, v))
 		}
 	}
 
 	req.Body = &bodyLogger{
-		s:    s,
-		id:   id,
-		mt:   Request,
-		body: req.Body,
+		s:      s,
+		id:     id,
+		mt:     Request,
+		body:   req.Body,
+		redact: bodyRedactor(p, req.Header),
 	}
 
 	return nil
@@ -189,6 +334,8 @@ func (s *Stream) LogRequest(id string, req *http.Request) error {
 
 // LogResponse writes an http.Response to Stream with an id unique for the request / response pair.
 func (s *Stream) LogResponse(id string, res *http.Response) error {
+	p := s.policy(res.Request)
+
 	s.sendHeader(id, Response, ":proto", res.Proto)
 	s.sendHeader(id, Response, ":status", strconv.Itoa(res.StatusCode))
 	s.sendHeader(id, Response, ":reason", res.Status)
@@ -200,30 +347,100 @@ func (s *Stream) LogResponse(id string, res *http.Response) error {
 		s.sendHeader(id, Response, ":api", "true")
 	}
 
+	if addr := ctx.RoundTripTrace().RemoteAddr; addr != nil {
+		s.sendHeader(id, Response, ":server", addr.String())
+	}
+	if res.TLS != nil {
+		s.sendTLS(id, Response, res.TLS)
+	}
+
 	h := proxyutil.ResponseHeader(res)
 
 	for k, vs := range h.Map() {
 		for _, v := range vs {
-			s.sendHeader(id, Response, k, v)
+			s.sendHeader(id, Response, k, p.Header(k, v))
 		}
 	}
 
+	start := time.Now()
+	if v, ok := ctx.Get(startKey); ok {
+		start = v.(time.Time)
+	}
+
+	// The body of a 101 Switching Protocols response is the upgraded
+	// connection, which is relayed as is.
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		s.sendEnd(id, Response, time.Since(start), nil)
+		return nil
+	}
+
 	res.Body = &bodyLogger{
-		s:    s,
-		id:   id,
-		mt:   Response,
-		body: res.Body,
+		s:      s,
+		id:     id,
+		mt:     Response,
+		body:   res.Body,
+		redact: bodyRedactor(p, res.Header),
+		start:  start,
 	}
 
 	return nil
 }
 
+// sendTLS sends the version and cipher suite of the connection in cs.
+func (s *Stream) sendTLS(id string, mt MessageType, cs *tls.ConnectionState) {
+	s.sendHeader(id, mt, ":tls-version", tlsVersion(cs.Version))
+	s.sendHeader(id, mt, ":tls-cipher", tls.CipherSuiteName(cs.CipherSuite))
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// maxRedactBuffer is the number of bytes of a body buffered to be redacted as
+// a whole. The redaction rules of larger bodies are applied to each part of
+// maxRedactBuffer bytes, so JSON paths do not apply to them and patterns only
+// match within a part.
+const maxRedactBuffer = 1 << 20
+
+// bodyRedactor returns a function that applies p to a body with header h, or
+// nil if the body is logged as is.
+func bodyRedactor(p *redact.Policy, h http.Header) func([]byte) []byte {
+	if !p.HasBodyRules() || h.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	ct := h.Get("Content-Type")
+	return func(b []byte) []byte {
+		return p.Body(ct, b)
+	}
+}
+
 type bodyLogger struct {
 	index uint32 // atomic
 	s     *Stream
 	id    string
 	mt    MessageType
 	body  io.ReadCloser
+	// redact, if set, is applied to the buffered body before it is sent.
+	redact func([]byte) []byte
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	sent   bool
+	// start is when the request was logged. If set, an end frame is sent once
+	// the body has been read or closed.
+	start   time.Time
+	endOnce sync.Once
 }
 
 // Read implements the standard Reader interface. Read reads the bytes of the body
@@ -232,16 +449,71 @@ func (bl *bodyLogger) Read(b []byte) (int, error) {
 	var terminal bool
 
 	n, err := bl.body.Read(b)
-	if err == io.EOF {
-		terminal = true
+	if bl.redact != nil {
+		bl.mu.Lock()
+		bl.buf.Write(b[:n])
+		switch {
+		case err != nil:
+			bl.flush(true)
+		case bl.buf.Len() > maxRedactBuffer:
+			// The body is too large to be redacted as a whole, so the rules are
+			// applied to each part of it instead.
+			bl.flush(false)
+		}
+		bl.mu.Unlock()
+	} else {
+		if err == io.EOF {
+			terminal = true
+		}
+
+		bl.s.sendData(bl.id, bl.mt, atomic.AddUint32(&bl.index, 1)-1, terminal, b, n)
 	}
 
-	bl.s.sendData(bl.id, bl.mt, atomic.AddUint32(&bl.index, 1)-1, terminal, b, n)
+	switch err {
+	case nil:
+	case io.EOF:
+		bl.end(nil)
+	default:
+		bl.end(err)
+	}
 
 	return n, err
 }
 
-// Close closes the bodyLogger.
+// flush sends the redacted buffered body as a data frame, unless the terminal
+// data frame has been sent already. bl.mu must be held.
+func (bl *bodyLogger) flush(terminal bool) {
+	if bl.sent {
+		return
+	}
+	bl.sent = terminal
+
+	data := bl.redact(bl.buf.Bytes())
+	bl.buf.Reset()
+
+	bl.s.sendData(bl.id, bl.mt, atomic.AddUint32(&bl.index, 1)-1, terminal, data, len(data))
+}
+
+// Close closes the bodyLogger. The part of a redacted body read so far is sent
+// if the body is closed before it has been read entirely.
 func (bl *bodyLogger) Close() error {
+	if bl.redact != nil {
+		bl.mu.Lock()
+		bl.flush(true)
+		bl.mu.Unlock()
+	}
+	bl.end(errBodyClosed)
+
 	return bl.body.Close()
 }
+
+// end sends the end frame of the message, unless it has been sent already.
+func (bl *bodyLogger) end(err error) {
+	if bl.start.IsZero() {
+		return
+	}
+
+	bl.endOnce.Do(func() {
+		bl.s.sendEnd(bl.id, bl.mt, time.Since(bl.start), err)
+	})
+}
@@ -16,15 +16,21 @@ package marbl
 
 import (
 	"bytes"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/martian/v3"
 	"github.com/google/martian/v3/proxyutil"
+	"github.com/google/martian/v3/redact"
 )
 
 func TestMarkAPIRequestsWithHeader(t *testing.T) {
@@ -403,3 +409,366 @@ func readAllDataFrames(reader *Reader, id string, t *testing.T) []byte {
 	
 	return res
 }
+
+func TestRedactPolicy(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://example.com/?token=abc&q=1", strings.NewReader(`{"password":"hunter2"}`))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("Content-Type", "application/json")
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	p := redact.NewPolicy()
+	p.RedactHeaders("Authorization")
+	p.RedactQueryParams("token")
+	p.RedactJSONPaths("password")
+
+	var b bytes.Buffer
+	s := NewStream(&b)
+	s.SetRedactPolicy(p)
+	s.LogRequest("Fake_Id0", req)
+
+	got, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := `{"password":"hunter2"}`; string(got) != want {
+		t.Errorf("req.Body: got %q, want %q", got, want)
+	}
+	s.Close()
+
+	headers := make(map[string]string)
+	var data []byte
+	reader := NewReader(&b)
+	for {
+		frame, err := reader.ReadFrame()
+		if frame == nil {
+			break
+		}
+		if err != nil && err != io.EOF {
+			t.Fatalf("reader.ReadFrame(): got %v, want no error or io.EOF", err)
+		}
+
+		switch f := frame.(type) {
+		case Header:
+			headers[f.Name] = f.Value
+		case Data:
+			data = append(data, f.Data...)
+		}
+	}
+
+	if got, want := headers["Authorization"], "[REDACTED]"; got != want {
+		t.Errorf("headers[Authorization]: got %q, want %q", got, want)
+	}
+	if got, want := headers[":query"], "token=%5BREDACTED%5D&q=1"; got != want {
+		t.Errorf("headers[:query]: got %q, want %q", got, want)
+	}
+	if got, want := string(data), `{"password":"[REDACTED]"}`; got != want {
+		t.Errorf("data: got %q, want %q", got, want)
+	}
+}
+
+// redactedData logs a request with body through a stream redacting pattern,
+// calls read with the body and returns the data frames that were written.
+func redactedData(t *testing.T, body string, pattern string, read func(io.ReadCloser)) []Data {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	p := redact.NewPolicy()
+	p.RedactPattern(regexp.MustCompile(pattern))
+
+	var b bytes.Buffer
+	s := NewStream(&b)
+	s.SetRedactPolicy(p)
+	s.LogRequest("Fake_Id0", req)
+
+	read(req.Body)
+	s.Close()
+
+	var ds []Data
+	reader := NewReader(&b)
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reader.ReadFrame(): got %v, want no error or io.EOF", err)
+		}
+		if d, ok := frame.(Data); ok {
+			ds = append(ds, d)
+		}
+	}
+
+	return ds
+}
+
+func TestRedactPolicyLargeBody(t *testing.T) {
+	part := strings.Repeat("x", 1000) + "secret"
+	body := strings.Repeat(part, 3*maxRedactBuffer/len(part))
+
+	ds := redactedData(t, body, "secret", func(rc io.ReadCloser) {
+		ioutil.ReadAll(rc)
+	})
+
+	if len(ds) < 3 {
+		t.Fatalf("len(data frames): got %d, want at least 3 for a body 3 times the buffer", len(ds))
+	}
+
+	var data []byte
+	for i, d := range ds {
+		if d.Index != uint32(i) {
+			t.Errorf("ds[%d].Index: got %d, want %d", i, d.Index, i)
+		}
+		if got, want := d.Terminal, i == len(ds)-1; got != want {
+			t.Errorf("ds[%d].Terminal: got %t, want %t", i, got, want)
+		}
+		if len(d.Data) > 2*maxRedactBuffer {
+			t.Errorf("len(ds[%d].Data): got %d, want no more than the buffer and a read", i, len(d.Data))
+		}
+		data = append(data, d.Data...)
+	}
+
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("data: got unredacted secret, want all occurrences redacted")
+	}
+}
+
+func TestRedactPolicyFlushesOnClose(t *testing.T) {
+	ds := redactedData(t, "secret=1&secret=2", "secret", func(rc io.ReadCloser) {
+		b := make([]byte, 8)
+		io.ReadFull(rc, b)
+		rc.Close()
+	})
+
+	if got, want := len(ds), 1; got != want {
+		t.Fatalf("len(data frames): got %d, want %d", got, want)
+	}
+	if !ds[0].Terminal {
+		t.Error("ds[0].Terminal: got false, want true")
+	}
+	if got, want := string(ds[0].Data), "[REDACTED]=1"; got != want {
+		t.Errorf("ds[0].Data: got %q, want %q", got, want)
+	}
+}
+
+func TestStreamVersion2Frames(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.TLS = &tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+		ServerName:  "example.com",
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+	ctx.Session().MarkSecure()
+
+	var b bytes.Buffer
+	s := NewStream(&b)
+
+	before := time.Now()
+	s.LogRequest("Fake_Id0", req)
+
+	ok := proxyutil.NewResponse(200, strings.NewReader("body"), req)
+	s.LogResponse("Fake_Id0", ok)
+	ioutil.ReadAll(ok.Body)
+
+	aborted := proxyutil.NewResponse(200, strings.NewReader("body"), req)
+	s.LogResponse("Fake_Id1", aborted)
+	aborted.Body.Close()
+	s.Close()
+
+	headers := make(map[string]string)
+	var ends []End
+
+	reader := NewReader(&b)
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reader.ReadFrame(): got %v, want no error or io.EOF", err)
+		}
+
+		switch f := frame.(type) {
+		case Header:
+			if f.Time.Before(before) {
+				t.Errorf("%s: got time %v, want after %v", f.Name, f.Time, before)
+			}
+			headers[f.Name] = f.Value
+		case End:
+			ends = append(ends, f)
+		}
+	}
+
+	if got, want := reader.Version(), Version; got != want {
+		t.Errorf("reader.Version(): got %d, want %d", got, want)
+	}
+
+	for k, want := range map[string]string{
+		":session":     ctx.Session().ID(),
+		":mitm":        "true",
+		":tls-version": "TLS 1.3",
+		":tls-cipher":  "TLS_AES_128_GCM_SHA256",
+		":tls-sni":     "example.com",
+	} {
+		if got := headers[k]; got != want {
+			t.Errorf("headers[%q]: got %q, want %q", k, got, want)
+		}
+	}
+
+	if got, want := len(ends), 2; got != want {
+		t.Fatalf("len(ends): got %d, want %d", got, want)
+	}
+	if ends[0].ID != "Fake_Id0" || ends[0].MessageType != Response || ends[0].Error != "" {
+		t.Errorf("ends[0]: got %v, want response ended without error", ends[0])
+	}
+	if ends[0].Duration <= 0 || ends[0].Duration > time.Since(before) {
+		t.Errorf("ends[0].Duration: got %v, want between 0 and %v", ends[0].Duration, time.Since(before))
+	}
+	if got, want := ends[1].Error, errBodyClosed.Error(); got != want {
+		t.Errorf("ends[1].Error: got %q, want %q", got, want)
+	}
+}
+
+func TestReaderVersion1(t *testing.T) {
+	// A header frame and a terminal data frame without timestamps.
+	var b bytes.Buffer
+	b.Write([]byte{byte(HeaderFrame), byte(Request)})
+	b.WriteString("00000001")
+	b.Write([]byte{0, 0, 0, 7, 0, 0, 0, 3})
+	b.WriteString(":methodGET")
+	b.Write([]byte{byte(DataFrame), byte(Request)})
+	b.WriteString("00000001")
+	b.Write([]byte{0, 0, 0, 0, 1, 0, 0, 0, 2})
+	b.WriteString("hi")
+
+	reader := NewReader(&b)
+
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatalf("reader.ReadFrame(): got %v, want no error", err)
+	}
+	hf, ok := frame.(Header)
+	if !ok {
+		t.Fatalf("frame.(Header): got %T, want Header", frame)
+	}
+	if hf.Name != ":method" || hf.Value != "GET" || !hf.Time.IsZero() {
+		t.Errorf("hf: got %v, want :method GET without time", hf)
+	}
+
+	frame, err = reader.ReadFrame()
+	if err != nil {
+		t.Fatalf("reader.ReadFrame(): got %v, want no error", err)
+	}
+	df, ok := frame.(Data)
+	if !ok {
+		t.Fatalf("frame.(Data): got %T, want Data", frame)
+	}
+	if string(df.Data) != "hi" || !df.Terminal {
+		t.Errorf("df: got %v, want terminal data %q", df, "hi")
+	}
+
+	if got, want := reader.Version(), 1; got != want {
+		t.Errorf("reader.Version(): got %d, want %d", got, want)
+	}
+}
+
+func TestCloseWritesLoggedFrames(t *testing.T) {
+	var b bytes.Buffer
+	s := NewStream(&b)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req, err := http.NewRequest("GET", "http://example.com", nil)
+			if err != nil {
+				t.Errorf("http.NewRequest(): got %v, want no error", err)
+				return
+			}
+			_, remove, err := martian.TestContext(req, nil, nil)
+			if err != nil {
+				t.Errorf("TestContext(): got %v, want no error", err)
+				return
+			}
+			defer remove()
+
+			s.LogRequest(fmt.Sprintf("Fake_Id%02d", i), req)
+		}(i)
+	}
+	wg.Wait()
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close(): got %v, want no error", err)
+	}
+
+	methods := 0
+	reader := NewReader(&b)
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reader.ReadFrame(): got %v, want no error or io.EOF", err)
+		}
+		if h, ok := frame.(Header); ok && h.Name == ":method" {
+			methods++
+		}
+	}
+	if got, want := methods, n; got != want {
+		t.Errorf("methods: got %d, want %d", got, want)
+	}
+
+	// Frames logged after Close are dropped instead of blocking.
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	res := proxyutil.NewResponse(200, strings.NewReader("body"), req)
+	done := make(chan struct{})
+	go func() {
+		s.LogResponse("Fake_Id99", res)
+		ioutil.ReadAll(res.Body)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LogResponse(): got blocked after Close, want frames dropped")
+	}
+}
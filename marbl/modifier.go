@@ -19,6 +19,7 @@ import (
 	"net/http"
 
 	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/redact"
 )
 
 // Modifier implements the Martian modifier interface so that marbl logs
@@ -34,6 +35,11 @@ func NewModifier(w io.Writer) *Modifier {
 	}
 }
 
+// SetRedactPolicy sets the redaction policy applied to logged messages.
+func (m *Modifier) SetRedactPolicy(p *redact.Policy) {
+	m.s.SetRedactPolicy(p)
+}
+
 // ModifyRequest writes an HTTP request to the log stream.
 func (m *Modifier) ModifyRequest(req *http.Request) error {
 	ctx := martian.NewContext(req)
@@ -45,3 +51,9 @@ func (m *Modifier) ModifyResponse(res *http.Response) error {
 	ctx := martian.NewContext(res.Request)
 	return m.s.LogResponse(ctx.ID(), res)
 }
+
+// Close stops the stream once the frames being logged have been written.
+// Frames logged afterwards are dropped.
+func (m *Modifier) Close() error {
+	return m.s.Close()
+}
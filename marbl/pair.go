@@ -0,0 +1,309 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marbl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a request or response reassembled from the frames that share its
+// ID and message type.
+type Message struct {
+	// Meta holds the pseudo headers, such as ":method" or ":status".
+	Meta map[string]string
+	// Header holds the HTTP headers.
+	Header http.Header
+	// Body is the body concatenated from the data frames, as it was read by the
+	// proxy.
+	Body []byte
+	// Complete is true once the terminal data frame has been read.
+	Complete bool
+	// Ended is true once the end frame has been read, which is only written
+	// for responses since version 2.
+	Ended bool
+	// Duration is the time from when the request was logged until the message
+	// ended.
+	Duration time.Duration
+	// Error describes why the body was not read completely, or is empty.
+	Error string
+
+	start time.Time
+}
+
+// Time returns when the message was logged, or the zero time if it is not
+// known.
+func (m *Message) Time() time.Time {
+	if !m.start.IsZero() {
+		return m.start
+	}
+
+	ms, err := strconv.ParseInt(m.Meta[":timestamp"], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Pair is a request and its response.
+type Pair struct {
+	// ID is the ID shared by the frames of the request and response.
+	ID string
+	// Request is the request, or nil if none of its frames were read.
+	Request *Message
+	// Response is the response, or nil if none of its frames were read.
+	Response *Message
+
+	seq int
+}
+
+// HTTPRequest returns the request as an *http.Request.
+func (p *Pair) HTTPRequest() (*http.Request, error) {
+	m := p.Request
+	if m == nil {
+		return nil, fmt.Errorf("marbl: pair %s has no request", p.ID)
+	}
+
+	u := &url.URL{
+		Scheme:   m.Meta[":scheme"],
+		Host:     m.Meta[":authority"],
+		RawQuery: m.Meta[":query"],
+	}
+	path, err := url.PathUnescape(m.Meta[":path"])
+	if err != nil {
+		return nil, fmt.Errorf("marbl: invalid path %q: %v", m.Meta[":path"], err)
+	}
+	u.Path = path
+	u.RawPath = m.Meta[":path"]
+
+	req, err := http.NewRequest(m.Meta[":method"], u.String(), bytes.NewReader(m.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = m.Meta[":remote"]
+	setProto(m.Meta[":proto"], &req.Proto, &req.ProtoMajor, &req.ProtoMinor)
+
+	req.Header = header(m.Header)
+	if host := m.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	req.Header.Del("Host")
+	req.ContentLength = int64(len(m.Body))
+	if len(m.Body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	return req, nil
+}
+
+// HTTPResponse returns the response as an *http.Response. Its Request is set
+// to the request of the pair, if any.
+func (p *Pair) HTTPResponse() (*http.Response, error) {
+	m := p.Response
+	if m == nil {
+		return nil, fmt.Errorf("marbl: pair %s has no response", p.ID)
+	}
+
+	code, err := strconv.Atoi(m.Meta[":status"])
+	if err != nil {
+		return nil, fmt.Errorf("marbl: invalid status %q: %v", m.Meta[":status"], err)
+	}
+
+	res := &http.Response{
+		StatusCode:    code,
+		Status:        m.Meta[":reason"],
+		Header:        header(m.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(m.Body)),
+		ContentLength: int64(len(m.Body)),
+	}
+	setProto(m.Meta[":proto"], &res.Proto, &res.ProtoMajor, &res.ProtoMinor)
+
+	if p.Request != nil {
+		if res.Request, err = p.HTTPRequest(); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// header returns a copy of h without the Content-Length and Transfer-Encoding
+// headers, which are replaced by the length of the reassembled body.
+func header(h http.Header) http.Header {
+	ch := make(http.Header, len(h))
+	for k, vs := range h {
+		ch[k] = append([]string(nil), vs...)
+	}
+	ch.Del("Content-Length")
+	ch.Del("Transfer-Encoding")
+
+	return ch
+}
+
+func setProto(proto string, p *string, major, minor *int) {
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	if ma, mi, ok := http.ParseHTTPVersion(proto); ok {
+		*p, *major, *minor = proto, ma, mi
+	}
+}
+
+// PairReader reassembles request and response pairs from the frames read from
+// a Reader.
+type PairReader struct {
+	r       *Reader
+	pending map[string]*Pair
+	ready   []*Pair
+	seq     int
+	err     error
+}
+
+// NewPairReader returns a PairReader that reads frames from r.
+func NewPairReader(r io.Reader) *PairReader {
+	return &PairReader{
+		r:       NewReader(r),
+		pending: make(map[string]*Pair),
+	}
+}
+
+// ReadPair returns the next pair whose response has ended, or whose response
+// body has been read completely before version 2.
+// Once the frames have been read, the remaining incomplete pairs are returned
+// in the order they started, followed by io.EOF or the error that ended the
+// frames.
+func (pr *PairReader) ReadPair() (*Pair, error) {
+	for {
+		if len(pr.ready) > 0 {
+			p := pr.ready[0]
+			pr.ready = pr.ready[1:]
+			return p, nil
+		}
+
+		if pr.err != nil {
+			if len(pr.pending) == 0 {
+				return nil, pr.err
+			}
+
+			for _, p := range pr.pending {
+				pr.ready = append(pr.ready, p)
+			}
+			sort.Slice(pr.ready, func(i, j int) bool {
+				return pr.ready[i].seq < pr.ready[j].seq
+			})
+			pr.pending = make(map[string]*Pair)
+			continue
+		}
+
+		f, err := pr.r.ReadFrame()
+		if err != nil {
+			pr.err = err
+			continue
+		}
+		pr.add(f)
+	}
+}
+
+func (pr *PairReader) add(f Frame) {
+	switch f := f.(type) {
+	case Header:
+		m := pr.message(f.ID, f.MessageType, f.Time)
+		if m == nil {
+			return
+		}
+
+		if strings.HasPrefix(f.Name, ":") {
+			m.Meta[f.Name] = f.Value
+		} else {
+			m.Header.Add(f.Name, f.Value)
+		}
+	case Data:
+		m := pr.message(f.ID, f.MessageType, f.Time)
+		if m == nil {
+			return
+		}
+
+		m.Body = append(m.Body, f.Data...)
+		if !f.Terminal {
+			return
+		}
+		m.Complete = true
+
+		if f.MessageType == Response && pr.r.Version() < 2 {
+			pr.done(f.ID)
+		}
+	case End:
+		m := pr.message(f.ID, f.MessageType, f.Time)
+		if m == nil {
+			return
+		}
+
+		m.Ended = true
+		m.Duration = f.Duration
+		m.Error = f.Error
+
+		if f.MessageType == Response {
+			pr.done(f.ID)
+		}
+	}
+}
+
+// done moves the pending pair with id to the pairs that are ready.
+func (pr *PairReader) done(id string) {
+	pr.ready = append(pr.ready, pr.pending[id])
+	delete(pr.pending, id)
+}
+
+// message returns the message of type mt in the pending pair with id, starting
+// the pair or message at time t if needed. It returns nil for unknown message
+// types.
+func (pr *PairReader) message(id string, mt MessageType, t time.Time) *Message {
+	if mt != Request && mt != Response {
+		return nil
+	}
+
+	p, ok := pr.pending[id]
+	if !ok {
+		pr.seq++
+		p = &Pair{
+			ID:  id,
+			seq: pr.seq,
+		}
+		pr.pending[id] = p
+	}
+
+	mp := &p.Request
+	if mt == Response {
+		mp = &p.Response
+	}
+	if *mp == nil {
+		*mp = &Message{
+			Meta:   make(map[string]string),
+			Header: make(http.Header),
+			start:  t,
+		}
+	}
+
+	return *mp
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marbl
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// logRequest logs a request to url with body on s and returns it after its
+// body has been read.
+func logRequest(t *testing.T, s *Stream, id, method, url, body string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := s.LogRequest(id, req); err != nil {
+		t.Fatalf("LogRequest(): got %v, want no error", err)
+	}
+	if _, err := ioutil.ReadAll(req.Body); err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+
+	return req
+}
+
+// logResponse logs a response to req with body on s, reading its body if read
+// is true.
+func logResponse(t *testing.T, s *Stream, id string, req *http.Request, code int, body string, read bool) {
+	t.Helper()
+
+	res := proxyutil.NewResponse(code, strings.NewReader(body), req)
+	res.Header.Set("Content-Type", "text/plain")
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := s.LogResponse(id, res); err != nil {
+		t.Fatalf("LogResponse(): got %v, want no error", err)
+	}
+	if read {
+		if _, err := ioutil.ReadAll(res.Body); err != nil {
+			t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+		}
+	}
+}
+
+func TestPairReader(t *testing.T) {
+	var b bytes.Buffer
+	s := NewStream(&b)
+
+	// Interleave two pairs, completing the second first, and leave a third
+	// without its response body.
+	req1 := logRequest(t, s, "00000001", "POST", "http://example.com/a%2Fb?q=1", "request body")
+	req2 := logRequest(t, s, "00000002", "GET", "http://example.com/two", "")
+	logResponse(t, s, "00000002", req2, 404, "not found", true)
+	logResponse(t, s, "00000001", req1, 200, "response body", true)
+	req3 := logRequest(t, s, "00000003", "GET", "http://example.com/three", "")
+	logResponse(t, s, "00000003", req3, 200, "never read", false)
+	s.Close()
+
+	pr := NewPairReader(&b)
+
+	var ps []*Pair
+	for {
+		p, err := pr.ReadPair()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadPair(): got %v, want no error", err)
+		}
+		ps = append(ps, p)
+	}
+
+	if got, want := len(ps), 3; got != want {
+		t.Fatalf("len(ps): got %d, want %d", got, want)
+	}
+	for i, id := range []string{"00000002", "00000001", "00000003"} {
+		if got := ps[i].ID; got != id {
+			t.Errorf("ps[%d].ID: got %q, want %q", i, got, id)
+		}
+	}
+	if ps[2].Response.Complete || ps[2].Response.Ended {
+		t.Error("ps[2].Response: got complete, want incomplete")
+	}
+	if !ps[1].Response.Ended || ps[1].Response.Error != "" {
+		t.Errorf("ps[1].Response: got ended %t with error %q, want ended without error", ps[1].Response.Ended, ps[1].Response.Error)
+	}
+
+	p := ps[1]
+	if got, want := string(p.Request.Body), "request body"; got != want {
+		t.Errorf("p.Request.Body: got %q, want %q", got, want)
+	}
+	if p.Request.Time().IsZero() {
+		t.Error("p.Request.Time(): got zero time, want timestamp")
+	}
+
+	res, err := p.HTTPResponse()
+	if err != nil {
+		t.Fatalf("HTTPResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Content-Type"), "text/plain"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Content-Type", got, want)
+	}
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "response body"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	req := res.Request
+	if got, want := req.Method, "POST"; got != want {
+		t.Errorf("req.Method: got %q, want %q", got, want)
+	}
+	if got, want := req.URL.String(), "http://example.com/a%2Fb?q=1"; got != want {
+		t.Errorf("req.URL: got %q, want %q", got, want)
+	}
+	if got, want := req.Host, "example.com"; got != want {
+		t.Errorf("req.Host: got %q, want %q", got, want)
+	}
+	if got, want := req.ContentLength, int64(len("request body")); got != want {
+		t.Errorf("req.ContentLength: got %d, want %d", got, want)
+	}
+}
+
+func TestPairReaderTruncated(t *testing.T) {
+	var b bytes.Buffer
+	s := NewStream(&b)
+	logRequest(t, s, "00000001", "GET", "http://example.com/", "")
+	s.Close()
+
+	// Cut the last frame short.
+	pr := NewPairReader(bytes.NewReader(b.Bytes()[:b.Len()-1]))
+
+	p, err := pr.ReadPair()
+	if err != nil {
+		t.Fatalf("ReadPair(): got %v, want no error", err)
+	}
+	if got, want := p.ID, "00000001"; got != want {
+		t.Errorf("p.ID: got %q, want %q", got, want)
+	}
+	if p.Response != nil {
+		t.Errorf("p.Response: got %v, want nil", p.Response)
+	}
+	if _, err := p.HTTPResponse(); err == nil {
+		t.Error("HTTPResponse(): got no error, want error for missing response")
+	}
+
+	if _, err := pr.ReadPair(); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadPair(): got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -19,14 +19,17 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 )
 
 // Header is either an HTTP header or meta-data pertaining to the request or response.
 type Header struct {
 	ID          string
 	MessageType MessageType
-	Name        string
-	Value       string
+	// Time is when the frame was written, or the zero time before version 2.
+	Time  time.Time
+	Name  string
+	Value string
 }
 
 // String returns the contents of a Header frame in a format appropriate for debugging and runtime logging.
@@ -43,9 +46,11 @@ func (hf Header) FrameType() FrameType {
 type Data struct {
 	ID          string
 	MessageType MessageType
-	Index       uint32
-	Terminal    bool
-	Data        []byte
+	// Time is when the frame was written, or the zero time before version 2.
+	Time     time.Time
+	Index    uint32
+	Terminal bool
+	Data     []byte
 }
 
 // String returns the contents of a Data frame in a format appropriate for debugging and runtime logging. The
@@ -60,7 +65,29 @@ func (df Data) FrameType() FrameType {
 	return DataFrame
 }
 
-// Frame describes the interface for a frame (either Data or Header).
+// End ends a request or response. It follows the body of the message.
+type End struct {
+	ID          string
+	MessageType MessageType
+	Time        time.Time
+	// Duration is the time from when the request was logged until the message
+	// ended.
+	Duration time.Duration
+	// Error describes why the body was not read completely, or is empty.
+	Error string
+}
+
+// String returns the contents of an End frame in a format appropriate for debugging and runtime logging.
+func (ef End) String() string {
+	return fmt.Sprintf("ID=%s; Type=%d; Duration=%s; Error=%s", ef.ID, ef.MessageType, ef.Duration, ef.Error)
+}
+
+// FrameType returns EndFrame
+func (ef End) FrameType() FrameType {
+	return EndFrame
+}
+
+// Frame describes the interface for a frame (either Data, Header or End).
 type Frame interface {
 	String() string
 	FrameType() FrameType
@@ -68,17 +95,26 @@ type Frame interface {
 
 // Reader wraps a buffered Reader that reads from the io.Reader and emits Frames.
 type Reader struct {
-	r io.Reader
+	r       io.Reader
+	version int
 }
 
 // NewReader returns a Reader initialized with a buffered reader.
 func NewReader(r io.Reader) *Reader {
 	return &Reader{
-		r: bufio.NewReader(r),
+		r:       bufio.NewReader(r),
+		version: 1,
 	}
 }
 
-// ReadFrame reads from r, determines the FrameType, and returns either a Header or Data and an error.
+// Version returns the version of the frames being read, which is 1 until a
+// version frame has been read.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// ReadFrame reads from r, determines the FrameType, and returns either a Header, Data or End and an error.
+// Version frames are consumed and change the version of the frames that follow.
 func (r *Reader) ReadFrame() (Frame, error) {
 	fh := make([]byte, 10)
 
@@ -86,11 +122,30 @@ func (r *Reader) ReadFrame() (Frame, error) {
 		return nil, err
 	}
 
+	if FrameType(fh[0]) == VersionFrame {
+		if v := int(fh[1]); v < 1 || v > Version {
+			return nil, fmt.Errorf("marbl: unsupported version %d", v)
+		}
+		r.version = int(fh[1])
+
+		return r.ReadFrame()
+	}
+
+	var ts time.Time
+	if r.version >= 2 {
+		tb := make([]byte, 8)
+		if _, err := io.ReadFull(r.r, tb); err != nil {
+			return nil, err
+		}
+		ts = time.Unix(0, int64(binary.BigEndian.Uint64(tb)))
+	}
+
 	switch FrameType(fh[0]) {
 	case HeaderFrame:
 		hf := Header{
 			ID:          string(fh[2:]),
 			MessageType: MessageType(fh[1]),
+			Time:        ts,
 		}
 
 		lens := make([]byte, 8)
@@ -114,6 +169,7 @@ func (r *Reader) ReadFrame() (Frame, error) {
 		df := Data{
 			ID:          string(fh[2:]),
 			MessageType: MessageType(fh[1]),
+			Time:        ts,
 		}
 
 		// Reading 9 bytes:
@@ -139,7 +195,32 @@ func (r *Reader) ReadFrame() (Frame, error) {
 		df.Data = data
 
 		return df, nil
-	default:
-		return nil, fmt.Errorf("marbl: unknown type of frame")
+	case EndFrame:
+		if r.version < 2 {
+			break
+		}
+
+		ef := End{
+			ID:          string(fh[2:]),
+			MessageType: MessageType(fh[1]),
+			Time:        ts,
+		}
+
+		desc := make([]byte, 12)
+		if _, err := io.ReadFull(r.r, desc); err != nil {
+			return nil, err
+		}
+
+		ef.Duration = time.Duration(binary.BigEndian.Uint64(desc[:8]))
+
+		msg := make([]byte, int(binary.BigEndian.Uint32(desc[8:])))
+		if _, err := io.ReadFull(r.r, msg); err != nil {
+			return nil, err
+		}
+		ef.Error = string(msg)
+
+		return ef, nil
 	}
+
+	return nil, fmt.Errorf("marbl: unknown type of frame")
 }
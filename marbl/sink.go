@@ -0,0 +1,257 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marbl
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/log"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor wraps the files written by a FileSink in a compressing writer.
+// If the writer has a Flush() error method, it is flushed after every frame
+// so that the frames survive the process dying.
+type Compressor struct {
+	// Ext is appended to the names of compressed files, such as ".zst".
+	Ext string
+	// NewWriter returns a writer that compresses to w.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// Gzip compresses files with gzip.
+var Gzip = &Compressor{
+	Ext: ".gz",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+}
+
+// Zstd compresses files with zstd.
+var Zstd = &Compressor{
+	Ext: ".zst",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	},
+}
+
+// FileSink is an io.Writer for a Stream that writes frames to files in a
+// directory, rotating to a new file once the current one exceeds a size or age
+// limit. Every file starts with a version frame and holds whole frames, so
+// each can be read on its own.
+type FileSink struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	comp    *Compressor
+
+	mu     sync.Mutex
+	f      *os.File
+	cw     io.WriteCloser
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+	seq    int
+	closed bool
+}
+
+// NewFileSink returns a FileSink that writes .marbl files to dir, creating
+// the directory if it does not exist. By default files are written
+// uncompressed and rotated once they reach 100MB.
+func NewFileSink(dir string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileSink{
+		dir:     dir,
+		maxSize: 100 << 20,
+	}, nil
+}
+
+// SetCompressor sets the compressor of files created after the call. A nil
+// compressor writes uncompressed files.
+func (s *FileSink) SetCompressor(c *Compressor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.comp = c
+}
+
+// SetMaxSize sets the number of uncompressed bytes after which the current
+// file is rotated. A size of zero or less disables size based rotation.
+func (s *FileSink) SetMaxSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxSize = size
+}
+
+// SetMaxAge sets the duration after which the current file is rotated. A
+// duration of zero or less disables time based rotation.
+func (s *FileSink) SetMaxAge(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxAge = d
+}
+
+// Write appends a frame to the current file, rotating it first if it has
+// reached its size or age limit. Version frames are dropped, since every file
+// starts with its own.
+func (s *FileSink) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, fmt.Errorf("marbl: write to closed sink")
+	}
+	if len(b) > 0 && FrameType(b[0]) == VersionFrame {
+		return len(b), nil
+	}
+
+	if s.f != nil && s.shouldRotate() {
+		if err := s.closeFile(); err != nil {
+			return 0, err
+		}
+	}
+	if s.f == nil {
+		if err := s.openFile(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := s.write(b); err != nil {
+		return 0, err
+	}
+
+	return len(b), s.flush()
+}
+
+// Rotate closes the current file. The next frame is written to a new file.
+func (s *FileSink) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+
+	return s.closeFile()
+}
+
+// Close flushes and syncs the current file to disk and closes it. Subsequent
+// writes to the sink fail.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+
+	return s.closeFile()
+}
+
+func (s *FileSink) shouldRotate() bool {
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		return true
+	}
+	if s.maxAge > 0 && time.Since(s.opened) >= s.maxAge {
+		return true
+	}
+	return false
+}
+
+func (s *FileSink) openFile() error {
+	ext := ".marbl"
+	if s.comp != nil {
+		ext += s.comp.Ext
+	}
+
+	s.opened = time.Now()
+	s.seq++
+	name := fmt.Sprintf("martian-%s-%04d%s", s.opened.UTC().Format("20060102T150405"), s.seq, ext)
+
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	log.Infof("marbl: writing frames to %s", f.Name())
+
+	s.f = f
+	s.size = 0
+	if s.comp != nil {
+		cw, err := s.comp.NewWriter(f)
+		if err != nil {
+			f.Close()
+			s.f = nil
+			return err
+		}
+		s.cw = cw
+		s.w = bufio.NewWriter(cw)
+	} else {
+		s.w = bufio.NewWriter(f)
+	}
+
+	return s.write(versionFrame())
+}
+
+func (s *FileSink) write(b []byte) error {
+	n, err := s.w.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+// flush pushes buffered data to the file so that it survives the process
+// dying. Compressed data is flushed if the compressor supports it.
+func (s *FileSink) flush() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if fw, ok := s.cw.(interface{ Flush() error }); ok {
+		return fw.Flush()
+	}
+	return nil
+}
+
+func (s *FileSink) closeFile() error {
+	f := s.f
+	s.f = nil
+
+	err := s.w.Flush()
+	if s.cw != nil {
+		if cerr := s.cw.Close(); err == nil {
+			err = cerr
+		}
+		s.cw = nil
+	}
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marbl
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// readFrames returns the frames in the .marbl file at path and the version
+// they were written with.
+func readFrames(t *testing.T, path string) ([]Frame, int) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("os.Open(): got %v, want no error", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip.NewReader(): got %v, want no error", err)
+		}
+		r = gr
+	}
+	if strings.HasSuffix(path, ".zst") {
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatalf("zstd.NewReader(): got %v, want no error", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	reader := NewReader(r)
+	var frames []Frame
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reader.ReadFrame(): got %v, want no error or io.EOF", err)
+		}
+		frames = append(frames, frame)
+	}
+
+	return frames, reader.Version()
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	dir := t.TempDir()
+
+	sink, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	// Rotate after every frame.
+	sink.SetMaxSize(1)
+
+	s := NewStream(sink)
+	s.sendHeader("00000001", Request, ":method", "GET")
+	s.sendHeader("00000001", Request, ":path", "/")
+	s.sendData("00000001", Request, 0, true, nil, 0)
+	s.Close()
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("sink.Close(): got %v, want no error", err)
+	}
+	if _, err := sink.Write([]byte{byte(HeaderFrame)}); err == nil {
+		t.Error("sink.Write(): got no error, want error for closed sink")
+	}
+
+	fs, err := filepath.Glob(filepath.Join(dir, "*.marbl"))
+	if err != nil {
+		t.Fatalf("filepath.Glob(): got %v, want no error", err)
+	}
+	if got, want := len(fs), 3; got != want {
+		t.Fatalf("len(files): got %d, want %d", got, want)
+	}
+
+	for _, path := range fs {
+		frames, v := readFrames(t, path)
+		if got, want := v, Version; got != want {
+			t.Errorf("%s: got version %d, want %d", path, got, want)
+		}
+		if got, want := len(frames), 1; got != want {
+			t.Errorf("%s: got %d frames, want %d", path, got, want)
+		}
+	}
+}
+
+func TestFileSinkCompressed(t *testing.T) {
+	dir := t.TempDir()
+
+	sink, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	sink.SetCompressor(Gzip)
+
+	s := NewStream(sink)
+	s.sendHeader("00000001", Request, ":method", "GET")
+	s.sendData("00000001", Request, 0, true, []byte("body"), 4)
+	s.Close()
+
+	// Frames are flushed as they are written, so the file can be read before
+	// the sink is closed.
+	fs, err := filepath.Glob(filepath.Join(dir, "*.marbl.gz"))
+	if err != nil {
+		t.Fatalf("filepath.Glob(): got %v, want no error", err)
+	}
+	if got, want := len(fs), 1; got != want {
+		t.Fatalf("len(files): got %d, want %d", got, want)
+	}
+
+	f, err := os.Open(fs[0])
+	if err != nil {
+		t.Fatalf("os.Open(): got %v, want no error", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader(): got %v, want no error", err)
+	}
+	reader := NewReader(gr)
+	for i := 0; i < 2; i++ {
+		if _, err := reader.ReadFrame(); err != nil {
+			t.Fatalf("reader.ReadFrame(): got %v, want no error", err)
+		}
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("sink.Close(): got %v, want no error", err)
+	}
+
+	frames, _ := readFrames(t, fs[0])
+	if got, want := len(frames), 2; got != want {
+		t.Fatalf("len(frames): got %d, want %d", got, want)
+	}
+	df, ok := frames[1].(Data)
+	if !ok {
+		t.Fatalf("frames[1].(Data): got %T, want Data", frames[1])
+	}
+	if got, want := string(df.Data), "body"; got != want {
+		t.Errorf("df.Data: got %q, want %q", got, want)
+	}
+}
+
+func TestFileSinkZstd(t *testing.T) {
+	dir := t.TempDir()
+
+	sink, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatalf("NewFileSink(): got %v, want no error", err)
+	}
+	sink.SetCompressor(Zstd)
+
+	s := NewStream(sink)
+	s.sendHeader("00000001", Request, ":method", "GET")
+	s.sendData("00000001", Request, 0, true, []byte("body"), 4)
+	s.Close()
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("sink.Close(): got %v, want no error", err)
+	}
+
+	fs, err := filepath.Glob(filepath.Join(dir, "*.marbl.zst"))
+	if err != nil {
+		t.Fatalf("filepath.Glob(): got %v, want no error", err)
+	}
+	if got, want := len(fs), 1; got != want {
+		t.Fatalf("len(files): got %d, want %d", got, want)
+	}
+
+	frames, _ := readFrames(t, fs[0])
+	if got, want := len(frames), 2; got != want {
+		t.Fatalf("len(frames): got %d, want %d", got, want)
+	}
+	df, ok := frames[1].(Data)
+	if !ok {
+		t.Fatalf("frames[1].(Data): got %T, want Data", frames[1])
+	}
+	if got, want := string(df.Data), "body"; got != want {
+		t.Errorf("df.Data: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package martianjson provides a modifier that edits JSON message bodies
+// with JSON Patch and JSONPath operations.
+package martianjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+func init() {
+	parse.Register("json.Modifier", modifierFromJSON)
+}
+
+// Operation is an operation applied to a JSON document.
+//
+// The ops add, remove, replace, move, copy and test are JSON Patch (RFC 6902)
+// operations, whose Path and From are JSON Pointers (RFC 6901). The ops set
+// and delete take a JSONPath expression (see Path) and apply to every value it
+// selects.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type operation struct {
+	op    string
+	expr  string
+	path  pointer
+	from  pointer
+	jpath *Path
+	value interface{}
+}
+
+// Modifier applies operations to JSON request and response bodies, decoding
+// and re-encoding the body according to its Content-Encoding.
+type Modifier struct {
+	ops []*operation
+}
+
+type modifierJSON struct {
+	Operations []Operation          `json:"operations"`
+	Scope      []parse.ModifierType `json:"scope"`
+}
+
+// NewModifier returns a modifier that applies ops in order. It returns an
+// error if an operation is invalid.
+func NewModifier(ops []Operation) (*Modifier, error) {
+	m := &Modifier{}
+	for _, o := range ops {
+		op, err := newOperation(o)
+		if err != nil {
+			return nil, err
+		}
+		m.ops = append(m.ops, op)
+	}
+
+	return m, nil
+}
+
+func newOperation(o Operation) (*operation, error) {
+	op := &operation{op: o.Op, expr: o.Path}
+
+	switch o.Op {
+	case "add", "replace", "test", "set":
+		if len(o.Value) == 0 {
+			return nil, fmt.Errorf("martianjson: %s operation on %q without value", o.Op, o.Path)
+		}
+		v, err := decode(o.Value)
+		if err != nil {
+			return nil, err
+		}
+		op.value = v
+	case "remove", "delete":
+	case "move", "copy":
+		from, err := parsePointer(o.From)
+		if err != nil {
+			return nil, err
+		}
+		op.from = from
+	default:
+		return nil, fmt.Errorf("martianjson: unknown operation %q", o.Op)
+	}
+
+	if o.Op == "set" || o.Op == "delete" {
+		jp, err := ParsePath(o.Path)
+		if err != nil {
+			return nil, err
+		}
+		op.jpath = jp
+		return op, nil
+	}
+
+	p, err := parsePointer(o.Path)
+	if err != nil {
+		return nil, err
+	}
+	op.path = p
+
+	return op, nil
+}
+
+// modifierFromJSON takes a JSON message as a byte slice and returns a
+// json.Modifier and an error.
+//
+// Example JSON configuration message:
+// {
+//   "scope": ["response"],
+//   "operations": [
+//     { "op": "replace", "path": "/user/name", "value": "martian" },
+//     { "op": "remove", "path": "/user/email" },
+//     { "op": "set", "path": "$.items[*].price", "value": 0 },
+//     { "op": "delete", "path": "$..debug" }
+//   ]
+// }
+func modifierFromJSON(b []byte) (*parse.Result, error) {
+	msg := &modifierJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	mod, err := NewModifier(msg.Operations)
+	if err != nil {
+		return nil, err
+	}
+
+	return parse.NewResult(mod, msg.Scope)
+}
+
+// ModifyRequest applies the operations to the request body. Bodies that are not
+// of a JSON media type or have an unsupported Content-Encoding are skipped. The
+// body is left unchanged if it is not valid JSON or an operation fails.
+func (m *Modifier) ModifyRequest(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || !modifiable(req.Header) {
+		return nil
+	}
+	log.Debugf("martianjson.ModifyRequest: request: %s", req.URL)
+
+	b, err := m.modifyBody(req.Header, req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	if req.Header.Get("Content-Length") != "" {
+		req.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	}
+
+	return err
+}
+
+// ModifyResponse applies the operations to the response body. Bodies that are
+// not of a JSON media type or have an unsupported Content-Encoding are skipped.
+// The body is left unchanged if it is not valid JSON or an operation fails.
+func (m *Modifier) ModifyResponse(res *http.Response) error {
+	if res.Body == nil || res.Body == http.NoBody || !modifiable(res.Header) {
+		return nil
+	}
+	log.Debugf("martianjson.ModifyResponse: request: %s", res.Request.URL)
+
+	b, err := m.modifyBody(res.Header, res.Body)
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+	res.ContentLength = int64(len(b))
+	if res.Header.Get("Content-Length") != "" {
+		res.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	}
+
+	return err
+}
+
+// modifiable returns whether the body of a message with header can be
+// modified, that is its media type is application/json or has a +json suffix
+// and its Content-Encoding is supported.
+func modifiable(header http.Header) bool {
+	mt, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if mt != "application/json" && !strings.HasSuffix(mt, "+json") {
+		return false
+	}
+	if !proxyutil.HasContentEncoding(header) {
+		log.Debugf("martianjson: skipping body with unsupported content encoding %q", header.Get("Content-Encoding"))
+		return false
+	}
+
+	return true
+}
+
+// modifyBody reads and closes body and returns it with the operations
+// applied, or as it was read along with an error.
+func (m *Modifier) modifyBody(header http.Header, body io.ReadCloser) ([]byte, error) {
+	raw, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || len(raw) == 0 {
+		return raw, err
+	}
+
+	b, err := proxyutil.DecodeContent(header, raw)
+	if err != nil {
+		return raw, err
+	}
+
+	doc, err := decode(b)
+	if err != nil {
+		return raw, err
+	}
+
+	doc, err = m.Apply(doc)
+	if err != nil {
+		return raw, err
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return raw, err
+	}
+
+	out, err := proxyutil.EncodeContent(header, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	if err != nil {
+		return raw, err
+	}
+
+	return out, nil
+}
+
+// Apply applies the operations in order to doc, a value decoded by
+// encoding/json into an interface{}, and returns the modified document.
+// Apply stops at the first operation that fails, such as a failed test.
+func (m *Modifier) Apply(doc interface{}) (interface{}, error) {
+	for _, op := range m.ops {
+		var err error
+		switch op.op {
+		case "add":
+			doc, err = op.path.add(doc, deepCopy(op.value))
+		case "remove":
+			doc, err = op.path.remove(doc)
+		case "replace":
+			doc, err = op.path.replace(doc, deepCopy(op.value))
+		case "move":
+			doc, err = move(doc, op.from, op.path)
+		case "copy":
+			var v interface{}
+			if v, err = op.from.get(doc); err == nil {
+				doc, err = op.path.add(doc, deepCopy(v))
+			}
+		case "test":
+			var v interface{}
+			if v, err = op.path.get(doc); err == nil && !equal(v, op.value) {
+				err = fmt.Errorf("martianjson: test of %q failed", op.expr)
+			}
+		case "set":
+			doc = op.jpath.Set(doc, op.value)
+		case "delete":
+			doc = op.jpath.Delete(doc)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// move moves the value at from to path. from must not be a proper prefix of
+// path.
+func move(doc interface{}, from, path pointer) (interface{}, error) {
+	if len(from) < len(path) {
+		prefix := true
+		for i, tok := range from {
+			prefix = prefix && tok == path[i]
+		}
+		if prefix {
+			return nil, fmt.Errorf("martianjson: cannot move a value into itself")
+		}
+	}
+
+	v, err := from.get(doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc, err = from.remove(doc); err != nil {
+		return nil, err
+	}
+
+	return path.add(doc, v)
+}
+
+// decode decodes a JSON document, keeping numbers as json.Number so that
+// they are re-encoded as they were.
+func decode(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("martianjson: unexpected data after JSON value")
+	}
+
+	return v, nil
+}
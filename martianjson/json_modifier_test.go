@@ -0,0 +1,330 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martianjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+func operations(t *testing.T, s string) []Operation {
+	t.Helper()
+
+	var ops []Operation
+	if err := json.Unmarshal([]byte(s), &ops); err != nil {
+		t.Fatalf("json.Unmarshal(%s): got %v, want no error", s, err)
+	}
+	return ops
+}
+
+func TestModifierApply(t *testing.T) {
+	tt := []struct {
+		doc  string
+		ops  string
+		want string
+	}{
+		{
+			doc:  `{"foo":"bar"}`,
+			ops:  `[{"op":"add","path":"/baz","value":"qux"}]`,
+			want: `{"baz":"qux","foo":"bar"}`,
+		},
+		{
+			doc:  `{"foo":["bar","baz"]}`,
+			ops:  `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			want: `{"foo":["bar","qux","baz"]}`,
+		},
+		{
+			doc:  `{"foo":["bar"]}`,
+			ops:  `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			want: `{"foo":["bar",["abc","def"]]}`,
+		},
+		{
+			doc:  `{"baz":"qux","foo":"bar"}`,
+			ops:  `[{"op":"remove","path":"/baz"}]`,
+			want: `{"foo":"bar"}`,
+		},
+		{
+			doc:  `{"foo":["bar","qux","baz"]}`,
+			ops:  `[{"op":"remove","path":"/foo/1"}]`,
+			want: `{"foo":["bar","baz"]}`,
+		},
+		{
+			doc:  `{"baz":"qux","foo":"bar"}`,
+			ops:  `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			want: `{"baz":"boo","foo":"bar"}`,
+		},
+		{
+			doc:  `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			ops:  `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			want: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			doc:  `{"foo":["all","grass","cows","eat"]}`,
+			ops:  `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			want: `{"foo":["all","cows","eat","grass"]}`,
+		},
+		{
+			doc:  `{"foo":{"bar":[1]}}`,
+			ops:  `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"add","path":"/baz/bar/-","value":2}]`,
+			want: `{"baz":{"bar":[1,2]},"foo":{"bar":[1]}}`,
+		},
+		{
+			doc:  `{"a/b":{"m~n":1.50}}`,
+			ops:  `[{"op":"test","path":"/a~1b/m~0n","value":1.5},{"op":"replace","path":"","value":[]}]`,
+			want: `[]`,
+		},
+		{
+			doc:  `{"items":[{"id":1,"secret":"x"},{"id":2,"secret":"y"}],"total":12345678901234567890}`,
+			ops:  `[{"op":"delete","path":"$.items[*].secret"},{"op":"set","path":"$.items[0].id","value":9}]`,
+			want: `{"items":[{"id":9},{"id":2}],"total":12345678901234567890}`,
+		},
+	}
+
+	for i, tc := range tt {
+		m, err := NewModifier(operations(t, tc.ops))
+		if err != nil {
+			t.Fatalf("%d. NewModifier(): got %v, want no error", i, err)
+		}
+
+		doc, err := m.Apply(mustDecode(t, tc.doc))
+		if err != nil {
+			t.Fatalf("%d. Apply(): got %v, want no error", i, err)
+		}
+		if got, want := mustEncode(t, doc), tc.want; got != want {
+			t.Errorf("%d. Apply(): got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestModifierApplyErrors(t *testing.T) {
+	tt := []struct {
+		doc string
+		ops string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"test","path":"/foo","value":"baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":1}]`},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/2","value":1}]`},
+		{`{"foo":[1]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"copy","from":"/baz","path":"/qux"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":""}]`},
+	}
+
+	for i, tc := range tt {
+		m, err := NewModifier(operations(t, tc.ops))
+		if err != nil {
+			t.Fatalf("%d. NewModifier(): got %v, want no error", i, err)
+		}
+
+		if _, err := m.Apply(mustDecode(t, tc.doc)); err == nil {
+			t.Errorf("%d. Apply(): got no error, want error", i)
+		}
+	}
+}
+
+func TestNewModifierErrors(t *testing.T) {
+	for _, ops := range []string{
+		`[{"op":"unknown","path":"/foo"}]`,
+		`[{"op":"add","path":"/foo"}]`,
+		`[{"op":"add","path":"foo","value":1}]`,
+		`[{"op":"move","from":"foo","path":"/foo"}]`,
+		`[{"op":"set","path":"/foo","value":1}]`,
+		`[{"op":"delete","path":"$["}]`,
+	} {
+		if _, err := NewModifier(operations(t, ops)); err == nil {
+			t.Errorf("NewModifier(%s): got no error, want error", ops)
+		}
+	}
+}
+
+func TestModifyResponseEncodedBody(t *testing.T) {
+	m, err := NewModifier(operations(t, `[{"op":"set","path":"$.name","value":"<martian>"}]`))
+	if err != nil {
+		t.Fatalf("NewModifier(): got %v, want no error", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	h := http.Header{}
+	h.Set("Content-Encoding", "gzip")
+	body, err := proxyutil.EncodeContent(h, []byte(`{"name":"proxy"}`))
+	if err != nil {
+		t.Fatalf("EncodeContent(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, bytes.NewReader(body), req)
+	res.Header.Set("Content-Type", "application/json; charset=utf-8")
+	res.Header.Set("Content-Encoding", "gzip")
+	res.Header.Set("Content-Length", "1")
+
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := res.ContentLength, int64(len(got)); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Content-Length"), strconv.Itoa(len(got)); got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Content-Length", got, want)
+	}
+
+	decoded, err := proxyutil.DecodeContent(res.Header, got)
+	if err != nil {
+		t.Fatalf("DecodeContent(): got %v, want no error", err)
+	}
+	if got, want := string(decoded), `{"name":"<martian>"}`; got != want {
+		t.Errorf("res.Body: got %s, want %s", got, want)
+	}
+}
+
+func TestModifyRequestInvalidBody(t *testing.T) {
+	m, err := NewModifier(operations(t, `[{"op":"remove","path":"/name"}]`))
+	if err != nil {
+		t.Fatalf("NewModifier(): got %v, want no error", err)
+	}
+
+	for _, body := range []string{"not json", `{"other":true}`} {
+		req, err := http.NewRequest("POST", "http://example.com", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		if err := m.ModifyRequest(req); err == nil {
+			t.Errorf("ModifyRequest(%q): got no error, want error", body)
+		}
+
+		got, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+		}
+		if string(got) != body {
+			t.Errorf("req.Body: got %q, want %q", got, body)
+		}
+		if got, want := req.ContentLength, int64(len(body)); got != want {
+			t.Errorf("req.ContentLength: got %d, want %d", got, want)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := m.ModifyRequest(req); err != nil {
+		t.Errorf("ModifyRequest(): got %v, want no error without body", err)
+	}
+}
+
+func TestModifySkipsUnsupportedBodies(t *testing.T) {
+	m, err := NewModifier(operations(t, `[{"op":"remove","path":"/name"}]`))
+	if err != nil {
+		t.Fatalf("NewModifier(): got %v, want no error", err)
+	}
+
+	tt := []struct {
+		contentType     string
+		contentEncoding string
+	}{
+		{contentType: "text/html", contentEncoding: ""},
+		{contentType: "", contentEncoding: ""},
+		{contentType: "application/json", contentEncoding: "zstd"},
+	}
+
+	for i, tc := range tt {
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+
+		body := "<html>not json</html>"
+		res := proxyutil.NewResponse(200, strings.NewReader(body), req)
+		res.Header.Set("Content-Type", tc.contentType)
+		res.Header.Set("Content-Encoding", tc.contentEncoding)
+
+		if err := m.ModifyResponse(res); err != nil {
+			t.Fatalf("%d. ModifyResponse(): got %v, want no error", i, err)
+		}
+
+		got, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("%d. ioutil.ReadAll(): got %v, want no error", i, err)
+		}
+		if string(got) != body {
+			t.Errorf("%d. res.Body: got %q, want %q", i, got, body)
+		}
+	}
+}
+
+func TestModifierFromJSON(t *testing.T) {
+	msg := []byte(`{
+	  "json.Modifier": {
+	    "scope": ["request"],
+	    "operations": [
+	      { "op": "add", "path": "/debug", "value": true }
+	    ]
+	  }
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	reqmod := r.RequestModifier()
+	if reqmod == nil {
+		t.Fatal("reqmod: got nil, want not nil")
+	}
+	if resmod := r.ResponseModifier(); resmod != nil {
+		t.Error("resmod: got not nil, want nil")
+	}
+
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	if err := reqmod.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	got, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(got), `{"debug":true}`; got != want {
+		t.Errorf("req.Body: got %s, want %s", got, want)
+	}
+
+	if _, err := parse.FromJSON([]byte(`{"json.Modifier": {"operations": [{"op": "bogus"}]}}`)); err == nil {
+		t.Error("parse.FromJSON(): got no error, want error")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martianjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// pointer is a JSON Pointer (RFC 6901) split into its reference tokens.
+type pointer []string
+
+func parsePointer(s string) (pointer, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("martianjson: pointer %q does not start with /", s)
+	}
+
+	toks := strings.Split(s[1:], "/")
+	for i, tok := range toks {
+		toks[i] = pointerUnescaper.Replace(tok)
+	}
+
+	return pointer(toks), nil
+}
+
+// arrayIndex returns the array index of tok in an array of length n. The
+// index n, written as -, is only valid when end is true.
+func arrayIndex(tok string, n int, end bool) (int, error) {
+	if tok == "-" && end {
+		return n, nil
+	}
+	if tok == "" || (len(tok) > 1 && tok[0] == '0') {
+		return 0, fmt.Errorf("martianjson: invalid array index %q", tok)
+	}
+
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("martianjson: invalid array index %q", tok)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("martianjson: array index %d out of range", i)
+	}
+
+	return i, nil
+}
+
+// get returns the value referenced by p in doc.
+func (p pointer) get(doc interface{}) (interface{}, error) {
+	v := doc
+	for _, tok := range p {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			cv, ok := c[tok]
+			if !ok {
+				return nil, fmt.Errorf("martianjson: member %q not found", tok)
+			}
+			v = cv
+		case []interface{}:
+			i, err := arrayIndex(tok, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			v = c[i]
+		default:
+			return nil, fmt.Errorf("martianjson: cannot reference %q in %T", tok, v)
+		}
+	}
+
+	return v, nil
+}
+
+// update calls fn with the parent of the value referenced by p, which must
+// not be empty, and the last token of p. The parent is replaced with the
+// value returned by fn, and the modified doc is returned.
+func (p pointer) update(doc interface{}, fn func(parent interface{}, tok string) (interface{}, error)) (interface{}, error) {
+	if len(p) == 1 {
+		return fn(doc, p[0])
+	}
+
+	tok := p[0]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		cv, ok := c[tok]
+		if !ok {
+			return nil, fmt.Errorf("martianjson: member %q not found", tok)
+		}
+		nv, err := p[1:].update(cv, fn)
+		if err != nil {
+			return nil, err
+		}
+		c[tok] = nv
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(tok, len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		nv, err := p[1:].update(c[i], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = nv
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("martianjson: cannot reference %q in %T", tok, doc)
+}
+
+// add adds value at p, inserting it into an array or setting an object
+// member, and returns the modified doc.
+func (p pointer) add(doc, value interface{}) (interface{}, error) {
+	if len(p) == 0 {
+		return value, nil
+	}
+
+	return p.update(doc, func(parent interface{}, tok string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			c[tok] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+
+		return nil, fmt.Errorf("martianjson: cannot add %q to %T", tok, parent)
+	})
+}
+
+// remove removes the value at p and returns the modified doc.
+func (p pointer) remove(doc interface{}) (interface{}, error) {
+	if len(p) == 0 {
+		return nil, fmt.Errorf("martianjson: cannot remove the whole document")
+	}
+
+	return p.update(doc, func(parent interface{}, tok string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := c[tok]; !ok {
+				return nil, fmt.Errorf("martianjson: member %q not found", tok)
+			}
+			delete(c, tok)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+
+		return nil, fmt.Errorf("martianjson: cannot remove %q from %T", tok, parent)
+	})
+}
+
+// replace replaces the existing value at p and returns the modified doc.
+func (p pointer) replace(doc, value interface{}) (interface{}, error) {
+	if len(p) == 0 {
+		return value, nil
+	}
+
+	return p.update(doc, func(parent interface{}, tok string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := c[tok]; !ok {
+				return nil, fmt.Errorf("martianjson: member %q not found", tok)
+			}
+			c[tok] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = value
+			return c, nil
+		}
+
+		return nil, fmt.Errorf("martianjson: cannot replace %q in %T", tok, parent)
+	})
+}
+
+// equal returns whether the JSON values a and b are equal, comparing numbers
+// by value.
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for n, c := range v {
+			m[n] = normalize(c)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, c := range v {
+			a[i] = normalize(c)
+		}
+		return a
+	}
+
+	return v
+}
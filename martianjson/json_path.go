@@ -0,0 +1,357 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martianjson
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	segmentName segmentKind = iota
+	segmentIndex
+	segmentWildcard
+	segmentDescend
+)
+
+type segment struct {
+	kind  segmentKind
+	name  string
+	index int
+}
+
+// Path is a JSONPath expression selecting values of a JSON document, such as
+// a value decoded by encoding/json into an interface{}.
+//
+// Paths start with $ and support the following subset of JSONPath:
+//   .name or ['name']  the member name of an object
+//   [n]                the element n of an array, counting from the end if n is negative
+//   .* or [*]          all members of an object or elements of an array
+//   ..                 the value and all of its descendants
+type Path struct {
+	expr string
+	segs []segment
+}
+
+// ParsePath parses a JSONPath expression.
+func ParsePath(expr string) (*Path, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("martianjson: path %q does not start with $", expr)
+	}
+
+	p := &Path{expr: expr}
+	s := expr[1:]
+	for len(s) > 0 {
+		switch {
+		case strings.HasPrefix(s, ".."):
+			p.segs = append(p.segs, segment{kind: segmentDescend})
+			s = s[2:]
+			if strings.HasPrefix(s, "[") {
+				continue
+			}
+		case s[0] == '.':
+			s = s[1:]
+		case s[0] == '[':
+			seg, rest, err := parseBracket(s)
+			if err != nil {
+				return nil, fmt.Errorf("martianjson: path %q: %v", expr, err)
+			}
+			p.segs = append(p.segs, seg)
+			s = rest
+			continue
+		default:
+			return nil, fmt.Errorf("martianjson: path %q: unexpected %q", expr, s)
+		}
+
+		i := strings.IndexAny(s, ".[")
+		if i == -1 {
+			i = len(s)
+		}
+		name := s[:i]
+		s = s[i:]
+
+		switch name {
+		case "":
+			return nil, fmt.Errorf("martianjson: path %q: missing member name", expr)
+		case "*":
+			p.segs = append(p.segs, segment{kind: segmentWildcard})
+		default:
+			p.segs = append(p.segs, segment{kind: segmentName, name: name})
+		}
+	}
+
+	return p, nil
+}
+
+// parseBracket parses a bracketed segment at the start of s and returns the
+// rest of s.
+func parseBracket(s string) (segment, string, error) {
+	if len(s) > 1 && (s[1] == '\'' || s[1] == '"') {
+		q := s[1]
+		end := strings.IndexByte(s[2:], q)
+		if end == -1 || !strings.HasPrefix(s[2+end+1:], "]") {
+			return segment{}, "", fmt.Errorf("unterminated name in %q", s)
+		}
+
+		return segment{kind: segmentName, name: s[2 : 2+end]}, s[2+end+2:], nil
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end == -1 {
+		return segment{}, "", fmt.Errorf("unterminated bracket in %q", s)
+	}
+
+	v := strings.TrimSpace(s[1:end])
+	if v == "*" {
+		return segment{kind: segmentWildcard}, s[end+1:], nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return segment{}, "", fmt.Errorf("invalid index %q", v)
+	}
+
+	return segment{kind: segmentIndex, index: i}, s[end+1:], nil
+}
+
+// String returns the expression of the path.
+func (p *Path) String() string {
+	return p.expr
+}
+
+// Get returns the values of doc selected by the path.
+func (p *Path) Get(doc interface{}) []interface{} {
+	var vs []interface{}
+	get(doc, p.segs, func(v interface{}) {
+		vs = append(vs, v)
+	})
+
+	return vs
+}
+
+func get(v interface{}, segs []segment, fn func(interface{})) {
+	if len(segs) == 0 {
+		fn(v)
+		return
+	}
+
+	seg, rest := segs[0], segs[1:]
+	switch seg.kind {
+	case segmentName:
+		if m, ok := v.(map[string]interface{}); ok {
+			if c, ok := m[seg.name]; ok {
+				get(c, rest, fn)
+			}
+		}
+	case segmentIndex:
+		if a, ok := v.([]interface{}); ok {
+			if i, ok := index(seg.index, len(a)); ok {
+				get(a[i], rest, fn)
+			}
+		}
+	case segmentWildcard:
+		for _, c := range children(v) {
+			get(c, rest, fn)
+		}
+	case segmentDescend:
+		get(v, rest, fn)
+		for _, c := range children(v) {
+			get(c, segs, fn)
+		}
+	}
+}
+
+// children returns the members of an object, ordered by name, or the
+// elements of an array.
+func children(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for n := range v {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		cs := make([]interface{}, 0, len(v))
+		for _, n := range names {
+			cs = append(cs, v[n])
+		}
+		return cs
+	case []interface{}:
+		return v
+	}
+
+	return nil
+}
+
+func index(i, n int) (int, bool) {
+	if i < 0 {
+		i += n
+	}
+
+	return i, i >= 0 && i < n
+}
+
+// Set sets the values of doc selected by the path to copies of value and
+// returns the modified doc. A missing object member is added when the
+// path selects it by name without wildcards or descendants.
+func (p *Path) Set(doc, value interface{}) interface{} {
+	if len(p.segs) == 0 {
+		return deepCopy(value)
+	}
+
+	return update(doc, p.segs, true, func(interface{}) (interface{}, bool) {
+		return deepCopy(value), true
+	})
+}
+
+// Delete removes the values of doc selected by the path and returns the
+// modified doc. Deleting the whole document returns nil.
+func (p *Path) Delete(doc interface{}) interface{} {
+	if len(p.segs) == 0 {
+		return nil
+	}
+
+	return update(doc, p.segs, true, func(interface{}) (interface{}, bool) {
+		return nil, false
+	})
+}
+
+// update calls fn with the values of v selected by segs, replacing each with
+// the value returned by fn or removing it if fn returns false. When definite
+// is true, fn is also called for a missing member selected by name.
+func update(v interface{}, segs []segment, definite bool, fn func(interface{}) (interface{}, bool)) interface{} {
+	seg, rest := segs[0], segs[1:]
+	leaf := len(rest) == 0
+
+	switch seg.kind {
+	case segmentName:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+
+		c, ok := m[seg.name]
+		switch {
+		case leaf && (ok || definite):
+			if nv, keep := fn(c); keep {
+				m[seg.name] = nv
+			} else {
+				delete(m, seg.name)
+			}
+		case ok:
+			m[seg.name] = update(c, rest, definite, fn)
+		}
+
+		return m
+	case segmentIndex:
+		a, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+
+		i, ok := index(seg.index, len(a))
+		if !ok {
+			return v
+		}
+		if !leaf {
+			a[i] = update(a[i], rest, definite, fn)
+			return a
+		}
+		if nv, keep := fn(a[i]); keep {
+			a[i] = nv
+			return a
+		}
+
+		return append(a[:i:i], a[i+1:]...)
+	case segmentWildcard:
+		switch c := v.(type) {
+		case map[string]interface{}:
+			for n, cv := range c {
+				if !leaf {
+					c[n] = update(cv, rest, false, fn)
+					continue
+				}
+				if nv, keep := fn(cv); keep {
+					c[n] = nv
+				} else {
+					delete(c, n)
+				}
+			}
+			return c
+		case []interface{}:
+			if !leaf {
+				for i, cv := range c {
+					c[i] = update(cv, rest, false, fn)
+				}
+				return c
+			}
+
+			a := make([]interface{}, 0, len(c))
+			for _, cv := range c {
+				if nv, keep := fn(cv); keep {
+					a = append(a, nv)
+				}
+			}
+			return a
+		}
+
+		return v
+	case segmentDescend:
+		// Descendants are updated before the value itself, so that values
+		// added by fn are not visited again.
+		switch c := v.(type) {
+		case map[string]interface{}:
+			for n, cv := range c {
+				c[n] = update(cv, segs, false, fn)
+			}
+		case []interface{}:
+			for i, cv := range c {
+				c[i] = update(cv, segs, false, fn)
+			}
+		}
+		if len(rest) == 0 {
+			return v
+		}
+
+		return update(v, rest, false, fn)
+	}
+
+	return v
+}
+
+// deepCopy returns a copy of v that shares no objects or arrays with v.
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for n, c := range v {
+			m[n] = deepCopy(c)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, c := range v {
+			a[i] = deepCopy(c)
+		}
+		return a
+	}
+
+	return v
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martianjson
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testDocument = `{
+  "store": {
+    "name": "martian",
+    "books": [
+      {"title": "a", "price": 8, "tags": ["x"]},
+      {"title": "b", "price": 12},
+      {"title": "c", "price": 9, "debug": true}
+    ],
+    "debug": {"trace": 1}
+  }
+}`
+
+func mustDecode(t *testing.T, s string) interface{} {
+	t.Helper()
+
+	v, err := decode([]byte(s))
+	if err != nil {
+		t.Fatalf("decode(%s): got %v, want no error", s, err)
+	}
+	return v
+}
+
+func mustEncode(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal(): got %v, want no error", err)
+	}
+	return string(b)
+}
+
+func TestPathGet(t *testing.T) {
+	tt := []struct {
+		path string
+		want string
+	}{
+		{"$", ""},
+		{"$.store.name", `["martian"]`},
+		{"$['store']['name']", `["martian"]`},
+		{`$["store"].books[1].title`, `["b"]`},
+		{"$.store.books[-1].title", `["c"]`},
+		{"$.store.books[3].title", `null`},
+		{"$.store.books[*].price", `[8,12,9]`},
+		{"$.store.books.*.title", `["a","b","c"]`},
+		{"$..title", `["a","b","c"]`},
+		{"$..[0]", `[{"price":8,"tags":["x"],"title":"a"},"x"]`},
+		{"$.missing.name", `null`},
+	}
+
+	doc := mustDecode(t, testDocument)
+	for _, tc := range tt {
+		p, err := ParsePath(tc.path)
+		if err != nil {
+			t.Fatalf("ParsePath(%q): got %v, want no error", tc.path, err)
+		}
+		if got, want := p.String(), tc.path; got != want {
+			t.Errorf("p.String(): got %q, want %q", got, want)
+		}
+		if tc.want == "" {
+			if got := len(p.Get(doc)); got != 1 {
+				t.Errorf("%s: len(Get()): got %d, want 1", tc.path, got)
+			}
+			continue
+		}
+		if got, want := mustEncode(t, p.Get(doc)), tc.want; got != want {
+			t.Errorf("%s: Get(): got %s, want %s", tc.path, got, want)
+		}
+	}
+}
+
+func TestParsePathErrors(t *testing.T) {
+	for _, path := range []string{"", "store", "$.", "$..", "$[", "$[x]", "$['a]"} {
+		if _, err := ParsePath(path); err == nil {
+			t.Errorf("ParsePath(%q): got no error, want error", path)
+		}
+	}
+}
+
+func TestPathSetAndDelete(t *testing.T) {
+	tt := []struct {
+		op    string
+		path  string
+		value string
+		want  string
+	}{
+		{
+			op:    "set",
+			path:  "$.store.name",
+			value: `"proxy"`,
+			want:  `"proxy"`,
+		},
+		{
+			op:    "set",
+			path:  "$.store.books[*].price",
+			value: `0`,
+			want:  `[{"price":0,"tags":["x"],"title":"a"},{"price":0,"title":"b"},{"debug":true,"price":0,"title":"c"}]`,
+		},
+		{
+			op:    "set",
+			path:  "$.store.open",
+			value: `{"hours":[9,17]}`,
+			want:  `{"hours":[9,17]}`,
+		},
+		{
+			op:    "set",
+			path:  "$.store.books[*].isbn",
+			value: `"none"`,
+			want:  `[{"price":8,"tags":["x"],"title":"a"},{"price":12,"title":"b"},{"debug":true,"price":9,"title":"c"}]`,
+		},
+		{
+			op:   "delete",
+			path: "$.store.books[1]",
+			want: `[{"price":8,"tags":["x"],"title":"a"},{"debug":true,"price":9,"title":"c"}]`,
+		},
+		{
+			op:   "delete",
+			path: "$.store.books[*].price",
+			want: `[{"tags":["x"],"title":"a"},{"title":"b"},{"debug":true,"title":"c"}]`,
+		},
+		{
+			op:   "delete",
+			path: "$..debug",
+			want: `{"books":[{"price":8,"tags":["x"],"title":"a"},{"price":12,"title":"b"},{"price":9,"title":"c"}],"name":"martian"}`,
+		},
+	}
+
+	for _, tc := range tt {
+		p, err := ParsePath(tc.path)
+		if err != nil {
+			t.Fatalf("ParsePath(%q): got %v, want no error", tc.path, err)
+		}
+
+		doc := mustDecode(t, testDocument)
+		if tc.op == "set" {
+			doc = p.Set(doc, mustDecode(t, tc.value))
+		} else {
+			doc = p.Delete(doc)
+		}
+
+		var got interface{}
+		switch {
+		case tc.path == "$.store.name" || tc.path == "$.store.open":
+			got = doc.(map[string]interface{})["store"].(map[string]interface{})[tc.path[len("$.store."):]]
+		case tc.path == "$..debug":
+			got = doc.(map[string]interface{})["store"]
+		default:
+			got = doc.(map[string]interface{})["store"].(map[string]interface{})["books"]
+		}
+		if got, want := mustEncode(t, got), tc.want; got != want {
+			t.Errorf("%s %s: got %s, want %s", tc.op, tc.path, got, want)
+		}
+	}
+}
+
+func TestPathSetRoot(t *testing.T) {
+	p, err := ParsePath("$")
+	if err != nil {
+		t.Fatalf("ParsePath(): got %v, want no error", err)
+	}
+
+	if got, want := mustEncode(t, p.Set(mustDecode(t, testDocument), mustDecode(t, `[1]`))), `[1]`; got != want {
+		t.Errorf("Set(): got %s, want %s", got, want)
+	}
+	if got := p.Delete(mustDecode(t, testDocument)); got != nil {
+		t.Errorf("Delete(): got %v, want nil", got)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
@@ -27,6 +28,7 @@ import (
 	"github.com/google/martian/v3/log"
 	"github.com/google/martian/v3/messageview"
 	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/redact"
 )
 
 // Logger is a modifier that logs requests and responses.
@@ -34,6 +36,7 @@ type Logger struct {
 	log         func(line string)
 	headersOnly bool
 	decode      bool
+	redact      *redact.Policy
 }
 
 type loggerJSON struct {
@@ -66,6 +69,13 @@ func (l *Logger) SetDecode(decode bool) {
 	l.decode = decode
 }
 
+// SetRedactPolicy sets the redaction policy applied to logged messages.
+// Without a policy, the policy attached to the request context by a
+// redact.Policy modifier is applied, if any.
+func (l *Logger) SetRedactPolicy(p *redact.Policy) {
+	l.redact = p
+}
+
 // SetLogFunc sets the logging function for the logger.
 func (l *Logger) SetLogFunc(logFunc func(line string)) {
 	l.log = logFunc
@@ -94,7 +104,9 @@ func (l *Logger) ModifyRequest(req *http.Request) error {
 
 	fmt.Fprintln(b, "")
 	fmt.Fprintln(b, strings.Repeat("-", 80))
-	fmt.Fprintf(b, "Request to %s\n", req.URL)
+	p := l.policy(ctx)
+
+	fmt.Fprintf(b, "Request to %s\n", p.URL(req.URL.String()))
 	fmt.Fprintln(b, strings.Repeat("-", 80))
 
 	mv := messageview.New()
@@ -108,13 +120,10 @@ func (l *Logger) ModifyRequest(req *http.Request) error {
 		opts = append(opts, messageview.Decode())
 	}
 
-	r, err := mv.Reader(opts...)
-	if err != nil {
+	if err := writeMessage(b, mv, p, req.Header, opts...); err != nil {
 		return err
 	}
 
-	io.Copy(b, r)
-
 	fmt.Fprintln(b, "")
 	fmt.Fprintln(b, strings.Repeat("-", 80))
 
@@ -144,7 +153,9 @@ func (l *Logger) ModifyResponse(res *http.Response) error {
 	b := &bytes.Buffer{}
 	fmt.Fprintln(b, "")
 	fmt.Fprintln(b, strings.Repeat("-", 80))
-	fmt.Fprintf(b, "Response from %s\n", res.Request.URL)
+	p := l.policy(ctx)
+
+	fmt.Fprintf(b, "Response from %s\n", p.URL(res.Request.URL.String()))
 	fmt.Fprintln(b, strings.Repeat("-", 80))
 
 	mv := messageview.New()
@@ -158,13 +169,10 @@ func (l *Logger) ModifyResponse(res *http.Response) error {
 		opts = append(opts, messageview.Decode())
 	}
 
-	r, err := mv.Reader(opts...)
-	if err != nil {
+	if err := writeMessage(b, mv, p, res.Header, opts...); err != nil {
 		return err
 	}
 
-	io.Copy(b, r)
-
 	fmt.Fprintln(b, "")
 	fmt.Fprintln(b, strings.Repeat("-", 80))
 
@@ -173,6 +181,72 @@ func (l *Logger) ModifyResponse(res *http.Response) error {
 	return nil
 }
 
+func (l *Logger) policy(ctx *martian.Context) *redact.Policy {
+	if l.redact != nil {
+		return l.redact
+	}
+	return redact.FromContext(ctx)
+}
+
+// writeMessage writes the message snapshotted in mv to b, applying p to the
+// request line, the headers and the body.
+func writeMessage(b *bytes.Buffer, mv *messageview.MessageView, p *redact.Policy, h http.Header, opts ...messageview.Option) error {
+	if p == nil {
+		r, err := mv.Reader(opts...)
+		if err != nil {
+			return err
+		}
+
+		io.Copy(b, r)
+		return nil
+	}
+
+	hb, err := ioutil.ReadAll(mv.HeaderReader())
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(hb), "\r\n")
+	for i, line := range lines {
+		if i == 0 {
+			// Request-Line: Method SP Request-URI SP HTTP-Version
+			if parts := strings.SplitN(line, " ", 3); len(parts) == 3 && !strings.HasPrefix(line, "HTTP/") {
+				parts[1] = p.URL(parts[1])
+				lines[i] = strings.Join(parts, " ")
+			}
+			continue
+		}
+
+		if j := strings.Index(line, ":"); j > 0 {
+			name := line[:j]
+			lines[i] = name + ": " + p.Header(name, strings.TrimSpace(line[j+1:]))
+		}
+	}
+	b.WriteString(strings.Join(lines, "\r\n"))
+
+	br, err := mv.BodyReader(opts...)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return err
+	}
+
+	// Encoded bodies are only redacted once they have been decoded, which is
+	// the only option the logger passes.
+	if h.Get("Content-Encoding") == "" || len(opts) > 0 {
+		body = p.Body(h.Get("Content-Type"), body)
+	}
+	b.Write(body)
+
+	io.Copy(b, mv.TrailerReader())
+
+	return nil
+}
+
 // loggerFromJSON builds a logger from JSON.
 //
 // Example JSON:
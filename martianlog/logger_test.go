@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
@@ -25,6 +26,7 @@ import (
 	"github.com/google/martian/v3"
 	"github.com/google/martian/v3/parse"
 	"github.com/google/martian/v3/proxyutil"
+	"github.com/google/martian/v3/redact"
 )
 
 func ExampleLogger() {
@@ -134,3 +136,66 @@ func TestLoggerFromJSON(t *testing.T) {
 		t.Error("l.decode: got false, want true")
 	}
 }
+
+func TestLoggerRedactPolicy(t *testing.T) {
+	var lines []string
+	l := NewLogger()
+	l.SetLogFunc(func(line string) {
+		lines = append(lines, line)
+	})
+
+	p := redact.NewPolicy()
+	p.RedactHeaders("Authorization")
+	p.RedactQueryParams("token")
+	p.RedactJSONPaths("password")
+	l.SetRedactPolicy(p)
+
+	req, err := http.NewRequest("POST", "http://example.com/login?token=abc", strings.NewReader(`{"password":"hunter2"}`))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("Content-Type", "application/json")
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := l.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader(`{"password":"hunter2"}`), req)
+	res.Header.Set("Content-Type", "application/json")
+	if err := l.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := len(lines), 2; got != want {
+		t.Fatalf("len(lines): got %d, want %d", got, want)
+	}
+	for _, line := range lines {
+		for _, secret := range []string{"hunter2", "Bearer abc", "token=abc"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("line: got %q in %q, want redacted", secret, line)
+			}
+		}
+	}
+	if !strings.Contains(lines[0], "Authorization: [REDACTED]\r\n") {
+		t.Errorf("lines[0]: got %q, want redacted Authorization header", lines[0])
+	}
+	if !strings.Contains(lines[0], `{"password":"[REDACTED]"}`) {
+		t.Errorf("lines[0]: got %q, want redacted body", lines[0])
+	}
+
+	// The request body is intact.
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(body), `{"password":"hunter2"}`; got != want {
+		t.Errorf("req.Body: got %q, want %q", got, want)
+	}
+}
@@ -83,13 +83,15 @@ func filterFromJSON(b []byte) (*parse.Result, error) {
 		RawQuery: msg.Query,
 	})
 
-	m, err := parse.FromJSON(msg.Modifier)
-	if err != nil {
-		return nil, err
-	}
+	if len(msg.Modifier) > 0 {
+		m, err := parse.FromJSON(msg.Modifier)
+		if err != nil {
+			return nil, err
+		}
 
-	filter.RequestWhenTrue(m.RequestModifier())
-	filter.ResponseWhenTrue(m.ResponseModifier())
+		filter.RequestWhenTrue(m.RequestModifier())
+		filter.ResponseWhenTrue(m.ResponseModifier())
+	}
 
 	if len(msg.ElseModifier) > 0 {
 		em, err := parse.FromJSON(msg.ElseModifier)
@@ -70,13 +70,15 @@ func regexFilterFromJSON(b []byte) (*parse.Result, error) {
 
 	filter := NewRegexFilter(matcher)
 
-	m, err := parse.FromJSON(msg.Modifier)
-	if err != nil {
-		return nil, err
-	}
+	if len(msg.Modifier) > 0 {
+		m, err := parse.FromJSON(msg.Modifier)
+		if err != nil {
+			return nil, err
+		}
 
-	filter.RequestWhenTrue(m.RequestModifier())
-	filter.ResponseWhenTrue(m.ResponseModifier())
+		filter.RequestWhenTrue(m.RequestModifier())
+		filter.ResponseWhenTrue(m.ResponseModifier())
+	}
 
 	if len(msg.ElseModifier) > 0 {
 		em, err := parse.FromJSON(msg.ElseModifier)
@@ -237,4 +237,41 @@ func TestRegexFilterFromJSON(t *testing.T) {
 	if got, want := res.Header.Get("Martian-Test"), "true"; got != want {
 		t.Errorf("res.Header.Get(%q): got %q, want %q", "Martian-Test", got, want)
 	}
-}
\ No newline at end of file
+}
+
+func TestRegexMatcherRecordsCaptures(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://www.example.com/users/42/posts/7", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	if got := RegexCaptures(req); len(got) != 0 {
+		t.Errorf("RegexCaptures(): got %v, want no captures without context", got)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if !NewRegexMatcher(regexp.MustCompile(`/users/(?P<user>\d+)`)).MatchRequest(req) {
+		t.Fatal("MatchRequest(): got false, want true")
+	}
+	if !NewRegexMatcher(regexp.MustCompile(`/posts/(\d+)`)).MatchRequest(req) {
+		t.Fatal("MatchRequest(): got false, want true")
+	}
+	if NewRegexMatcher(regexp.MustCompile(`/comments/(\d+)`)).MatchRequest(req) {
+		t.Fatal("MatchRequest(): got true, want false")
+	}
+
+	captures := RegexCaptures(req)
+	for k, want := range map[string]string{"user": "42", "1": "7"} {
+		if got := captures[k]; got != want {
+			t.Errorf("RegexCaptures()[%q]: got %q, want %q", k, got, want)
+		}
+	}
+	if got, want := len(captures), 2; got != want {
+		t.Errorf("len(RegexCaptures()): got %d, want %d", got, want)
+	}
+}
@@ -18,8 +18,15 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
+
+	"github.com/google/martian/v3"
 )
 
+// regexCapturesKey is the context key of the submatches of the request URL
+// recorded by RegexMatchers.
+const regexCapturesKey = "url.RegexCaptures"
+
 // RegexMatcher is a conditional evaluator of request urls to be used in
 // filters that take conditionals.
 type RegexMatcher struct {
@@ -33,9 +40,30 @@ func NewRegexMatcher(r *regexp.Regexp) *RegexMatcher {
 	}
 }
 
-// MatchRequest retuns true if the request URL matches r.
+// MatchRequest retuns true if the request URL matches r. The submatches of
+// the URL are recorded in the context of req, see RegexCaptures.
 func (m *RegexMatcher) MatchRequest(req *http.Request) bool {
-	return m.matches(req.URL)
+	sm := m.r.FindStringSubmatch(req.URL.String())
+	if sm == nil {
+		return false
+	}
+
+	if ctx := martian.NewContext(req); ctx != nil && len(sm) > 1 {
+		captures := RegexCaptures(req)
+		for i, name := range m.r.SubexpNames() {
+			if i == 0 {
+				continue
+			}
+
+			captures[strconv.Itoa(i)] = sm[i]
+			if name != "" {
+				captures[name] = sm[i]
+			}
+		}
+		ctx.Set(regexCapturesKey, captures)
+	}
+
+	return true
 }
 
 // MatchResponse retuns true if the response URL matches r.
@@ -47,3 +75,24 @@ func (m *RegexMatcher) MatchResponse(res *http.Response) bool {
 func (m *RegexMatcher) matches(u *url.URL) bool {
 	return m.r.MatchString(u.String())
 }
+
+// RegexCaptures returns the submatches of the URL of req recorded by the
+// RegexMatchers that matched it, keyed by the index of the group and, for
+// named groups, by name. When several matchers matched, later submatches
+// replace earlier ones with the same key.
+func RegexCaptures(req *http.Request) map[string]string {
+	captures := make(map[string]string)
+
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return captures
+	}
+
+	v, _ := ctx.Get(regexCapturesKey)
+	prev, _ := v.(map[string]string)
+	for k, c := range prev {
+		captures[k] = c
+	}
+
+	return captures
+}
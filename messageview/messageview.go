@@ -18,14 +18,14 @@ package messageview
 
 import (
 	"bytes"
-	"compress/flate"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+
+	"github.com/google/martian/v3/proxyutil"
 )
 
 // MessageView is a static view of an HTTP request or response.
@@ -172,8 +172,10 @@ func (mv *MessageView) SnapshotResponse(res *http.Response) error {
 	mv.bodyoffset = int64(buf.Len())
 	mv.traileroffset = int64(buf.Len())
 
+	// The body of a 101 Switching Protocols response is the upgraded
+	// connection, which must not be read.
 	ct := res.Header.Get("Content-Type")
-	if mv.skipBody && !mv.matchContentType(ct) || res.Body == nil {
+	if mv.skipBody && !mv.matchContentType(ct) || res.Body == nil || res.StatusCode == http.StatusSwitchingProtocols {
 		mv.message = buf.Bytes()
 		return nil
 	}
@@ -237,7 +239,8 @@ func (mv *MessageView) HeaderReader() io.Reader {
 //
 // If the Decode option is passed the body will be unchunked if
 // Transfer-Encoding is set to "chunked", and will decode the following
-// Content-Encodings: gzip, deflate.
+// Content-Encodings: gzip, deflate and those registered with
+// proxyutil.RegisterContentEncoding.
 func (mv *MessageView) BodyReader(opts ...Option) (io.ReadCloser, error) {
 	var r io.Reader
 
@@ -256,18 +259,14 @@ func (mv *MessageView) BodyReader(opts ...Option) (io.ReadCloser, error) {
 	if mv.chunked {
 		r = httputil.NewChunkedReader(r)
 	}
-	switch mv.compress {
-	case "gzip":
-		gr, err := gzip.NewReader(r)
-		if err != nil {
-			return nil, err
-		}
-		return gr, nil
-	case "deflate":
-		return flate.NewReader(r), nil
-	default:
+
+	h := http.Header{}
+	h.Set("Content-Encoding", mv.compress)
+	if !proxyutil.HasContentEncoding(h) {
 		return ioutil.NopCloser(r), nil
 	}
+
+	return proxyutil.NewContentReader(h, r)
 }
 
 // TrailerReader returns an io.Reader that reads the HTTP request or response
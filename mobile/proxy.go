@@ -44,10 +44,14 @@ import (
 	// side-effect importing to register with JSON API
 	_ "github.com/google/martian/v3/body"
 	_ "github.com/google/martian/v3/cookie"
+	_ "github.com/google/martian/v3/delay"
 	_ "github.com/google/martian/v3/failure"
+	_ "github.com/google/martian/v3/fault"
 	_ "github.com/google/martian/v3/header"
+	_ "github.com/google/martian/v3/martianjson"
 	_ "github.com/google/martian/v3/martianurl"
 	_ "github.com/google/martian/v3/method"
+	_ "github.com/google/martian/v3/mock"
 	_ "github.com/google/martian/v3/pingback"
 	_ "github.com/google/martian/v3/port"
 	_ "github.com/google/martian/v3/priority"
@@ -136,6 +140,7 @@ func (m *Martian) Start() {
 		tsl := trafficshape.NewListener(m.listener)
 		tsh := trafficshape.NewHandler(tsl)
 		m.handle("/shape-traffic", tsh)
+		m.handle("/shape-traffic/stats", trafficshape.NewStatsHandler(tsl))
 		m.listener = tsl
 	}
 
@@ -0,0 +1,286 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mock provides a modifier that skips the HTTP round-trip and returns
+// a response rendered from templates.
+package mock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/martianurl"
+	"github.com/google/martian/v3/parse"
+)
+
+func init() {
+	parse.Register("mock.Response", responseFromJSON)
+}
+
+// funcs are the functions available to templates in addition to the
+// text/template builtins.
+var funcs = template.FuncMap{
+	// now returns the current time, as in {{now.Unix}} or
+	// {{now.Format "2006-01-02"}}.
+	"now": time.Now,
+	// json returns v encoded as JSON, as in {{json .JSON.user}}.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// uuid returns a random version 4 UUID.
+	"uuid": func() (string, error) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// Request is the data that response templates are rendered with.
+type Request struct {
+	// ID is the martian context ID of the request.
+	ID     string
+	Method string
+	URL    *url.URL
+	Scheme string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	// Body is the request body.
+	Body string
+	// JSON is the request body decoded as JSON, or nil if the body is not
+	// JSON.
+	JSON interface{}
+	// Captures are the submatches of the URL recorded by url.RegexFilter,
+	// keyed by group index and name.
+	Captures map[string]string
+}
+
+// Response is a modifier that skips the round-trip of requests and returns a
+// response whose headers and body are rendered with text/template from the
+// request.
+type Response struct {
+	statusCode int
+	headers    map[string]*template.Template
+	body       *template.Template
+}
+
+type responseJSON struct {
+	Status  int                  `json:"status"`
+	Headers map[string]string    `json:"headers"`
+	Body    string               `json:"body"`
+	Scope   []parse.ModifierType `json:"scope"`
+}
+
+// NewResponse returns a mock.Response with statusCode and an empty body.
+func NewResponse(statusCode int) *Response {
+	return &Response{
+		statusCode: statusCode,
+		headers:    make(map[string]*template.Template),
+	}
+}
+
+// SetBody sets the template of the response body. It returns an error if
+// text is not a valid template.
+func (r *Response) SetBody(text string) error {
+	t, err := template.New("body").Funcs(funcs).Parse(text)
+	if err != nil {
+		return err
+	}
+	r.body = t
+
+	return nil
+}
+
+// SetHeader sets the template of the value of the response header name. It
+// returns an error if text is not a valid template.
+func (r *Response) SetHeader(name, text string) error {
+	t, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return err
+	}
+	r.headers[http.CanonicalHeaderKey(name)] = t
+
+	return nil
+}
+
+// ModifyRequest skips the round-trip of the request.
+func (r *Response) ModifyRequest(req *http.Request) error {
+	if ctx := martian.NewContext(req); ctx != nil {
+		ctx.SkipRoundTrip()
+	}
+
+	return nil
+}
+
+// ModifyResponse replaces the response with one rendered from the request.
+// If a template fails to render, the response is replaced with a 500
+// response and the error is returned.
+func (r *Response) ModifyResponse(res *http.Response) error {
+	log.Debugf("mock.Response.ModifyResponse: request: %s", res.Request.URL)
+
+	data, err := newRequest(res.Request)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	names := make([]string, 0, len(r.headers))
+	for name := range r.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	for _, name := range names {
+		buf.Reset()
+		if err := r.headers[name].Execute(buf, data); err != nil {
+			return renderError(res, err)
+		}
+		header.Set(name, buf.String())
+	}
+
+	buf = new(bytes.Buffer)
+	if r.body != nil {
+		if err := r.body.Execute(buf, data); err != nil {
+			return renderError(res, err)
+		}
+	}
+
+	if res.Body != nil {
+		res.Body.Close()
+	}
+
+	res.StatusCode = r.statusCode
+	res.Status = fmt.Sprintf("%d %s", r.statusCode, http.StatusText(r.statusCode))
+	res.Header = header
+	res.ContentLength = int64(buf.Len())
+	res.Body = ioutil.NopCloser(buf)
+
+	return nil
+}
+
+// renderError replaces res with an empty 500 response and returns err.
+func renderError(res *http.Response, err error) error {
+	if res.Body != nil {
+		res.Body.Close()
+	}
+
+	res.StatusCode = http.StatusInternalServerError
+	res.Status = fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	res.Header = http.Header{}
+	res.ContentLength = 0
+	res.Body = ioutil.NopCloser(new(bytes.Buffer))
+
+	return fmt.Errorf("mock.Response: %v", err)
+}
+
+// newRequest returns the template data of req. The body of req is read and
+// replaced with an in-memory copy.
+func newRequest(req *http.Request) (*Request, error) {
+	data := &Request{
+		Method:   req.Method,
+		URL:      req.URL,
+		Scheme:   req.URL.Scheme,
+		Host:     req.Host,
+		Path:     req.URL.Path,
+		Query:    req.URL.Query(),
+		Header:   req.Header,
+		Captures: martianurl.RegexCaptures(req),
+	}
+	if data.Host == "" {
+		data.Host = req.URL.Host
+	}
+	if ctx := martian.NewContext(req); ctx != nil {
+		data.ID = ctx.ID()
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return data, nil
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	data.Body = string(b)
+	if err := json.Unmarshal(b, &data.JSON); err != nil {
+		data.JSON = nil
+	}
+
+	return data, nil
+}
+
+// responseFromJSON takes a JSON message as a byte slice and returns a
+// mock.Response and an error. The headers and body are text/template
+// templates rendered with a mock.Request, and status defaults to 200.
+//
+// Example JSON configuration message:
+// {
+//   "scope": ["request", "response"],
+//   "status": 200,
+//   "headers": {
+//     "Content-Type": "application/json",
+//     "X-Request-Id": "{{.Header.Get \"X-Request-Id\"}}"
+//   },
+//   "body": "{\"id\": \"{{index .Captures \"id\"}}\", \"q\": \"{{.Query.Get \"q\"}}\", \"at\": {{now.Unix}}}"
+// }
+func responseFromJSON(b []byte) (*parse.Result, error) {
+	msg := &responseJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	status := msg.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status < 100 || status > 999 {
+		return nil, fmt.Errorf("mock.Response: invalid status %d", status)
+	}
+
+	r := NewResponse(status)
+	for name, text := range msg.Headers {
+		if err := r.SetHeader(name, text); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.SetBody(msg.Body); err != nil {
+		return nil, err
+	}
+
+	return parse.NewResult(r, msg.Scope)
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/martianurl"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+func TestResponse(t *testing.T) {
+	r := NewResponse(201)
+	if err := r.SetHeader("content-type", "application/json"); err != nil {
+		t.Fatalf("SetHeader(): got %v, want no error", err)
+	}
+	if err := r.SetHeader("X-Request-Id", `{{.Header.Get "X-Request-Id"}}`); err != nil {
+		t.Fatalf("SetHeader(): got %v, want no error", err)
+	}
+	if err := r.SetBody(`{{.Method}} {{.Scheme}}://{{.Host}}{{.Path}} q={{.Query.Get "q"}} user={{.JSON.user.name | upper}} ctx={{if .ID}}set{{end}} at={{now.Unix}}`); err != nil {
+		t.Fatalf("SetBody(): got %v, want no error", err)
+	}
+
+	req, err := http.NewRequest("POST", "http://example.com/users?q=martian", strings.NewReader(`{"user":{"name":"gopher"}}`))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("X-Request-Id", "abc-123")
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := r.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if !ctx.SkippingRoundTrip() {
+		t.Error("ctx.SkippingRoundTrip(): got false, want true")
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	res.Header.Set("Server", "upstream")
+	if err := r.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.StatusCode, 201; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Content-Type", got, want)
+	}
+	if got, want := res.Header.Get("X-Request-Id"), "abc-123"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "X-Request-Id", got, want)
+	}
+	if got := res.Header.Get("Server"); got != "" {
+		t.Errorf("res.Header.Get(%q): got %q, want no header", "Server", got)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := res.ContentLength, int64(len(got)); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+
+	want := "POST http://example.com/users q=martian user=GOPHER ctx=set at="
+	if !strings.HasPrefix(string(got), want) {
+		t.Fatalf("res.Body: got %q, want prefix %q", got, want)
+	}
+	at, err := strconv.ParseInt(strings.TrimPrefix(string(got), want), 10, 64)
+	if err != nil {
+		t.Fatalf("strconv.ParseInt(): got %v, want no error", err)
+	}
+	if d := time.Since(time.Unix(at, 0)); d < 0 || d > time.Minute {
+		t.Errorf("at: got %d, want current time", at)
+	}
+
+	// The request body is still readable after rendering.
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(b), `{"user":{"name":"gopher"}}`; got != want {
+		t.Errorf("req.Body: got %q, want %q", got, want)
+	}
+}
+
+func TestResponseRenderError(t *testing.T) {
+	r := NewResponse(200)
+	if err := r.SetBody(`{{.Missing}}`); err != nil {
+		t.Fatalf("SetBody(): got %v, want no error", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	res := proxyutil.NewResponse(200, nil, req)
+
+	if err := r.ModifyResponse(res); err == nil {
+		t.Fatal("ModifyResponse(): got no error, want error")
+	}
+	if got, want := res.StatusCode, 500; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	if err := r.SetBody(`{{.Method`); err == nil {
+		t.Error("SetBody(): got no error, want error")
+	}
+}
+
+func TestResponseFromJSON(t *testing.T) {
+	msg := []byte(`{
+	  "url.RegexFilter": {
+	    "scope": ["request", "response"],
+	    "regex": "/users/(?P<id>\\d+)$",
+	    "modifier": {
+	      "mock.Response": {
+	        "scope": ["request", "response"],
+	        "headers": {
+	          "Content-Type": "application/json",
+	          "X-Mock-Id": "{{uuid}}"
+	        },
+	        "body": "{\"id\":{{index .Captures \"id\"}},\"path\":{{json .Path}},\"first\":\"{{index .Captures \"1\"}}\"}"
+	      }
+	    }
+	  }
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	reqmod := r.RequestModifier()
+	if reqmod == nil {
+		t.Fatal("reqmod: got nil, want not nil")
+	}
+	resmod := r.ResponseModifier()
+	if resmod == nil {
+		t.Fatal("resmod: got nil, want not nil")
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/users/42", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := reqmod.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if got, want := martianurl.RegexCaptures(req)["id"], "42"; got != want {
+		t.Errorf("martianurl.RegexCaptures()[%q]: got %q, want %q", "id", got, want)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := resmod.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`); !uuid.MatchString(res.Header.Get("X-Mock-Id")) {
+		t.Errorf("res.Header.Get(%q): got %q, want UUID", "X-Mock-Id", res.Header.Get("X-Mock-Id"))
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(got), `{"id":42,"path":"/users/42","first":"42"}`; got != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	for _, msg := range []string{
+		`{"mock.Response": {"status": 42}}`,
+		`{"mock.Response": {"body": "{{"}}`,
+		`{"mock.Response": {"headers": {"X-Bad": "{{end}}"}}}`,
+	} {
+		if _, err := parse.FromJSON([]byte(msg)); err == nil {
+			t.Errorf("parse.FromJSON(%s): got no error, want error", msg)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -74,69 +75,78 @@ func (f *Filter) SetResponseModifier(resmod martian.ResponseModifier) {
 	f.resmod = resmod
 }
 
-// ModifyRequest runs the modifier if the port matches the provided port.
+// ModifyRequest runs the modifier if the port matches the provided port. It
+// returns an error if the request URL has a malformed port.
 func (f *Filter) ModifyRequest(req *http.Request) error {
-	var defaultPort int
-	if req.URL.Scheme == "http" {
-		defaultPort = 80
+	ok, err := f.matches(req.URL)
+	if err != nil {
+		return err
 	}
-	if req.URL.Scheme == "https" {
-		defaultPort = 443
+	if ok {
+		return f.reqmod.ModifyRequest(req)
 	}
 
-	hasPort := strings.Contains(req.URL.Host, ":")
-	if hasPort {
-		_, p, err := net.SplitHostPort(req.URL.Host)
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		pt, err := strconv.Atoi(p)
-		if err != nil {
-			return err
-		}
-		if pt == f.port {
-			return f.reqmod.ModifyRequest(req)
-		}
+// ModifyResponse runs the modifier if the request URL matches urlMatcher. It
+// returns an error if the request URL has a malformed port.
+func (f *Filter) ModifyResponse(res *http.Response) error {
+	if res.Request == nil {
 		return nil
 	}
 
-	// no port explictly declared - default port
-	if f.port == defaultPort {
-		return f.reqmod.ModifyRequest(req)
+	ok, err := f.matches(res.Request.URL)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return f.resmod.ModifyResponse(res)
 	}
 
 	return nil
 }
 
-// ModifyResponse runs the modifier if the request URL matches urlMatcher.
-func (f *Filter) ModifyResponse(res *http.Response) error {
-	var defaultPort int
-	if res.Request.URL.Scheme == "http" {
-		defaultPort = 80
-	}
-	if res.Request.URL.Scheme == "https" {
-		defaultPort = 443
+// MatchRequest returns true if the port of the request URL matches the port
+// of the filter, so that the filter can be used as a condition. A malformed
+// port does not match.
+func (f *Filter) MatchRequest(req *http.Request) bool {
+	ok, _ := f.matches(req.URL)
+	return ok
+}
+
+// MatchResponse returns true if the port of the URL of the request of the
+// response matches the port of the filter. A malformed port does not match.
+func (f *Filter) MatchResponse(res *http.Response) bool {
+	if res.Request == nil {
+		return false
 	}
 
-	if !strings.Contains(res.Request.URL.Host, ":") && (f.port == defaultPort) {
-		return f.resmod.ModifyResponse(res)
+	ok, _ := f.matches(res.Request.URL)
+	return ok
+}
+
+func (f *Filter) matches(u *url.URL) (bool, error) {
+	if !strings.Contains(u.Host, ":") {
+		switch u.Scheme {
+		case "http":
+			return f.port == 80, nil
+		case "https":
+			return f.port == 443, nil
+		}
+		return f.port == 0, nil
 	}
 
-	_, p, err := net.SplitHostPort(res.Request.URL.Host)
+	_, p, err := net.SplitHostPort(u.Host)
 	if err != nil {
-		return err
+		return false, err
 	}
-
 	pt, err := strconv.Atoi(p)
 	if err != nil {
-		return err
-	}
-	if pt == f.port {
-		return f.resmod.ModifyResponse(res)
+		return false, err
 	}
 
-	return nil
+	return pt == f.port, nil
 }
 
 func filterFromJSON(b []byte) (*parse.Result, error) {
@@ -146,22 +156,24 @@ func filterFromJSON(b []byte) (*parse.Result, error) {
 	}
 
 	filter := NewFilter(msg.Port)
-	r, err := parse.FromJSON(msg.Modifier)
-	if err != nil {
-		return nil, err
-	}
+	if len(msg.Modifier) > 0 {
+		r, err := parse.FromJSON(msg.Modifier)
+		if err != nil {
+			return nil, err
+		}
 
-	reqmod := r.RequestModifier()
-	if err != nil {
-		return nil, err
-	}
-	if reqmod != nil {
-		filter.SetRequestModifier(reqmod)
-	}
+		reqmod := r.RequestModifier()
+		if err != nil {
+			return nil, err
+		}
+		if reqmod != nil {
+			filter.SetRequestModifier(reqmod)
+		}
 
-	resmod := r.ResponseModifier()
-	if resmod != nil {
-		filter.SetResponseModifier(resmod)
+		resmod := r.ResponseModifier()
+		if resmod != nil {
+			filter.SetResponseModifier(resmod)
+		}
 	}
 
 	return parse.NewResult(filter, msg.Scope)
@@ -90,6 +90,43 @@ func TestFilterModifyRequest(t *testing.T) {
 		if tm.RequestModified() != tc.want {
 			t.Errorf("%d. tm.RequestModified(): got %t, want %t", i, tm.RequestModified(), tc.want)
 		}
+		if got, want := mod.MatchRequest(req), tc.want; got != want {
+			t.Errorf("%d. mod.MatchRequest(): got %t, want %t", i, got, want)
+		}
+	}
+}
+
+func TestFilterInvalidPorts(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("NewRequest(): got %v, want no error", err)
+	}
+	req.URL.Host = "example.com:http"
+
+	mod := NewFilter(80)
+	tm := martiantest.NewModifier()
+	mod.SetRequestModifier(tm)
+	mod.SetResponseModifier(tm)
+
+	if err := mod.ModifyRequest(req); err == nil {
+		t.Fatal("ModifyRequest(): got no error, want error for malformed port")
+	}
+	if tm.RequestModified() {
+		t.Error("tm.RequestModified(): got true, want false")
+	}
+	if mod.MatchRequest(req) {
+		t.Error("mod.MatchRequest(): got true, want false")
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := mod.ModifyResponse(res); err == nil {
+		t.Fatal("ModifyResponse(): got no error, want error for malformed port")
+	}
+	if tm.ResponseModified() {
+		t.Error("tm.ResponseModified(): got true, want false")
+	}
+	if mod.MatchResponse(res) {
+		t.Error("mod.MatchResponse(): got true, want false")
 	}
 }
 
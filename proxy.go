@@ -17,27 +17,42 @@ package martian
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/martian/v3/h2"
 	"github.com/google/martian/v3/log"
 	"github.com/google/martian/v3/mitm"
 	"github.com/google/martian/v3/nosigpipe"
 	"github.com/google/martian/v3/proxyutil"
 	"github.com/google/martian/v3/trafficshape"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 var errClose = errors.New("closing connection")
 var noop = Noop("martian")
 
+// connectURLKey is the session key under which the URL of the CONNECT request that established a
+// plaintext MITM tunnel is stored.
+const connectURLKey = "martian.ConnectURL"
+
+// h2cPrefaceLine is the part of the HTTP/2 connection preface that http.ReadRequest consumes as
+// a request with method PRI. The remainder of the preface stays buffered.
+// https://tools.ietf.org/html/rfc7540#section-3.5
+const h2cPrefaceLine = "PRI * HTTP/2.0\r\n\r\n"
+
 func isCloseable(err error) bool {
 	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 		return true
@@ -54,9 +69,10 @@ func isCloseable(err error) bool {
 // Proxy is an HTTP proxy with support for TLS MITM and customizable behavior.
 type Proxy struct {
 	roundTripper http.RoundTripper
-	dial         func(string, string) (net.Conn, error)
+	dial         func(context.Context, string, string) (net.Conn, error)
 	timeout      time.Duration
 	mitm         *mitm.Config
+	h2c          *h2.Config
 	proxyURL     *url.URL
 	conns        sync.WaitGroup
 	connsMu      sync.Mutex // protects conns.Add/Wait from concurrent access
@@ -82,10 +98,10 @@ func NewProxy() *Proxy {
 		reqmod:  noop,
 		resmod:  noop,
 	}
-	proxy.SetDial((&net.Dialer{
+	proxy.SetDialContext((&net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
-	}).Dial)
+	}).DialContext)
 	return proxy
 }
 
@@ -101,7 +117,7 @@ func (p *Proxy) SetRoundTripper(rt http.RoundTripper) {
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
 		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 		tr.Proxy = http.ProxyURL(p.proxyURL)
-		tr.Dial = p.dial
+		tr.DialContext = p.dial
 	}
 }
 
@@ -125,16 +141,44 @@ func (p *Proxy) SetMITM(config *mitm.Config) {
 	p.mitm = config
 }
 
+// SetH2CConfig sets the config used to relay cleartext HTTP/2 (h2c), whether the client sends the
+// connection preface directly or upgrades an HTTP/1.1 request. h2c does not require MITM. If the
+// AllowedHostsFilter of config is nil, h2c to every host is relayed as HTTP/2. When no h2c config
+// is set, the HTTP/2 config of the MITM config is used.
+func (p *Proxy) SetH2CConfig(config *h2.Config) {
+	p.h2c = config
+}
+
 // SetDial sets the dial func used to establish a connection.
+//
+// Since dial does not receive the context of the request, DNS lookups are not
+// reported in the round trip trace of requests; see SetDialContext.
 func (p *Proxy) SetDial(dial func(string, string) (net.Conn, error)) {
-	p.dial = func(a, b string) (net.Conn, error) {
-		c, e := dial(a, b)
+	p.SetDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart(network, addr)
+		}
+		c, err := dial(network, addr)
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone(network, addr, err)
+		}
+		return c, err
+	})
+}
+
+// SetDialContext sets the dial func used to establish a connection. The
+// context passed to dial carries the httptrace.ClientTrace of the request, so
+// dialers built on net.Dialer report DNS and connect timings.
+func (p *Proxy) SetDialContext(dial func(context.Context, string, string) (net.Conn, error)) {
+	p.dial = func(ctx context.Context, a, b string) (net.Conn, error) {
+		c, e := dial(ctx, a, b)
 		nosigpipe.IgnoreSIGPIPE(c)
 		return c, e
 	}
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
-		tr.Dial = p.dial
+		tr.DialContext = p.dial
 	}
 }
 
@@ -349,7 +393,8 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 				return err
 			}
 			if tlsconn.ConnectionState().NegotiatedProtocol == "h2" {
-				return p.mitm.H2Config().Proxy(p.closing, tlsconn, req.URL)
+				dctx := httptrace.WithClientTrace(req.Context(), ctx.clientTrace())
+				return p.mitm.H2Config().ProxyDial(dctx, p.dial, p.closing, tlsconn, req.URL)
 			}
 
 			var nconn net.Conn
@@ -364,6 +409,10 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 			return p.handle(ctx, nconn, brw)
 		}
 
+		// Remember the tunnel destination in case the client speaks h2c with prior knowledge, since
+		// the HTTP/2 connection preface carries no host.
+		session.Set(connectURLKey, req.URL)
+
 		// Prepend the previously read data to be read again by http.ReadRequest.
 		brw.Reader.Reset(io.MultiReader(bytes.NewReader(b), bytes.NewReader(buf), conn))
 		return p.handle(ctx, conn, brw)
@@ -397,6 +446,9 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 	defer res.Body.Close()
 	defer cconn.Close()
 
+	ctx.expectTunnel()
+	defer ctx.closeTunnel()
+
 	if err := p.resmod.ModifyResponse(res); err != nil {
 		log.Errorf("martian: error modifying CONNECT response: %v", err)
 		proxyutil.Warning(res.Header, err)
@@ -418,27 +470,185 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 	cbr := bufio.NewReader(cconn)
 	defer cbw.Flush()
 
-	copySync := func(w io.Writer, r io.Reader, donec chan<- bool) {
-		if _, err := io.Copy(w, r); err != nil && err != io.EOF {
-			log.Errorf("martian: failed to copy CONNECT tunnel: %v", err)
+	ctx.startTunnel()
+	donec := make(chan bool, 2)
+	go copySync(cbw, &tunnelReader{r: brw, ctx: ctx, fromClient: true}, donec)
+	go copySync(brw, &tunnelReader{r: cbr, ctx: ctx, fromClient: false}, donec)
+
+	log.Debugf("martian: established CONNECT tunnel, proxying traffic")
+	<-donec
+	<-donec
+	log.Debugf("martian: closed CONNECT tunnel")
+
+	return errClose
+}
+
+func copySync(w io.Writer, r io.Reader, donec chan<- bool) {
+	if _, err := io.Copy(w, r); err != nil && err != io.EOF {
+		log.Errorf("martian: failed to copy CONNECT tunnel: %v", err)
+	}
+
+	log.Debugf("martian: CONNECT tunnel finished copying")
+	donec <- true
+}
+
+// handleH2CPriorKnowledge proxies cleartext HTTP/2 from a client that started the connection with
+// the HTTP/2 connection preface. Only the first line of the preface has been read from brw. The
+// upstream host is the destination of the CONNECT tunnel the preface was sent through or, on a
+// direct connection, the :authority of the first request on the connection.
+func (p *Proxy) handleH2CPriorKnowledge(session *Session, conn net.Conn, brw *bufio.ReadWriter) error {
+	var u *url.URL
+	cr := io.Reader(brw.Reader)
+	if v, ok := session.Get(connectURLKey); ok {
+		u = v.(*url.URL)
+	} else {
+		buf := new(bytes.Buffer)
+		var err error
+		if u, err = h2cRequestURL(io.TeeReader(brw.Reader, buf)); err != nil {
+			log.Errorf("martian: failed to read h2c request from %v: %v", conn.RemoteAddr(), err)
+			return errClose
 		}
+		cr = io.MultiReader(buf, brw.Reader)
+	}
+
+	sconn, err := p.dial(context.Background(), "tcp", u.Host)
+	if err != nil {
+		log.Errorf("martian: failed to dial h2c upstream %s: %v", u.Host, err)
+		return errClose
+	}
+	defer sconn.Close()
+
+	cconn := &peekedConn{conn, io.MultiReader(strings.NewReader(h2cPrefaceLine), cr)}
 
-		log.Debugf("martian: CONNECT tunnel finished copying")
-		donec <- true
+	if h2c := p.h2cConfigForHost(u.Host); h2c != nil {
+		log.Debugf("martian: proxying h2c with prior knowledge: %s", u.Host)
+		if err := h2c.ProxyConn(p.closing, cconn, sconn, u); err != nil {
+			log.Errorf("martian: failed to proxy h2c: %v", err)
+		}
+		return errClose
 	}
 
+	log.Debugf("martian: tunnelling h2c with prior knowledge: %s", u.Host)
 	donec := make(chan bool, 2)
-	go copySync(cbw, brw, donec)
-	go copySync(brw, cbr, donec)
+	go copySync(sconn, cconn, donec)
+	go copySync(cconn, sconn, donec)
+	<-donec
+	<-donec
 
-	log.Debugf("martian: established CONNECT tunnel, proxying traffic")
+	return errClose
+}
+
+// handleUpgrade writes a 101 Switching Protocols response back to the client and proxies the
+// upgraded connection. Connections upgraded to h2c are relayed as HTTP/2 so that they are visible
+// to the HTTP/2 stream processors, any other protocol is tunnelled as is.
+func (p *Proxy) handleUpgrade(ctx *Context, req *http.Request, res *http.Response, conn net.Conn, brw *bufio.ReadWriter) error {
+	sconn, ok := res.Body.(io.ReadWriter)
+	if !ok {
+		log.Errorf("martian: upgraded response for %s does not have a writable body", req.URL)
+		return errClose
+	}
+
+	// http.Response.Write adds framing headers that are not valid for a 101, so the status line and
+	// headers are written directly.
+	if _, err := io.WriteString(brw, "HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		log.Errorf("martian: got error while writing response back to client: %v", err)
+	}
+	if err := res.Header.Write(brw); err != nil {
+		log.Errorf("martian: got error while writing response back to client: %v", err)
+	}
+	if _, err := io.WriteString(brw, "\r\n"); err != nil {
+		log.Errorf("martian: got error while writing response back to client: %v", err)
+	}
+	if err := brw.Flush(); err != nil {
+		log.Errorf("martian: got error while flushing response back to client: %v", err)
+		return errClose
+	}
+
+	ctx.startTunnel()
+	cr := &tunnelReader{r: brw.Reader, ctx: ctx, fromClient: true}
+	sr := &tunnelReader{r: sconn, ctx: ctx, fromClient: false}
+
+	if strings.EqualFold(res.Header.Get("Upgrade"), "h2c") {
+		if h2c := p.h2cConfigForHost(req.URL.Host); h2c != nil {
+			log.Debugf("martian: proxying connection upgraded to h2c: %s", req.URL.Host)
+			cc := struct {
+				io.Reader
+				io.Writer
+			}{cr, conn}
+			sc := struct {
+				io.Reader
+				io.Writer
+			}{sr, sconn}
+			if err := h2c.ProxyConn(p.closing, cc, sc, req.URL); err != nil {
+				log.Errorf("martian: failed to proxy h2c: %v", err)
+			}
+			return errClose
+		}
+	}
+
+	log.Debugf("martian: tunnelling connection upgraded to %s: %s", res.Header.Get("Upgrade"), req.URL.Host)
+	donec := make(chan bool, 2)
+	go copySync(sconn, cr, donec)
+	go copySync(conn, sr, donec)
 	<-donec
 	<-donec
-	log.Debugf("martian: closed CONNECT tunnel")
 
 	return errClose
 }
 
+// h2cConfigForHost returns the config used to relay cleartext HTTP/2 to host, or nil if h2c to host
+// should be tunnelled as is.
+func (p *Proxy) h2cConfigForHost(host string) *h2.Config {
+	c := p.h2c
+	if c == nil {
+		if p.mitm == nil {
+			return nil
+		}
+		if c = p.mitm.H2Config(); c == nil || c.AllowedHostsFilter == nil {
+			return nil
+		}
+	}
+	if c.AllowedHostsFilter != nil && !c.AllowedHostsFilter(host) {
+		return nil
+	}
+	return c
+}
+
+// h2cRequestURL reads the rest of the HTTP/2 connection preface and the frames that follow it from
+// r up to the headers of the first request, and returns the URL built from its :scheme and
+// :authority pseudo-headers.
+func h2cRequestURL(r io.Reader) (*url.URL, error) {
+	rest := make([]byte, len(http2.ClientPreface)-len(h2cPrefaceLine))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	if string(rest) != http2.ClientPreface[len(h2cPrefaceLine):] {
+		return nil, errors.New("invalid HTTP/2 connection preface")
+	}
+
+	fr := http2.NewFramer(nil, r)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		hf, ok := f.(*http2.MetaHeadersFrame)
+		if !ok {
+			continue
+		}
+
+		u := &url.URL{Scheme: hf.PseudoValue("scheme"), Host: hf.PseudoValue("authority")}
+		if u.Scheme == "" {
+			u.Scheme = "http"
+		}
+		if u.Host == "" {
+			return nil, errors.New("first request has no :authority")
+		}
+		return u, nil
+	}
+}
+
 func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error {
 	log.Debugf("martian: waiting for request: %v", conn.RemoteAddr())
 
@@ -455,6 +665,14 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		return err
 	}
 
+	if req.Method == "PRI" && req.Proto == "HTTP/2.0" && req.RequestURI == "*" {
+		return p.handleH2CPriorKnowledge(session, conn, brw)
+	}
+
+	rctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(rctx)
+
 	link(req, ctx)
 	defer unlink(req)
 
@@ -490,6 +708,30 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		return p.handleConnectRequest(ctx, req, session, brw, conn)
 	}
 
+	// Cancel the context of the request if the client disconnects while the
+	// request is handled. The connections of upgrade requests are read by the
+	// tunnel instead.
+	if req.Header.Get("Upgrade") == "" {
+		w := &connWatcher{
+			conn:    conn,
+			br:      brw.Reader,
+			cancel:  cancel,
+			timeout: p.timeout,
+			done:    make(chan struct{}),
+		}
+		session.setHijackHook(w.stop)
+		defer func() {
+			session.setHijackHook(nil)
+			w.stop()
+		}()
+
+		if req.Body == http.NoBody {
+			w.start()
+		} else {
+			req.Body = &watchedBody{ReadCloser: req.Body, w: w}
+		}
+	}
+
 	// Not a CONNECT request
 	if err := p.reqmod.ModifyRequest(req); err != nil {
 		log.Errorf("martian: error modifying request: %v", err)
@@ -512,6 +754,11 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 	// see https://github.com/google/martian/issues/298
 	res.Request = req
 
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		ctx.expectTunnel()
+		defer ctx.closeTunnel()
+	}
+
 	if err := p.resmod.ModifyResponse(res); err != nil {
 		log.Errorf("martian: error modifying response: %v", err)
 		proxyutil.Warning(res.Header, err)
@@ -521,6 +768,10 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		return nil
 	}
 
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return p.handleUpgrade(ctx, req, res, conn, brw)
+	}
+
 	var closing error
 	if req.Close || res.Close || p.Closing() {
 		log.Debugf("martian: received close request: %v", req.RemoteAddr)
@@ -530,38 +781,49 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 
 	// check if conn is a traffic shaped connection.
 	if ptsconn, ok := conn.(*trafficshape.Conn); ok {
-		ptsconn.Context = &trafficshape.Context{}
+		ptsconn.SetContext(&trafficshape.Context{})
 		// Check if the request URL matches any URLRegex in Shapes. If so, set the connections's Context
 		// with the required information, so that the Write() method of the Conn has access to it.
 		for urlregex, buckets := range ptsconn.LocalBuckets {
-			if match, _ := regexp.MatchString(urlregex, req.URL.String()); match {
-				if rangeStart := proxyutil.GetRangeStart(res); rangeStart > -1 {
-					dump, err := httputil.DumpResponse(res, false)
-					if err != nil {
-						return err
-					}
-					ptsconn.Context = &trafficshape.Context{
-						Shaping:            true,
-						Buckets:            buckets,
-						GlobalBucket:       ptsconn.GlobalBuckets[urlregex],
-						URLRegex:           urlregex,
-						RangeStart:         rangeStart,
-						ByteOffset:         rangeStart,
-						HeaderLen:          int64(len(dump)),
-						HeaderBytesWritten: 0,
-					}
-					// Get the next action to perform, if there.
-					ptsconn.Context.NextActionInfo = ptsconn.GetNextActionFromByte(rangeStart)
-					// Check if response lies in a throttled byte range.
-					ptsconn.Context.ThrottleContext = ptsconn.GetCurrentThrottle(rangeStart)
-					if ptsconn.Context.ThrottleContext.ThrottleNow {
-						ptsconn.Context.Buckets.WriteBucket.SetCapacity(
-							ptsconn.Context.ThrottleContext.Bandwidth)
-					}
-					log.Infof(
-						"trafficshape: Request %s with Range Start: %d matches a Shaping request %s. Enforcing Traffic shaping.",
-						req.URL, rangeStart, urlregex)
+			if match, _ := regexp.MatchString(urlregex, req.URL.String()); match && ptsconn.ShapeInScope(urlregex, req, res) {
+				// Byte offsets count from the start of the body unless it is a single range of
+				// the resource.
+				rangeStart := proxyutil.GetRangeStart(res)
+				if rangeStart < 0 {
+					rangeStart = 0
 				}
+				dump, err := httputil.DumpResponse(res, false)
+				if err != nil {
+					return err
+				}
+				ptsconn.SetContext(&trafficshape.Context{
+					Shaping:            true,
+					Buckets:            buckets,
+					GlobalBucket:       ptsconn.GlobalBuckets[urlregex],
+					URLRegex:           urlregex,
+					RangeStart:         rangeStart,
+					ByteOffset:         rangeStart,
+					HeaderLen:          int64(len(dump)),
+					HeaderBytesWritten: 0,
+					RequestID:          ctx.ID(),
+					URL:                req.URL.String(),
+				})
+				ptsconn.RecordEvent(trafficshape.Event{Type: trafficshape.EventShape})
+				// Get the next action to perform, if there.
+				ptsconn.Context.NextActionInfo = ptsconn.GetNextActionFromByte(rangeStart)
+				// Check if response lies in a throttled byte range.
+				ptsconn.Context.ThrottleContext = ptsconn.GetCurrentThrottle(rangeStart)
+				if ptsconn.Context.ThrottleContext.ThrottleNow {
+					ptsconn.Context.Buckets.WriteBucket.SetCapacity(
+						ptsconn.Context.ThrottleContext.Bandwidth)
+					ptsconn.RecordEvent(trafficshape.Event{
+						Type:      trafficshape.EventThrottle,
+						Bandwidth: ptsconn.Context.ThrottleContext.Bandwidth,
+					})
+				}
+				log.Infof(
+					"trafficshape: Request %s with Range Start: %d matches a Shaping request %s. Enforcing Traffic shaping.",
+					req.URL, rangeStart, urlregex)
 				break
 			}
 		}
@@ -596,12 +858,96 @@ type peekedConn struct {
 // be read again.
 func (c *peekedConn) Read(buf []byte) (int, error) { return c.r.Read(buf) }
 
+// aLongTimeAgo is a deadline in the past, used to interrupt pending reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connWatcher cancels the context of a request when the client closes the
+// connection while the request is handled. Once the request body has been
+// read, it waits for more data on the connection: an error means the client
+// is gone, while data, such as a pipelined request, is left buffered for the
+// next request.
+type connWatcher struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	cancel  context.CancelFunc
+	timeout time.Duration
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	done    chan struct{}
+}
+
+// start starts watching the connection, unless the watcher has been stopped.
+func (w *connWatcher) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.started || w.stopped {
+		return
+	}
+	w.started = true
+
+	go func() {
+		defer close(w.done)
+
+		if _, err := w.br.Peek(1); err == nil {
+			return
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if !w.stopped {
+			log.Debugf("martian: client closed connection: %v", w.conn.RemoteAddr())
+			w.cancel()
+		}
+	}()
+}
+
+// stop stops watching the connection, interrupting a pending read, so that the
+// connection can be read by someone else.
+func (w *connWatcher) stop() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	started := w.started
+	w.mu.Unlock()
+
+	if !started {
+		return
+	}
+
+	w.conn.SetReadDeadline(aLongTimeAgo)
+	<-w.done
+	w.conn.SetReadDeadline(time.Now().Add(w.timeout))
+}
+
+// watchedBody starts its connWatcher once the request body has been read.
+type watchedBody struct {
+	io.ReadCloser
+	w *connWatcher
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.w.start()
+	}
+
+	return n, err
+}
+
 func (p *Proxy) roundTrip(ctx *Context, req *http.Request) (*http.Response, error) {
 	if ctx.SkippingRoundTrip() {
 		log.Debugf("martian: skipping round trip")
 		return proxyutil.NewResponse(200, nil, req), nil
 	}
 
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), ctx.clientTrace()))
 	return p.roundTripper.RoundTrip(req)
 }
 
@@ -609,7 +955,7 @@ func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
 	if p.proxyURL != nil {
 		log.Debugf("martian: CONNECT with downstream proxy: %s", p.proxyURL.Host)
 
-		conn, err := p.dial("tcp", p.proxyURL.Host)
+		conn, err := p.dial(req.Context(), "tcp", p.proxyURL.Host)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -629,7 +975,7 @@ func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
 
 	log.Debugf("martian: CONNECT to host directly: %s", req.URL.Host)
 
-	conn, err := p.dial("tcp", req.URL.Host)
+	conn, err := p.dial(req.Context(), "tcp", req.URL.Host)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -17,6 +17,7 @@ package martian
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -28,13 +29,18 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/martian/v3/h2"
 	"github.com/google/martian/v3/log"
 	"github.com/google/martian/v3/martiantest"
 	"github.com/google/martian/v3/mitm"
 	"github.com/google/martian/v3/proxyutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
 )
 
 type tempError struct{}
@@ -1222,6 +1228,517 @@ func TestHTTPThroughConnectWithMITM(t *testing.T) {
 	}
 }
 
+func TestIntegrationRoundTripTrace(t *testing.T) {
+	t.Parallel()
+
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer sl.Close()
+	go http.Serve(sl, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("body"))
+	}))
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	traces := make(chan RoundTripTrace, 2)
+	tm := martiantest.NewModifier()
+	tm.ResponseFunc(func(res *http.Response) {
+		traces <- NewContext(res.Request).RoundTripTrace()
+	})
+	p.SetResponseModifier(tm)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "http://"+sl.Addr().String(), nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+
+		// GET http://127.0.0.1:port/ HTTP/1.1
+		// Host: 127.0.0.1:port
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+		}
+
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	first, second := <-traces, <-traces
+
+	if first.Reused {
+		t.Error("first.Reused: got true, want false")
+	}
+	if first.ConnectStart.IsZero() || first.ConnectDone.Before(first.ConnectStart) {
+		t.Errorf("first.ConnectStart, first.ConnectDone: got %v, %v, want connect to be traced", first.ConnectStart, first.ConnectDone)
+	}
+	if !first.TLSHandshakeStart.IsZero() {
+		t.Errorf("first.TLSHandshakeStart: got %v, want zero time for plain HTTP", first.TLSHandshakeStart)
+	}
+	for name, ts := range map[string][]time.Time{
+		"GetConn":              {first.GetConn, second.GetConn},
+		"GotConn":              {first.GotConn, second.GotConn},
+		"WroteRequest":         {first.WroteRequest, second.WroteRequest},
+		"GotFirstResponseByte": {first.GotFirstResponseByte, second.GotFirstResponseByte},
+	} {
+		if ts[0].IsZero() || ts[1].IsZero() {
+			t.Errorf("%s: got %v, want non-zero times", name, ts)
+		}
+	}
+
+	if !second.Reused {
+		t.Error("second.Reused: got false, want true")
+	}
+	if !second.ConnectStart.IsZero() {
+		t.Errorf("second.ConnectStart: got %v, want zero time for reused connection", second.ConnectStart)
+	}
+	if got, want := second.LocalAddr.String(), first.LocalAddr.String(); got != want {
+		t.Errorf("second.LocalAddr: got %s, want %s", got, want)
+	}
+	if got, want := second.RemoteAddr.String(), sl.Addr().String(); got != want {
+		t.Errorf("second.RemoteAddr: got %s, want %s", got, want)
+	}
+}
+
+// pathRecorder is an HTTP/2 stream processor that records the :path of requests.
+type pathRecorder struct {
+	h2.Processor
+	paths chan string
+}
+
+func (p *pathRecorder) Header(headers []hpack.HeaderField, streamEnded bool, priority http2.PriorityParam) error {
+	for _, h := range headers {
+		if h.Name == ":path" {
+			p.paths <- h.Value
+		}
+	}
+	return p.Processor.Header(headers, streamEnded, priority)
+}
+
+// newH2CProxy returns a proxy that relays h2c for all hosts, recording the paths of requests
+// relayed as HTTP/2 in paths.
+func newH2CProxy(t *testing.T, paths chan string) *Proxy {
+	t.Helper()
+
+	p := NewProxy()
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+	mc.SetH2Config(&h2.Config{
+		AllowedHostsFilter: func(string) bool { return true },
+		StreamProcessorFactories: []h2.StreamProcessorFactory{
+			func(_ *url.URL, sinks *h2.Processors) (h2.Processor, h2.Processor) {
+				return &pathRecorder{sinks.ForDirection(h2.ClientToServer), paths}, nil
+			},
+		},
+	})
+	p.SetMITM(mc)
+
+	return p
+}
+
+// newH2CServer starts a server that accepts h2c with prior knowledge and through Upgrade, and
+// responds with the protocol of the request.
+func newH2CServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	sl, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	h := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Proto))
+	})
+	go http.Serve(sl, h2c.NewHandler(h, &http2.Server{}))
+
+	return sl
+}
+
+func TestIntegrationH2CPriorKnowledge(t *testing.T) {
+	t.Parallel()
+
+	sl := newH2CServer(t)
+	defer sl.Close()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	paths := make(chan string, 1)
+	p := newH2CProxy(t, paths)
+	defer p.Close()
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("CONNECT", "//"+sl.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	// CONNECT [::]:port HTTP/1.1
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	tr := &http2.Transport{AllowHTTP: true}
+	cc, err := tr.NewClientConn(conn)
+	if err != nil {
+		t.Fatalf("tr.NewClientConn(): got %v, want no error", err)
+	}
+
+	req, err = http.NewRequest("GET", "http://"+sl.Addr().String()+"/h2c", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res, err = cc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("cc.RoundTrip(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "HTTP/2.0"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	select {
+	case path := <-paths:
+		if want := "/h2c"; path != want {
+			t.Errorf(":path: got %q, want %q", path, want)
+		}
+	case <-time.After(time.Second):
+		t.Error("request was not relayed through the HTTP/2 stream processors")
+	}
+}
+
+func TestIntegrationH2CPriorKnowledgeWithoutMITM(t *testing.T) {
+	t.Parallel()
+
+	sl := newH2CServer(t)
+	defer sl.Close()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	paths := make(chan string, 1)
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetH2CConfig(&h2.Config{
+		StreamProcessorFactories: []h2.StreamProcessorFactory{
+			func(_ *url.URL, sinks *h2.Processors) (h2.Processor, h2.Processor) {
+				return &pathRecorder{sinks.ForDirection(h2.ClientToServer), paths}, nil
+			},
+		},
+	})
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	// The client speaks h2c to the proxy directly, the upstream is taken from :authority.
+	tr := &http2.Transport{AllowHTTP: true}
+	cc, err := tr.NewClientConn(conn)
+	if err != nil {
+		t.Fatalf("tr.NewClientConn(): got %v, want no error", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://"+sl.Addr().String()+"/h2c", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("cc.RoundTrip(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "HTTP/2.0"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	select {
+	case path := <-paths:
+		if want := "/h2c"; path != want {
+			t.Errorf(":path: got %q, want %q", path, want)
+		}
+	case <-time.After(time.Second):
+		t.Error("request was not relayed through the HTTP/2 stream processors")
+	}
+}
+
+func TestIntegrationH2CUpgrade(t *testing.T) {
+	t.Parallel()
+
+	sl := newH2CServer(t)
+	defer sl.Close()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	paths := make(chan string, 1)
+	p := newH2CProxy(t, paths)
+	defer p.Close()
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://"+sl.Addr().String()+"/upgrade", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", "")
+
+	// GET http://[::]:port/upgrade HTTP/1.1
+	// Connection: Upgrade, HTTP2-Settings
+	// Upgrade: h2c
+	// HTTP2-Settings:
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.StatusCode, 101; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Upgrade"), "h2c"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Upgrade", got, want)
+	}
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatalf("io.WriteString(): got %v, want no error", err)
+	}
+	fr := http2.NewFramer(conn, br)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatalf("fr.WriteSettings(): got %v, want no error", err)
+	}
+
+	// The response to the upgrade request is sent on stream 1.
+	var body []byte
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("fr.ReadFrame(): got %v, want no error", err)
+		}
+		if df, ok := f.(*http2.DataFrame); ok && df.StreamID == 1 {
+			body = append(body, df.Data()...)
+			if df.StreamEnded() {
+				break
+			}
+		}
+	}
+
+	if got, want := string(body), "HTTP/2.0"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+
+	// A subsequent request on the upgraded connection is relayed as HTTP/2.
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: sl.Addr().String()})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/h2c"})
+	if err := fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: hbuf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	}); err != nil {
+		t.Fatalf("fr.WriteHeaders(): got %v, want no error", err)
+	}
+
+	select {
+	case path := <-paths:
+		if want := "/h2c"; path != want {
+			t.Errorf(":path: got %q, want %q", path, want)
+		}
+	case <-time.After(time.Second):
+		t.Error("request was not relayed through the HTTP/2 stream processors")
+	}
+}
+
+func TestIntegrationH2CUpstream(t *testing.T) {
+	t.Parallel()
+
+	sl := newH2CServer(t)
+	defer sl.Close()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	paths := make(chan string, 1)
+	p := newH2CProxy(t, paths)
+	defer p.Close()
+
+	p.mitm.H2Config().H2CHostsFilter = func(string) bool { return true }
+
+	dials := make(chan string, 1)
+	p.SetDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials <- addr
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("CONNECT", "//"+sl.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	// CONNECT [::]:port HTTP/1.1
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	// The client speaks h2 over TLS to the proxy, which relays it as h2c to the server.
+	tlsconn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	if err := tlsconn.Handshake(); err != nil {
+		t.Fatalf("tlsconn.Handshake(): got %v, want no error", err)
+	}
+	if got, want := tlsconn.ConnectionState().NegotiatedProtocol, "h2"; got != want {
+		t.Fatalf("NegotiatedProtocol: got %q, want %q", got, want)
+	}
+
+	tr := &http2.Transport{}
+	cc, err := tr.NewClientConn(tlsconn)
+	if err != nil {
+		t.Fatalf("tr.NewClientConn(): got %v, want no error", err)
+	}
+
+	req, err = http.NewRequest("GET", "https://"+sl.Addr().String()+"/upstream", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res, err = cc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("cc.RoundTrip(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "HTTP/2.0"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	select {
+	case addr := <-dials:
+		if want := sl.Addr().String(); addr != want {
+			t.Errorf("dial: got %q, want %q", addr, want)
+		}
+	default:
+		t.Error("h2c upstream was not dialed through the dial func of the proxy")
+	}
+
+	select {
+	case path := <-paths:
+		if want := "/upstream"; path != want {
+			t.Errorf(":path: got %q, want %q", path, want)
+		}
+	case <-time.After(time.Second):
+		t.Error("request was not relayed through the HTTP/2 stream processors")
+	}
+}
+
 func TestServerClosesConnection(t *testing.T) {
 	t.Parallel()
 
@@ -1350,3 +1867,253 @@ func TestRacyClose(t *testing.T) {
 		openAndConnect()
 	}
 }
+
+type tunnelRecorder struct {
+	mu       sync.Mutex
+	sent     bytes.Buffer
+	received bytes.Buffer
+	closec   chan TunnelStats
+}
+
+func (tr *tunnelRecorder) TunnelData(fromClient bool, b []byte) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if fromClient {
+		tr.sent.Write(b)
+	} else {
+		tr.received.Write(b)
+	}
+}
+
+func (tr *tunnelRecorder) TunnelClosed(stats TunnelStats) {
+	tr.closec <- stats
+}
+
+func TestIntegrationConnectTunnelObserver(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	el, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer el.Close()
+
+	go func() {
+		conn, err := el.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// The tunnel closes once both sides have closed their connection.
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		conn.Write(b)
+	}()
+
+	p := NewProxy()
+	defer p.Close()
+
+	tr := &tunnelRecorder{closec: make(chan TunnelStats, 1)}
+	observed := make(chan bool, 1)
+
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		req.URL.Host = el.Addr().String()
+	})
+	tm.ResponseFunc(func(res *http.Response) {
+		observed <- NewContext(res.Request).ObserveTunnel(tr)
+	})
+
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("CONNECT", "//example.com:443", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if !<-observed {
+		t.Fatal("ObserveTunnel(): got false, want true for CONNECT tunnel")
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatalf("io.ReadFull(): got %v, want no error", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("echo: got %q, want %q", got, "hello")
+	}
+	conn.Close()
+
+	var stats TunnelStats
+	select {
+	case stats = <-tr.closec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TunnelClosed(): not called within 5s")
+	}
+
+	if got, want := stats.BytesSent, int64(5); got != want {
+		t.Errorf("stats.BytesSent: got %d, want %d", got, want)
+	}
+	if got, want := stats.BytesReceived, int64(5); got != want {
+		t.Errorf("stats.BytesReceived: got %d, want %d", got, want)
+	}
+	if stats.Start.IsZero() || stats.End.Before(stats.Start) {
+		t.Errorf("stats: got start %v and end %v, want end after start", stats.Start, stats.End)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if got, want := tr.sent.String(), "hello"; got != want {
+		t.Errorf("sent: got %q, want %q", got, want)
+	}
+	if got, want := tr.received.String(), "hello"; got != want {
+		t.Errorf("received: got %q, want %q", got, want)
+	}
+}
+
+func TestObserveTunnelWithoutTunnel(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if ctx.ObserveTunnel(&tunnelRecorder{}) {
+		t.Error("ObserveTunnel(): got true, want false for request without tunnel")
+	}
+}
+
+func TestIntegrationCancelsRequestOnClientDisconnect(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(martiantest.NewTransport())
+
+	errc := make(chan error, 1)
+	p.SetRequestModifier(RequestModifierFunc(func(req *http.Request) error {
+		select {
+		case <-req.Context().Done():
+			errc <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			errc <- errors.New("request not canceled")
+		}
+		return nil
+	}))
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	conn.Close()
+
+	if got, want := <-errc, context.Canceled; got != want {
+		t.Errorf("req.Context().Err(): got %v, want %v", got, want)
+	}
+}
+
+func TestIntegrationPipelinedRequests(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(martiantest.NewTransport())
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	var reqs []*http.Request
+	buf := new(bytes.Buffer)
+	for _, body := range []string{"", "body"} {
+		req, err := http.NewRequest("POST", "http://example.com", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		if err := req.WriteProxy(buf); err != nil {
+			t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+		}
+		reqs = append(reqs, req)
+	}
+
+	// Both requests are sent before the first response is read.
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	for i, req := range reqs {
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("%d. http.ReadResponse(): got %v, want no error", i, err)
+		}
+		res.Body.Close()
+
+		if got, want := res.StatusCode, 200; got != want {
+			t.Errorf("%d. res.StatusCode: got %d, want %d", i, got, want)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -662,3 +663,195 @@ func TestConcurrentResponseActions(t *testing.T) {
 		t.Errorf("res.Body: got %s, want %s", bodystr2, want2)
 	}
 }
+
+// Tests that shapes apply to responses without a single byte range, counting
+// from the start of the body, and only to requests and responses within their
+// scope.
+func TestShapeScopeAndMultipartByteRanges(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := trafficshape.NewListener(l)
+	tsh := trafficshape.NewHandler(tsl)
+
+	testString := strings.Repeat("0", 500)
+
+	jsonString := `{"trafficshape":{"shapes":[{"url_regex":"http://example/example","methods":["GET"],"content_types":["multipart/*"],"close_connections":[{"byte":100,"count":-1}]}]}}`
+
+	tsReq, err := http.NewRequest("POST", "test", bytes.NewBufferString(jsonString))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw := httptest.NewRecorder()
+	tsh.ServeHTTP(rw, tsReq)
+
+	if got, want := rw.Code, 200; got != want {
+		t.Fatalf("rw.Code: got %d, want %d", got, want)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(martiantest.NewTransport())
+	p.SetTimeout(15 * time.Second)
+
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		ctx := NewContext(req)
+		ctx.SkipRoundTrip()
+	})
+	tm.ResponseFunc(func(res *http.Response) {
+		res.StatusCode = http.StatusPartialContent
+		res.Header.Set("Content-Type", "multipart/byteranges; boundary=b")
+		res.ContentLength = int64(len(testString))
+		res.Body = ioutil.NopCloser(bytes.NewBufferString(testString))
+	})
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.Serve(tsl)
+
+	tt := []struct {
+		method string
+		want   string
+	}{
+		{method: "GET", want: strings.Repeat("0", 100)},
+		{method: "POST", want: testString},
+	}
+
+	for i, tc := range tt {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%d. net.Dial(): got %v, want no error", i, err)
+		}
+		defer conn.Close()
+
+		req, err := http.NewRequest(tc.method, "http://example/example", nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("%d. req.WriteProxy(): got %v, want no error", i, err)
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatalf("%d. http.ReadResponse(): got %v, want no error", i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if got := string(body); got != tc.want {
+			t.Errorf("%d. %s res.Body: got %d bytes, want %d", i, tc.method, len(got), len(tc.want))
+		}
+	}
+}
+
+func TestTrafficShapingEvents(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := trafficshape.NewListener(l)
+	tsh := trafficshape.NewHandler(tsl)
+
+	var mu sync.Mutex
+	var events []trafficshape.Event
+	tsl.SetEventObserver(func(e trafficshape.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		events = append(events, e)
+	})
+
+	testString := strings.Repeat("0", 500)
+
+	jsonString := `{"trafficshape":{"shapes":[{"url_regex":"http://example/example","halts":[{"byte":100,"duration":10,"count":1}],"close_connections":[{"byte":200,"count":1}]}]}}`
+
+	tsReq, err := http.NewRequest("POST", "test", bytes.NewBufferString(jsonString))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw := httptest.NewRecorder()
+	tsh.ServeHTTP(rw, tsReq)
+
+	if got, want := rw.Code, 200; got != want {
+		t.Fatalf("rw.Code: got %d, want %d", got, want)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(martiantest.NewTransport())
+	p.SetTimeout(15 * time.Second)
+
+	var id string
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		ctx := NewContext(req)
+		ctx.SkipRoundTrip()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		id = ctx.ID()
+	})
+	tm.ResponseFunc(func(res *http.Response) {
+		res.StatusCode = http.StatusOK
+		res.Body = ioutil.NopCloser(bytes.NewBufferString(testString))
+	})
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.Serve(tsl)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://example/example", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+		if got, want := e.RequestID, id; got != want {
+			t.Errorf("%s event RequestID: got %q, want %q", e.Type, got, want)
+		}
+		if got, want := e.URLRegex, "http://example/example"; got != want {
+			t.Errorf("%s event URLRegex: got %q, want %q", e.Type, got, want)
+		}
+	}
+	if got, want := strings.Join(types, ","), "shape,halt,close"; got != want {
+		t.Fatalf("event types: got %s, want %s", got, want)
+	}
+	if got, want := events[1].ByteOffset, int64(100); got != want {
+		t.Errorf("halt ByteOffset: got %d, want %d", got, want)
+	}
+	if got, want := events[1].Duration, int64(10); got != want {
+		t.Errorf("halt Duration: got %d, want %d", got, want)
+	}
+	if got, want := events[2].ByteOffset, int64(200); got != want {
+		t.Errorf("close ByteOffset: got %d, want %d", got, want)
+	}
+}
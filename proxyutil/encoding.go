@@ -0,0 +1,246 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyutil
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// ContentEncoding decodes and encodes message bodies with a Content-Encoding.
+type ContentEncoding struct {
+	// NewReader returns a reader of the decoded body read from r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+	// NewWriter returns a writer that encodes the body to w. Closing it
+	// flushes the encoded body, but does not close w.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// UnsupportedEncodingError is returned for bodies with a Content-Encoding that
+// has not been registered, such as "zstd".
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("proxyutil: unsupported content encoding %q", e.Encoding)
+}
+
+var gzipEncoding = &ContentEncoding{
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+}
+
+// deflateEncoding reads both the zlib format required by HTTP and the raw
+// deflate format sent by some servers, and writes the zlib format.
+var deflateEncoding = &ContentEncoding{
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		br := bufio.NewReader(r)
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	},
+}
+
+var brotliEncoding = &ContentEncoding{
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriter(w), nil
+	},
+}
+
+var (
+	encodingsMu sync.RWMutex
+	encodings   = map[string]*ContentEncoding{
+		"gzip":    gzipEncoding,
+		"x-gzip":  gzipEncoding,
+		"deflate": deflateEncoding,
+		"br":      brotliEncoding,
+	}
+)
+
+// RegisterContentEncoding registers ce for the Content-Encoding name, such as
+// "zstd", replacing any encoding registered with the same name. Gzip, deflate
+// and br are registered by default.
+func RegisterContentEncoding(name string, ce *ContentEncoding) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	encodings[strings.ToLower(name)] = ce
+}
+
+// contentEncodings returns the registered encodings of header in the order
+// they were applied.
+func contentEncodings(header http.Header) ([]*ContentEncoding, error) {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+
+	var ces []*ContentEncoding
+	for _, v := range header["Content-Encoding"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" || name == "identity" {
+				continue
+			}
+
+			ce, ok := encodings[name]
+			if !ok {
+				return nil, &UnsupportedEncodingError{Encoding: name}
+			}
+			ces = append(ces, ce)
+		}
+	}
+
+	return ces, nil
+}
+
+// HasContentEncoding returns whether the Content-Encoding of header is
+// supported, that is every encoding in it has been registered.
+func HasContentEncoding(header http.Header) bool {
+	_, err := contentEncodings(header)
+	return err == nil
+}
+
+type contentReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (cr *contentReader) Close() error {
+	var err error
+	for i := len(cr.closers) - 1; i >= 0; i-- {
+		if cerr := cr.closers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewContentReader returns a reader of the body read from r decoded
+// according to the Content-Encoding of header. Closing it closes r if it is
+// an io.Closer.
+func NewContentReader(header http.Header, r io.Reader) (io.ReadCloser, error) {
+	ces, err := contentEncodings(header)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &contentReader{Reader: r}
+	if c, ok := r.(io.Closer); ok {
+		cr.closers = append(cr.closers, c)
+	}
+	// Encodings are listed in the order they were applied, so they are
+	// decoded in reverse.
+	for i := len(ces) - 1; i >= 0; i-- {
+		dr, err := ces[i].NewReader(cr.Reader)
+		if err != nil {
+			cr.Close()
+			return nil, err
+		}
+		cr.Reader = dr
+		cr.closers = append(cr.closers, dr)
+	}
+
+	return cr, nil
+}
+
+type contentWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (cw *contentWriter) Close() error {
+	var err error
+	for i := len(cw.closers) - 1; i >= 0; i-- {
+		if cerr := cw.closers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewContentWriter returns a writer that encodes a body to w according to
+// the Content-Encoding of header. Closing it flushes the encoded body, but
+// does not close w.
+func NewContentWriter(header http.Header, w io.Writer) (io.WriteCloser, error) {
+	ces, err := contentEncodings(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// The last encoding applied is the one written to w.
+	cw := &contentWriter{Writer: w}
+	for i := len(ces) - 1; i >= 0; i-- {
+		ew, err := ces[i].NewWriter(cw.Writer)
+		if err != nil {
+			return nil, err
+		}
+		cw.Writer = ew
+		cw.closers = append(cw.closers, ew)
+	}
+
+	return cw, nil
+}
+
+// DecodeContent returns body decoded according to the Content-Encoding of
+// header.
+func DecodeContent(header http.Header, body []byte) ([]byte, error) {
+	r, err := NewContentReader(header, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// EncodeContent returns body encoded according to the Content-Encoding of
+// header.
+func EncodeContent(header http.Header, body []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := NewContentWriter(header, buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
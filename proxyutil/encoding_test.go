@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyutil
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestContentEncodingRoundTrip(t *testing.T) {
+	for _, ce := range []string{"", "identity", "gzip", "x-gzip", "deflate", "br", "gzip, deflate", "br, gzip"} {
+		h := http.Header{}
+		if ce != "" {
+			h.Set("Content-Encoding", ce)
+		}
+
+		b, err := EncodeContent(h, []byte("body content"))
+		if err != nil {
+			t.Fatalf("%q: EncodeContent(): got %v, want no error", ce, err)
+		}
+		if (ce == "" || ce == "identity") != (string(b) == "body content") {
+			t.Errorf("%q: EncodeContent(): got %q", ce, b)
+		}
+
+		got, err := DecodeContent(h, b)
+		if err != nil {
+			t.Fatalf("%q: DecodeContent(): got %v, want no error", ce, err)
+		}
+		if want := "body content"; string(got) != want {
+			t.Errorf("%q: DecodeContent(): got %q, want %q", ce, got, want)
+		}
+	}
+}
+
+func TestDecodeContentRawDeflate(t *testing.T) {
+	buf := new(bytes.Buffer)
+	fw, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatalf("flate.NewWriter(): got %v, want no error", err)
+	}
+	fw.Write([]byte("raw deflate"))
+	fw.Close()
+
+	h := http.Header{}
+	h.Set("Content-Encoding", "deflate")
+
+	got, err := DecodeContent(h, buf.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeContent(): got %v, want no error", err)
+	}
+	if want := "raw deflate"; string(got) != want {
+		t.Errorf("DecodeContent(): got %q, want %q", got, want)
+	}
+}
+
+func TestRegisterContentEncoding(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Encoding", "rot13")
+
+	if HasContentEncoding(h) {
+		t.Fatal("HasContentEncoding(): got true, want false")
+	}
+	_, err := DecodeContent(h, []byte("obql"))
+	if _, ok := err.(*UnsupportedEncodingError); !ok {
+		t.Fatalf("DecodeContent(): got %v, want UnsupportedEncodingError", err)
+	}
+
+	rot13 := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return 'a' + (r-'a'+13)%26
+		}
+		return r
+	}
+	RegisterContentEncoding("rot13", &ContentEncoding{
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(strings.NewReader(strings.Map(rot13, string(b)))), nil
+		},
+	})
+
+	if !HasContentEncoding(h) {
+		t.Fatal("HasContentEncoding(): got false, want true")
+	}
+	got, err := DecodeContent(h, []byte("obql"))
+	if err != nil {
+		t.Fatalf("DecodeContent(): got %v, want no error", err)
+	}
+	if want := "body"; string(got) != want {
+		t.Errorf("DecodeContent(): got %q, want %q", got, want)
+	}
+}
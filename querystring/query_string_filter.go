@@ -68,13 +68,15 @@ func filterFromJSON(b []byte) (*parse.Result, error) {
 
 	f := NewFilter(msg.Name, msg.Value)
 
-	r, err := parse.FromJSON(msg.Modifier)
-	if err != nil {
-		return nil, err
-	}
+	if len(msg.Modifier) > 0 {
+		r, err := parse.FromJSON(msg.Modifier)
+		if err != nil {
+			return nil, err
+		}
 
-	f.RequestWhenTrue(r.RequestModifier())
-	f.ResponseWhenTrue(r.ResponseModifier())
+		f.RequestWhenTrue(r.RequestModifier())
+		f.ResponseWhenTrue(r.ResponseModifier())
+	}
 
 	if len(msg.ElseModifier) > 0 {
 		em, err := parse.FromJSON(msg.ElseModifier)
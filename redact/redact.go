@@ -0,0 +1,568 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redact provides a redaction policy that removes secrets from the
+// requests and responses recorded by the har, marbl and martianlog loggers.
+//
+// A Policy can be set on each logger directly, or added to the modifier tree
+// as a modifier ahead of the loggers, in which case every logger that handles
+// the request applies it.
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/parse"
+)
+
+const key = "redact.Policy"
+
+// DefaultMask replaces redacted values unless another mask is set.
+const DefaultMask = "[REDACTED]"
+
+// Policy is a set of rules that select the parts of HTTP messages that must
+// not be logged. Methods on a nil Policy return their input unchanged.
+type Policy struct {
+	mu       sync.RWMutex
+	mask     string
+	hash     bool
+	hashKey  []byte
+	headers  map[string]bool
+	cookies  map[string]bool
+	params   map[string]bool
+	paths    [][]string
+	patterns []*regexp.Regexp
+}
+
+type policyJSON struct {
+	Mask        string               `json:"mask"`
+	Hash        bool                 `json:"hash"`
+	HashKey     string               `json:"hashKey"`
+	Headers     []string             `json:"headers"`
+	Cookies     []string             `json:"cookies"`
+	QueryParams []string             `json:"queryParams"`
+	JSONPaths   []string             `json:"jsonPaths"`
+	Patterns    []string             `json:"patterns"`
+	Scope       []parse.ModifierType `json:"scope"`
+}
+
+func init() {
+	parse.Register("redact.Policy", policyFromJSON)
+}
+
+// NewPolicy returns a Policy without any rules that masks values with
+// DefaultMask.
+func NewPolicy() *Policy {
+	return &Policy{
+		mask:    DefaultMask,
+		headers: make(map[string]bool),
+		cookies: make(map[string]bool),
+		params:  make(map[string]bool),
+	}
+}
+
+// FromContext returns the Policy attached to the request context by a Policy
+// modifier, or nil if there is none.
+func FromContext(ctx *martian.Context) *Policy {
+	if ctx == nil {
+		return nil
+	}
+	if v, ok := ctx.Get(key); ok {
+		return v.(*Policy)
+	}
+	return nil
+}
+
+// ModifyRequest attaches the policy to the request context, so that loggers
+// later in the modifier tree redact the request and its response.
+func (p *Policy) ModifyRequest(req *http.Request) error {
+	if ctx := martian.NewContext(req); ctx != nil {
+		ctx.Set(key, p)
+	}
+	return nil
+}
+
+// ModifyResponse attaches the policy to the context of the request of the
+// response.
+func (p *Policy) ModifyResponse(res *http.Response) error {
+	return p.ModifyRequest(res.Request)
+}
+
+// SetMask sets the string that replaces redacted values.
+func (p *Policy) SetMask(mask string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.mask = mask
+}
+
+// SetHash sets whether redacted values are replaced with the mask followed by
+// a short hash of the value, so that equal values can be correlated across
+// messages without being revealed.
+func (p *Policy) SetHash(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.hash = enabled
+}
+
+// SetHashKey sets a secret key for hashing, which prevents recovering short
+// values by hashing candidates.
+func (p *Policy) SetHashKey(key []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.hashKey = key
+}
+
+// RedactHeaders redacts the values of the named headers.
+func (p *Policy) RedactHeaders(names ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, n := range names {
+		p.headers[http.CanonicalHeaderKey(n)] = true
+	}
+}
+
+// RedactCookies redacts the values of the named cookies in Cookie and
+// Set-Cookie headers.
+func (p *Policy) RedactCookies(names ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, n := range names {
+		p.cookies[n] = true
+	}
+}
+
+// RedactQueryParams redacts the values of the named parameters in URLs and in
+// URL encoded bodies.
+func (p *Policy) RedactQueryParams(names ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, n := range names {
+		p.params[n] = true
+	}
+}
+
+// RedactJSONPaths redacts values in JSON bodies. Paths are dot separated
+// object keys or array indexes, optionally prefixed with "$.", where "*"
+// matches any key or index (e.g. "user.password" or "items.*.token").
+func (p *Policy) RedactJSONPaths(paths ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, path := range paths {
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+		p.paths = append(p.paths, strings.Split(path, "."))
+	}
+}
+
+// RedactPattern redacts every match of re in header values, URLs and bodies.
+func (p *Policy) RedactPattern(re *regexp.Regexp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.patterns = append(p.patterns, re)
+}
+
+// HasBodyRules returns whether the policy may change bodies.
+func (p *Policy) HasBodyRules() bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.paths) > 0 || len(p.patterns) > 0 || len(p.params) > 0
+}
+
+// Value returns the replacement for a redacted value.
+func (p *Policy) Value(v string) string {
+	if p == nil {
+		return v
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.value(v)
+}
+
+// Header returns the value of a header with the policy applied.
+func (p *Policy) Header(name, value string) string {
+	if p == nil {
+		return value
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	name = http.CanonicalHeaderKey(name)
+	if p.headers[name] {
+		return p.value(value)
+	}
+
+	switch name {
+	case "Cookie":
+		value = p.cookieHeader(value, ";")
+	case "Set-Cookie":
+		value = p.setCookieHeader(value)
+	case "Location", "Referer", "Content-Location":
+		value = p.url(value)
+	}
+
+	return p.text(value)
+}
+
+// Cookie returns the value of a cookie with the policy applied.
+func (p *Policy) Cookie(name, value string) string {
+	if p == nil {
+		return value
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.cookies[name] {
+		return p.value(value)
+	}
+	return p.text(value)
+}
+
+// QueryParam returns the value of a URL or form parameter with the policy
+// applied.
+func (p *Policy) QueryParam(name, value string) string {
+	if p == nil {
+		return value
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.params[name] {
+		return p.value(value)
+	}
+	return p.text(value)
+}
+
+// URL returns rawurl with the values of redacted query parameters replaced
+// and the patterns applied. The order of the parameters is preserved.
+func (p *Policy) URL(rawurl string) string {
+	if p == nil {
+		return rawurl
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.text(p.url(rawurl))
+}
+
+// Query returns the URL encoded query q with the values of redacted
+// parameters replaced and the patterns applied.
+func (p *Policy) Query(q string) string {
+	if p == nil {
+		return q
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.params) > 0 {
+		q = p.query(q)
+	}
+	return p.text(q)
+}
+
+// Text returns s with the patterns applied.
+func (p *Policy) Text(s string) string {
+	if p == nil {
+		return s
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.text(s)
+}
+
+// Body returns the decoded body b of a message with the given Content-Type
+// with the policy applied. JSON paths apply to JSON bodies, query parameters
+// to URL encoded bodies, and patterns to any body.
+func (p *Policy) Body(contentType string, b []byte) []byte {
+	if p == nil || len(b) == 0 {
+		return b
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = strings.ToLower(contentType)
+	}
+
+	switch {
+	case len(p.paths) > 0 && (mt == "application/json" || strings.HasSuffix(mt, "+json")):
+		b = p.jsonBody(b)
+	case len(p.params) > 0 && mt == "application/x-www-form-urlencoded":
+		b = []byte(p.query(string(b)))
+	}
+
+	for _, re := range p.patterns {
+		b = re.ReplaceAllFunc(b, func(m []byte) []byte {
+			return []byte(p.value(string(m)))
+		})
+	}
+
+	return b
+}
+
+// value returns the mask, followed by a hash of v if hashing is enabled.
+// p.mu must be held.
+func (p *Policy) value(v string) string {
+	if !p.hash {
+		return p.mask
+	}
+
+	var sum []byte
+	if p.hashKey != nil {
+		mac := hmac.New(sha256.New, p.hashKey)
+		mac.Write([]byte(v))
+		sum = mac.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(v))
+		sum = s[:]
+	}
+
+	return p.mask + ":" + hex.EncodeToString(sum[:8])
+}
+
+// text applies the patterns to s. p.mu must be held.
+func (p *Policy) text(s string) string {
+	for _, re := range p.patterns {
+		s = re.ReplaceAllStringFunc(s, p.value)
+	}
+	return s
+}
+
+// url redacts the query parameters of rawurl. p.mu must be held.
+func (p *Policy) url(rawurl string) string {
+	if len(p.params) == 0 {
+		return rawurl
+	}
+
+	i := strings.Index(rawurl, "?")
+	if i < 0 {
+		return rawurl
+	}
+
+	var frag string
+	if j := strings.Index(rawurl, "#"); j > i {
+		rawurl, frag = rawurl[:j], rawurl[j:]
+	}
+
+	return rawurl[:i+1] + p.query(rawurl[i+1:]) + frag
+}
+
+// query redacts the values of parameters in a URL encoded query, preserving
+// the order and encoding of the other parameters. p.mu must be held.
+func (p *Policy) query(q string) string {
+	pairs := strings.Split(q, "&")
+	for i, pair := range pairs {
+		k := pair
+		if j := strings.Index(pair, "="); j >= 0 {
+			k = pair[:j]
+		}
+
+		name, err := url.QueryUnescape(k)
+		if err != nil || !p.params[name] {
+			continue
+		}
+
+		v := pair[len(k):]
+		if len(v) > 0 {
+			v = v[1:]
+		}
+		if uv, err := url.QueryUnescape(v); err == nil {
+			v = uv
+		}
+
+		pairs[i] = k + "=" + url.QueryEscape(p.value(v))
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// cookieHeader redacts the values of cookies in a list of name=value pairs.
+// p.mu must be held.
+func (p *Policy) cookieHeader(v, sep string) string {
+	if len(p.cookies) == 0 {
+		return v
+	}
+
+	pairs := strings.Split(v, sep)
+	for i, pair := range pairs {
+		j := strings.Index(pair, "=")
+		if j < 0 {
+			continue
+		}
+
+		if name := strings.TrimSpace(pair[:j]); p.cookies[name] {
+			pairs[i] = pair[:j+1] + p.value(pair[j+1:])
+		}
+	}
+
+	return strings.Join(pairs, sep)
+}
+
+// setCookieHeader redacts the value of the cookie set by a Set-Cookie header,
+// leaving its attributes intact. p.mu must be held.
+func (p *Policy) setCookieHeader(v string) string {
+	i := strings.Index(v, ";")
+	if i < 0 {
+		return p.cookieHeader(v, ";")
+	}
+	return p.cookieHeader(v[:i], ";") + v[i:]
+}
+
+// jsonBody redacts the JSON paths in b. Bodies that are not valid JSON are
+// returned unchanged. p.mu must be held.
+func (p *Policy) jsonBody(b []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return b
+	}
+
+	var changed bool
+	for _, path := range p.paths {
+		v = p.redactPath(v, path, &changed)
+	}
+	if !changed {
+		return b
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return b
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// redactPath replaces the values at path in v. p.mu must be held.
+func (p *Policy) redactPath(v interface{}, path []string, changed *bool) interface{} {
+	if len(path) == 0 {
+		*changed = true
+
+		var s string
+		switch tv := v.(type) {
+		case string:
+			s = tv
+		default:
+			b, _ := json.Marshal(tv)
+			s = string(b)
+		}
+		return p.value(s)
+	}
+
+	seg, rest := path[0], path[1:]
+
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for k, cv := range tv {
+			if seg == "*" || seg == k {
+				tv[k] = p.redactPath(cv, rest, changed)
+			}
+		}
+	case []interface{}:
+		if seg == "*" {
+			for i, cv := range tv {
+				tv[i] = p.redactPath(cv, rest, changed)
+			}
+			break
+		}
+		if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(tv) {
+			tv[i] = p.redactPath(tv[i], rest, changed)
+		}
+	}
+
+	return v
+}
+
+// policyFromJSON builds a redact.Policy from JSON.
+//
+// Example JSON:
+// {
+//   "redact.Policy": {
+//     "scope": ["request", "response"],
+//     "mask": "***",
+//     "hash": true,
+//     "headers": ["Authorization", "X-Api-Key"],
+//     "cookies": ["session"],
+//     "queryParams": ["access_token"],
+//     "jsonPaths": ["password", "items.*.token"],
+//     "patterns": ["\\b\\d{4}-\\d{4}-\\d{4}-\\d{4}\\b"]
+//   }
+// }
+func policyFromJSON(b []byte) (*parse.Result, error) {
+	msg := &policyJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	p := NewPolicy()
+	if msg.Mask != "" {
+		p.SetMask(msg.Mask)
+	}
+	p.SetHash(msg.Hash)
+	if msg.HashKey != "" {
+		p.SetHashKey([]byte(msg.HashKey))
+	}
+	p.RedactHeaders(msg.Headers...)
+	p.RedactCookies(msg.Cookies...)
+	p.RedactQueryParams(msg.QueryParams...)
+	p.RedactJSONPaths(msg.JSONPaths...)
+
+	for _, expr := range msg.Patterns {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		p.RedactPattern(re)
+	}
+
+	return parse.NewResult(p, msg.Scope)
+}
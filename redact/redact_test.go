@@ -0,0 +1,218 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/parse"
+)
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+
+	if got, want := p.Header("Authorization", "secret"), "secret"; got != want {
+		t.Errorf("p.Header(): got %q, want %q", got, want)
+	}
+	if got, want := p.URL("http://example.com/?token=secret"), "http://example.com/?token=secret"; got != want {
+		t.Errorf("p.URL(): got %q, want %q", got, want)
+	}
+	if got, want := string(p.Body("application/json", []byte(`{"a":1}`))), `{"a":1}`; got != want {
+		t.Errorf("p.Body(): got %q, want %q", got, want)
+	}
+	if p.HasBodyRules() {
+		t.Error("p.HasBodyRules(): got true, want false")
+	}
+}
+
+func TestPolicyHeadersAndCookies(t *testing.T) {
+	p := NewPolicy()
+	p.RedactHeaders("authorization")
+	p.RedactCookies("session")
+	p.RedactQueryParams("token")
+
+	tt := []struct {
+		name, value, want string
+	}{
+		{"Authorization", "Bearer abc", "[REDACTED]"},
+		{"Accept", "text/html", "text/html"},
+		{"Cookie", "theme=dark; session=abc", "theme=dark; session=[REDACTED]"},
+		{"Set-Cookie", "session=abc; Path=/; HttpOnly", "session=[REDACTED]; Path=/; HttpOnly"},
+		{"Set-Cookie", "theme=dark; Path=/", "theme=dark; Path=/"},
+		{"Location", "https://example.com/cb?token=abc&state=1", "https://example.com/cb?token=%5BREDACTED%5D&state=1"},
+	}
+
+	for i, tc := range tt {
+		if got := p.Header(tc.name, tc.value); got != tc.want {
+			t.Errorf("%d. p.Header(%q, %q): got %q, want %q", i, tc.name, tc.value, got, tc.want)
+		}
+	}
+
+	if got, want := p.Cookie("session", "abc"), "[REDACTED]"; got != want {
+		t.Errorf("p.Cookie(): got %q, want %q", got, want)
+	}
+}
+
+func TestPolicyURL(t *testing.T) {
+	p := NewPolicy()
+	p.SetMask("xxx")
+	p.RedactQueryParams("access_token", "key")
+
+	tt := []struct {
+		url, want string
+	}{
+		{"http://example.com/", "http://example.com/"},
+		{"http://example.com/?b=2&access_token=abc&a=1", "http://example.com/?b=2&access_token=xxx&a=1"},
+		{"http://example.com/?key&q=x#frag", "http://example.com/?key=xxx&q=x#frag"},
+		{"http://example.com/?q=%20&access%5Ftoken=abc", "http://example.com/?q=%20&access%5Ftoken=xxx"},
+	}
+
+	for i, tc := range tt {
+		if got := p.URL(tc.url); got != tc.want {
+			t.Errorf("%d. p.URL(%q): got %q, want %q", i, tc.url, got, tc.want)
+		}
+	}
+
+	if got, want := p.Query("key=abc&x=1"), "key=xxx&x=1"; got != want {
+		t.Errorf("p.Query(): got %q, want %q", got, want)
+	}
+}
+
+func TestPolicyBody(t *testing.T) {
+	p := NewPolicy()
+	p.RedactJSONPaths("$.password", "items.*.token", "list.1")
+	p.RedactQueryParams("password")
+	p.RedactPattern(regexp.MustCompile(`\d{4}-\d{4}-\d{4}-\d{4}`))
+
+	tt := []struct {
+		ct, body, want string
+	}{
+		{
+			"application/json; charset=utf-8",
+			`{"user":"martian","password":"hunter2"}`,
+			`{"password":"[REDACTED]","user":"martian"}`,
+		},
+		{
+			"application/vnd.api+json",
+			`{"items":[{"token":"a","id":1},{"token":{"nested":true}}],"list":[1,2,3]}`,
+			`{"items":[{"id":1,"token":"[REDACTED]"},{"token":"[REDACTED]"}],"list":[1,"[REDACTED]",3]}`,
+		},
+		{
+			"application/json",
+			`{"user":"<martian>"}`,
+			`{"user":"<martian>"}`,
+		},
+		{
+			"application/json",
+			`not json 1234-5678-9012-3456`,
+			`not json [REDACTED]`,
+		},
+		{
+			"application/x-www-form-urlencoded",
+			`user=martian&password=hunter2`,
+			`user=martian&password=%5BREDACTED%5D`,
+		},
+		{
+			"text/plain",
+			`card 1234-5678-9012-3456`,
+			`card [REDACTED]`,
+		},
+	}
+
+	for i, tc := range tt {
+		if got := string(p.Body(tc.ct, []byte(tc.body))); got != tc.want {
+			t.Errorf("%d. p.Body(%q): got %q, want %q", i, tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyHash(t *testing.T) {
+	p := NewPolicy()
+	p.SetHash(true)
+
+	a, b, c := p.Value("secret"), p.Value("secret"), p.Value("other")
+	if a != b {
+		t.Errorf("p.Value(): got %q and %q for equal values, want equal", a, b)
+	}
+	if a == c {
+		t.Errorf("p.Value(): got %q for different values, want different", a)
+	}
+	if !strings.HasPrefix(a, DefaultMask+":") || strings.Contains(a, "secret") {
+		t.Errorf("p.Value(): got %q, want masked hash", a)
+	}
+
+	p.SetHashKey([]byte("key"))
+	if got := p.Value("secret"); got == a {
+		t.Errorf("p.Value(): got %q with hash key, want different hash", got)
+	}
+}
+
+func TestPolicyFromJSON(t *testing.T) {
+	msg := []byte(`{
+		"redact.Policy": {
+			"scope": ["request"],
+			"mask": "***",
+			"headers": ["Authorization"],
+			"patterns": ["secret"]
+		}
+	}`)
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	reqmod := r.RequestModifier()
+	if reqmod == nil {
+		t.Fatal("reqmod: got nil, want not nil")
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if FromContext(ctx) != nil {
+		t.Fatal("FromContext(): got policy, want nil before modifier")
+	}
+	if err := reqmod.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	p := FromContext(ctx)
+	if p == nil {
+		t.Fatal("FromContext(): got nil, want policy")
+	}
+	if got, want := p.Header("Authorization", "Basic abc"), "***"; got != want {
+		t.Errorf("p.Header(): got %q, want %q", got, want)
+	}
+	if got, want := p.Text("a secret b"), "a *** b"; got != want {
+		t.Errorf("p.Text(): got %q, want %q", got, want)
+	}
+
+	if _, err := parse.FromJSON([]byte(`{"redact.Policy": {"scope": ["request"], "patterns": ["("]}}`)); err == nil {
+		t.Error("parse.FromJSON(): got no error, want error for invalid pattern")
+	}
+}
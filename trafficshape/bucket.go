@@ -30,8 +30,13 @@ type Bucket struct {
 	fill     int64 // atomic
 	mu       sync.Mutex
 
-	t      *time.Ticker
-	closec chan struct{}
+	t        *time.Ticker
+	interval time.Duration
+	closec   chan struct{}
+
+	// schedule returns the capacity for the next interval, if set.
+	smu      sync.Mutex
+	schedule func() int64
 }
 
 var (
@@ -47,6 +52,7 @@ func NewBucket(capacity int64, interval time.Duration) *Bucket {
 	b := &Bucket{
 		capacity: capacity,
 		t:        time.NewTicker(interval),
+		interval: interval,
 		closec:   make(chan struct{}),
 	}
 
@@ -188,6 +194,32 @@ func (b *Bucket) Fill(fn func(int64) (int64, error)) (int64, error) {
 	return 0, nil
 }
 
+// SetSchedule drains the bucket every interval instead and sets its capacity
+// to the value returned by next before each drain. A nil next restores the
+// interval the bucket was created with and keeps the current capacity.
+func (b *Bucket) SetSchedule(interval time.Duration, next func() int64) {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+
+	b.schedule = next
+	if next == nil {
+		interval = b.interval
+	} else {
+		atomic.StoreInt64(&b.capacity, next())
+		atomic.StoreInt64(&b.fill, 0)
+	}
+	b.t.Reset(interval)
+}
+
+func (b *Bucket) nextCapacity() {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+
+	if b.schedule != nil {
+		atomic.StoreInt64(&b.capacity, b.schedule())
+	}
+}
+
 // loop drains the fill at interval and returns when the bucket is closed.
 func (b *Bucket) loop() {
 	log.Debugf("trafficshape: started drain loop")
@@ -196,6 +228,7 @@ func (b *Bucket) loop() {
 	for {
 		select {
 		case t := <-b.t.C:
+			b.nextCapacity()
 			atomic.StoreInt64(&b.fill, 0)
 			log.Debugf("trafficshape: fill reset @ %s", t)
 		case <-b.closec:
@@ -19,6 +19,7 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/martian/v3/log"
@@ -41,10 +42,20 @@ type Conn struct {
 	ReadBucket       *Bucket // Shared by listener.
 	WriteBucket      *Bucket // Shared by listener.
 
-	conn    net.Conn
-	latency time.Duration
-	ronce   sync.Once
-	wonce   sync.Once
+	conn     net.Conn
+	latency  time.Duration
+	impairer *impairer
+	ronce    sync.Once
+	wonce    sync.Once
+
+	id           int64
+	bytesRead    int64 // atomic
+	bytesWritten int64 // atomic
+
+	emu         sync.Mutex
+	events      []Event
+	urlRegex    string
+	shapeBucket *Bucket
 }
 
 // Read reads bytes from connection into b, optionally simulating connection
@@ -60,11 +71,17 @@ func (c *Conn) Read(b []byte) (int, error) {
 		}
 
 		n, err := c.conn.Read(b[:max])
+		atomic.AddInt64(&c.bytesRead, int64(n))
 		return int64(n), err
 	})
 	if err != nil && err != io.EOF {
 		log.Errorf("trafficshape: error on throttled read: %v", err)
 	}
+	if n > 0 {
+		if ierr := c.impair(n); ierr != nil {
+			return int(n), ierr
+		}
+	}
 
 	return int(n), err
 }
@@ -82,6 +99,7 @@ func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
 		})
 
 		total += n
+		atomic.AddInt64(&c.bytesWritten, n)
 
 		if err == io.EOF {
 			log.Debugf("trafficshape: exhausted reader successfully")
@@ -96,6 +114,9 @@ func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
 // Close closes the connection.
 // Any blocked Read or Write operations will be unblocked and return errors.
 func (c *Conn) Close() error {
+	if c.Listener != nil {
+		c.Listener.untrack(c)
+	}
 	return c.conn.Close()
 }
 
@@ -169,6 +190,7 @@ func (c *Conn) WriteTo(w io.Writer) (int64, error) {
 		})
 
 		total += n
+		atomic.AddInt64(&c.bytesRead, n)
 
 		if err != nil {
 			if err != io.EOF {
@@ -335,6 +357,9 @@ func (c *Conn) GetNextActionFromIndex(ind int64) *NextActionInfo {
 // bandwidth constraints. It uses the WriteBucket inherited from the listener.
 func (c *Conn) WriteDefaultBuckets(b []byte) (int, error) {
 	c.wonce.Do(c.sleepLatency)
+	if err := c.impair(int64(len(b))); err != nil {
+		return 0, err
+	}
 
 	var total int64
 	for len(b) > 0 {
@@ -347,6 +372,7 @@ func (c *Conn) WriteDefaultBuckets(b []byte) (int, error) {
 			}
 
 			n, err := c.conn.Write(b[:max])
+			atomic.AddInt64(&c.bytesWritten, int64(n))
 			return int64(n), err
 		})
 
@@ -372,6 +398,9 @@ func (c *Conn) Write(b []byte) (int, error) {
 		return c.WriteDefaultBuckets(b)
 	}
 	c.wonce.Do(c.sleepLatency)
+	if err := c.impair(int64(len(b))); err != nil {
+		return 0, err
+	}
 	var total int64
 
 	// Write the header if needed, without enforcing any traffic shaping, and without updating
@@ -380,6 +409,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 		writeAmount := min(int64(len(b)), headerToWrite)
 
 		n, err := c.conn.Write(b[:writeAmount])
+		atomic.AddInt64(&c.bytesWritten, int64(n))
 
 		if err != nil {
 			if err != io.EOF {
@@ -417,6 +447,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 			return c.Context.GlobalBucket.FillThrottleLocked(func(rem int64) (int64, error) {
 				max = min(rem, max)
 				n, err := c.conn.Write(b[:max])
+				atomic.AddInt64(&c.bytesWritten, int64(n))
 
 				return int64(n), err
 			})
@@ -463,12 +494,14 @@ func (c *Conn) Write(b []byte) (int, error) {
 						d, c.Context.URLRegex, c.Context.ByteOffset)
 					c.Shapes.M[c.Context.URLRegex].Unlock()
 					c.Shapes.RUnlock()
+					c.RecordEvent(Event{Type: EventHalt, Duration: d})
 					time.Sleep(time.Duration(d) * time.Millisecond)
 				case *CloseConnection:
 					log.Infof("trafficshape: Closing connection for urlregex %s at byte offset %d",
 						c.Context.URLRegex, c.Context.ByteOffset)
 					c.Shapes.M[c.Context.URLRegex].Unlock()
 					c.Shapes.RUnlock()
+					c.RecordEvent(Event{Type: EventClose})
 					return int(total), &ErrForceClose{message: "Forcing close connection"}
 				case *ChangeBandwidth:
 					bw := action.Bandwidth
@@ -477,6 +510,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 					c.Shapes.M[c.Context.URLRegex].Unlock()
 					c.Shapes.RUnlock()
 					c.Context.Buckets.WriteBucket.SetCapacity(bw)
+					c.RecordEvent(Event{Type: EventThrottle, Bandwidth: bw})
 				default:
 					c.Shapes.M[c.Context.URLRegex].Unlock()
 					c.Shapes.RUnlock()
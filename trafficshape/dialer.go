@@ -0,0 +1,171 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+// UpstreamRule constrains the bandwidth and latency of connections from the proxy to the servers
+// matching Host.
+type UpstreamRule struct {
+	// Host is a host, a host and port, a "*.example.com" pattern matching subdomains, or "*"
+	// matching all servers. The port of the destination is ignored unless Host has one.
+	Host string `json:"host"`
+	// Bandwidth limits the bytes per second written to the server (Up) and read from it (Down).
+	// Connections matching the same rule share the bandwidth. Zero is unlimited.
+	Bandwidth Bandwidth `json:"bandwidth"`
+	// Latency is the delay in milliseconds before the first read and write of a connection.
+	Latency int64 `json:"latency"`
+}
+
+func (r *UpstreamRule) matches(addr string) bool {
+	return r.Host == "*" || matchesHost([]string{r.Host}, addr)
+}
+
+// Dialer establishes connections to upstream servers and shapes them according to the rule of
+// their destination, so that the uplink from the proxy to a server under test can be constrained.
+// Its DialContext and Dial methods may be passed to Proxy.SetDialContext and Proxy.SetDial.
+type Dialer struct {
+	dial func(context.Context, string, string) (net.Conn, error)
+
+	mu    sync.RWMutex
+	rules []*UpstreamRule
+	// buckets are kept by the host of the rule, so that a connection keeps
+	// sharing the bandwidth of its rule when the rules are updated.
+	buckets map[string]*Buckets
+}
+
+// NewDialer returns a Dialer that establishes connections with dial and shapes them. If dial is
+// nil, connections are established by a net.Dialer with the timeouts of the proxy.
+func NewDialer(dial func(context.Context, string, string) (net.Conn, error)) *Dialer {
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	return &Dialer{
+		dial:    dial,
+		buckets: make(map[string]*Buckets),
+	}
+}
+
+// Rules returns the rules of the dialer.
+func (d *Dialer) Rules() []*UpstreamRule {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.rules
+}
+
+// SetRules sets the rules applied to connections established after the call. The first rule
+// matching the destination of a connection applies. Connections established before the call keep
+// the latency of their rule and the bandwidth of the rule with the same host, if any.
+func (d *Dialer) SetRules(rules []*UpstreamRule) error {
+	for i, r := range rules {
+		if r == nil || r.Host == "" {
+			return fmt.Errorf("trafficshape: no host for upstream rule at index %d", i)
+		}
+		if r.Bandwidth.Up < 0 || r.Bandwidth.Down < 0 || r.Latency < 0 {
+			return fmt.Errorf("trafficshape: invalid upstream rule at index %d", i)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	active := make(map[string]bool)
+	for _, r := range rules {
+		up, down := r.Bandwidth.Up, r.Bandwidth.Down
+		if up == 0 {
+			up = DefaultBitrate / 8
+		}
+		if down == 0 {
+			down = DefaultBitrate / 8
+		}
+
+		b, ok := d.buckets[r.Host]
+		if !ok {
+			b = &Buckets{
+				ReadBucket:  NewBucket(down, time.Second),
+				WriteBucket: NewBucket(up, time.Second),
+			}
+			d.buckets[r.Host] = b
+		} else {
+			b.ReadBucket.SetCapacity(down)
+			b.WriteBucket.SetCapacity(up)
+		}
+		active[r.Host] = true
+	}
+
+	// Lift the limits of rules that were removed; their connections may
+	// still be open.
+	for host, b := range d.buckets {
+		if !active[host] {
+			b.ReadBucket.SetCapacity(DefaultBitrate / 8)
+			b.WriteBucket.SetCapacity(DefaultBitrate / 8)
+		}
+	}
+
+	d.rules = rules
+
+	return nil
+}
+
+// DialContext establishes a connection to addr and shapes it according to the first rule matching
+// addr. Connections that match no rule are returned as is.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, r := range d.rules {
+		if !r.matches(addr) {
+			continue
+		}
+
+		log.Debugf("trafficshape: shaping upstream connection to %s with rule for %s", addr, r.Host)
+		b := d.buckets[r.Host]
+
+		return &Conn{
+			conn:        conn,
+			latency:     time.Duration(r.Latency) * time.Millisecond,
+			ReadBucket:  b.ReadBucket,
+			WriteBucket: b.WriteBucket,
+			Shapes:      &urlShapes{M: make(map[string]*urlShape)},
+			Context:     &Context{},
+			Established: time.Now(),
+		}, nil
+	}
+
+	return conn, nil
+}
+
+// Dial establishes a connection to addr like DialContext.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
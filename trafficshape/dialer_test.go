@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDialerShapesMatchingDestinations(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(bytes.Repeat([]byte("0"), 1500))
+			}()
+		}
+	}()
+
+	d := NewDialer(nil)
+	if err := d.SetRules([]*UpstreamRule{
+		{Host: "example.com", Bandwidth: Bandwidth{Down: 10}},
+		{Host: "127.0.0.1", Bandwidth: Bandwidth{Down: 1000}, Latency: 100},
+	}); err != nil {
+		t.Fatalf("SetRules(): got %v, want no error", err)
+	}
+
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*Conn); !ok {
+		t.Fatalf("Dial(): got %T, want *Conn", conn)
+	}
+
+	// The first 1000 bytes are read after the latency, the remaining 500
+	// once the bucket drains a second later.
+	start := time.Now()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := len(b), 1500; got != want {
+		t.Errorf("len(b): got %d, want %d", got, want)
+	}
+	if got, min := time.Since(start), 900*time.Millisecond; got < min {
+		t.Errorf("ioutil.ReadAll(): took %s, want at least %s", got, min)
+	}
+
+	if err := d.SetRules(nil); err != nil {
+		t.Fatalf("SetRules(): got %v, want no error", err)
+	}
+	conn, err = d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*Conn); ok {
+		t.Error("Dial(): got *Conn, want unshaped connection without rules")
+	}
+
+	if err := d.SetRules([]*UpstreamRule{{Bandwidth: Bandwidth{Up: 1}}}); err == nil {
+		t.Error("SetRules(): got no error, want error for rule without host")
+	}
+}
+
+func TestHandlerUpstream(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := NewListener(l)
+	defer tsl.Close()
+
+	h := NewHandler(tsl)
+	body := `{"trafficshape":{"upstream":[{"host":"*.example.com","bandwidth":{"up":1000,"down":2000},"latency":50}]}}`
+
+	req, err := http.NewRequest("POST", "test", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, 400; got != want {
+		t.Errorf("rw.Code: got %d, want %d without dialer", got, want)
+	}
+
+	d := NewDialer(nil)
+	h.SetDialer(d)
+
+	req, err = http.NewRequest("POST", "test", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, 200; got != want {
+		t.Fatalf("rw.Code: got %d, want %d", got, want)
+	}
+
+	rules := d.Rules()
+	if got, want := len(rules), 1; got != want {
+		t.Fatalf("len(d.Rules()): got %d, want %d", got, want)
+	}
+	if !rules[0].matches("www.example.com:443") || rules[0].matches("example.org:443") {
+		t.Errorf("rules[0].matches(): got wrong matches for host %q", rules[0].Host)
+	}
+	if got, want := d.buckets["*.example.com"].WriteBucket.Capacity(), int64(1000); got != want {
+		t.Errorf("WriteBucket.Capacity(): got %d, want %d", got, want)
+	}
+}
@@ -17,17 +17,21 @@ package trafficshape
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/martian/v3/log"
 )
 
-// Handler configures a trafficshape.Listener.
+// Handler configures a trafficshape.Listener and, optionally, a trafficshape.Dialer.
 type Handler struct {
 	l *Listener
+	d *Dialer
 }
 
 // Throttle represents a byte interval with a specific bandwidth.
@@ -92,8 +96,16 @@ func (cc *CloseConnection) decrementCount() {
 }
 
 // Shape encloses the traffic shape of a particular url regex.
+//
+// Hosts, Methods and ContentTypes scope the shape to requests to one of the hosts, requests with
+// one of the methods and responses with one of the content types; an empty list matches all of
+// them. Hosts may start with "*." to match subdomains and content types may end with "/*" to match
+// all subtypes.
 type Shape struct {
 	URLRegex         string             `json:"url_regex"`
+	Hosts            []string           `json:"hosts,omitempty"`
+	Methods          []string           `json:"methods,omitempty"`
+	ContentTypes     []string           `json:"content_types,omitempty"`
 	MaxBandwidth     int64              `json:"max_global_bandwidth"`
 	Throttles        []*Throttle        `json:"throttles"`
 	Halts            []*Halt            `json:"halts"`
@@ -111,21 +123,119 @@ type Bandwidth struct {
 	Down int64 `json:"down"`
 }
 
-// Default encloses information about the default traffic shaping parameters: bandwidth and latency.
+// Stall is a pause of the connection that occurs at random.
+type Stall struct {
+	// Probability is the chance of a stall before every read and write.
+	Probability float64 `json:"probability"`
+	// Duration is the length of a stall in milliseconds.
+	Duration int64 `json:"duration"`
+}
+
+// Reorder simulates chunks that arrive out of order, which delays their delivery until the
+// chunks sent before them have arrived.
+type Reorder struct {
+	// Probability is the chance of a chunk, that is a read or write, arriving out of order.
+	Probability float64 `json:"probability"`
+	// Delay is the maximum delay in milliseconds of a chunk that arrived out of order.
+	Delay int64 `json:"delay"`
+}
+
+// Default encloses information about the default traffic shaping parameters: bandwidth, latency
+// and random impairments.
 type Default struct {
 	Bandwidth Bandwidth `json:"bandwidth"`
 	Latency   int64     `json:"latency"`
+	// Jitter is the scale in milliseconds of the delay added at random to every read and write.
+	Jitter int64 `json:"jitter,omitempty"`
+	// JitterDistribution is the distribution of the jitter: "uniform" (the default) between 0
+	// and Jitter, "normal" for the absolute value of a normal distribution with Jitter as the
+	// standard deviation, or "pareto" for a heavy tailed distribution with Jitter as the mean.
+	JitterDistribution string `json:"jitter_distribution,omitempty"`
+	// Loss is the fraction of TCP segments that are lost and retransmitted after a timeout.
+	Loss float64 `json:"loss,omitempty"`
+	// Stall pauses the connection at random.
+	Stall *Stall `json:"stall,omitempty"`
+	// ResetsPerMB is the chance of the connection being reset for every megabyte read or written.
+	ResetsPerMB float64 `json:"resets_per_mb,omitempty"`
+	// Reorder delays chunks at random as if they arrived out of order.
+	Reorder *Reorder `json:"reorder,omitempty"`
+	// Seed seeds the random impairments of the connections accepted after the configuration, so
+	// that runs can be reproduced. Zero keeps the current source.
+	Seed int64 `json:"seed,omitempty"`
+}
+
+func (d *Default) validate() error {
+	if d.Bandwidth.Up < 0 || d.Bandwidth.Down < 0 {
+		return errors.New("negative bandwidth")
+	}
+	if d.Latency < 0 || d.Jitter < 0 {
+		return errors.New("negative latency or jitter")
+	}
+	switch d.JitterDistribution {
+	case "", "uniform", "normal", "pareto":
+	default:
+		return fmt.Errorf("unknown jitter distribution %q", d.JitterDistribution)
+	}
+	if d.Loss < 0 || d.Loss >= 1 {
+		return errors.New("loss must be at least 0 and less than 1")
+	}
+	if d.Stall != nil && (d.Stall.Probability < 0 || d.Stall.Probability > 1 || d.Stall.Duration < 0) {
+		return errors.New("invalid stall")
+	}
+	if d.ResetsPerMB < 0 || d.ResetsPerMB > 1 {
+		return errors.New("resets per MB must be between 0 and 1")
+	}
+	if d.Reorder != nil && (d.Reorder.Probability < 0 || d.Reorder.Probability > 1 || d.Reorder.Delay < 0) {
+		return errors.New("invalid reorder")
+	}
+	return nil
 }
 
 // Trafficshape contains global shape of traffic, i.e information about shape of each url specified and
-// the default traffic shaping parameters.
+// the default traffic shaping parameters. If Profile names a registered profile, its parameters are
+// used for the defaults that are not set. Upstream holds the rules for connections to servers, which
+// require a Dialer. If Trace is set, it drives the bandwidths of the defaults over time.
 type Trafficshape struct {
-	Defaults *Default `json:"default"`
-	Shapes   []*Shape `json:"shapes"`
+	Profile  string          `json:"profile,omitempty"`
+	Defaults *Default        `json:"default"`
+	Shapes   []*Shape        `json:"shapes"`
+	Upstream []*UpstreamRule `json:"upstream,omitempty"`
+	Trace    *TraceConfig    `json:"trace,omitempty"`
+}
+
+// TraceConfig holds the traces of the bandwidths written to the client (Up) and read from it
+// (Down), in Format, which is either "mahimahi" or "csv". An empty trace leaves the bandwidth of
+// the defaults in place.
+type TraceConfig struct {
+	Format string `json:"format"`
+	Up     string `json:"up,omitempty"`
+	Down   string `json:"down,omitempty"`
+}
+
+// parse returns the up and down traces of the config.
+func (tc *TraceConfig) parse() (up, down *Trace, err error) {
+	if tc == nil {
+		return nil, nil, nil
+	}
+
+	if tc.Up != "" {
+		if up, err = ParseTrace(strings.NewReader(tc.Up), tc.Format); err != nil {
+			return nil, nil, err
+		}
+	}
+	if tc.Down != "" {
+		if down, err = ParseTrace(strings.NewReader(tc.Down), tc.Format); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return up, down, nil
 }
 
-// ConfigRequest represents a request to configure the global traffic shape.
+// ConfigRequest represents a request to configure the global traffic shape. A request with only a
+// Profile is shorthand for a Trafficshape with that profile.
 type ConfigRequest struct {
+	Profile      string        `json:"profile,omitempty"`
 	Trafficshape *Trafficshape `json:"trafficshape"`
 }
 
@@ -155,8 +265,15 @@ func NewHandler(l *Listener) *Handler {
 	}
 }
 
+// SetDialer sets the dialer whose upstream rules are configured along with the listener.
+func (h *Handler) SetDialer(d *Dialer) {
+	h.d = d
+}
+
 // ServeHTTP configures latency and bandwidth constraints.
 //
+// The "profile" property selects a registered profile, such as "3g-slow", for
+// the defaults.
 // The "latency" query string parameter accepts a duration string in any format
 // supported by time.ParseDuration.
 // The "up" and "down" query string parameters accept integers as bits per
@@ -180,6 +297,9 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if receivedConfig.Trafficshape == nil && receivedConfig.Profile != "" {
+		receivedConfig.Trafficshape = &Trafficshape{Profile: receivedConfig.Profile}
+	}
 	if receivedConfig.Trafficshape == nil {
 		http.Error(rw, "Error: trafficshape property not found", 400)
 		return
@@ -190,11 +310,21 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		defaults = &Default{}
 	}
 
-	if defaults.Bandwidth.Up < 0 || defaults.Bandwidth.Down < 0 || defaults.Latency < 0 {
-		http.Error(rw, "Error: Invalid Defaults", 400)
+	if err := defaults.validate(); err != nil {
+		http.Error(rw, fmt.Sprintf("Error: Invalid Defaults: %v", err), 400)
 		return
 	}
 
+	profile := receivedConfig.Trafficshape.Profile
+	if profile != "" {
+		p, ok := LookupProfile(profile)
+		if !ok {
+			http.Error(rw, fmt.Sprintf("Error: unknown profile %q", profile), 400)
+			return
+		}
+		defaults = p.withDefaults(defaults)
+	}
+
 	if defaults.Bandwidth.Up == 0 {
 		defaults.Bandwidth.Up = DefaultBitrate / 8
 	}
@@ -208,14 +338,28 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	up, down, err := receivedConfig.Trafficshape.Trace.parse()
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Error: Invalid Trace: %v", err), 400)
+		return
+	}
+
+	if upstream := receivedConfig.Trafficshape.Upstream; h.d != nil {
+		if err := h.d.SetRules(upstream); err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+	} else if len(upstream) > 0 {
+		http.Error(rw, "Error: upstream shaping is not enabled", 400)
+		return
+	}
+
 	// Update the Listener with the new traffic shape.
 	h.l.Shapes.Lock()
 
 	h.l.Shapes.LastModifiedTime = time.Now()
-	h.l.ReadBucket.SetCapacity(defaults.Bandwidth.Down)
-	h.l.WriteBucket.SetCapacity(defaults.Bandwidth.Up)
-	h.l.SetLatency(time.Duration(defaults.Latency) * time.Millisecond)
-	h.l.SetDefaults(defaults)
+	h.l.applyDefaults(profile, defaults)
+	h.l.SetTraces(up, down)
 
 	h.l.Shapes.M = make(map[string]*urlShape)
 	for _, shape := range receivedConfig.Trafficshape.Shapes {
@@ -117,6 +117,14 @@ func TestHandlerIncorrectInputs(t *testing.T) {
 			testcase: `negative default latency`,
 			body:     `{"trafficshape":{"default":{"bandwidth":{"up":100000,"down":100000},"latency":-1000},"shapes":[{"url_regex":"http://example/example","throttles":[{"bytes":"500-1000","bandwidth":100}]",close_connections":[{"byte":100,"count":1}]}]}}`,
 		},
+		{
+			testcase: `unknown jitter distribution`,
+			body:     `{"trafficshape":{"default":{"jitter":10,"jitter_distribution":"cauchy"}}}`,
+		},
+		{
+			testcase: `stall probability above 1`,
+			body:     `{"trafficshape":{"default":{"stall":{"probability":1.5,"duration":100}}}}`,
+		},
 	}
 
 	for i, tc := range tt {
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+const (
+	// segmentSize is the payload of a TCP segment used to simulate loss.
+	segmentSize = 1460
+	// minRetransmitTimeout is the lowest delay before a lost segment is
+	// retransmitted, as used by Linux.
+	minRetransmitTimeout = 200 * time.Millisecond
+	// maxJitterFactor caps the jitter drawn from unbounded distributions at a
+	// multiple of the configured jitter.
+	maxJitterFactor = 10
+	// paretoShape is the shape of the pareto distribution of jitter.
+	paretoShape = 2.0
+)
+
+// impairer draws the random impairments of a connection.
+type impairer struct {
+	jitter      time.Duration
+	dist        string
+	loss        float64
+	rto         time.Duration
+	stall       Stall
+	resetsPerMB float64
+	reorder     Reorder
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newImpairer returns an impairer for the impairments in defaults of a
+// connection with latency, drawing from a source seeded with seed.
+func newImpairer(defaults *Default, latency time.Duration, seed int64) *impairer {
+	im := &impairer{
+		jitter:      time.Duration(defaults.Jitter) * time.Millisecond,
+		dist:        defaults.JitterDistribution,
+		loss:        defaults.Loss,
+		rto:         minRetransmitTimeout,
+		resetsPerMB: defaults.ResetsPerMB,
+		rand:        rand.New(rand.NewSource(seed)),
+	}
+	if rto := 2 * latency; rto > im.rto {
+		im.rto = rto
+	}
+	if defaults.Stall != nil {
+		im.stall = *defaults.Stall
+	}
+	if defaults.Reorder != nil {
+		im.reorder = *defaults.Reorder
+	}
+
+	return im
+}
+
+// draw returns the delay of a read or write of n bytes and whether the
+// connection is reset instead.
+func (im *impairer) draw(n int64) (time.Duration, bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if im.resetsPerMB > 0 && n > 0 {
+		mb := float64(n) / (1 << 20)
+		if im.rand.Float64() < 1-math.Pow(1-im.resetsPerMB, mb) {
+			return 0, true
+		}
+	}
+
+	var d time.Duration
+	if im.jitter > 0 {
+		d += im.drawJitter()
+	}
+	if im.loss > 0 && n > 0 {
+		segments := (n + segmentSize - 1) / segmentSize
+		if im.rand.Float64() < 1-math.Pow(1-im.loss, float64(segments)) {
+			d += im.rto
+		}
+	}
+	if im.stall.Probability > 0 && im.rand.Float64() < im.stall.Probability {
+		d += time.Duration(im.stall.Duration) * time.Millisecond
+	}
+	if im.reorder.Probability > 0 && im.reorder.Delay > 0 && im.rand.Float64() < im.reorder.Probability {
+		d += time.Duration(im.rand.Int63n(im.reorder.Delay*int64(time.Millisecond) + 1))
+	}
+
+	return d, false
+}
+
+// drawJitter returns a jitter from the configured distribution.
+func (im *impairer) drawJitter() time.Duration {
+	var f float64
+	switch im.dist {
+	case "normal":
+		f = math.Abs(im.rand.NormFloat64())
+	case "pareto":
+		// A Lomax distribution, that is a pareto distribution shifted to
+		// start at zero, scaled to a mean of one.
+		f = (math.Pow(1-im.rand.Float64(), -1/paretoShape) - 1) * (paretoShape - 1)
+	default:
+		f = im.rand.Float64()
+	}
+	if f > maxJitterFactor {
+		f = maxJitterFactor
+	}
+
+	return time.Duration(f * float64(im.jitter))
+}
+
+// impair sleeps for the random impairments of a read or write of n bytes. If
+// the connection is reset instead, it is closed and an ErrForceClose is
+// returned.
+func (c *Conn) impair(n int64) error {
+	if c.impairer == nil {
+		return nil
+	}
+
+	d, reset := c.impairer.draw(n)
+	if reset {
+		log.Infof("trafficshape: simulating connection reset")
+		if tconn, ok := c.conn.(*net.TCPConn); ok {
+			// Discard unsent data so that the peer receives a RST.
+			tconn.SetLinger(0)
+		}
+		c.conn.Close()
+		return &ErrForceClose{message: "Simulated connection reset"}
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	log.Debugf("trafficshape: simulating impairments: %s", d)
+	time.Sleep(d)
+
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestImpairerIsReproducible(t *testing.T) {
+	defaults := &Default{
+		Jitter:      50,
+		Loss:        0.1,
+		Stall:       &Stall{Probability: 0.2, Duration: 300},
+		ResetsPerMB: 0.5,
+		Reorder:     &Reorder{Probability: 0.3, Delay: 20},
+	}
+
+	draw := func(seed int64) []time.Duration {
+		im := newImpairer(defaults, 0, seed)
+
+		var ds []time.Duration
+		for i := 0; i < 100; i++ {
+			d, reset := im.draw(64 << 10)
+			if reset {
+				d = -1
+			}
+			ds = append(ds, d)
+		}
+		return ds
+	}
+
+	a, b, c := draw(1), draw(1), draw(2)
+	same := true
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("draw %d: got %s and %s for the same seed, want equal", i, a[i], b[i])
+		}
+		if a[i] != c[i] {
+			same = false
+		}
+	}
+	if same {
+		t.Error("draws: got the same impairments for different seeds, want different")
+	}
+}
+
+func TestImpairerJitterDistributions(t *testing.T) {
+	for _, dist := range []string{"uniform", "normal", "pareto"} {
+		im := newImpairer(&Default{Jitter: 10, JitterDistribution: dist}, 0, 1)
+
+		var total time.Duration
+		for i := 0; i < 1000; i++ {
+			d, reset := im.draw(1)
+			if reset {
+				t.Fatalf("%s: draw(): got reset, want none", dist)
+			}
+			if d < 0 || d > maxJitterFactor*10*time.Millisecond {
+				t.Fatalf("%s: draw(): got %s, want between 0 and %s", dist, d, maxJitterFactor*10*time.Millisecond)
+			}
+			total += d
+		}
+
+		if mean := total / 1000; mean < 3*time.Millisecond || mean > 15*time.Millisecond {
+			t.Errorf("%s: mean jitter: got %s, want about 5-10ms", dist, mean)
+		}
+	}
+}
+
+func TestImpairerStallsAndLoss(t *testing.T) {
+	im := newImpairer(&Default{
+		Loss:  0.5,
+		Stall: &Stall{Probability: 1, Duration: 100},
+	}, 300*time.Millisecond, 1)
+
+	// A write of a megabyte spans hundreds of segments, one of which is
+	// certainly lost and retransmitted after twice the latency.
+	d, _ := im.draw(1 << 20)
+	if got, want := d, 700*time.Millisecond; got != want {
+		t.Errorf("draw(): got %s, want %s", got, want)
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := NewListener(l)
+	defer tsl.Close()
+	tsl.SetDefaults(&Default{ResetsPerMB: 1})
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := tsl.GetTrafficShapedConn(c1)
+	conn.Context = &Context{}
+
+	n, err := conn.Write(make([]byte, 1<<20))
+	if _, ok := err.(*ErrForceClose); !ok {
+		t.Fatalf("conn.Write(): got %v, want ErrForceClose", err)
+	}
+	if n != 0 {
+		t.Errorf("conn.Write(): got %d bytes written, want 0", n)
+	}
+
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Error("c2.Read(): got no error, want error for closed connection")
+	}
+}
+
+func TestListenerSetSeed(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := NewListener(l)
+	defer tsl.Close()
+	tsl.SetDefaults(&Default{Jitter: 100})
+
+	seeds := func() [2]time.Duration {
+		tsl.SetSeed(42)
+
+		var ds [2]time.Duration
+		for i := range ds {
+			c1, c2 := net.Pipe()
+			c2.Close()
+			conn := tsl.GetTrafficShapedConn(c1)
+			ds[i], _ = conn.impairer.draw(1)
+			c1.Close()
+		}
+		return ds
+	}
+
+	if a, b := seeds(), seeds(); a != b {
+		t.Errorf("jitter of connections: got %v and %v for the same seed, want equal", a, b)
+	}
+}
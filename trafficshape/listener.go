@@ -15,6 +15,8 @@
 package trafficshape
 
 import (
+	"fmt"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -99,6 +101,10 @@ type Context struct {
 	ByteOffset         int64
 	HeaderLen          int64
 	HeaderBytesWritten int64
+	// RequestID and URL identify the request whose response is being written, for the events
+	// recorded while shaping it.
+	RequestID string
+	URL       string
 }
 
 // Listener wraps a net.Listener and simulates connection latency and bandwidth
@@ -114,6 +120,15 @@ type Listener struct {
 	GlobalBuckets map[string]*Bucket
 	Shapes        *urlShapes
 	defaults      *Default
+	profile       string
+	observer      func(Event)
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	connsMu sync.Mutex
+	conns   map[*Conn]bool
+	nextID  int64
 }
 
 // NewListener returns a new bandwidth constrained listener. Defaults to
@@ -132,6 +147,8 @@ func NewListener(l net.Listener) *Listener {
 			},
 			Latency: 0,
 		},
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		conns: make(map[*Conn]bool),
 	}
 }
 
@@ -187,6 +204,71 @@ func (l *Listener) SetLatency(latency time.Duration) {
 	l.latency = latency
 }
 
+// Profile returns the name of the profile last applied to the listener, or
+// the empty string if the defaults were not taken from a profile.
+func (l *Listener) Profile() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.profile
+}
+
+// SetProfile applies the bandwidths, latency and impairments of the
+// registered profile with name to connections accepted after the call.
+func (l *Listener) SetProfile(name string) error {
+	p, ok := LookupProfile(name)
+	if !ok {
+		return fmt.Errorf("trafficshape: unknown profile %q", name)
+	}
+
+	l.applyDefaults(name, p.withDefaults(nil))
+
+	return nil
+}
+
+// applyDefaults sets the buckets, latency and defaults of the listener from
+// defaults, which were taken from the named profile if it is not empty.
+func (l *Listener) applyDefaults(profile string, defaults *Default) {
+	l.ReadBucket.SetCapacity(defaults.Bandwidth.Down)
+	l.WriteBucket.SetCapacity(defaults.Bandwidth.Up)
+	l.SetLatency(time.Duration(defaults.Latency) * time.Millisecond)
+	l.SetDefaults(defaults)
+	if defaults.Seed != 0 {
+		l.SetSeed(defaults.Seed)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.profile = profile
+}
+
+// SetSeed seeds the source of the random impairments of the connections
+// accepted after the call. Connections draw their own seeds from the source in
+// the order they are accepted, so a sequence of connections sees the same
+// impairments for the same seed.
+func (l *Listener) SetSeed(seed int64) {
+	l.randMu.Lock()
+	defer l.randMu.Unlock()
+
+	l.rand.Seed(seed)
+}
+
+// newImpairer returns the impairments described by defaults, with a source
+// seeded from that of the listener, or nil if there are none.
+func (l *Listener) newImpairer(defaults *Default, latency time.Duration) *impairer {
+	if defaults.Jitter == 0 && defaults.Loss == 0 && defaults.Stall == nil &&
+		defaults.ResetsPerMB == 0 && defaults.Reorder == nil {
+		return nil
+	}
+
+	l.randMu.Lock()
+	seed := l.rand.Int63()
+	l.randMu.Unlock()
+
+	return newImpairer(defaults, latency, seed)
+}
+
 // GetTrafficShapedConn takes in a normal connection and returns a traffic shaped connection.
 func (l *Listener) GetTrafficShapedConn(oc net.Conn) *Conn {
 	if tsconn, ok := oc.(*Conn); ok {
@@ -221,7 +303,9 @@ func (l *Listener) GetTrafficShapedConn(oc net.Conn) *Conn {
 		Established:      time.Now(),
 		DefaultBandwidth: defaultBandwidth,
 		Listener:         l,
+		impairer:         l.newImpairer(defaults, latency),
 	}
+	l.track(lc)
 	return lc
 }
 
@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Profile is a named set of default traffic shaping parameters describing a
+// network, such as "3g-slow". Its bandwidths are applied like those of a
+// Default: Up limits the bytes per second written to the client and Down the
+// bytes per second read from it.
+type Profile struct {
+	Name string `json:"name"`
+	Default
+}
+
+// kbps converts kilobits per second to bytes per second.
+func kbps(n int64) int64 {
+	return n * 1000 / 8
+}
+
+// builtinProfiles are the profiles registered by default. The bandwidths and
+// latencies of the cellular and fixed line profiles follow the presets of
+// common web performance tools.
+var builtinProfiles = []*Profile{
+	{Name: "2g", Default: Default{Bandwidth: Bandwidth{Up: kbps(280), Down: kbps(256)}, Latency: 800}},
+	{Name: "3g-slow", Default: Default{Bandwidth: Bandwidth{Up: kbps(400), Down: kbps(400)}, Latency: 400}},
+	{Name: "3g", Default: Default{Bandwidth: Bandwidth{Up: kbps(1600), Down: kbps(768)}, Latency: 300}},
+	{Name: "3g-fast", Default: Default{Bandwidth: Bandwidth{Up: kbps(1600), Down: kbps(768)}, Latency: 150}},
+	{Name: "4g", Default: Default{Bandwidth: Bandwidth{Up: kbps(9000), Down: kbps(9000)}, Latency: 170}},
+	{Name: "lte", Default: Default{Bandwidth: Bandwidth{Up: kbps(12000), Down: kbps(12000)}, Latency: 70}},
+	{Name: "dsl", Default: Default{Bandwidth: Bandwidth{Up: kbps(1500), Down: kbps(384)}, Latency: 50}},
+	{Name: "cable", Default: Default{Bandwidth: Bandwidth{Up: kbps(5000), Down: kbps(1000)}, Latency: 28}},
+	{Name: "satellite", Default: Default{Bandwidth: Bandwidth{Up: kbps(15000), Down: kbps(3000)}, Latency: 600, Jitter: 40, Loss: 0.01}},
+	{Name: "wifi-flaky", Default: Default{
+		Bandwidth:          Bandwidth{Up: kbps(10000), Down: kbps(5000)},
+		Latency:            20,
+		Jitter:             80,
+		JitterDistribution: "pareto",
+		Loss:               0.03,
+		Stall:              &Stall{Probability: 0.01, Duration: 1500},
+		ResetsPerMB:        0.01,
+	}},
+}
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = make(map[string]*Profile)
+)
+
+func init() {
+	for _, p := range builtinProfiles {
+		if err := RegisterProfile(p); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterProfile registers p under its name, replacing any profile with the
+// same name, including the built-in ones.
+func RegisterProfile(p *Profile) error {
+	if p == nil || p.Name == "" {
+		return fmt.Errorf("trafficshape: profile has no name")
+	}
+	if err := p.Default.validate(); err != nil {
+		return fmt.Errorf("trafficshape: profile %q: %v", p.Name, err)
+	}
+
+	cp := *p
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+
+	profiles[p.Name] = &cp
+
+	return nil
+}
+
+// LookupProfile returns a copy of the profile registered under name.
+func LookupProfile(name string) (*Profile, bool) {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	p, ok := profiles[name]
+	if !ok {
+		return nil, false
+	}
+	cp := *p
+
+	return &cp, true
+}
+
+// Profiles returns copies of the registered profiles sorted by name.
+func Profiles() []*Profile {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	ps := make([]*Profile, 0, len(profiles))
+	for _, p := range profiles {
+		cp := *p
+		ps = append(ps, &cp)
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Name < ps[j].Name
+	})
+
+	return ps
+}
+
+// LoadProfiles registers the profiles in the JSON array read from r. No
+// profile is registered if any of them is invalid.
+func LoadProfiles(r io.Reader) error {
+	var ps []*Profile
+	if err := json.NewDecoder(r).Decode(&ps); err != nil {
+		return fmt.Errorf("trafficshape: invalid profiles: %v", err)
+	}
+
+	for i, p := range ps {
+		if p == nil || p.Name == "" {
+			return fmt.Errorf("trafficshape: profile at index %d has no name", i)
+		}
+		if err := p.Default.validate(); err != nil {
+			return fmt.Errorf("trafficshape: profile %q: %v", p.Name, err)
+		}
+	}
+	for _, p := range ps {
+		RegisterProfile(p)
+	}
+
+	return nil
+}
+
+// LoadProfilesFile registers the profiles in the JSON file at path, as
+// LoadProfiles does.
+func LoadProfilesFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return LoadProfiles(f)
+}
+
+// withDefaults returns the defaults of the profile with the non-zero
+// parameters of d applied on top.
+func (p *Profile) withDefaults(d *Default) *Default {
+	nd := p.Default
+	if d == nil {
+		return &nd
+	}
+
+	if d.Bandwidth.Up != 0 {
+		nd.Bandwidth.Up = d.Bandwidth.Up
+	}
+	if d.Bandwidth.Down != 0 {
+		nd.Bandwidth.Down = d.Bandwidth.Down
+	}
+	if d.Latency != 0 {
+		nd.Latency = d.Latency
+	}
+	if d.Jitter != 0 {
+		nd.Jitter = d.Jitter
+	}
+	if d.JitterDistribution != "" {
+		nd.JitterDistribution = d.JitterDistribution
+	}
+	if d.Loss != 0 {
+		nd.Loss = d.Loss
+	}
+	if d.Stall != nil {
+		nd.Stall = d.Stall
+	}
+	if d.ResetsPerMB != 0 {
+		nd.ResetsPerMB = d.ResetsPerMB
+	}
+	if d.Reorder != nil {
+		nd.Reorder = d.Reorder
+	}
+	if d.Seed != 0 {
+		nd.Seed = d.Seed
+	}
+
+	return &nd
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	data := `[{"name":"test-edge","bandwidth":{"up":30000,"down":15000},"latency":500,"jitter":100,"loss":0.02}]`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): got %v, want no error", err)
+	}
+
+	if err := LoadProfilesFile(path); err != nil {
+		t.Fatalf("LoadProfilesFile(): got %v, want no error", err)
+	}
+
+	p, ok := LookupProfile("test-edge")
+	if !ok {
+		t.Fatal("LookupProfile(): got !ok, want profile")
+	}
+	if got, want := p.Bandwidth.Up, int64(30000); got != want {
+		t.Errorf("p.Bandwidth.Up: got %d, want %d", got, want)
+	}
+	if got, want := p.Loss, 0.02; got != want {
+		t.Errorf("p.Loss: got %v, want %v", got, want)
+	}
+
+	var names []string
+	for _, p := range Profiles() {
+		names = append(names, p.Name)
+	}
+	for _, name := range []string{"3g-slow", "lte", "satellite", "test-edge", "wifi-flaky"} {
+		if !strings.Contains(","+strings.Join(names, ",")+",", ","+name+",") {
+			t.Errorf("Profiles(): got %v, want %q", names, name)
+		}
+	}
+
+	for _, tc := range []string{
+		`[{"bandwidth":{"up":1}}]`,
+		`[{"name":"test-lossy","loss":1}]`,
+		`[{"name":"test-negative","latency":-1}]`,
+		`{"name":"test-object"}`,
+	} {
+		if err := LoadProfiles(strings.NewReader(tc)); err == nil {
+			t.Errorf("LoadProfiles(%s): got no error, want error", tc)
+		}
+	}
+}
+
+func TestListenerSetProfile(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := NewListener(l)
+	defer tsl.Close()
+
+	if err := tsl.SetProfile("satellite"); err != nil {
+		t.Fatalf("SetProfile(): got %v, want no error", err)
+	}
+	if err := tsl.SetProfile("unknown"); err == nil {
+		t.Error("SetProfile(): got no error, want error for unknown profile")
+	}
+
+	if got, want := tsl.Profile(), "satellite"; got != want {
+		t.Errorf("tsl.Profile(): got %q, want %q", got, want)
+	}
+	if got, want := tsl.WriteBucket.Capacity(), kbps(15000); got != want {
+		t.Errorf("tsl.WriteBucket.Capacity(): got %d, want %d", got, want)
+	}
+	if got, want := tsl.ReadBucket.Capacity(), kbps(3000); got != want {
+		t.Errorf("tsl.ReadBucket.Capacity(): got %d, want %d", got, want)
+	}
+	if got, want := tsl.Latency(), 600*time.Millisecond; got != want {
+		t.Errorf("tsl.Latency(): got %s, want %s", got, want)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	conn := tsl.GetTrafficShapedConn(c1)
+	if conn.impairer == nil {
+		t.Fatal("conn.impairer: got nil, want impairments")
+	}
+	if got, want := conn.impairer.jitter, 40*time.Millisecond; got != want {
+		t.Errorf("conn.impairer.jitter: got %s, want %s", got, want)
+	}
+	if got, want := conn.impairer.loss, 0.01; got != want {
+		t.Errorf("conn.impairer.loss: got %v, want %v", got, want)
+	}
+}
+
+func TestHandlerProfile(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tt := []struct {
+		body    string
+		code    int
+		latency int64
+	}{
+		{
+			body:    `{"profile":"3g-slow"}`,
+			code:    200,
+			latency: 400,
+		},
+		{
+			body:    `{"trafficshape":{"profile":"3g-slow","default":{"latency":50}}}`,
+			code:    200,
+			latency: 50,
+		},
+		{
+			body: `{"profile":"unknown"}`,
+			code: 400,
+		},
+		{
+			body: `{"trafficshape":{"profile":"3g-slow","default":{"loss":2}}}`,
+			code: 400,
+		},
+	}
+
+	for i, tc := range tt {
+		tsl := NewListener(l)
+		defer tsl.Close()
+
+		h := NewHandler(tsl)
+
+		req, err := http.NewRequest("POST", "test", bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		rw := httptest.NewRecorder()
+
+		h.ServeHTTP(rw, req)
+
+		if got, want := rw.Code, tc.code; got != want {
+			t.Fatalf("%d. rw.Code: got %d, want %d", i, got, want)
+		}
+		if tc.code != 200 {
+			continue
+		}
+
+		if got, want := tsl.Profile(), "3g-slow"; got != want {
+			t.Errorf("%d. tsl.Profile(): got %q, want %q", i, got, want)
+		}
+		if got, want := tsl.Defaults().Latency, tc.latency; got != want {
+			t.Errorf("%d. tsl.Defaults().Latency: got %d, want %d", i, got, want)
+		}
+		if got, want := tsl.WriteBucket.Capacity(), kbps(400); got != want {
+			t.Errorf("%d. tsl.WriteBucket.Capacity(): got %d, want %d", i, got, want)
+		}
+	}
+}
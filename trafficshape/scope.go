@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// InScope reports whether the response res to req is within the hosts, methods and content types
+// that the shape is scoped to.
+func (s *Shape) InScope(req *http.Request, res *http.Response) bool {
+	if len(s.Hosts) > 0 && !matchesHost(s.Hosts, req.Host) {
+		return false
+	}
+
+	if len(s.Methods) > 0 {
+		ok := false
+		for _, m := range s.Methods {
+			if strings.EqualFold(m, req.Method) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(s.ContentTypes) > 0 {
+		mt, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err != nil {
+			return false
+		}
+		ok := false
+		for _, ct := range s.ContentTypes {
+			ct = strings.ToLower(ct)
+			if ct == mt || (strings.HasSuffix(ct, "/*") && strings.HasPrefix(mt, ct[:len(ct)-1])) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesHost reports whether host matches one of hosts. The port of host is
+// ignored unless the pattern has one.
+func matchesHost(hosts []string, host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	for _, pattern := range hosts {
+		h := hostname
+		if _, _, err := net.SplitHostPort(pattern); err == nil {
+			h = host
+		}
+
+		if strings.HasPrefix(pattern, "*.") {
+			if len(h) > len(pattern)-1 && strings.EqualFold(h[len(h)-len(pattern)+1:], pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(h, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ShapeInScope reports whether the shape of urlregex applies to the response res to req. Shapes
+// that have since been removed are in scope, since the connection keeps the buckets it was
+// established with.
+func (c *Conn) ShapeInScope(urlregex string, req *http.Request, res *http.Response) bool {
+	c.Shapes.RLock()
+	defer c.Shapes.RUnlock()
+
+	us, ok := c.Shapes.M[urlregex]
+	if !ok {
+		return true
+	}
+
+	us.RLock()
+	defer us.RUnlock()
+
+	return us.Shape.InScope(req, res)
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestShapeInScope(t *testing.T) {
+	s := &Shape{
+		Hosts:        []string{"*.example.com", "localhost:8080"},
+		Methods:      []string{"get", "HEAD"},
+		ContentTypes: []string{"video/*", "application/dash+xml"},
+	}
+
+	tt := []struct {
+		method string
+		host   string
+		ct     string
+		want   bool
+	}{
+		{"GET", "cdn.example.com", "video/mp4", true},
+		{"GET", "cdn.example.com:443", "Video/MP4; codecs=avc1", true},
+		{"HEAD", "localhost:8080", "application/dash+xml", true},
+		{"GET", "example.com", "video/mp4", false},
+		{"GET", "localhost:9090", "video/mp4", false},
+		{"POST", "cdn.example.com", "video/mp4", false},
+		{"GET", "cdn.example.com", "text/html", false},
+		{"GET", "cdn.example.com", "", false},
+	}
+
+	for i, tc := range tt {
+		req, err := http.NewRequest(tc.method, "http://"+tc.host+"/", nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		res := &http.Response{Header: http.Header{}, Request: req}
+		if tc.ct != "" {
+			res.Header.Set("Content-Type", tc.ct)
+		}
+
+		if got := s.InScope(req, res); got != tc.want {
+			t.Errorf("%d. InScope(%s %s, %q): got %t, want %t", i, tc.method, tc.host, tc.ct, got, tc.want)
+		}
+	}
+
+	if !(&Shape{}).InScope(&http.Request{Method: "GET"}, &http.Response{Header: http.Header{}}) {
+		t.Error("InScope(): got false for unscoped shape, want true")
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+// Types of shaping events.
+const (
+	// EventShape is recorded when a response starts being shaped by a URL regex.
+	EventShape = "shape"
+	// EventThrottle is recorded when the bandwidth of a shaped response changes.
+	EventThrottle = "throttle"
+	// EventHalt is recorded when a shaped response is halted.
+	EventHalt = "halt"
+	// EventClose is recorded when a connection is closed by a shape.
+	EventClose = "close"
+)
+
+// maxEvents is the number of events kept per connection; older events are
+// discarded first.
+const maxEvents = 100
+
+// Event is a shaping action performed on a connection.
+type Event struct {
+	// Type is one of EventShape, EventThrottle, EventHalt and EventClose.
+	Type string `json:"type"`
+	// Time is when the action was performed.
+	Time time.Time `json:"time"`
+	// RequestID is the ID of the context of the request whose response was being shaped.
+	RequestID string `json:"requestId,omitempty"`
+	// URL is the URL of the request whose response was being shaped.
+	URL string `json:"url,omitempty"`
+	// URLRegex is the regex of the shape that matched the request.
+	URLRegex string `json:"urlRegex"`
+	// ByteOffset is the offset in the response body at which the action was performed.
+	ByteOffset int64 `json:"byteOffset"`
+	// Bandwidth is the bandwidth in bytes per second set by a throttle.
+	Bandwidth int64 `json:"bandwidth,omitempty"`
+	// Duration is the duration in milliseconds of a halt.
+	Duration int64 `json:"duration,omitempty"`
+}
+
+// ConnStats describes a connection accepted by a Listener.
+type ConnStats struct {
+	// ID identifies the connection among those accepted by the listener.
+	ID int64 `json:"id"`
+	// RemoteAddr is the address of the client.
+	RemoteAddr string `json:"remoteAddr"`
+	// Established is when the connection was accepted.
+	Established time.Time `json:"established"`
+	// BytesRead is the number of bytes read from the client.
+	BytesRead int64 `json:"bytesRead"`
+	// BytesWritten is the number of bytes written to the client.
+	BytesWritten int64 `json:"bytesWritten"`
+	// WriteCapacity is the capacity in bytes per second of the bucket that limits writes of the
+	// current response.
+	WriteCapacity int64 `json:"writeCapacity"`
+	// URLRegex is the regex of the shape of the current response, if any.
+	URLRegex string `json:"urlRegex,omitempty"`
+	// Events are the latest shaping actions performed on the connection.
+	Events []Event `json:"events"`
+}
+
+// Stats describes a Listener and its active connections.
+type Stats struct {
+	// Profile is the name of the profile applied to the listener, if any.
+	Profile string `json:"profile,omitempty"`
+	// ReadCapacity is the capacity in bytes per second of the bucket shared by reads.
+	ReadCapacity int64 `json:"readCapacity"`
+	// WriteCapacity is the capacity in bytes per second of the bucket shared by writes.
+	WriteCapacity int64 `json:"writeCapacity"`
+	// Connections are the open connections, in the order they were accepted.
+	Connections []*ConnStats `json:"connections"`
+}
+
+// SetContext sets the context of the response being written on the connection.
+func (c *Conn) SetContext(ctx *Context) {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+
+	c.Context = ctx
+	c.urlRegex = ""
+	c.shapeBucket = nil
+	if ctx.Shaping {
+		c.urlRegex = ctx.URLRegex
+		if ctx.Buckets != nil {
+			c.shapeBucket = ctx.Buckets.WriteBucket
+		}
+	}
+}
+
+// RecordEvent records a shaping action on the connection and passes it to the observer of the
+// listener, if any. The time, request and shape of the event are taken from the Context if they
+// are not set.
+func (c *Conn) RecordEvent(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if ctx := c.Context; ctx != nil {
+		if e.RequestID == "" {
+			e.RequestID = ctx.RequestID
+		}
+		if e.URL == "" {
+			e.URL = ctx.URL
+		}
+		if e.URLRegex == "" {
+			e.URLRegex = ctx.URLRegex
+		}
+		if e.ByteOffset == 0 {
+			e.ByteOffset = ctx.ByteOffset
+		}
+	}
+
+	c.emu.Lock()
+	c.events = append(c.events, e)
+	if len(c.events) > maxEvents {
+		c.events = c.events[len(c.events)-maxEvents:]
+	}
+	c.emu.Unlock()
+
+	if c.Listener != nil {
+		if obs := c.Listener.EventObserver(); obs != nil {
+			obs(e)
+		}
+	}
+}
+
+// Stats returns the counters and latest shaping events of the connection.
+func (c *Conn) Stats() *ConnStats {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+
+	bucket := c.WriteBucket
+	if c.shapeBucket != nil {
+		bucket = c.shapeBucket
+	}
+
+	cs := &ConnStats{
+		ID:           c.id,
+		Established:  c.Established,
+		BytesRead:    atomic.LoadInt64(&c.bytesRead),
+		BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+		URLRegex:     c.urlRegex,
+		Events:       append([]Event{}, c.events...),
+	}
+	if bucket != nil {
+		cs.WriteCapacity = bucket.Capacity()
+	}
+	if addr := c.conn.RemoteAddr(); addr != nil {
+		cs.RemoteAddr = addr.String()
+	}
+
+	return cs
+}
+
+// EventObserver returns the function that observes the events of the connections of the
+// listener.
+func (l *Listener) EventObserver() func(Event) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.observer
+}
+
+// SetEventObserver sets a function that is called with every shaping event recorded on the
+// connections of the listener, such as to annotate logs. It is called on the goroutine writing the
+// response and must not block.
+func (l *Listener) SetEventObserver(fn func(Event)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.observer = fn
+}
+
+// Stats returns the capacities of the buckets of the listener and the stats of its open
+// connections.
+func (l *Listener) Stats() *Stats {
+	l.connsMu.Lock()
+	conns := make([]*Conn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.connsMu.Unlock()
+
+	s := &Stats{
+		Profile:       l.Profile(),
+		ReadCapacity:  l.ReadBucket.Capacity(),
+		WriteCapacity: l.WriteBucket.Capacity(),
+		Connections:   make([]*ConnStats, 0, len(conns)),
+	}
+	for _, c := range conns {
+		s.Connections = append(s.Connections, c.Stats())
+	}
+	sort.Slice(s.Connections, func(i, j int) bool {
+		return s.Connections[i].ID < s.Connections[j].ID
+	})
+
+	return s
+}
+
+// track registers c as an open connection of the listener.
+func (l *Listener) track(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	l.nextID++
+	c.id = l.nextID
+	l.conns[c] = true
+}
+
+// untrack removes c from the open connections of the listener.
+func (l *Listener) untrack(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	delete(l.conns, c)
+}
+
+type statsHandler struct {
+	l *Listener
+}
+
+// NewStatsHandler returns a handler that writes the Stats of l as JSON.
+func NewStatsHandler(l *Listener) http.Handler {
+	return &statsHandler{
+		l: l,
+	}
+}
+
+// ServeHTTP writes the stats of the listener.
+func (h *statsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		rw.Header().Add("Allow", "GET")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		log.Errorf("trafficshape: method not allowed on stats: %s", req.Method)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(rw).Encode(h.l.Stats()); err != nil {
+		log.Errorf("trafficshape: error encoding stats: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListenerStats(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := NewListener(l)
+	defer tsl.Close()
+
+	var observed []Event
+	tsl.SetEventObserver(func(e Event) {
+		observed = append(observed, e)
+	})
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	o1, o2 := net.Pipe()
+	defer o2.Close()
+
+	conn := tsl.GetTrafficShapedConn(c1)
+	other := tsl.GetTrafficShapedConn(o1)
+
+	go io.Copy(ioutil.Discard, c2)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+
+	go c2.Write([]byte("hi"))
+	if _, err := conn.Read(make([]byte, 2)); err != nil {
+		t.Fatalf("conn.Read(): got %v, want no error", err)
+	}
+
+	conn.SetContext(&Context{
+		Shaping:    true,
+		URLRegex:   "example",
+		Buckets:    NewBuckets(DefaultBitrate/8, 1000),
+		ByteOffset: 10,
+		RequestID:  "request",
+	})
+	conn.RecordEvent(Event{Type: EventHalt, Duration: 5})
+
+	s := tsl.Stats()
+	if got, want := len(s.Connections), 2; got != want {
+		t.Fatalf("len(s.Connections): got %d, want %d", got, want)
+	}
+	if got, want := s.WriteCapacity, DefaultBitrate/8; got != want {
+		t.Errorf("s.WriteCapacity: got %d, want %d", got, want)
+	}
+
+	cs := s.Connections[0]
+	if got, want := cs.BytesWritten, int64(5); got != want {
+		t.Errorf("cs.BytesWritten: got %d, want %d", got, want)
+	}
+	if got, want := cs.BytesRead, int64(2); got != want {
+		t.Errorf("cs.BytesRead: got %d, want %d", got, want)
+	}
+	if got, want := cs.URLRegex, "example"; got != want {
+		t.Errorf("cs.URLRegex: got %q, want %q", got, want)
+	}
+	if got, want := cs.WriteCapacity, int64(1000); got != want {
+		t.Errorf("cs.WriteCapacity: got %d, want %d", got, want)
+	}
+	if got, want := len(cs.Events), 1; got != want {
+		t.Fatalf("len(cs.Events): got %d, want %d", got, want)
+	}
+
+	e := cs.Events[0]
+	if got, want := e.Type, EventHalt; got != want {
+		t.Errorf("e.Type: got %q, want %q", got, want)
+	}
+	if got, want := e.ByteOffset, int64(10); got != want {
+		t.Errorf("e.ByteOffset: got %d, want %d", got, want)
+	}
+	if got, want := e.RequestID, "request"; got != want {
+		t.Errorf("e.RequestID: got %q, want %q", got, want)
+	}
+	if e.Time.IsZero() {
+		t.Error("e.Time: got zero time, want time of event")
+	}
+	if got, want := len(observed), 1; got != want {
+		t.Errorf("len(observed): got %d, want %d", got, want)
+	}
+
+	other.Close()
+	if got, want := len(tsl.Stats().Connections), 1; got != want {
+		t.Errorf("len(Stats().Connections): got %d, want %d after close", got, want)
+	}
+
+	for i := 0; i < maxEvents+10; i++ {
+		conn.RecordEvent(Event{Type: EventThrottle, Bandwidth: int64(i)})
+	}
+	events := conn.Stats().Events
+	if got, want := len(events), maxEvents; got != want {
+		t.Fatalf("len(Events): got %d, want %d", got, want)
+	}
+	if got, want := events[len(events)-1].Bandwidth, int64(maxEvents+9); got != want {
+		t.Errorf("last event Bandwidth: got %d, want %d", got, want)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := NewListener(l)
+	defer tsl.Close()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := tsl.GetTrafficShapedConn(c1)
+	defer conn.Close()
+
+	h := NewStatsHandler(tsl)
+
+	req, err := http.NewRequest("GET", "/shape-traffic/stats", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, 200; got != want {
+		t.Fatalf("rw.Code: got %d, want %d", got, want)
+	}
+
+	s := &Stats{}
+	if err := json.NewDecoder(rw.Body).Decode(s); err != nil {
+		t.Fatalf("json.Decode(): got %v, want no error", err)
+	}
+	if got, want := len(s.Connections), 1; got != want {
+		t.Fatalf("len(s.Connections): got %d, want %d", got, want)
+	}
+	if got, want := s.Connections[0].ID, conn.Stats().ID; got != want {
+		t.Errorf("s.Connections[0].ID: got %d, want %d", got, want)
+	}
+
+	req, err = http.NewRequest("POST", "/shape-traffic/stats", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceInterval is the duration of the steps of parsed traces.
+	TraceInterval = 100 * time.Millisecond
+	// mahimahiPacketSize is the number of bytes delivered at every delivery
+	// opportunity of a Mahimahi trace.
+	mahimahiPacketSize = 1500
+)
+
+// Trace is a schedule of the bytes that may be transferred in consecutive steps of a link. It
+// repeats once it ends.
+type Trace struct {
+	// Interval is the duration of each step.
+	Interval time.Duration
+	// Bytes holds the number of bytes that may be transferred in each step.
+	Bytes []int64
+}
+
+// ParseTrace parses a trace in format, which is either "mahimahi" or "csv".
+//
+// Mahimahi traces have one line per packet delivery opportunity, holding the millisecond at which
+// a packet of 1500 bytes may be delivered; the trace repeats after the last millisecond.
+//
+// CSV traces have lines of "milliseconds,bits per second" with increasing milliseconds starting at
+// 0, optionally preceded by a header. Each bandwidth lasts until the next line; the last lasts as
+// long as the one before it, or a second if it is the only one.
+func ParseTrace(r io.Reader, format string) (*Trace, error) {
+	switch format {
+	case "mahimahi":
+		return parseMahimahiTrace(r)
+	case "csv":
+		return parseCSVTrace(r)
+	}
+
+	return nil, fmt.Errorf("trafficshape: unknown trace format %q", format)
+}
+
+// LoadTraceFile parses the trace in the file at path, which is in CSV format if its extension is
+// ".csv" and in Mahimahi format otherwise.
+func LoadTraceFile(path string) (*Trace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	format := "mahimahi"
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = "csv"
+	}
+
+	return ParseTrace(f, format)
+}
+
+func parseMahimahiTrace(r io.Reader) (*Trace, error) {
+	step := int64(TraceInterval / time.Millisecond)
+
+	var bs []int64
+	var last int64
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+
+		ms, err := strconv.ParseInt(line, 10, 64)
+		if err != nil || ms < last {
+			return nil, fmt.Errorf("trafficshape: invalid millisecond %q on line %d", line, n)
+		}
+		last = ms
+
+		// Opportunities at the last millisecond fall into the first step of
+		// the next repetition.
+		i := ms / step
+		for int64(len(bs)) <= i {
+			bs = append(bs, 0)
+		}
+		bs[i] += mahimahiPacketSize
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if last <= 0 {
+		return nil, fmt.Errorf("trafficshape: trace has no delivery opportunities after 0ms")
+	}
+
+	steps := (last + step - 1) / step
+	if last%step == 0 {
+		// The final step only holds the opportunities at the last
+		// millisecond, which start the next repetition.
+		bs[0] += bs[steps]
+	}
+	bs = bs[:steps]
+
+	return &Trace{
+		Interval: TraceInterval,
+		Bytes:    bs,
+	}, nil
+}
+
+func parseCSVTrace(r io.Reader) (*Trace, error) {
+	var times, rates []int64
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("trafficshape: want 2 fields on line %d, got %d", n, len(fields))
+		}
+		ms, merr := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+		bps, berr := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		if merr != nil || berr != nil {
+			if len(times) == 0 && n == 1 {
+				// Skip the header.
+				continue
+			}
+			return nil, fmt.Errorf("trafficshape: invalid values on line %d", n)
+		}
+		if bps < 0 || (len(times) == 0 && ms != 0) || (len(times) > 0 && ms <= times[len(times)-1]) {
+			return nil, fmt.Errorf("trafficshape: invalid values on line %d", n)
+		}
+
+		times = append(times, ms)
+		rates = append(rates, bps)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(times) == 0 {
+		return nil, fmt.Errorf("trafficshape: empty trace")
+	}
+
+	end := int64(1000)
+	if l := len(times); l > 1 {
+		end = 2*times[l-1] - times[l-2]
+	}
+	times = append(times, end)
+
+	step := int64(TraceInterval / time.Millisecond)
+	bs := make([]int64, (end+step-1)/step)
+	for i, bps := range rates {
+		// Steps that span two lines are split between their rates.
+		for ms := times[i]; ms < times[i+1]; {
+			s := ms / step
+			until := (s + 1) * step
+			if times[i+1] < until {
+				until = times[i+1]
+			}
+			bs[s] += bps * (until - ms) / 8000
+			ms = until
+		}
+	}
+
+	return &Trace{
+		Interval: TraceInterval,
+		Bytes:    bs,
+	}, nil
+}
+
+// next returns a function that returns the bytes of the steps of the trace in turn, looping when
+// the trace ends.
+func (t *Trace) next() func() int64 {
+	var mu sync.Mutex
+	i := 0
+
+	return func() int64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		b := t.Bytes[i]
+		i = (i + 1) % len(t.Bytes)
+		return b
+	}
+}
+
+// SetTraces drives the capacity of the write bucket with up and that of the read bucket with down,
+// so that the bandwidths of the connections follow the traces. A nil trace stops driving its
+// bucket and restores the bandwidth of the defaults.
+func (l *Listener) SetTraces(up, down *Trace) error {
+	for _, t := range []*Trace{up, down} {
+		if t != nil && (t.Interval <= 0 || len(t.Bytes) == 0) {
+			return fmt.Errorf("trafficshape: trace has no steps")
+		}
+	}
+
+	defaults := l.Defaults()
+	setTrace(l.WriteBucket, up, defaults.Bandwidth.Up)
+	setTrace(l.ReadBucket, down, defaults.Bandwidth.Down)
+
+	return nil
+}
+
+func setTrace(b *Bucket, t *Trace, capacity int64) {
+	if t == nil {
+		b.SetSchedule(0, nil)
+		b.SetCapacity(capacity)
+		return
+	}
+
+	b.SetSchedule(t.Interval, t.next())
+}
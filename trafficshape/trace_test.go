@@ -0,0 +1,275 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trafficshape
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTrace(t *testing.T) {
+	tt := []struct {
+		format string
+		trace  string
+		want   []int64
+	}{
+		{
+			// Two opportunities in the first 100ms, none in the second and
+			// one at the last millisecond, which starts the next repetition.
+			format: "mahimahi",
+			trace:  "10\n10\n250\n300\n",
+			want:   []int64{4500, 0, 1500},
+		},
+		{
+			format: "mahimahi",
+			trace:  "1\n2\n3\n150\n",
+			want:   []int64{4500, 1500},
+		},
+		{
+			// 8000bps is 1000 bytes per second, or 100 bytes per step.
+			format: "csv",
+			trace:  "time_ms,bps\n0,8000\n200,16000\n250,0\n",
+			want:   []int64{100, 100, 100},
+		},
+		{
+			format: "csv",
+			trace:  "0,80000\n",
+			want:   []int64{1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000},
+		},
+	}
+
+	for i, tc := range tt {
+		trace, err := ParseTrace(strings.NewReader(tc.trace), tc.format)
+		if err != nil {
+			t.Fatalf("%d. ParseTrace(): got %v, want no error", i, err)
+		}
+		if got, want := trace.Interval, TraceInterval; got != want {
+			t.Errorf("%d. trace.Interval: got %s, want %s", i, got, want)
+		}
+		if got, want := trace.Bytes, tc.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d. trace.Bytes: got %v, want %v", i, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		format string
+		trace  string
+	}{
+		{"mahimahi", ""},
+		{"mahimahi", "0\n"},
+		{"mahimahi", "20\n10\n"},
+		{"mahimahi", "ten\n"},
+		{"csv", "time_ms,bps\n"},
+		{"csv", "100,8000\n"},
+		{"csv", "0,8000\n0,16000\n"},
+		{"csv", "0,-1\n"},
+		{"csv", "0,8000,1\n"},
+		{"pcap", "0\n"},
+	} {
+		if _, err := ParseTrace(strings.NewReader(tc.trace), tc.format); err == nil {
+			t.Errorf("ParseTrace(%q, %q): got no error, want error", tc.trace, tc.format)
+		}
+	}
+}
+
+func TestLoadTraceFile(t *testing.T) {
+	dir := t.TempDir()
+
+	mahimahi := filepath.Join(dir, "link.up")
+	if err := ioutil.WriteFile(mahimahi, []byte("50\n100\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): got %v, want no error", err)
+	}
+	csv := filepath.Join(dir, "link.csv")
+	if err := ioutil.WriteFile(csv, []byte("0,8000\n100,0\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): got %v, want no error", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want []int64
+	}{
+		{mahimahi, []int64{3000}},
+		{csv, []int64{100, 0}},
+	} {
+		trace, err := LoadTraceFile(tc.path)
+		if err != nil {
+			t.Fatalf("LoadTraceFile(%q): got %v, want no error", tc.path, err)
+		}
+		if got, want := trace.Bytes, tc.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("LoadTraceFile(%q).Bytes: got %v, want %v", tc.path, got, want)
+		}
+	}
+}
+
+func TestTraceLoops(t *testing.T) {
+	trace := &Trace{
+		Interval: TraceInterval,
+		Bytes:    []int64{1, 2, 3},
+	}
+
+	next := trace.next()
+
+	var got []int64
+	for i := 0; i < 7; i++ {
+		got = append(got, next())
+	}
+	if want := []int64{1, 2, 3, 1, 2, 3, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("next(): got %v, want %v", got, want)
+	}
+}
+
+func TestBucketSetSchedule(t *testing.T) {
+	b := NewBucket(100, time.Hour)
+	defer b.Close()
+
+	capacities := make(chan int64, 100)
+	capacities <- 10
+	b.SetSchedule(10*time.Millisecond, func() int64 {
+		select {
+		case c := <-capacities:
+			return c
+		default:
+			return 30
+		}
+	})
+
+	if got, want := b.Capacity(), int64(10); got != want {
+		t.Errorf("b.Capacity(): got %d, want %d", got, want)
+	}
+
+	capacities <- 20
+	time.Sleep(100 * time.Millisecond)
+
+	if got, want := b.Capacity(), int64(30); got != want {
+		t.Errorf("b.Capacity(): got %d, want %d after the schedule", got, want)
+	}
+
+	b.SetSchedule(0, nil)
+	b.SetCapacity(100)
+	time.Sleep(50 * time.Millisecond)
+
+	if got, want := b.Capacity(), int64(100); got != want {
+		t.Errorf("b.Capacity(): got %d, want %d without a schedule", got, want)
+	}
+}
+
+func TestListenerSetTraces(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tsl := NewListener(l)
+	defer tsl.Close()
+
+	up := &Trace{Interval: time.Hour, Bytes: []int64{500, 600}}
+	down := &Trace{Interval: time.Hour, Bytes: []int64{700}}
+	if err := tsl.SetTraces(up, down); err != nil {
+		t.Fatalf("SetTraces(): got %v, want no error", err)
+	}
+
+	if got, want := tsl.WriteBucket.Capacity(), int64(500); got != want {
+		t.Errorf("tsl.WriteBucket.Capacity(): got %d, want %d", got, want)
+	}
+	if got, want := tsl.ReadBucket.Capacity(), int64(700); got != want {
+		t.Errorf("tsl.ReadBucket.Capacity(): got %d, want %d", got, want)
+	}
+
+	if err := tsl.SetTraces(nil, nil); err != nil {
+		t.Fatalf("SetTraces(nil, nil): got %v, want no error", err)
+	}
+	if got, want := tsl.WriteBucket.Capacity(), tsl.Defaults().Bandwidth.Up; got != want {
+		t.Errorf("tsl.WriteBucket.Capacity(): got %d, want %d", got, want)
+	}
+	if got, want := tsl.ReadBucket.Capacity(), tsl.Defaults().Bandwidth.Down; got != want {
+		t.Errorf("tsl.ReadBucket.Capacity(): got %d, want %d", got, want)
+	}
+
+	if err := tsl.SetTraces(&Trace{Interval: time.Second}, nil); err == nil {
+		t.Error("SetTraces(): got no error, want error for empty trace")
+	}
+}
+
+func TestHandlerTrace(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	tt := []struct {
+		body string
+		code int
+		up   int64
+		down int64
+	}{
+		{
+			body: `{"trafficshape":{"trace":{"format":"mahimahi","up":"10\n20\n100\n"}}}`,
+			code: 200,
+			up:   4500,
+			down: DefaultBitrate / 8,
+		},
+		{
+			body: `{"trafficshape":{"default":{"bandwidth":{"up":1000}},"trace":{"format":"csv","down":"0,16000\n"}}}`,
+			code: 200,
+			up:   1000,
+			down: 200,
+		},
+		{
+			body: `{"trafficshape":{"trace":{"format":"csv","up":"100,8000\n"}}}`,
+			code: 400,
+		},
+		{
+			body: `{"trafficshape":{"trace":{"format":"pcap","up":"10\n"}}}`,
+			code: 400,
+		},
+	}
+
+	for i, tc := range tt {
+		tsl := NewListener(l)
+		defer tsl.Close()
+
+		h := NewHandler(tsl)
+
+		req, err := http.NewRequest("POST", "test", bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		rw := httptest.NewRecorder()
+
+		h.ServeHTTP(rw, req)
+
+		if got, want := rw.Code, tc.code; got != want {
+			t.Fatalf("%d. rw.Code: got %d, want %d", i, got, want)
+		}
+		if tc.code != 200 {
+			continue
+		}
+
+		if got, want := tsl.WriteBucket.Capacity(), tc.up; got != want {
+			t.Errorf("%d. tsl.WriteBucket.Capacity(): got %d, want %d", i, got, want)
+		}
+		if got, want := tsl.ReadBucket.Capacity(), tc.down; got != want {
+			t.Errorf("%d. tsl.ReadBucket.Capacity(): got %d, want %d", i, got, want)
+		}
+	}
+}
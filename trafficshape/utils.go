@@ -3,6 +3,7 @@ package trafficshape
 import (
 	"errors"
 	"fmt"
+	"mime"
 	"regexp"
 	"sort"
 	"strconv"
@@ -91,6 +92,22 @@ func parseShapes(ts *Trafficshape) error {
 			return fmt.Errorf("url_regex for shape at index doesn't compile: %d", shapeIndex)
 		}
 
+		for _, h := range shape.Hosts {
+			if h == "" {
+				return fmt.Errorf("empty host for shape at index: %d", shapeIndex)
+			}
+		}
+		for _, m := range shape.Methods {
+			if m == "" {
+				return fmt.Errorf("empty method for shape at index: %d", shapeIndex)
+			}
+		}
+		for _, ct := range shape.ContentTypes {
+			if _, _, err := mime.ParseMediaType(ct); err != nil && !strings.HasSuffix(ct, "/*") {
+				return fmt.Errorf("invalid content type %q for shape at index: %d", ct, shapeIndex)
+			}
+		}
+
 		if shape.MaxBandwidth < 0 {
 			return fmt.Errorf("max_bandwidth cannot be negative for shape at index: %d", shapeIndex)
 		}